@@ -0,0 +1,83 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// The external address is added to the egress interface of the node
+	FloatingIPModeAddress string = "Address"
+	// The node answers ARP requests for the external address with proxy ARP
+	FloatingIPModeProxyARP string = "ProxyARP"
+)
+
+// FloatingIPSpec defines the desired state of FloatingIP
+type FloatingIPSpec struct {
+	// External address which is mapped 1:1 to the virtual machine address
+	ExternalAddress string `json:"externalAddress"`
+	// Address of the virtual machine on the Tabby bridge
+	InternalAddress string `json:"internalAddress"`
+	// Linux bridge the virtual machine is attached to
+	Bridge string `json:"bridge"`
+	// Name of the VirtualMachineInstance in the same namespace. The floating ip
+	// is programmed on the node which hosts the virtual machine.
+	VirtualMachineInstance string `json:"virtualMachineInstance"`
+	// Network used to find the node interface the external address is announced on.
+	// If not defined, the interface is looked up by the route to the external address.
+	EgressNetwork string `json:"egressnetwork,omitempty"`
+	// How the external address is announced, Address or ProxyARP
+	// +kubebuilder:validation:Enum=Address;ProxyARP
+	// +kubebuilder:default=Address
+	Mode string `json:"mode,omitempty"`
+}
+
+// FloatingIPStatus defines the observed state of FloatingIP
+type FloatingIPStatus struct {
+	// Node where the floating ip is currently programmed
+	NodeName string `json:"nodeName,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="External",type=string,JSONPath=`.spec.externalAddress`
+//+kubebuilder:printcolumn:name="Internal",type=string,JSONPath=`.spec.internalAddress`
+//+kubebuilder:printcolumn:name="VMI",type=string,JSONPath=`.spec.virtualMachineInstance`
+//+kubebuilder:printcolumn:name="Node",type=string,JSONPath=`.status.nodeName`
+
+// FloatingIP is the Schema for the floatingips API
+type FloatingIP struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   FloatingIPSpec   `json:"spec,omitempty"`
+	Status FloatingIPStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// FloatingIPList contains a list of FloatingIP
+type FloatingIPList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []FloatingIP `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&FloatingIP{}, &FloatingIPList{})
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Labels of the IPAllocation used to find the allocations of a pool and an owner
+	IPAllocationPoolLabel  string = "cloud.spaceship.com/ippool"
+	IPAllocationOwnerLabel string = "cloud.spaceship.com/owner"
+
+	IPAllocationOwnerPod                    string = "Pod"
+	IPAllocationOwnerVirtualMachineInstance string = "VirtualMachineInstance"
+)
+
+// IPAllocationSpec defines the desired state of IPAllocation.
+// The name of the allocation is derived from the pool and the address, so the API
+// server rejects a second allocation of the same address.
+type IPAllocationSpec struct {
+	Pool string `json:"pool"`
+	// Address with prefix length of the pool, e.g. 192.168.1.10/24
+	Address string `json:"address"`
+	// Kind of the owner, the VirtualMachineInstance for KubeVirt virtual machines,
+	// so the address is kept across live migration, or the Pod otherwise.
+	// +kubebuilder:validation:Enum=Pod;VirtualMachineInstance
+	OwnerKind string `json:"ownerKind"`
+	OwnerName string `json:"ownerName"`
+	// Interface of the owner, e.g. net1
+	Interface string `json:"interface,omitempty"`
+	// Container and node the interface was attached on, CNI GC of the node
+	// releases addresses of containers which are gone
+	ContainerID string `json:"containerID,omitempty"`
+	NodeName    string `json:"nodeName,omitempty"`
+}
+
+// IPAllocationStatus defines the observed state of IPAllocation
+type IPAllocationStatus struct {
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Pool",type=string,JSONPath=`.spec.pool`
+//+kubebuilder:printcolumn:name="Address",type=string,JSONPath=`.spec.address`
+//+kubebuilder:printcolumn:name="Kind",type=string,JSONPath=`.spec.ownerKind`
+//+kubebuilder:printcolumn:name="Owner",type=string,JSONPath=`.spec.ownerName`
+
+// IPAllocation is the Schema for the ipallocations API
+type IPAllocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IPAllocationSpec   `json:"spec,omitempty"`
+	Status IPAllocationStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// IPAllocationList contains a list of IPAllocation
+type IPAllocationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPAllocation `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IPAllocation{}, &IPAllocationList{})
+}
@@ -28,10 +28,31 @@ type NetworkSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	Bridge        []Bridge               `json:"bridge"`
-	IpMasq        Masquerade             `json:"ipMasq,omitempty"`
-	Routes        []Route                `json:"routes,omitempty"`
-	NodeSelectors []metav1.LabelSelector `json:"nodeSelectors,omitempty"`
+	Bridge       []Bridge      `json:"bridge"`
+	IpMasq       Masquerade    `json:"ipMasq,omitempty"`
+	Routes       []Route       `json:"routes,omitempty"`
+	PortForwards []PortForward `json:"portForwards,omitempty"`
+	DHCP         *DHCPServer   `json:"dhcp,omitempty"`
+	// IPv6 router advertisements for the virtual machines
+	RouterAdvertisement *RouterAdvertisement `json:"routerAdvertisement,omitempty"`
+	// Multus NetworkAttachmentDefinition generated for the network
+	NetworkAttachmentDefinition *NetworkAttachmentDefinition `json:"networkAttachmentDefinition,omitempty"`
+	NodeSelectors               []metav1.LabelSelector       `json:"nodeSelectors,omitempty"`
+	// Nodes only publish the plan of the changes in the status of their NetworkAttachment
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// Multus NetworkAttachmentDefinition with the bridge CNI configuration of the network.
+// It has the same name as the network, so virtual machines refer to the network directly.
+type NetworkAttachmentDefinition struct {
+	Enabled bool `json:"enabled"`
+	// Namespaces the definition is created in, the namespace of the network if not defined
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Bridge the virtual machines are connected to, defaults to the ipMasq bridge or the first bridge
+	Bridge string `json:"bridge,omitempty"`
+	// Addresses are allocated from the IPPool by the tabby-ipam plugin, the guests
+	// configure their addresses themselves if not defined
+	IPPool string `json:"ipPool,omitempty"`
 }
 
 // Linux bridge
@@ -39,6 +60,9 @@ type Bridge struct {
 	Name  string `json:"name"`
 	Mtu   int    `json:"mtu,omitempty"`
 	Ports []Port `json:"ports,omitempty"`
+	// Every node gets a unique address from the pool configured on the bridge,
+	// e.g. for routed virtual machine networks
+	AddressPool string `json:"addressPool,omitempty"`
 }
 
 type Port struct {
@@ -55,19 +79,160 @@ type Route struct {
 	Source      string `json:"source,omitempty"`
 }
 
+// Forward a port of the node to the virtual machine, like hostPort does.
+// Port forwards are rendered into the <bridge>-PREROUTING nat chain of the
+// ipMasq bridge, or of the first bridge if masquerading isn't configured.
+type PortForward struct {
+	// +kubebuilder:validation:Enum=tcp;udp;sctp
+	// +kubebuilder:default=tcp
+	Protocol string `json:"protocol,omitempty"`
+	// Node address, any local address of the node is used if empty
+	ExternalAddress string `json:"externalAddress,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	ExternalPort    int    `json:"externalPort"`
+	InternalAddress string `json:"internalAddress"`
+	// Defaults to the external port
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=65535
+	InternalPort int `json:"internalPort,omitempty"`
+}
+
+// DHCPv4 server embedded into the agent. Every node runs its own server on the bridge,
+// so the range shouldn't overlap between networks sharing the same layer 2 segment.
+type DHCPServer struct {
+	Enabled bool `json:"enabled"`
+	// Defaults to the ipMasq bridge
+	Bridge     string `json:"bridge,omitempty"`
+	RangeStart string `json:"rangeStart"`
+	RangeEnd   string `json:"rangeEnd"`
+	// Subnet of the virtual machines, defaults to the ipMasq source network
+	Subnet string `json:"subnet,omitempty"`
+	// Defaults to the ipMasq gateway address
+	Gateway string   `json:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+	// Lease time in seconds, one hour if not defined
+	// +kubebuilder:validation:Minimum=60
+	LeaseTime    int         `json:"leaseTime,omitempty"`
+	StaticLeases []DHCPLease `json:"staticLeases,omitempty"`
+}
+
+type DHCPLease struct {
+	// +kubebuilder:validation:Pattern=`^([0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}$`
+	MAC      string `json:"mac"`
+	Address  string `json:"address"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// Router advertisements sent by the agent on the bridge, so the virtual machines
+// configure their addresses with SLAAC and use the node as the default gateway.
+type RouterAdvertisement struct {
+	Enabled bool `json:"enabled"`
+	// Defaults to the ipMasq bridge
+	Bridge string `json:"bridge,omitempty"`
+	// Link-local address the advertisements are sent from, it becomes the default gateway
+	// of the virtual machines. Defaults to the IPv6 ipMasq gateway, or fe80::1.
+	Gateway  string     `json:"gateway,omitempty"`
+	Prefixes []RAPrefix `json:"prefixes,omitempty"`
+	// Addresses are assigned by DHCPv6
+	Managed bool `json:"managed,omitempty"`
+	// Other configuration is available via DHCPv6
+	OtherConfig bool `json:"otherConfig,omitempty"`
+	// Router lifetime in seconds, 1800 if not defined
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=9000
+	RouterLifetime int      `json:"routerLifetime,omitempty"`
+	RDNSS          []string `json:"rdnss,omitempty"`
+	// RDNSS lifetime in seconds, defaults to the router lifetime
+	RDNSSLifetime int `json:"rdnssLifetime,omitempty"`
+	MTU           int `json:"mtu,omitempty"`
+	// Maximum interval between unsolicited advertisements in seconds, 600 if not defined
+	// +kubebuilder:validation:Minimum=4
+	// +kubebuilder:validation:Maximum=1800
+	Interval int `json:"interval,omitempty"`
+}
+
+type RAPrefix struct {
+	Prefix string `json:"prefix"`
+	// Prefix is used for on-link determination, true if not defined
+	OnLink *bool `json:"onLink,omitempty"`
+	// Prefix is used for SLAAC, true if not defined
+	Autonomous *bool `json:"autonomous,omitempty"`
+	// Valid lifetime in seconds, 86400 if not defined
+	ValidLifetime int `json:"validLifetime,omitempty"`
+	// Preferred lifetime in seconds, 14400 if not defined
+	PreferredLifetime int `json:"preferredLifetime,omitempty"`
+}
+
 // Masquerade virtual machine traffic
 type Masquerade struct {
-	Enabled       bool     `json:"enabled"`
-	Source        string   `json:"source"`
-	Ignore        []string `json:"ignore,omitempty"`
-	Bridge        string   `json:"bridge"`
-	EgressNetwork string   `json:"egressnetwork,omitempty"`
+	Enabled bool     `json:"enabled"`
+	Source  string   `json:"source"`
+	Ignore  []string `json:"ignore,omitempty"`
+	// Dynamic sources of networks which are not masqueraded, in addition to Ignore
+	IgnoreFrom    []IgnoreSource `json:"ignoreFrom,omitempty"`
+	Bridge        string         `json:"bridge"`
+	EgressNetwork string         `json:"egressnetwork,omitempty"`
+	// Default gateway of the virtual machines, 169.254.1.1 if not defined.
+	// IPv6 link-local address could be used as well, e.g. fe80::1
+	Gateway string `json:"gateway,omitempty"`
+	// Fixed mac address of the gateway. The mac address of the bridge is used if not defined,
+	// or a deterministic virtual mac address in Anycast mode.
+	// +kubebuilder:validation:Pattern=`^([0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}$`
+	GatewayMAC string `json:"gatewayMAC,omitempty"`
+	// How the gateway is served, ProxyARP or Anycast. In ProxyARP mode every node answers
+	// with its own bridge mac address. In Anycast mode every node has the same gateway address
+	// and mac address on the macvlan interface of the bridge, so migrated virtual machines never need to re-resolve it.
+	// +kubebuilder:validation:Enum=ProxyARP;Anycast
+	// +kubebuilder:default=ProxyARP
+	GatewayMode string `json:"gatewayMode,omitempty"`
+}
+
+const (
+	GatewayModeProxyARP string = "ProxyARP"
+	GatewayModeAnycast  string = "Anycast"
+)
+
+// Dynamic source of networks which are not masqueraded. The agent watches
+// the source and updates the ignore list as it changes.
+type IgnoreSource struct {
+	// Pod CIDRs of all cluster nodes
+	NodePodCIDRs bool `json:"nodePodCIDRs,omitempty"`
+	// Networks listed in a ConfigMap key, separated by spaces, commas or new lines
+	ConfigMap *ConfigMapIgnoreSource `json:"configMap,omitempty"`
+	// Cluster IPs and endpoint addresses of the selected Services
+	Services *ServiceIgnoreSource `json:"services,omitempty"`
+	// Masquerade source networks of the selected Networks
+	Networks *metav1.LabelSelector `json:"networks,omitempty"`
+}
+
+type ConfigMapIgnoreSource struct {
+	Name string `json:"name"`
+	// Defaults to the namespace of the Network
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+}
+
+type ServiceIgnoreSource struct {
+	// Services from all namespaces are selected if empty
+	Namespace string               `json:"namespace,omitempty"`
+	Selector  metav1.LabelSelector `json:"selector"`
 }
 
 // NetworkStatus defines the observed state of Network
 type NetworkStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// Addresses allocated to the nodes from bridge address pools
+	Allocations []AddressAllocation `json:"allocations,omitempty"`
+}
+
+type AddressAllocation struct {
+	NodeName string `json:"nodeName"`
+	Bridge   string `json:"bridge"`
+	// Address with prefix length of the pool, e.g. 10.0.0.5/24
+	Address string `json:"address"`
 }
 
 //+kubebuilder:object:root=true
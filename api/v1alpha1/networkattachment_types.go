@@ -28,17 +28,55 @@ type NetworkAttachmentSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	Bridge        []Bridge               `json:"bridge"`
-	IpMasq        Masquerade             `json:"ipMasq,omitempty"`
-	Routes        []Route                `json:"routes,omitempty"`
-	NodeName      string                 `json:"nodeName"`
-	NodeSelectors []metav1.LabelSelector `json:"nodeSelectors,omitempty"`
+	Bridge       []Bridge      `json:"bridge"`
+	IpMasq       Masquerade    `json:"ipMasq,omitempty"`
+	Routes       []Route       `json:"routes,omitempty"`
+	PortForwards []PortForward `json:"portForwards,omitempty"`
+	DHCP         *DHCPServer   `json:"dhcp,omitempty"`
+	// IPv6 router advertisements for the virtual machines
+	RouterAdvertisement *RouterAdvertisement   `json:"routerAdvertisement,omitempty"`
+	NodeName            string                 `json:"nodeName"`
+	NodeSelectors       []metav1.LabelSelector `json:"nodeSelectors,omitempty"`
+	// Changes are planned but not applied on the node
+	DryRun bool `json:"dryRun,omitempty"`
 }
 
 // NetworkStatus defines the observed state of Network
 type NetworkAttachmentStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// Addresses of the node allocated from bridge address pools
+	Addresses []BridgeAddress `json:"addresses,omitempty"`
+	// Leases handed out by the DHCP server of the node
+	Leases []DHCPLease `json:"leases,omitempty"`
+	// Ready condition shows whether the network is programmed on the node
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Drift of the host network from the spec repaired by the last resync
+	Repaired []string `json:"repaired,omitempty"`
+	// Time of the last repair of the host network
+	LastRepairTime *metav1.Time `json:"lastRepairTime,omitempty"`
+	// Changes the node would make to apply the spec in the dry run mode
+	Plan []string `json:"plan,omitempty"`
+	// Time of the last plan, there is nothing to change if the plan is empty
+	PlanTime *metav1.Time `json:"planTime,omitempty"`
+}
+
+const (
+	NetworkAttachmentConditionReady = "Ready"
+	// Masquerade ignore sources exist, missing ones are ignored while they are gone
+	NetworkAttachmentConditionIgnoreSourcesResolved = "IgnoreSourcesResolved"
+
+	NetworkAttachmentReasonApplied        = "Applied"
+	NetworkAttachmentReasonFailed         = "Failed"
+	NetworkAttachmentReasonResolved       = "Resolved"
+	NetworkAttachmentReasonSourceNotFound = "SourceNotFound"
+)
+
+type BridgeAddress struct {
+	Bridge string `json:"bridge"`
+	// Address with prefix length of the pool, e.g. 10.0.0.5/24
+	Address string `json:"address"`
 }
 
 //+kubebuilder:object:root=true
@@ -0,0 +1,238 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	virtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/controllers"
+)
+
+// Networks of the command, the named one or all networks of the namespace
+func networks(ctx context.Context, c client.Client, o *options, args []string) ([]networkv1alpha1.Network, error) {
+	if len(args) > 0 {
+		network := networkv1alpha1.Network{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: o.namespace, Name: args[0]}, &network); err != nil {
+			return nil, fmt.Errorf("failed to get network %s/%s: %v", o.namespace, args[0], err)
+		}
+		return []networkv1alpha1.Network{network}, nil
+	}
+
+	list := &networkv1alpha1.NetworkList{}
+	if err := c.List(ctx, list, client.InNamespace(o.listNamespace())); err != nil {
+		return nil, fmt.Errorf("failed to get list of networks: %v", err)
+	}
+
+	return list.Items, nil
+}
+
+// Network attachments created by the network controller for the nodes, or for the node of the options
+func attachments(ctx context.Context, c client.Client, network *networkv1alpha1.Network, node string) ([]networkv1alpha1.NetworkAttachment, error) {
+	list := &networkv1alpha1.NetworkAttachmentList{}
+	if err := c.List(ctx, list, client.InNamespace(network.Namespace)); err != nil {
+		return nil, fmt.Errorf("failed to get list of networkattachments: %v", err)
+	}
+
+	var result []networkv1alpha1.NetworkAttachment
+	for _, na := range list.Items {
+		if !metav1.IsControlledBy(&na, network) {
+			continue
+		}
+
+		if node != "" && na.Spec.NodeName != node {
+			continue
+		}
+
+		result = append(result, na)
+	}
+
+	return result, nil
+}
+
+func runStatus(ctx context.Context, c client.Client, o *options, args []string) error {
+	items, err := networks(ctx, c, o, args)
+	if err != nil {
+		return err
+	}
+
+	w := newTabWriter()
+	fmt.Fprintln(w, "NAMESPACE\tNETWORK\tNODE\tREADY\tLAST REPAIR\tPLAN\tMESSAGE")
+
+	for i := range items {
+		network := &items[i]
+
+		nas, err := attachments(ctx, c, network, o.node)
+		if err != nil {
+			return err
+		}
+
+		if len(nas) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t<none>\t-\t-\t-\t\n", network.Namespace, network.Name)
+			continue
+		}
+
+		for _, na := range nas {
+			ready, message := string(metav1.ConditionUnknown), ""
+			if condition := meta.FindStatusCondition(na.Status.Conditions, networkv1alpha1.NetworkAttachmentConditionReady); condition != nil {
+				ready = string(condition.Status)
+				if condition.Status != metav1.ConditionTrue {
+					message = condition.Message
+				}
+			}
+
+			repair := "-"
+			if na.Status.LastRepairTime != nil {
+				repair = na.Status.LastRepairTime.UTC().Format(time.RFC3339)
+			}
+
+			plan := "-"
+			if na.Status.PlanTime != nil {
+				plan = fmt.Sprintf("%d changes", len(na.Status.Plan))
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", network.Namespace, network.Name, na.Spec.NodeName, ready, repair, plan, message)
+		}
+	}
+
+	return w.Flush()
+}
+
+func runVMs(ctx context.Context, c client.Client, o *options, args []string) error {
+	vmis := &virtv1.VirtualMachineInstanceList{}
+	if err := c.List(ctx, vmis, client.InNamespace(o.listNamespace())); err != nil {
+		return fmt.Errorf("failed to get list of virtual machine instances: %v", err)
+	}
+
+	w := newTabWriter()
+	fmt.Fprintln(w, "NAMESPACE\tVMI\tNODE\tINTERFACE\tNETWORK\tBRIDGE")
+
+	for _, vmi := range vmis.Items {
+		for _, n := range vmi.Spec.Networks {
+			if n.Multus == nil {
+				continue
+			}
+
+			network, err := controllers.ResolveNetwork(ctx, c, vmi.Namespace, n.Multus.NetworkName)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %s/%s: %v\n", vmi.Namespace, vmi.Name, err)
+				continue
+			}
+
+			if len(args) > 0 && (network.Name != args[0] || network.Namespace != o.namespace) {
+				continue
+			}
+
+			bridge, err := controllers.ResolveBridge(ctx, c, vmi.Namespace, n.Multus.NetworkName, network)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %s/%s: %v\n", vmi.Namespace, vmi.Name, err)
+				continue
+			}
+
+			if o.node != "" && vmi.Status.NodeName != o.node {
+				continue
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s/%s\t%s\n", vmi.Namespace, vmi.Name, vmi.Status.NodeName, n.Name, network.Namespace, network.Name, bridge)
+		}
+	}
+
+	return w.Flush()
+}
+
+// Spec of the network attachments with the masquerade ignore sources resolved, as the nodes apply it
+func runSpec(ctx context.Context, c client.Client, o *options, args []string) error {
+	items, err := networks(ctx, c, o, args)
+	if err != nil {
+		return err
+	}
+
+	nas, err := attachments(ctx, c, &items[0], o.node)
+	if err != nil {
+		return err
+	}
+
+	r := &controllers.NetworkAttachmentReconciler{Client: c}
+
+	for i := range nas {
+		spec, err := r.EffectiveSpec(ctx, &nas[i])
+		if err != nil {
+			return err
+		}
+
+		data, err := yaml.Marshal(spec)
+		if err != nil {
+			return err
+		}
+
+		if i > 0 {
+			fmt.Println("---")
+		}
+		fmt.Printf("# networkattachment %s/%s\n%s", nas[i].Namespace, nas[i].Name, data)
+	}
+
+	return nil
+}
+
+// Nodes apply the network again when the reapply annotation changes
+func runReapply(ctx context.Context, c client.Client, o *options, args []string) error {
+	items, err := networks(ctx, c, o, args)
+	if err != nil {
+		return err
+	}
+
+	nas, err := attachments(ctx, c, &items[0], o.node)
+	if err != nil {
+		return err
+	}
+
+	if len(nas) == 0 {
+		return fmt.Errorf("network %s/%s has no network attachments", items[0].Namespace, items[0].Name)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	for i := range nas {
+		na := &nas[i]
+		patch := client.MergeFrom(na.DeepCopy())
+
+		annotations := na.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[controllers.ReapplyAnnotation] = now
+		na.SetAnnotations(annotations)
+
+		if err := c.Patch(ctx, na, patch); err != nil {
+			return fmt.Errorf("failed to patch networkattachment %s/%s: %v", na.Namespace, na.Name, err)
+		}
+
+		fmt.Printf("networkattachment %s/%s on node %s reapplied\n", na.Namespace, na.Name, na.Spec.NodeName)
+	}
+
+	return nil
+}
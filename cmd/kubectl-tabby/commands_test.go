@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/controllers"
+)
+
+func TestReapply(t *testing.T) {
+	network := &networkv1alpha1.Network{ObjectMeta: metav1.ObjectMeta{Name: "vm-network", Namespace: "default", UID: "network-uid"}}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "vm-network"}}
+
+	var objects []*networkv1alpha1.NetworkAttachment
+	for _, node := range []string{"node1", "node2"} {
+		na, _ := controllers.NewNetworkAttachment(node, network, req)
+		objects = append(objects, na)
+	}
+	// Attachment of another network
+	objects = append(objects, &networkv1alpha1.NetworkAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1-other", Namespace: "default"},
+		Spec:       networkv1alpha1.NetworkAttachmentSpec{NodeName: "node1"},
+	})
+
+	builder := fake.NewClientBuilder().WithScheme(scheme).WithObjects(network)
+	for _, na := range objects {
+		builder = builder.WithObjects(na)
+	}
+	c := builder.Build()
+
+	o := &options{namespace: "default", node: "node2"}
+	if err := runReapply(context.Background(), c, o, []string{"vm-network"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"node1-vm-network", "node2-vm-network", "node1-other"} {
+		na := &networkv1alpha1.NetworkAttachment{}
+		if err := c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: name}, na); err != nil {
+			t.Fatal(err)
+		}
+
+		_, reapplied := na.Annotations[controllers.ReapplyAnnotation]
+		if reapplied != (name == "node2-vm-network") {
+			t.Errorf("%s: unexpected reapply annotation %q", name, na.Annotations)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-tabby shows the state of networks across the cluster. Installed in the PATH
+// it's run by kubectl as a plugin:
+//
+//	kubectl tabby status [network]
+//	kubectl tabby vms [network]
+//	kubectl tabby spec <network> [--node node]
+//	kubectl tabby reapply <network> [--node node]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	virtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+const apiTimeout = 30 * time.Second
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(networkv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(virtv1.AddToScheme(scheme))
+}
+
+type options struct {
+	kubeconfig    string
+	context       string
+	namespace     string
+	allNamespaces bool
+	node          string
+}
+
+// Namespace of the command, empty for all namespaces
+func (o *options) listNamespace() string {
+	if o.allNamespaces {
+		return ""
+	}
+	return o.namespace
+}
+
+type command struct {
+	usage string
+	args  int
+	run   func(ctx context.Context, c client.Client, o *options, args []string) error
+}
+
+var commands = map[string]command{
+	"status":  {"status [network]", -1, runStatus},
+	"vms":     {"vms [network]", -1, runVMs},
+	"spec":    {"spec <network> [--node node]", 1, runSpec},
+	"reapply": {"reapply <network> [--node node]", 1, runReapply},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: kubectl tabby <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "  status   network attachments of every node, their readiness and errors")
+	fmt.Fprintln(os.Stderr, "  vms      virtual machines and the networks and bridges they are connected to")
+	fmt.Fprintln(os.Stderr, "  spec     effective spec of the network on the nodes")
+	fmt.Fprintln(os.Stderr, "  reapply  force the nodes to apply the network again")
+}
+
+// Flags could follow the arguments, like they do with kubectl
+func parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func newClient(o *options) (client.Client, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.kubeconfig
+
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: o.context})
+
+	if o.namespace == "" {
+		namespace, _, err := config.Namespace()
+		if err != nil {
+			return nil, err
+		}
+		o.namespace = namespace
+	}
+
+	restConfig, err := config.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.New(restConfig, client.Options{Scheme: scheme})
+}
+
+func newTabWriter() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	o := &options{}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file.")
+	fs.StringVar(&o.context, "context", "", "Name of the kubeconfig context.")
+	fs.StringVar(&o.namespace, "namespace", "", "Namespace of the networks, the namespace of the context if not defined.")
+	fs.StringVar(&o.namespace, "n", "", "Shorthand of --namespace.")
+	fs.BoolVar(&o.allNamespaces, "all-namespaces", false, "Networks of all namespaces.")
+	fs.BoolVar(&o.allNamespaces, "A", false, "Shorthand of --all-namespaces.")
+	fs.StringVar(&o.node, "node", "", "Name of the node, all nodes if not defined.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: kubectl tabby %s\n\n", cmd.usage)
+		fs.PrintDefaults()
+	}
+
+	args, err := parse(fs, os.Args[2:])
+	if err != nil {
+		os.Exit(2)
+	}
+
+	if cmd.args >= 0 && len(args) != cmd.args || cmd.args < 0 && len(args) > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := newClient(o)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	if err := cmd.run(ctx, c, o, args); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
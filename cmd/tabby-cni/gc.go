@@ -0,0 +1,102 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/vishvananda/netlink"
+)
+
+// Remove attachments which are not valid anymore, together with their veths and addresses
+func cmdGC(args *skel.CmdArgs) error {
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	valid := map[string]bool{}
+	for _, a := range conf.ValidAttachments {
+		valid[attachmentFile("", a.ContainerID, a.IfName)] = true
+	}
+
+	dir := conf.stateDir()
+
+	attachments, err := listAttachments(dir)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, a := range attachments {
+		if valid[attachmentFile("", a.ContainerID, a.IfName)] {
+			continue
+		}
+
+		if err := deleteHostInterface(&a); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := removeAttachment(dir, a.ContainerID, a.IfName); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// IPAM plugin gets the same list of valid attachments
+	if conf.IPAM.Type != "" {
+		if err := invoke.DelegateGC(context.Background(), conf.IPAM.Type, args.StdinData, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to collect garbage of network %s: %v", conf.Name, errs)
+	}
+
+	return nil
+}
+
+// Deleting the host side deletes the container side of the veth pair as well
+func deleteHostInterface(a *Attachment) error {
+	if !a.Owned || a.HostInterface == "" {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(a.HostInterface)
+	if err != nil {
+		// The container netns is gone together with the veth
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to find interface %s: %v", a.HostInterface, err)
+	}
+
+	if link.Type() != "veth" {
+		return nil
+	}
+
+	if err := ip.DelLinkByName(a.HostInterface); err != nil && err != ip.ErrLinkNotFound {
+		return fmt.Errorf("failed to delete interface %s of container %s: %v", a.HostInterface, a.ContainerID, err)
+	}
+
+	return nil
+}
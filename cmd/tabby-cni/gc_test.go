@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	"github.com/NCCloud/tabby-cni/pkg/netnstest"
+)
+
+func addVeth(t *testing.T, name string) {
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func linkExists(name string) bool {
+	_, err := netlink.LinkByName(name)
+	return err == nil
+}
+
+func TestGC(t *testing.T) {
+	netnstest.New(t)
+
+	conf := &NetConf{NetConf: types.NetConf{Name: "vm-network"}, DataDir: t.TempDir()}
+
+	addVeth(t, "vethlive")
+	addVeth(t, "vethstale")
+	addVeth(t, "vethchained")
+
+	attachments := []Attachment{
+		{ContainerID: "live", IfName: "eth0", HostInterface: "vethlive", Owned: true},
+		{ContainerID: "stale", IfName: "eth0", HostInterface: "vethstale", Owned: true},
+		// Veth of the previous plugin is collected by the plugin itself
+		{ContainerID: "chained", IfName: "eth0", HostInterface: "vethchained"},
+		// Veth is gone together with the container netns
+		{ContainerID: "gone", IfName: "eth0", HostInterface: "vethgone", Owned: true},
+	}
+	for i := range attachments {
+		if err := saveAttachment(conf.stateDir(), &attachments[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"cniVersion":                "1.1.0",
+		"name":                      "vm-network",
+		"type":                      "tabby",
+		"bridge":                    "br0",
+		"dataDir":                   conf.DataDir,
+		"cni.dev/valid-attachments": []types.GCAttachment{{ContainerID: "live", IfName: "eth0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cmdGC(&skel.CmdArgs{StdinData: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !linkExists("vethlive") {
+		t.Error("expected veth of the valid attachment to stay")
+	}
+
+	if linkExists("vethstale") {
+		t.Error("expected veth of the stale attachment to be deleted")
+	}
+
+	if !linkExists("vethchained") {
+		t.Error("expected veth of the previous plugin to stay")
+	}
+
+	left, err := listAttachments(conf.stateDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(left) != 1 || left[0].ContainerID != "live" {
+		t.Errorf("expected only the valid attachment to stay, got %+v", left)
+	}
+}
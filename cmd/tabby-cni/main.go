@@ -0,0 +1,460 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// tabby is a CNI plugin which creates the bridge of the network with the vlan of the uplink,
+// static routes and masquerade. It attaches the container itself, or the host side veth of the
+// previous plugin when it's chained, e.g. after the bridge plugin.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+	"github.com/vishvananda/netlink"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/controllers"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+)
+
+// Network of the node, tests swap the firewall for a fake one
+var newHost = host.New
+
+func init() {
+	// Namespace operations are bound to the thread
+	runtime.LockOSThread()
+}
+
+type Route struct {
+	// Gateway address or device of the route
+	Via string `json:"via,omitempty"`
+	Dev string `json:"dev,omitempty"`
+	// Network of the node the source address of the route is taken from
+	Src string `json:"src,omitempty"`
+	Dst string `json:"dst"`
+}
+
+type NetConf struct {
+	types.NetConf
+	Bridge string `json:"bridge"`
+	// Uplink of the bridge, the vlan interface is created on it if vlan is defined
+	Interface string  `json:"interface,omitempty"`
+	Vlan      int     `json:"vlan,omitempty"`
+	MTU       int     `json:"mtu,omitempty"`
+	Routes    []Route `json:"routes,omitempty"`
+	// Bridge of the masquerade defaults to the bridge of the network
+	IPMasq *networkv1alpha1.Masquerade `json:"ipMasq,omitempty"`
+	// Attachments are stored in the directory for GC, /var/lib/cni/tabby if not defined
+	DataDir string `json:"dataDir,omitempty"`
+	// STATUS reports the NetworkAttachment of the node, the plugin runs standalone if there is no kubeconfig
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// Defaults to NODE_NAME or the hostname
+	NodeName string `json:"nodeName,omitempty"`
+}
+
+func loadConf(data []byte) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if conf.Bridge == "" {
+		return nil, fmt.Errorf("bridge is required")
+	}
+
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+	}
+
+	return conf, nil
+}
+
+// Network of the configuration, it is programmed the same way the agent does it
+func (c *NetConf) spec() *networkv1alpha1.NetworkAttachmentSpec {
+	br := networkv1alpha1.Bridge{Name: c.Bridge, Mtu: c.MTU}
+	if c.Interface != "" {
+		br.Ports = []networkv1alpha1.Port{{Name: c.Interface, Vlan: c.Vlan, Mtu: c.MTU}}
+	}
+
+	spec := &networkv1alpha1.NetworkAttachmentSpec{Bridge: []networkv1alpha1.Bridge{br}}
+
+	for _, r := range c.Routes {
+		via := r.Via
+		if via == "" {
+			via = r.Dev
+		}
+		spec.Routes = append(spec.Routes, networkv1alpha1.Route{Via: via, Destination: r.Dst, Source: r.Src})
+	}
+
+	if c.IPMasq != nil && c.IPMasq.Enabled {
+		spec.IpMasq = *c.IPMasq
+		if spec.IpMasq.Bridge == "" {
+			spec.IpMasq.Bridge = c.Bridge
+		}
+	}
+
+	return spec
+}
+
+func (c *NetConf) uplink() string {
+	if c.Interface != "" && c.Vlan != 0 {
+		return fmt.Sprintf("%s.%d", c.Interface, c.Vlan)
+	}
+	return c.Interface
+}
+
+// Host side interfaces of the previous plugin which belong to the bridge
+func hostVeths(result *current.Result, bridge string) ([]netlink.Link, error) {
+	var links []netlink.Link
+
+	for _, iface := range result.Interfaces {
+		if iface.Sandbox != "" || iface.Name == bridge {
+			continue
+		}
+
+		link, err := netlink.LinkByName(iface.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find interface %s: %v", iface.Name, err)
+		}
+
+		if link.Type() == "veth" {
+			links = append(links, link)
+		}
+	}
+
+	return links, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err := controllers.CreateNetwork(context.Background(), newHost(), conf.spec(), nil); err != nil {
+		return fmt.Errorf("failed to create network %s: %v", conf.Name, err)
+	}
+
+	br, err := netlink.LinkByName(conf.Bridge)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge %s: %v", conf.Bridge, err)
+	}
+
+	brInterface := &current.Interface{Name: br.Attrs().Name, Mac: br.Attrs().HardwareAddr.String()}
+
+	attachment := &Attachment{ContainerID: args.ContainerID, IfName: args.IfName, Netns: args.Netns}
+
+	var result *current.Result
+	if conf.PrevResult != nil {
+		result, err = chain(conf, br, brInterface)
+	} else {
+		result, err = attach(args, conf, br, brInterface)
+		attachment.Owned = true
+	}
+	if err != nil {
+		return err
+	}
+
+	// Host side veth is the interface of the result without sandbox, other than the bridge
+	for _, iface := range result.Interfaces {
+		if iface.Sandbox == "" && iface.Name != conf.Bridge {
+			attachment.HostInterface = iface.Name
+			break
+		}
+	}
+
+	if err := saveAttachment(conf.stateDir(), attachment); err != nil {
+		// The runtime gets no result, so the attachment is undone like a failure of attach
+		if attachment.Owned {
+			_ = ip.DelLinkByName(attachment.HostInterface)
+			if conf.IPAM.Type != "" {
+				_ = ipam.ExecDel(conf.IPAM.Type, args.StdinData)
+			}
+		}
+		return err
+	}
+
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+// Attach host side veths of the previous plugin to the bridge and pass its result through
+func chain(conf *NetConf, br netlink.Link, brInterface *current.Interface) (*current.Result, error) {
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert prevResult: %v", err)
+	}
+
+	links, err := hostVeths(result, conf.Bridge)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, link := range links {
+		if link.Attrs().MasterIndex != br.Attrs().Index {
+			if err := netlink.LinkSetMaster(link, br); err != nil {
+				return nil, fmt.Errorf("failed to add interface %s to the bridge %s: %v", link.Attrs().Name, conf.Bridge, err)
+			}
+		}
+
+		if err := netlink.LinkSetUp(link); err != nil {
+			return nil, fmt.Errorf("failed to enable interface %s: %v", link.Attrs().Name, err)
+		}
+	}
+
+	for _, iface := range result.Interfaces {
+		if iface.Name == conf.Bridge && iface.Sandbox == "" {
+			return result, nil
+		}
+	}
+
+	result.Interfaces = append(result.Interfaces, brInterface)
+
+	return result, nil
+}
+
+// Create the veth pair of the container, attach it to the bridge and configure addresses from ipam
+func attach(args *skel.CmdArgs, conf *NetConf, br netlink.Link, brInterface *current.Interface) (*current.Result, error) {
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	hostInterface := &current.Interface{}
+	containerInterface := &current.Interface{Sandbox: netns.Path()}
+
+	err = netns.Do(func(hostNS ns.NetNS) error {
+		hostVeth, containerVeth, err := ip.SetupVeth(args.IfName, conf.MTU, "", hostNS)
+		if err != nil {
+			return err
+		}
+
+		hostInterface.Name = hostVeth.Name
+		containerInterface.Name = containerVeth.Name
+		containerInterface.Mac = containerVeth.HardwareAddr.String()
+
+		link, err := netlink.LinkByName(containerVeth.Name)
+		if err != nil {
+			return err
+		}
+
+		return netlink.LinkSetUp(link)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create veth pair: %v", err)
+	}
+
+	// Deleting the host side veth removes the whole pair, so a retry starts from scratch
+	success := false
+	defer func() {
+		if !success {
+			_ = ip.DelLinkByName(hostInterface.Name)
+		}
+	}()
+
+	hostVeth, err := netlink.LinkByName(hostInterface.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %s: %v", hostInterface.Name, err)
+	}
+	hostInterface.Mac = hostVeth.Attrs().HardwareAddr.String()
+
+	if err := netlink.LinkSetMaster(hostVeth, br); err != nil {
+		return nil, fmt.Errorf("failed to add interface %s to the bridge %s: %v", hostInterface.Name, conf.Bridge, err)
+	}
+
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{brInterface, hostInterface, containerInterface},
+	}
+
+	// Guests could configure their addresses themselves, e.g. virtual machines
+	if conf.IPAM.Type == "" {
+		success = true
+		return result, nil
+	}
+
+	r, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if !success {
+			_ = ipam.ExecDel(conf.IPAM.Type, args.StdinData)
+		}
+	}()
+
+	ipamResult, err := current.NewResultFromResult(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result.IPs = ipamResult.IPs
+	result.Routes = ipamResult.Routes
+	result.DNS = ipamResult.DNS
+
+	for _, ipc := range result.IPs {
+		ipc.Interface = current.Int(2)
+	}
+
+	if err := netns.Do(func(_ ns.NetNS) error {
+		return ipam.ConfigureIface(args.IfName, result)
+	}); err != nil {
+		return nil, err
+	}
+
+	success = true
+
+	return result, nil
+}
+
+// The bridge, vlan, routes and masquerade are shared by all containers of the network, so they are kept
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.IPAM.Type != "" {
+		if err := ipam.ExecDel(conf.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	// Runtimes pass the result of ADD as prevResult on DEL too, so the stored attachment
+	// tells whether the veth was created by this plugin
+	owned := conf.PrevResult == nil
+	attachment, err := loadAttachment(conf.stateDir(), args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	if attachment != nil {
+		owned = attachment.Owned
+	}
+
+	if err := removeAttachment(conf.stateDir(), args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+
+	// Interfaces of the previous plugin are deleted by the plugin itself
+	if args.Netns == "" || !owned {
+		return nil
+	}
+
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil && err != ip.ErrLinkNotFound {
+			return err
+		}
+		return nil
+	})
+
+	// The container is already gone
+	var notExist ns.NSPathNotExistErr
+	if errors.As(err, &notExist) {
+		return nil
+	}
+
+	return err
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return fmt.Errorf("failed to convert prevResult: %v", err)
+	}
+
+	br, err := netlink.LinkByName(conf.Bridge)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge %s: %v", conf.Bridge, err)
+	}
+
+	if _, ok := br.(*netlink.Bridge); !ok {
+		return fmt.Errorf("interface %s is not a bridge", conf.Bridge)
+	}
+
+	if br.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("bridge %s is down", conf.Bridge)
+	}
+
+	if uplink := conf.uplink(); uplink != "" {
+		link, err := netlink.LinkByName(uplink)
+		if err != nil {
+			return fmt.Errorf("failed to find uplink %s: %v", uplink, err)
+		}
+
+		if link.Attrs().MasterIndex != br.Attrs().Index {
+			return fmt.Errorf("uplink %s is not attached to the bridge %s", uplink, conf.Bridge)
+		}
+	}
+
+	links, err := hostVeths(result, conf.Bridge)
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		if link.Attrs().MasterIndex != br.Attrs().Index {
+			return fmt.Errorf("interface %s is not attached to the bridge %s", link.Attrs().Name, conf.Bridge)
+		}
+	}
+
+	if args.Netns != "" {
+		err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			_, err := netlink.LinkByName(args.IfName)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to find interface %s of the container: %v", args.IfName, err)
+		}
+	}
+
+	if conf.IPAM.Type != "" {
+		return ipam.ExecCheck(conf.IPAM.Type, args.StdinData)
+	}
+
+	return nil
+}
+
+func main() {
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Del:    cmdDel,
+		Check:  cmdCheck,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}, version.All, bv.BuildString("tabby"))
+}
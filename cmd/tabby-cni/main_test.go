@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/host/fake"
+	"github.com/NCCloud/tabby-cni/pkg/netnstest"
+)
+
+func TestAttachIPAMFailure(t *testing.T) {
+	netnstest.New(t)
+	t.Setenv("CNI_PATH", t.TempDir())
+
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	if err := netlink.LinkAdd(br); err != nil {
+		t.Fatal(err)
+	}
+
+	container, err := testutils.NewNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testutils.UnmountNS(container)
+
+	conf := &NetConf{NetConf: types.NetConf{Name: "vm-network", IPAM: types.IPAM{Type: "missing-ipam"}}, Bridge: "br0"}
+	args := &skel.CmdArgs{ContainerID: "vm", Netns: container.Path(), IfName: "eth0", StdinData: []byte(`{}`)}
+
+	if _, err := attach(args, conf, br, &current.Interface{Name: "br0"}); err == nil {
+		t.Fatal("expected ipam error")
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range links {
+		if link.Type() == "veth" {
+			t.Errorf("veth %s left behind after the ipam failure", link.Attrs().Name)
+		}
+	}
+}
+
+// IPAM plugin in PATH, which testutils passes as CNI_PATH, which hands out 10.10.0.2 on ADD
+// and accepts everything else. Commands are logged to the returned file.
+func stubIPAM(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "commands")
+	script := `#!/bin/sh
+echo "$CNI_COMMAND" >> ` + log + `
+if [ "$CNI_COMMAND" = "ADD" ]; then
+	echo '{"cniVersion":"1.0.0","ips":[{"address":"10.10.0.2/24","gateway":"10.10.0.1"}]}'
+fi
+`
+	if err := os.WriteFile(filepath.Join(dir, "stub-ipam"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return "stub-ipam", log
+}
+
+// Kernel of the test netns with the firewall left out, iptables is rarely installed where tests run
+func netnsHost(t *testing.T) {
+	t.Cleanup(func() { newHost = host.New })
+	newHost = func() *host.Host {
+		h := host.New()
+		rules := fake.New().Host()
+		h.NAT, h.Filter = rules.NAT, rules.Filter
+		return h
+	}
+}
+
+func netConf(t *testing.T, conf map[string]interface{}) []byte {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func bridgeMaster(t *testing.T, name string) string {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master, err := netlink.LinkByIndex(link.Attrs().MasterIndex)
+	if err != nil {
+		t.Fatalf("interface %s has no master: %v", name, err)
+	}
+	return master.Attrs().Name
+}
+
+func TestAddCheckDel(t *testing.T) {
+	netnstest.New(t)
+	netnsHost(t)
+	ipamType, _ := stubIPAM(t)
+	dataDir := t.TempDir()
+
+	container, err := testutils.NewNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testutils.UnmountNS(container)
+
+	conf := map[string]interface{}{
+		"cniVersion": "1.0.0",
+		"name":       "vm-network",
+		"type":       "tabby",
+		"bridge":     "br10",
+		"dataDir":    dataDir,
+		"ipam":       map[string]interface{}{"type": ipamType},
+	}
+	args := &skel.CmdArgs{ContainerID: "vm", Netns: container.Path(), IfName: "eth0", StdinData: netConf(t, conf)}
+
+	r, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := current.GetResult(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Interfaces) != 3 {
+		t.Fatalf("interfaces = %v, want the bridge and the veth pair", result.Interfaces)
+	}
+	br, hostVeth, containerVeth := result.Interfaces[0], result.Interfaces[1], result.Interfaces[2]
+	if br.Name != "br10" || br.Sandbox != "" {
+		t.Errorf("bridge interface = %v", br)
+	}
+	if hostVeth.Sandbox != "" || containerVeth.Name != "eth0" || containerVeth.Sandbox != container.Path() {
+		t.Errorf("veth interfaces = %v, %v", hostVeth, containerVeth)
+	}
+	if len(result.IPs) != 1 || result.IPs[0].Address.String() != "10.10.0.2/24" || *result.IPs[0].Interface != 2 {
+		t.Errorf("ips = %v, want 10.10.0.2/24 on the container interface", result.IPs)
+	}
+
+	if master := bridgeMaster(t, hostVeth.Name); master != "br10" {
+		t.Errorf("master of %s = %s, want br10", hostVeth.Name, master)
+	}
+
+	err = container.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		if len(addrs) != 1 || addrs[0].IPNet.String() != "10.10.0.2/24" {
+			t.Errorf("addresses of eth0 = %v, want 10.10.0.2/24", addrs)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attachments, err := listAttachments(filepath.Join(dataDir, "vm-network"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Attachment{{ContainerID: "vm", IfName: "eth0", Netns: container.Path(), HostInterface: hostVeth.Name, Owned: true}}
+	if !reflect.DeepEqual(attachments, want) {
+		t.Errorf("attachments = %v, want %v", attachments, want)
+	}
+
+	conf["prevResult"] = result
+	args.StdinData = netConf(t, conf)
+	if err := testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) }); err != nil {
+		t.Fatal(err)
+	}
+	if linkExists(hostVeth.Name) {
+		t.Errorf("veth %s left behind", hostVeth.Name)
+	}
+	if attachments, _ := listAttachments(filepath.Join(dataDir, "vm-network")); len(attachments) != 0 {
+		t.Errorf("attachments = %v, want none", attachments)
+	}
+	// Bridge is shared by the containers of the network
+	if !linkExists("br10") {
+		t.Error("bridge br10 removed")
+	}
+
+	// Runtime repeats DEL when the container is gone
+	if err := testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) }); err != nil {
+		t.Errorf("repeated DEL: %v", err)
+	}
+}
+
+func TestAddCheckDelChained(t *testing.T) {
+	netnstest.New(t)
+	netnsHost(t)
+	dataDir := t.TempDir()
+
+	container, err := testutils.NewNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testutils.UnmountNS(container)
+
+	// Veth pair of the previous plugin
+	addVeth(t, "vethprev")
+	peer, err := netlink.LinkByName("vethprevp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(container.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	err = container.Do(func(_ ns.NetNS) error {
+		return netlink.LinkSetName(peer, "eth0")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := map[string]interface{}{
+		"cniVersion": "1.0.0",
+		"name":       "vm-network",
+		"type":       "tabby",
+		"bridge":     "br10",
+		"dataDir":    dataDir,
+		"prevResult": map[string]interface{}{
+			"cniVersion": "1.0.0",
+			"interfaces": []map[string]interface{}{
+				{"name": "vethprev"},
+				{"name": "eth0", "sandbox": container.Path()},
+			},
+		},
+	}
+	args := &skel.CmdArgs{ContainerID: "vm", Netns: container.Path(), IfName: "eth0", StdinData: netConf(t, conf)}
+
+	r, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := current.GetResult(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Result of the previous plugin is passed through with the bridge
+	var names []string
+	for _, iface := range result.Interfaces {
+		names = append(names, iface.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"vethprev", "eth0", "br10"}) {
+		t.Errorf("interfaces = %v, want vethprev, eth0, br10", names)
+	}
+	if master := bridgeMaster(t, "vethprev"); master != "br10" {
+		t.Errorf("master of vethprev = %s, want br10", master)
+	}
+
+	attachments, err := listAttachments(filepath.Join(dataDir, "vm-network"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Attachment{{ContainerID: "vm", IfName: "eth0", Netns: container.Path(), HostInterface: "vethprev"}}
+	if !reflect.DeepEqual(attachments, want) {
+		t.Errorf("attachments = %v, want %v", attachments, want)
+	}
+
+	conf["prevResult"] = result
+	args.StdinData = netConf(t, conf)
+	if err := testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) }); err != nil {
+		t.Fatal(err)
+	}
+
+	// Veth is left to the previous plugin
+	if err := testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) }); err != nil {
+		t.Fatal(err)
+	}
+	if !linkExists("vethprev") {
+		t.Error("veth of the previous plugin removed")
+	}
+	if attachments, _ := listAttachments(filepath.Join(dataDir, "vm-network")); len(attachments) != 0 {
+		t.Errorf("attachments = %v, want none", attachments)
+	}
+}
+
+func TestAddStateFailure(t *testing.T) {
+	netnstest.New(t)
+	netnsHost(t)
+	ipamType, log := stubIPAM(t)
+
+	// State directory can't be created under a file
+	dataDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(dataDir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	container, err := testutils.NewNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testutils.UnmountNS(container)
+
+	conf := netConf(t, map[string]interface{}{
+		"cniVersion": "1.0.0",
+		"name":       "vm-network",
+		"type":       "tabby",
+		"bridge":     "br10",
+		"dataDir":    dataDir,
+		"ipam":       map[string]interface{}{"type": ipamType},
+	})
+	args := &skel.CmdArgs{ContainerID: "vm", Netns: container.Path(), IfName: "eth0", StdinData: conf}
+
+	if _, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) }); err == nil {
+		t.Fatal("expected state error")
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range links {
+		if link.Type() == "veth" {
+			t.Errorf("veth %s left behind after the state failure", link.Attrs().Name)
+		}
+	}
+
+	commands, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(commands) != "ADD\nDEL\n" {
+		t.Errorf("ipam commands = %q, want the address released", commands)
+	}
+}
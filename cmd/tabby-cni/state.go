@@ -0,0 +1,124 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultDataDir = "/var/lib/cni/tabby"
+
+// Attachment of a container, it's stored on ADD so GC could clean up after crashed runtimes
+type Attachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+	Netns       string `json:"netns,omitempty"`
+	// Host side veth of the container
+	HostInterface string `json:"hostInterface,omitempty"`
+	// Veth was created by the plugin, chained veths belong to the previous plugin
+	Owned bool `json:"owned,omitempty"`
+}
+
+func (c *NetConf) stateDir() string {
+	dir := c.DataDir
+	if dir == "" {
+		dir = defaultDataDir
+	}
+	return filepath.Join(dir, c.Name)
+}
+
+func attachmentFile(dir string, containerID string, ifName string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.json", containerID, ifName))
+}
+
+func saveAttachment(dir string, a *Attachment) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create state directory %s: %v", dir, err)
+	}
+
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	// Readers never see a partially written file
+	path := attachmentFile(dir, a.ContainerID, a.IfName)
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return fmt.Errorf("failed to write attachment %s: %v", path, err)
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// Returns nil if the attachment is not stored
+func loadAttachment(dir string, containerID string, ifName string) (*Attachment, error) {
+	data, err := os.ReadFile(attachmentFile(dir, containerID, ifName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment of container %s: %v", containerID, err)
+	}
+
+	a := &Attachment{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("failed to parse attachment of container %s: %v", containerID, err)
+	}
+	return a, nil
+}
+
+func removeAttachment(dir string, containerID string, ifName string) error {
+	err := os.Remove(attachmentFile(dir, containerID, ifName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove attachment of container %s: %v", containerID, err)
+	}
+	return nil
+}
+
+func listAttachments(dir string) ([]Attachment, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state directory %s: %v", dir, err)
+	}
+
+	var attachments []Attachment
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attachment %s: %v", entry.Name(), err)
+		}
+
+		a := Attachment{}
+		if err := json.Unmarshal(data, &a); err != nil {
+			return nil, fmt.Errorf("failed to parse attachment %s: %v", entry.Name(), err)
+		}
+		attachments = append(attachments, a)
+	}
+
+	return attachments, nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+const (
+	defaultKubeconfig string        = "/etc/cni/net.d/tabby.d/tabby.kubeconfig"
+	apiTimeout        time.Duration = 30 * time.Second
+
+	// Well known STATUS error code, the plugin is not able to add containers
+	errPluginNotAvailable uint = 50
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(networkv1alpha1.AddToScheme(scheme))
+}
+
+// The network is ready when the agent has programmed the NetworkAttachment of the bridge on the node.
+// Without a kubeconfig the plugin runs standalone and creates the network itself.
+func cmdStatus(args *skel.CmdArgs) error {
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	kubeconfig := conf.Kubeconfig
+	if kubeconfig == "" {
+		kubeconfig = defaultKubeconfig
+		if _, err := os.Stat(kubeconfig); os.IsNotExist(err) {
+			return nil
+		}
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return fmt.Errorf("failed to load kubeconfig %s: %v", kubeconfig, err)
+	}
+
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+
+	node, err := conf.nodeName()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	if err := networkStatus(ctx, c, node, conf.Bridge); err != nil {
+		return types.NewError(errPluginNotAvailable, fmt.Sprintf("network %s is not ready", conf.Name), err.Error())
+	}
+
+	return nil
+}
+
+func (c *NetConf) nodeName() (string, error) {
+	if c.NodeName != "" {
+		return c.NodeName, nil
+	}
+
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		return node, nil
+	}
+
+	return os.Hostname()
+}
+
+func networkStatus(ctx context.Context, c client.Client, node string, bridge string) error {
+	attachments := &networkv1alpha1.NetworkAttachmentList{}
+	if err := c.List(ctx, attachments); err != nil {
+		return fmt.Errorf("failed to get list of networkattachments: %v", err)
+	}
+
+	var networkAttachment *networkv1alpha1.NetworkAttachment
+	for i := range attachments.Items {
+		if attachments.Items[i].Spec.NodeName == node && hasBridge(&attachments.Items[i], bridge) {
+			networkAttachment = &attachments.Items[i]
+			break
+		}
+	}
+
+	if networkAttachment == nil {
+		return fmt.Errorf("there is no networkattachment of bridge %s on node %s", bridge, node)
+	}
+
+	ready := meta.FindStatusCondition(networkAttachment.Status.Conditions, networkv1alpha1.NetworkAttachmentConditionReady)
+	if ready == nil {
+		return fmt.Errorf("networkattachment %s/%s is not programmed yet", networkAttachment.Namespace, networkAttachment.Name)
+	}
+
+	if ready.Status != metav1.ConditionTrue {
+		return fmt.Errorf("networkattachment %s/%s has failed: %s", networkAttachment.Namespace, networkAttachment.Name, ready.Message)
+	}
+
+	if _, err := netlink.LinkByName(bridge); err != nil {
+		return fmt.Errorf("failed to find bridge %s: %v", bridge, err)
+	}
+
+	return nil
+}
+
+func hasBridge(networkAttachment *networkv1alpha1.NetworkAttachment, bridge string) bool {
+	for _, br := range networkAttachment.Spec.Bridge {
+		if br.Name == bridge {
+			return true
+		}
+	}
+	return false
+}
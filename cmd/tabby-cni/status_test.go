@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/netnstest"
+)
+
+func networkAttachment(node string, conditions ...metav1.Condition) *networkv1alpha1.NetworkAttachment {
+	return &networkv1alpha1.NetworkAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: node + "-vm-network", Namespace: "default"},
+		Spec: networkv1alpha1.NetworkAttachmentSpec{
+			Bridge:   []networkv1alpha1.Bridge{{Name: "br0"}},
+			NodeName: node,
+		},
+		Status: networkv1alpha1.NetworkAttachmentStatus{Conditions: conditions},
+	}
+}
+
+func TestNetworkStatus(t *testing.T) {
+	netnstest.New(t)
+
+	if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ready := metav1.Condition{Type: networkv1alpha1.NetworkAttachmentConditionReady, Status: metav1.ConditionTrue}
+	failed := metav1.Condition{Type: networkv1alpha1.NetworkAttachmentConditionReady, Status: metav1.ConditionFalse, Message: "vlan failed"}
+
+	tests := []struct {
+		name    string
+		objects []*networkv1alpha1.NetworkAttachment
+		bridge  string
+		ready   bool
+	}{
+		{"ready", []*networkv1alpha1.NetworkAttachment{networkAttachment("node1", ready)}, "br0", true},
+		{"missing", []*networkv1alpha1.NetworkAttachment{networkAttachment("node2", ready)}, "br0", false},
+		{"failed", []*networkv1alpha1.NetworkAttachment{networkAttachment("node1", failed)}, "br0", false},
+		{"not programmed yet", []*networkv1alpha1.NetworkAttachment{networkAttachment("node1")}, "br0", false},
+		{"bridge is gone", []*networkv1alpha1.NetworkAttachment{networkAttachment("node1", ready)}, "br1", false},
+	}
+
+	// Subtests would run outside of the network namespace
+	for _, tt := range tests {
+		builder := fake.NewClientBuilder().WithScheme(scheme)
+		for _, o := range tt.objects {
+			o.Spec.Bridge[0].Name = tt.bridge
+			builder = builder.WithObjects(o)
+		}
+
+		err := networkStatus(context.Background(), builder.Build(), "node1", tt.bridge)
+		if tt.ready && err != nil {
+			t.Errorf("%s: expected network to be ready, got %v", tt.name, err)
+		}
+		if !tt.ready && err == nil {
+			t.Errorf("%s: expected network not to be ready", tt.name)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+const pluginType = "tabby"
+
+// Source is a CNI config file and the host it came from
+type Source struct {
+	Host string
+	Path string
+	Data []byte
+}
+
+type route struct {
+	Via string `json:"via,omitempty"`
+	Dev string `json:"dev,omitempty"`
+	Src string `json:"src,omitempty"`
+	Dst string `json:"dst"`
+}
+
+type masquerade struct {
+	Enabled       bool     `json:"enabled"`
+	Source        string   `json:"source"`
+	Ignore        []string `json:"ignore,omitempty"`
+	Bridge        string   `json:"bridge,omitempty"`
+	EgressNetwork string   `json:"egressnetwork,omitempty"`
+	Gateway       string   `json:"gateway,omitempty"`
+	GatewayMAC    string   `json:"gatewayMAC,omitempty"`
+	GatewayMode   string   `json:"gatewayMode,omitempty"`
+}
+
+type pluginConf struct {
+	Name      string          `json:"name"`
+	Type      string          `json:"type"`
+	Bridge    string          `json:"bridge"`
+	Interface string          `json:"interface,omitempty"`
+	Vlan      int             `json:"vlan,omitempty"`
+	MTU       int             `json:"mtu,omitempty"`
+	Routes    []route         `json:"routes,omitempty"`
+	IPMasq    *masquerade     `json:"ipMasq,omitempty"`
+	IPAM      json.RawMessage `json:"ipam,omitempty"`
+}
+
+type confList struct {
+	Name    string            `json:"name"`
+	Plugins []json.RawMessage `json:"plugins"`
+}
+
+// Fields of the plugin config which are either mapped or don't matter for the Network
+var knownFields = map[string]bool{
+	"cniVersion": true, "name": true, "type": true, "bridge": true, "interface": true, "vlan": true,
+	"mtu": true, "routes": true, "ipMasq": true, "ipam": true, "dns": true, "prevResult": true,
+	"capabilities": true, "runtimeConfig": true, "args": true,
+	"dataDir": true, "kubeconfig": true, "nodeName": true,
+}
+
+var knownMasqueradeFields = map[string]bool{
+	"enabled": true, "source": true, "ignore": true, "bridge": true, "egressnetwork": true,
+	"gateway": true, "gatewayMAC": true, "gatewayMode": true,
+}
+
+func unknownFields(data []byte, known map[string]bool) []string {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+
+	var unknown []string
+	for field := range fields {
+		if !known[field] {
+			unknown = append(unknown, field)
+		}
+	}
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+// Find the tabby plugin in a config or a config list
+func parse(source Source) (*pluginConf, []string, error) {
+	var warnings []string
+
+	list := &confList{}
+	if err := json.Unmarshal(source.Data, list); err != nil {
+		return nil, nil, fmt.Errorf("%s: failed to parse config: %v", source.Path, err)
+	}
+
+	plugins := list.Plugins
+	if len(plugins) == 0 {
+		plugins = []json.RawMessage{source.Data}
+	}
+
+	var conf *pluginConf
+	var raw json.RawMessage
+	for _, p := range plugins {
+		c := &pluginConf{}
+		if err := json.Unmarshal(p, c); err != nil {
+			return nil, nil, fmt.Errorf("%s: failed to parse plugin config: %v", source.Path, err)
+		}
+
+		if c.Type != pluginType {
+			// The bridge plugin in front of tabby only attaches containers
+			warnings = append(warnings, fmt.Sprintf("%s: plugin %q is not converted", source.Path, c.Type))
+			continue
+		}
+
+		if conf != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: only the first %s plugin is converted", source.Path, pluginType))
+			continue
+		}
+
+		conf, raw = c, p
+	}
+
+	if conf == nil {
+		return nil, warnings, fmt.Errorf("%s: there is no %s plugin", source.Path, pluginType)
+	}
+
+	if conf.Name == "" {
+		conf.Name = list.Name
+	}
+
+	for _, field := range unknownFields(raw, knownFields) {
+		warnings = append(warnings, fmt.Sprintf("%s: field %q doesn't map to the Network", source.Path, field))
+	}
+
+	if conf.IPMasq != nil {
+		masq := map[string]json.RawMessage{}
+		_ = json.Unmarshal(raw, &masq)
+		for _, field := range unknownFields(masq["ipMasq"], knownMasqueradeFields) {
+			warnings = append(warnings, fmt.Sprintf("%s: field \"ipMasq.%s\" doesn't map to the Network", source.Path, field))
+		}
+	}
+
+	if ipam := string(conf.IPAM); ipam != "" && ipam != "{}" && ipam != "null" {
+		warnings = append(warnings, fmt.Sprintf("%s: ipam doesn't map to the Network, use an IPPool instead", source.Path))
+	}
+
+	return conf, warnings, nil
+}
+
+func validCIDR(cidr string) bool {
+	_, _, err := net.ParseCIDR(cidr)
+	return err == nil
+}
+
+// Spec of the Network equivalent to the plugin config
+func networkSpec(path string, conf *pluginConf) (networkv1alpha1.NetworkSpec, []string) {
+	var warnings []string
+
+	br := networkv1alpha1.Bridge{Name: conf.Bridge, Mtu: conf.MTU}
+	if conf.Interface != "" {
+		br.Ports = []networkv1alpha1.Port{{Name: conf.Interface, Vlan: conf.Vlan, Mtu: conf.MTU}}
+	} else if conf.Vlan != 0 {
+		warnings = append(warnings, fmt.Sprintf("%s: vlan %d without interface doesn't map to the Network", path, conf.Vlan))
+	}
+
+	spec := networkv1alpha1.NetworkSpec{Bridge: []networkv1alpha1.Bridge{br}}
+
+	for _, r := range conf.Routes {
+		via := r.Via
+		if via == "" {
+			via = r.Dev
+		}
+
+		if via == "" || !validCIDR(r.Dst) {
+			warnings = append(warnings, fmt.Sprintf("%s: route %+v is not valid", path, r))
+			continue
+		}
+
+		if r.Src != "" && !validCIDR(r.Src) {
+			warnings = append(warnings, fmt.Sprintf("%s: source %q of route to %s is not a network", path, r.Src, r.Dst))
+		}
+
+		spec.Routes = append(spec.Routes, networkv1alpha1.Route{Via: via, Destination: r.Dst, Source: r.Src})
+	}
+
+	if masq := conf.IPMasq; masq != nil && masq.Enabled {
+		spec.IpMasq = networkv1alpha1.Masquerade{
+			Enabled:       true,
+			Source:        masq.Source,
+			Ignore:        masq.Ignore,
+			Bridge:        masq.Bridge,
+			EgressNetwork: masq.EgressNetwork,
+			Gateway:       masq.Gateway,
+			GatewayMAC:    masq.GatewayMAC,
+			GatewayMode:   masq.GatewayMode,
+		}
+
+		if spec.IpMasq.Bridge == "" {
+			spec.IpMasq.Bridge = conf.Bridge
+		}
+
+		for _, ignore := range masq.Ignore {
+			if !validCIDR(ignore) {
+				warnings = append(warnings, fmt.Sprintf("%s: masquerade ignore %q is not a network", path, ignore))
+			}
+		}
+	}
+
+	return spec, warnings
+}
+
+func hostSelector(hosts []string) []metav1.LabelSelector {
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	return []metav1.LabelSelector{{
+		MatchExpressions: []metav1.LabelSelectorRequirement{{
+			Key:      corev1.LabelHostname,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   hosts,
+		}},
+	}}
+}
+
+// Convert the configs into networks. Configs with the same name and spec are merged
+// into one network selected to all of their hosts.
+func Convert(sources []Source, namespace string, name string) ([]*networkv1alpha1.Network, []string, error) {
+	var warnings []string
+	var networks []*networkv1alpha1.Network
+	hosts := map[*networkv1alpha1.Network][]string{}
+	anyHost := map[*networkv1alpha1.Network]bool{}
+	networkNames := map[*networkv1alpha1.Network]string{}
+	names := map[string]int{}
+
+	for _, source := range sources {
+		conf, w, err := parse(source)
+		warnings = append(warnings, w...)
+		if err != nil {
+			return nil, warnings, err
+		}
+
+		if conf.Bridge == "" {
+			return nil, warnings, fmt.Errorf("%s: bridge is required", source.Path)
+		}
+
+		spec, w := networkSpec(source.Path, conf)
+		warnings = append(warnings, w...)
+
+		networkName := name
+		if networkName == "" {
+			networkName = conf.Name
+		}
+
+		var network *networkv1alpha1.Network
+		for _, n := range networks {
+			if networkNames[n] == networkName && reflect.DeepEqual(n.Spec, spec) {
+				network = n
+				break
+			}
+		}
+
+		if network == nil {
+			// Different configs of the same network on other hosts get their own Network
+			resourceName := networkName
+			if names[networkName] > 0 {
+				resourceName = fmt.Sprintf("%s-%d", networkName, names[networkName])
+				warnings = append(warnings, fmt.Sprintf("%s: config differs from other hosts, converted into network %s", source.Path, resourceName))
+			}
+			names[networkName]++
+
+			network = &networkv1alpha1.Network{
+				TypeMeta: metav1.TypeMeta{APIVersion: networkv1alpha1.GroupVersion.String(), Kind: "Network"},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName,
+					Namespace: namespace,
+				},
+				Spec: spec,
+			}
+			networks = append(networks, network)
+			networkNames[network] = networkName
+		}
+
+		if source.Host == "" {
+			// The network runs on every node
+			anyHost[network] = true
+			warnings = append(warnings, fmt.Sprintf("%s: host is unknown, network %s is not limited to hosts", source.Path, network.Name))
+			continue
+		}
+
+		hosts[network] = append(hosts[network], source.Host)
+	}
+
+	for _, network := range networks {
+		if !anyHost[network] {
+			sort.Strings(hosts[network])
+			network.Spec.NodeSelectors = hostSelector(hosts[network])
+		}
+	}
+
+	return networks, warnings, nil
+}
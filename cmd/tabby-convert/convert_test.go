@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	data, err := os.ReadFile("../../tests/10-tabby-cni.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := `{"cniVersion": "0.3.1", "name": "vm-network", "type": "tabby", "bridge": "br2724", "mtu": 9000, "hairpin": true}`
+
+	networks, warnings, err := Convert([]Source{
+		{Host: "node2", Path: "node2.conf", Data: data},
+		{Host: "node1", Path: "node1.conf", Data: data},
+		{Host: "node3", Path: "node3.conf", Data: []byte(other)},
+	}, "default", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(networks) != 2 {
+		t.Fatalf("expected 2 networks, got %d", len(networks))
+	}
+
+	first := networks[0]
+	if first.Name != "vm-network" || first.Spec.Bridge[0].Ports[0].Vlan != 2724 || first.Spec.Routes[0].Via != "br2724" || first.Spec.IpMasq.Bridge != "br2724" {
+		t.Errorf("unexpected network %+v", first)
+	}
+	if hosts := first.Spec.NodeSelectors[0].MatchExpressions[0].Values; !reflect.DeepEqual(hosts, []string{"node1", "node2"}) {
+		t.Errorf("unexpected hosts %v", hosts)
+	}
+
+	second := networks[1]
+	if second.Name != "vm-network-1" || second.Spec.Bridge[0].Mtu != 9000 || len(second.Spec.Bridge[0].Ports) != 0 {
+		t.Errorf("unexpected network %+v", second)
+	}
+
+	all := strings.Join(warnings, "\n")
+	for _, w := range []string{`"10.25.20/24" is not a network`, `field "hairpin" doesn't map`, "converted into network vm-network-1"} {
+		if !strings.Contains(all, w) {
+			t.Errorf("missing warning %q in %q", w, all)
+		}
+	}
+}
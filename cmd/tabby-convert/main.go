@@ -0,0 +1,108 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// tabby-convert converts CNI configs of the tabby plugin into Network resources.
+//
+//	tabby-convert [-namespace default] [-name vm-network] [host=]file...
+//
+// Files of the same network with the same configuration become one Network, which
+// is selected to the hosts the files came from. Fields which don't map are reported on stderr.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+// Manifest of the network without the fields set by the API server
+func manifest(network *networkv1alpha1.Network) ([]byte, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(network)
+	if err != nil {
+		return nil, err
+	}
+
+	unstructured.RemoveNestedField(obj, "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(obj, "status")
+
+	return yaml.Marshal(obj)
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [host=]file...\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	var namespace string
+	var name string
+
+	flag.StringVar(&namespace, "namespace", "default", "Namespace of the networks.")
+	flag.StringVar(&name, "name", "", "Name of the networks, the name of the CNI network if not defined.")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var sources []Source
+	for _, arg := range flag.Args() {
+		source := Source{Path: arg}
+		if host, path, ok := strings.Cut(arg, "="); ok {
+			source = Source{Host: host, Path: path}
+		}
+
+		data, err := os.ReadFile(source.Path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		source.Data = data
+
+		sources = append(sources, source)
+	}
+
+	networks, warnings, err := Convert(sources, namespace, name)
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	for i, network := range networks {
+		data, err := manifest(network)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if i > 0 {
+			fmt.Println("---")
+		}
+		fmt.Print(string(data))
+	}
+}
@@ -0,0 +1,346 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// tabby-ipam is an IPAM CNI plugin which hands out addresses of IPPool objects
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/ipam"
+)
+
+const (
+	defaultKubeconfig string        = "/etc/cni/net.d/tabby.d/tabby.kubeconfig"
+	apiTimeout        time.Duration = 30 * time.Second
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(networkv1alpha1.AddToScheme(scheme))
+}
+
+type IPAMConfig struct {
+	Type       string `json:"type"`
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// Name of the IPPool, the pool bound to the network is used if not defined
+	Pool    string `json:"pool,omitempty"`
+	Network string `json:"network,omitempty"`
+	// Namespace of the pool, the pod namespace is used if not defined
+	Namespace string `json:"namespace,omitempty"`
+	// Node of GC, defaults to NODE_NAME or the hostname
+	NodeName string `json:"nodeName,omitempty"`
+}
+
+type NetConf struct {
+	types.NetConf
+	IPAM *IPAMConfig `json:"ipam"`
+}
+
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAME      types.UnmarshallableString //nolint:revive,stylecheck
+	K8S_POD_NAMESPACE types.UnmarshallableString //nolint:revive,stylecheck
+}
+
+func loadNetConf(data []byte) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if conf.IPAM == nil {
+		return nil, fmt.Errorf("missing ipam configuration")
+	}
+
+	if conf.IPAM.Kubeconfig == "" {
+		conf.IPAM.Kubeconfig = defaultKubeconfig
+	}
+
+	if conf.IPAM.Network == "" {
+		conf.IPAM.Network = conf.Name
+	}
+
+	return conf, nil
+}
+
+func loadConfig(args *skel.CmdArgs) (*NetConf, *K8sArgs, error) {
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k8sArgs := &K8sArgs{}
+	if err := types.LoadArgs(args.Args, k8sArgs); err != nil {
+		return nil, nil, fmt.Errorf("failed to load CNI_ARGS: %v", err)
+	}
+
+	if k8sArgs.K8S_POD_NAME == "" || k8sArgs.K8S_POD_NAMESPACE == "" {
+		return nil, nil, fmt.Errorf("K8S_POD_NAME and K8S_POD_NAMESPACE are required")
+	}
+
+	if conf.IPAM.Namespace == "" {
+		conf.IPAM.Namespace = string(k8sArgs.K8S_POD_NAMESPACE)
+	}
+
+	return conf, k8sArgs, nil
+}
+
+// Replaced by tests
+var newClient = func(kubeconfig string) (client.Client, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig %s: %v", kubeconfig, err)
+	}
+
+	return client.New(config, client.Options{Scheme: scheme})
+}
+
+func (c *IPAMConfig) nodeName() (string, error) {
+	if c.NodeName != "" {
+		return c.NodeName, nil
+	}
+
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		return node, nil
+	}
+
+	return os.Hostname()
+}
+
+func getPod(ctx context.Context, c client.Client, k8sArgs *K8sArgs) (*corev1.Pod, error) {
+	pod := &corev1.Pod{}
+	key := k8stypes.NamespacedName{Namespace: string(k8sArgs.K8S_POD_NAMESPACE), Name: string(k8sArgs.K8S_POD_NAME)}
+	if err := c.Get(ctx, key, pod); err != nil {
+		return nil, err
+	}
+
+	return pod, nil
+}
+
+func result(pool *networkv1alpha1.IPPool, alloc *networkv1alpha1.IPAllocation) (*current.Result, error) {
+	ip, address, err := net.ParseCIDR(alloc.Spec.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q of ipallocation %s: %v", alloc.Spec.Address, alloc.Name, err)
+	}
+	address.IP = ip
+
+	config := &current.IPConfig{Address: *address}
+
+	r := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+
+	if gw := net.ParseIP(pool.Spec.Gateway); gw != nil {
+		config.Gateway = gw
+
+		dst := &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+		if ip.To4() == nil {
+			dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+		}
+		r.Routes = append(r.Routes, &types.Route{Dst: *dst, GW: gw})
+	}
+
+	r.IPs = append(r.IPs, config)
+
+	return r, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, k8sArgs, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+
+	c, err := newClient(conf.IPAM.Kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	pod, err := getPod(ctx, c, k8sArgs)
+	if err != nil {
+		return fmt.Errorf("failed to get pod: %v", err)
+	}
+
+	allocator := ipam.NewAllocator(c)
+
+	pool, err := allocator.Pool(ctx, conf.IPAM.Namespace, conf.IPAM.Pool, conf.IPAM.Network)
+	if err != nil {
+		return err
+	}
+
+	attachment := ipam.Attachment{ContainerID: args.ContainerID, Interface: args.IfName, NodeName: pod.Spec.NodeName}
+
+	alloc, err := allocator.Allocate(ctx, pool, ipam.OwnerOf(pod), attachment)
+	if err != nil {
+		return err
+	}
+
+	r, err := result(pool, alloc)
+	if err != nil {
+		return err
+	}
+
+	return types.PrintResult(r, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, k8sArgs, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+
+	c, err := newClient(conf.IPAM.Kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	pod, err := getPod(ctx, c, k8sArgs)
+	if errors.IsNotFound(err) {
+		// Allocations are garbage collected together with the owner
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get pod: %v", err)
+	}
+
+	// Addresses of virtual machines are kept when the source pod of a live migration is deleted
+	owner := ipam.OwnerOf(pod)
+	if owner.Kind != networkv1alpha1.IPAllocationOwnerPod {
+		return nil
+	}
+
+	return ipam.NewAllocator(c).Release(ctx, conf.IPAM.Namespace, owner, args.IfName)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, k8sArgs, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+
+	c, err := newClient(conf.IPAM.Kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	pod, err := getPod(ctx, c, k8sArgs)
+	if err != nil {
+		return fmt.Errorf("failed to get pod: %v", err)
+	}
+
+	allocator := ipam.NewAllocator(c)
+
+	pool, err := allocator.Pool(ctx, conf.IPAM.Namespace, conf.IPAM.Pool, conf.IPAM.Network)
+	if err != nil {
+		return err
+	}
+
+	allocations, err := allocator.Allocations(ctx, pool, ipam.OwnerOf(pod))
+	if err != nil {
+		return err
+	}
+
+	for _, alloc := range allocations {
+		if alloc.Spec.Interface == args.IfName {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("there is no address of interface %s in ippool %s/%s", args.IfName, pool.Namespace, pool.Name)
+}
+
+// Release addresses of pod interfaces on the node which are not in the list of valid attachments.
+// The pool namespace is not known without a pod, so pools of the network in all namespaces are collected.
+func cmdGC(args *skel.CmdArgs) error {
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	node, err := conf.IPAM.nodeName()
+	if err != nil {
+		return err
+	}
+
+	c, err := newClient(conf.IPAM.Kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	allocator := ipam.NewAllocator(c)
+
+	pools, err := allocator.Pools(ctx, conf.IPAM.Namespace, conf.IPAM.Pool, conf.IPAM.Network)
+	if err != nil {
+		return err
+	}
+
+	var valid []ipam.Attachment
+	for _, a := range conf.ValidAttachments {
+		valid = append(valid, ipam.Attachment{ContainerID: a.ContainerID, Interface: a.IfName})
+	}
+
+	for i := range pools {
+		if err := allocator.Collect(ctx, &pools[i], node, valid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var funcs = skel.CNIFuncs{
+	Add:   cmdAdd,
+	Del:   cmdDel,
+	Check: cmdCheck,
+	GC:    cmdGC,
+}
+
+func main() {
+	skel.PluginMainFuncs(funcs, version.All, bv.BuildString("tabby-ipam"))
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/ipam"
+)
+
+var pool = &networkv1alpha1.IPPool{
+	ObjectMeta: metav1.ObjectMeta{Name: "pool", Namespace: "default"},
+	Spec:       networkv1alpha1.IPPoolSpec{Network: "vm-network", CIDR: "10.10.0.0/24", Gateway: "10.10.0.1"},
+}
+
+// The plugin talks to the fake client instead of the kubeconfig
+func newFakeClient(t *testing.T, objs ...client.Object) client.Client {
+	c := fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(append(objs, pool.DeepCopy())...).Build()
+
+	orig := newClient
+	newClient = func(string) (client.Client, error) { return c, nil }
+	t.Cleanup(func() { newClient = orig })
+
+	return c
+}
+
+// pluginExec runs the plugin in the test process through skel, the way the runtime runs the binary
+type pluginExec struct{}
+
+func newPluginExec(t *testing.T) *pluginExec {
+	// Variables set by the exec are restored after the test
+	for _, env := range []string{"CNI_COMMAND", "CNI_CONTAINERID", "CNI_NETNS", "CNI_IFNAME", "CNI_ARGS", "CNI_PATH"} {
+		t.Setenv(env, os.Getenv(env))
+	}
+	return &pluginExec{}
+}
+
+func (e *pluginExec) ExecPlugin(_ context.Context, _ string, stdinData []byte, environ []string) ([]byte, error) {
+	for _, env := range environ {
+		if key, value, ok := strings.Cut(env, "="); ok && strings.HasPrefix(key, "CNI_") {
+			os.Setenv(key, value)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "tabby-ipam")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	stdin, stdout := filepath.Join(dir, "stdin"), filepath.Join(dir, "stdout")
+	if err := os.WriteFile(stdin, stdinData, 0o600); err != nil {
+		return nil, err
+	}
+
+	in, err := os.Open(stdin)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	out, err := os.Create(stdout)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	origStdin, origStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = in, out
+	defer func() { os.Stdin, os.Stdout = origStdin, origStdout }()
+
+	if err := skel.PluginMainFuncsWithError(funcs, version.All, ""); err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(stdout)
+}
+
+func (e *pluginExec) FindInPath(plugin string, _ []string) (string, error) {
+	return plugin, nil
+}
+
+func (e *pluginExec) Decode(jsonBytes []byte) (version.PluginInfo, error) {
+	return (&version.PluginDecoder{}).Decode(jsonBytes)
+}
+
+func allocate(t *testing.T, c client.Client, owner ipam.Owner, attachment ipam.Attachment) *networkv1alpha1.IPAllocation {
+	alloc, err := ipam.NewAllocator(c).Allocate(context.Background(), pool, owner, attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alloc
+}
+
+func podOwner(name string) ipam.Owner {
+	return ipam.Owner{APIVersion: "v1", Kind: networkv1alpha1.IPAllocationOwnerPod, Name: name, UID: k8stypes.UID("uid-" + name)}
+}
+
+func exists(t *testing.T, c client.Client, alloc *networkv1alpha1.IPAllocation) bool {
+	err := c.Get(context.Background(), client.ObjectKeyFromObject(alloc), &networkv1alpha1.IPAllocation{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestLoadConfig(t *testing.T) {
+	const podArgs = "IgnoreUnknown=1;K8S_POD_NAMESPACE=vms;K8S_POD_NAME=launcher"
+
+	tests := []struct {
+		name  string
+		stdin string
+		args  string
+		want  *IPAMConfig
+	}{
+		{
+			name:  "defaults",
+			stdin: `{"name":"vm-network","ipam":{"type":"tabby-ipam"}}`,
+			args:  podArgs,
+			want:  &IPAMConfig{Type: "tabby-ipam", Kubeconfig: defaultKubeconfig, Network: "vm-network", Namespace: "vms"},
+		},
+		{
+			name:  "pool of another namespace",
+			stdin: `{"name":"vm-network","ipam":{"type":"tabby-ipam","kubeconfig":"/tmp/kubeconfig","pool":"pool","network":"shared","namespace":"default"}}`,
+			args:  podArgs,
+			want:  &IPAMConfig{Type: "tabby-ipam", Kubeconfig: "/tmp/kubeconfig", Pool: "pool", Network: "shared", Namespace: "default"},
+		},
+		{name: "invalid json", stdin: `{`, args: podArgs},
+		{name: "missing ipam", stdin: `{"name":"vm-network"}`, args: podArgs},
+		{name: "missing pod", stdin: `{"name":"vm-network","ipam":{"type":"tabby-ipam"}}`, args: "K8S_POD_NAMESPACE=vms"},
+		{name: "unknown args", stdin: `{"name":"vm-network","ipam":{"type":"tabby-ipam"}}`, args: "K8S_POD_NAMESPACE=vms;K8S_POD_NAME=launcher;FOO=bar"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, k8sArgs, err := loadConfig(&skel.CmdArgs{StdinData: []byte(tt.stdin), Args: tt.args})
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", conf.IPAM)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *conf.IPAM != *tt.want {
+				t.Errorf("ipam = %+v, want %+v", conf.IPAM, tt.want)
+			}
+
+			if k8sArgs.K8S_POD_NAME != "launcher" || k8sArgs.K8S_POD_NAMESPACE != "vms" {
+				t.Errorf("pod = %s/%s, want vms/launcher", k8sArgs.K8S_POD_NAMESPACE, k8sArgs.K8S_POD_NAME)
+			}
+		})
+	}
+}
+
+func newPod(name string, owner *metav1.OwnerReference) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: k8stypes.UID("uid-" + name)},
+		Spec:       corev1.PodSpec{NodeName: "node1"},
+	}
+	if owner != nil {
+		pod.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+	return pod
+}
+
+func podArgs(pod string, ifName string) *skel.CmdArgs {
+	return &skel.CmdArgs{
+		ContainerID: "container-" + pod,
+		IfName:      ifName,
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=" + pod,
+		StdinData:   []byte(`{"cniVersion":"1.0.0","name":"vm-network","type":"bridge","ipam":{"type":"tabby-ipam"}}`),
+	}
+}
+
+func allocations(t *testing.T, c client.Client) []networkv1alpha1.IPAllocation {
+	list := &networkv1alpha1.IPAllocationList{}
+	if err := c.List(context.Background(), list); err != nil {
+		t.Fatal(err)
+	}
+	return list.Items
+}
+
+func TestAddCheckDel(t *testing.T) {
+	c := newFakeClient(t, newPod("pod", nil))
+	args := podArgs("pod", "net1")
+
+	r, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := current.GetResult(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.IPs) != 1 || result.IPs[0].Address.String() != "10.10.0.2/24" || result.IPs[0].Gateway.String() != "10.10.0.1" {
+		t.Errorf("ips = %+v, want 10.10.0.2/24 via 10.10.0.1", result.IPs)
+	}
+
+	if len(result.Routes) != 1 || result.Routes[0].Dst.String() != "0.0.0.0/0" || result.Routes[0].GW.String() != "10.10.0.1" {
+		t.Errorf("routes = %+v, want default route via the gateway", result.Routes)
+	}
+
+	allocs := allocations(t, c)
+	if len(allocs) != 1 {
+		t.Fatalf("expected one ipallocation, got %d", len(allocs))
+	}
+	if spec := allocs[0].Spec; spec.ContainerID != "container-pod" || spec.Interface != "net1" || spec.NodeName != "node1" || spec.OwnerKind != networkv1alpha1.IPAllocationOwnerPod {
+		t.Errorf("ipallocation = %+v", spec)
+	}
+
+	// ADD is idempotent
+	if _, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) }); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(allocations(t, c)); n != 1 {
+		t.Errorf("expected the address to be reused, got %d ipallocations", n)
+	}
+
+	if err := testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) }); err != nil {
+		t.Errorf("CHECK of the allocated interface: %v", err)
+	}
+
+	other := podArgs("pod", "net2")
+	if err := testutils.CmdCheckWithArgs(other, func() error { return cmdCheck(other) }); err == nil {
+		t.Error("expected CHECK of an interface without address to fail")
+	}
+
+	if err := testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) }); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(allocations(t, c)); n != 0 {
+		t.Errorf("expected the address to be released, got %d ipallocations", n)
+	}
+
+	// The pod is gone, the allocations go away together with it
+	gone := podArgs("gone", "net1")
+	if err := testutils.CmdDelWithArgs(gone, func() error { return cmdDel(gone) }); err != nil {
+		t.Errorf("DEL of a deleted pod: %v", err)
+	}
+}
+
+func TestDelVirtualMachine(t *testing.T) {
+	controller := true
+	vmi := &metav1.OwnerReference{APIVersion: "kubevirt.io/v1", Kind: networkv1alpha1.IPAllocationOwnerVirtualMachineInstance, Name: "vm", UID: "uid-vm", Controller: &controller}
+
+	c := newFakeClient(t, newPod("source", vmi), newPod("target", vmi))
+
+	source, target := podArgs("source", "net1"), podArgs("target", "net1")
+
+	if _, _, err := testutils.CmdAddWithArgs(source, func() error { return cmdAdd(source) }); err != nil {
+		t.Fatal(err)
+	}
+
+	// The target pod of the live migration gets the address of the virtual machine
+	if _, _, err := testutils.CmdAddWithArgs(target, func() error { return cmdAdd(target) }); err != nil {
+		t.Fatal(err)
+	}
+
+	allocs := allocations(t, c)
+	if len(allocs) != 1 || allocs[0].Spec.OwnerName != "vm" || allocs[0].Spec.ContainerID != "container-target" {
+		t.Fatalf("expected one ipallocation of the virtual machine attached to the target, got %+v", allocs)
+	}
+
+	if err := testutils.CmdDelWithArgs(source, func() error { return cmdDel(source) }); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(allocations(t, c)); n != 1 {
+		t.Error("expected the address of the virtual machine to be kept on DEL of the source pod")
+	}
+}
+
+func TestDelegateGC(t *testing.T) {
+	c := newFakeClient(t)
+
+	live := allocate(t, c, podOwner("live"), ipam.Attachment{ContainerID: "live", Interface: "eth0", NodeName: "node1"})
+	stale := allocate(t, c, podOwner("stale"), ipam.Attachment{ContainerID: "stale", Interface: "eth0", NodeName: "node1"})
+	vm := allocate(t, c, ipam.Owner{APIVersion: "kubevirt.io/v1", Kind: networkv1alpha1.IPAllocationOwnerVirtualMachineInstance, Name: "vm", UID: "uid-vm"},
+		ipam.Attachment{ContainerID: "launcher", Interface: "eth0", NodeName: "node1"})
+
+	// GC of the tabby plugin passes its configuration with the valid attachments through
+	data, err := json.Marshal(map[string]interface{}{
+		"cniVersion":                "1.1.0",
+		"name":                      "vm-network",
+		"type":                      "tabby",
+		"bridge":                    "br0",
+		"ipam":                      map[string]string{"type": "tabby-ipam", "nodeName": "node1"},
+		"cni.dev/valid-attachments": []types.GCAttachment{{ContainerID: "live", IfName: "eth0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := newPluginExec(t)
+	t.Setenv("CNI_PATH", t.TempDir())
+
+	if err := invoke.DelegateGC(context.Background(), "tabby-ipam", data, exec); err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists(t, c, live) {
+		t.Error("expected address of the valid attachment to stay")
+	}
+
+	if exists(t, c, stale) {
+		t.Error("expected address of the stale attachment to be released")
+	}
+
+	if !exists(t, c, vm) {
+		t.Error("expected address of the virtual machine to stay")
+	}
+}
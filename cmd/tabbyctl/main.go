@@ -0,0 +1,156 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// tabbyctl compares the NetworkAttachments of the node with the host network.
+//
+//	tabbyctl [flags] status
+//	tabbyctl [flags] diff
+//	tabbyctl [flags] show bridge|routes|nat|ebtables
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+)
+
+const apiTimeout = 30 * time.Second
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(networkv1alpha1.AddToScheme(scheme))
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] status|diff|show bridge|routes|nat|ebtables\n\n", os.Args[0])
+	fmt.Fprintln(out, "  status  ready condition and drift of every network attachment of the node")
+	fmt.Fprintln(out, "  diff    differences of the host network from the network attachments")
+	fmt.Fprintln(out, "  show    desired and actual state of bridges, routes, nat and ebtables rules")
+	fmt.Fprintln(out)
+	flag.PrintDefaults()
+}
+
+// Attachments of the node
+func attachments(ctx context.Context, namespace string, node string) ([]networkv1alpha1.NetworkAttachment, error) {
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+
+	list := &networkv1alpha1.NetworkAttachmentList{}
+	if err := c.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("failed to get list of networkattachments: %v", err)
+	}
+
+	var result []networkv1alpha1.NetworkAttachment
+	for _, na := range list.Items {
+		if na.Spec.NodeName == node {
+			result = append(result, na)
+		}
+	}
+
+	return result, nil
+}
+
+func nodeName() string {
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		return node
+	}
+
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+func main() {
+	var namespace string
+	var node string
+	var output string
+
+	flag.StringVar(&namespace, "namespace", "", "Namespace of the network attachments, all namespaces if not defined.")
+	flag.StringVar(&node, "node", nodeName(), "Name of the node, NODE_NAME or the hostname by default.")
+	flag.StringVar(&output, "o", "text", "Output format, text or json.")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 || output != "text" && output != "json" {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	items, err := attachments(ctx, namespace, node)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	network := host.New()
+
+	var report Report
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		report, err = statusReport(network, items)
+	case args[0] == "diff" && len(args) == 1:
+		report, err = diffReport(network, items)
+	case args[0] == "show" && len(args) == 2:
+		report, err = showReport(network, args[1], items)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		report.Print(w)
+		err = w.Flush()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
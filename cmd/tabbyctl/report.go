@@ -0,0 +1,432 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/controllers"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+)
+
+// Report is printed as a table or as json
+type Report interface {
+	Print(w io.Writer)
+}
+
+type AttachmentStatus struct {
+	Namespace      string       `json:"namespace"`
+	Name           string       `json:"name"`
+	Ready          string       `json:"ready"`
+	Message        string       `json:"message,omitempty"`
+	Drift          int          `json:"drift"`
+	LastRepairTime *metav1.Time `json:"lastRepairTime,omitempty"`
+}
+
+type StatusReport []AttachmentStatus
+
+func (r StatusReport) Print(w io.Writer) {
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tREADY\tDRIFT\tLAST REPAIR\tMESSAGE")
+	for _, s := range r {
+		repair := "-"
+		if s.LastRepairTime != nil {
+			repair = s.LastRepairTime.UTC().Format("2006-01-02T15:04:05Z")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", s.Namespace, s.Name, s.Ready, s.Drift, repair, s.Message)
+	}
+}
+
+// Spec which is on the node, nil for a dry run attachment which was only planned
+func appliedSpec(na *networkv1alpha1.NetworkAttachment) (*networkv1alpha1.NetworkAttachmentSpec, error) {
+	if !na.Spec.DryRun {
+		return &na.Spec, nil
+	}
+
+	return controllers.LastAppliedSpec(na)
+}
+
+func statusReport(node *host.Host, items []networkv1alpha1.NetworkAttachment) (Report, error) {
+	report := StatusReport{}
+
+	for i := range items {
+		na := &items[i]
+
+		spec, err := appliedSpec(na)
+		if err != nil {
+			return nil, err
+		}
+
+		if spec == nil {
+			report = append(report, AttachmentStatus{
+				Namespace: na.Namespace,
+				Name:      na.Name,
+				Ready:     "Planned",
+				Message:   fmt.Sprintf("dry run, %d planned changes", len(na.Status.Plan)),
+			})
+			continue
+		}
+
+		drift, err := controllers.NetworkDrift(node, spec)
+		if err != nil {
+			return nil, err
+		}
+
+		status := AttachmentStatus{
+			Namespace:      na.Namespace,
+			Name:           na.Name,
+			Ready:          string(metav1.ConditionUnknown),
+			Drift:          len(drift),
+			LastRepairTime: na.Status.LastRepairTime,
+		}
+
+		if ready := meta.FindStatusCondition(na.Status.Conditions, networkv1alpha1.NetworkAttachmentConditionReady); ready != nil {
+			status.Ready = string(ready.Status)
+			if ready.Status != metav1.ConditionTrue {
+				status.Message = ready.Message
+			}
+		}
+
+		report = append(report, status)
+	}
+
+	return report, nil
+}
+
+type AttachmentDrift struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Drift     string `json:"drift"`
+	Action    string `json:"action"`
+}
+
+type DiffReport []AttachmentDrift
+
+func (r DiffReport) Print(w io.Writer) {
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tKIND\tDRIFT")
+	for _, d := range r {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Namespace, d.Name, d.Kind, d.Drift)
+	}
+}
+
+func diffReport(node *host.Host, items []networkv1alpha1.NetworkAttachment) (Report, error) {
+	report := DiffReport{}
+
+	for i := range items {
+		spec, err := appliedSpec(&items[i])
+		if err != nil {
+			return nil, err
+		}
+
+		// Nothing of a planned attachment is on the node yet
+		if spec == nil {
+			continue
+		}
+
+		drift, err := controllers.NetworkDrift(node, spec)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range drift {
+			report = append(report, AttachmentDrift{
+				Namespace: items[i].Namespace,
+				Name:      items[i].Name,
+				Kind:      d.Kind,
+				Drift:     d.Message,
+				Action:    d.Action,
+			})
+		}
+	}
+
+	return report, nil
+}
+
+func showReport(node *host.Host, what string, items []networkv1alpha1.NetworkAttachment) (Report, error) {
+	switch what {
+	case "bridge":
+		return bridgeReport(node, items)
+	case "routes":
+		return routeReport(node, items)
+	case "nat":
+		return natReport(node, items)
+	case "ebtables":
+		return ebtablesReport(node, items)
+	}
+
+	return nil, fmt.Errorf("unknown resource %q, expected bridge, routes, nat or ebtables", what)
+}
+
+type BridgeState struct {
+	MTU   int      `json:"mtu,omitempty"`
+	Up    bool     `json:"up"`
+	Ports []string `json:"ports,omitempty"`
+}
+
+type BridgeDetails struct {
+	Attachment string       `json:"attachment"`
+	Name       string       `json:"name"`
+	Desired    BridgeState  `json:"desired"`
+	Actual     *BridgeState `json:"actual"`
+}
+
+type BridgeReport []BridgeDetails
+
+func (r BridgeReport) Print(w io.Writer) {
+	fmt.Fprintln(w, "ATTACHMENT\tBRIDGE\tDESIRED MTU\tACTUAL MTU\tUP\tDESIRED PORTS\tACTUAL PORTS")
+	for _, b := range r {
+		if b.Actual == nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\t<missing>\t-\t%s\t-\n", b.Attachment, b.Name, mtu(b.Desired.MTU), strings.Join(b.Desired.Ports, ","))
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%v\t%s\t%s\n", b.Attachment, b.Name, mtu(b.Desired.MTU), b.Actual.MTU, b.Actual.Up,
+			strings.Join(b.Desired.Ports, ","), strings.Join(b.Actual.Ports, ","))
+	}
+}
+
+func mtu(value int) string {
+	if value == 0 {
+		return "-"
+	}
+	return fmt.Sprint(value)
+}
+
+func bridgeReport(node *host.Host, items []networkv1alpha1.NetworkAttachment) (Report, error) {
+	report := BridgeReport{}
+
+	for i := range items {
+		na := &items[i]
+
+		// Bridges of a planned attachment are not on the node
+		spec, err := appliedSpec(na)
+		if err != nil {
+			return nil, err
+		}
+		if spec == nil {
+			continue
+		}
+
+		for _, br := range spec.Bridge {
+			details := BridgeDetails{Attachment: na.Namespace + "/" + na.Name, Name: br.Name, Desired: BridgeState{MTU: br.Mtu, Up: true}}
+
+			for _, port := range br.Ports {
+				details.Desired.Ports = append(details.Desired.Ports, fmt.Sprintf("%s.%d", port.Name, port.Vlan))
+			}
+
+			if link, err := node.Links.LinkByName(br.Name); err == nil {
+				ports, err := bridgePorts(node, link)
+				if err != nil {
+					return nil, err
+				}
+
+				details.Actual = &BridgeState{MTU: link.Attrs().MTU, Up: link.Attrs().Flags&net.FlagUp != 0, Ports: ports}
+			}
+
+			report = append(report, details)
+		}
+	}
+
+	return report, nil
+}
+
+// Names of the interfaces attached to the bridge
+func bridgePorts(node *host.Host, br netlink.Link) ([]string, error) {
+	var ports []string
+
+	links, err := node.Links.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+
+	for _, link := range links {
+		if link.Attrs().MasterIndex == br.Attrs().Index {
+			ports = append(ports, link.Attrs().Name)
+		}
+	}
+
+	return ports, nil
+}
+
+type RouteDetails struct {
+	Attachment  string `json:"attachment"`
+	Destination string `json:"destination"`
+	Via         string `json:"via"`
+	Source      string `json:"source,omitempty"`
+	Present     bool   `json:"present"`
+}
+
+type RouteReport []RouteDetails
+
+func (r RouteReport) Print(w io.Writer) {
+	fmt.Fprintln(w, "ATTACHMENT\tDESTINATION\tVIA\tSOURCE\tPRESENT")
+	for _, route := range r {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\n", route.Attachment, route.Destination, route.Via, route.Source, route.Present)
+	}
+}
+
+func routeReport(node *host.Host, items []networkv1alpha1.NetworkAttachment) (Report, error) {
+	report := RouteReport{}
+
+	for i := range items {
+		na := &items[i]
+
+		spec, err := appliedSpec(na)
+		if err != nil {
+			return nil, err
+		}
+		if spec == nil {
+			continue
+		}
+
+		for _, r := range spec.Routes {
+			present, err := controllers.RouteExists(node, r)
+			if err != nil {
+				return nil, err
+			}
+
+			report = append(report, RouteDetails{
+				Attachment:  na.Namespace + "/" + na.Name,
+				Destination: r.Destination,
+				Via:         r.Via,
+				Source:      r.Source,
+				Present:     present,
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// Actual rules of the bridge and the missing ones of the spec
+type RuleDetails struct {
+	Attachment string   `json:"attachment"`
+	Bridge     string   `json:"bridge"`
+	Rules      []string `json:"rules"`
+	Missing    []string `json:"missing"`
+}
+
+type RuleReport []RuleDetails
+
+func (r RuleReport) Print(w io.Writer) {
+	for _, details := range r {
+		fmt.Fprintf(w, "# %s bridge %s\n", details.Attachment, details.Bridge)
+		for _, rule := range details.Rules {
+			fmt.Fprintln(w, rule)
+		}
+		for _, rule := range details.Missing {
+			fmt.Fprintf(w, "# %s\n", rule)
+		}
+	}
+}
+
+// Firewall rules of the spec which are missing on the node
+func missingRules(node *host.Host, spec *networkv1alpha1.NetworkAttachmentSpec, kind string) ([]controllers.Drift, error) {
+	drift, err := controllers.NetworkDrift(node, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []controllers.Drift
+	for _, d := range drift {
+		if d.Kind == kind {
+			missing = append(missing, d)
+		}
+	}
+
+	return missing, nil
+}
+
+// Ebtables rules name the bridge of the traffic they match, iptables rules all belong to the nat bridge
+func bridgeRule(d controllers.Drift, bridge string) bool {
+	return d.Kind != controllers.DriftEbtables || strings.Contains(d.Message, " "+bridge+" ")
+}
+
+func ruleReport(node *host.Host, items []networkv1alpha1.NetworkAttachment, kind string,
+	bridges func(*networkv1alpha1.NetworkAttachmentSpec) []string, list func(string) ([]string, error)) (Report, error) {
+	report := RuleReport{}
+
+	for i := range items {
+		// Rules of a planned attachment are not on the node
+		spec, err := appliedSpec(&items[i])
+		if err != nil {
+			return nil, err
+		}
+		if spec == nil {
+			continue
+		}
+
+		drift, err := missingRules(node, spec, kind)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range bridges(spec) {
+			rules, err := list(name)
+			if err != nil {
+				return nil, err
+			}
+
+			missing := []string{}
+			for _, d := range drift {
+				if bridgeRule(d, name) {
+					missing = append(missing, d.Message)
+				}
+			}
+
+			report = append(report, RuleDetails{
+				Attachment: items[i].Namespace + "/" + items[i].Name,
+				Bridge:     name,
+				Rules:      rules,
+				Missing:    missing,
+			})
+		}
+	}
+
+	return report, nil
+}
+
+func natReport(node *host.Host, items []networkv1alpha1.NetworkAttachment) (Report, error) {
+	natBridge := func(spec *networkv1alpha1.NetworkAttachmentSpec) []string {
+		if name := controllers.NatBridge(spec); name != "" {
+			return []string{name}
+		}
+		return nil
+	}
+
+	return ruleReport(node, items, controllers.DriftIptables, natBridge, node.NAT.ListRules)
+}
+
+func ebtablesReport(node *host.Host, items []networkv1alpha1.NetworkAttachment) (Report, error) {
+	// Gateway, DHCP and router advertisement rules could be on any bridge of the attachment
+	bridges := func(spec *networkv1alpha1.NetworkAttachmentSpec) []string {
+		var names []string
+		for _, br := range spec.Bridge {
+			names = append(names, br.Name)
+		}
+		return names
+	}
+
+	return ruleReport(node, items, controllers.DriftEbtables, bridges, node.Filter.ListRules)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/controllers"
+	"github.com/NCCloud/tabby-cni/pkg/ebtables"
+	"github.com/NCCloud/tabby-cni/pkg/host/fake"
+)
+
+func TestBridgeReport(t *testing.T) {
+	node := fake.New()
+	node.Links.Add(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "bond0"}})
+
+	br, err := node.Links.CreateBridge("br10", 9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := node.Links.AddVlan("bond0", 10, 9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Links.LinkSetMaster(port, br); err != nil {
+		t.Fatal(err)
+	}
+
+	items := []networkv1alpha1.NetworkAttachment{{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1-vm-network", Namespace: "default"},
+		Spec: networkv1alpha1.NetworkAttachmentSpec{
+			Bridge: []networkv1alpha1.Bridge{
+				{Name: "br10", Mtu: 9000, Ports: []networkv1alpha1.Port{{Name: "bond0", Vlan: 10}}},
+				{Name: "br20", Mtu: 9000, Ports: []networkv1alpha1.Port{{Name: "bond0", Vlan: 20}}},
+			},
+		},
+	}}
+
+	report, err := bridgeReport(node.Host(), items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bridges := report.(BridgeReport)
+	if len(bridges) != 2 {
+		t.Fatalf("unexpected report %+v", bridges)
+	}
+	if actual := bridges[0].Actual; actual == nil || actual.MTU != 9000 || !reflect.DeepEqual(actual.Ports, []string{"bond0.10"}) {
+		t.Errorf("actual br10 = %+v, want mtu 9000 with bond0.10", actual)
+	}
+	if bridges[1].Actual != nil || bridges[1].Desired.Ports[0] != "bond0.20" {
+		t.Errorf("unexpected br20 %+v", bridges[1])
+	}
+
+	out := &bytes.Buffer{}
+	report.Print(out)
+
+	if !strings.Contains(out.String(), "default/node1-vm-network\tbr20\t9000\t<missing>") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestPlannedAttachmentReport(t *testing.T) {
+	node := fake.New()
+
+	spec := networkv1alpha1.NetworkAttachmentSpec{Bridge: []networkv1alpha1.Bridge{{Name: "br10"}}}
+	planned := spec
+	planned.DryRun = true
+
+	items := []networkv1alpha1.NetworkAttachment{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1-vm-network", Namespace: "default"}, Spec: spec},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1-test-network", Namespace: "default"},
+			Spec:       planned,
+			Status:     networkv1alpha1.NetworkAttachmentStatus{Plan: []string{"create bridge br10"}},
+		},
+	}
+
+	report, err := statusReport(node.Host(), items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := report.(StatusReport)
+	if len(status) != 2 || status[0].Drift == 0 {
+		t.Fatalf("unexpected report %+v", status)
+	}
+	if status[1].Ready != "Planned" || status[1].Drift != 0 || status[1].Message != "dry run, 1 planned changes" {
+		t.Errorf("planned status = %+v", status[1])
+	}
+
+	report, err = diffReport(node.Host(), items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range report.(DiffReport) {
+		if d.Name != "node1-vm-network" {
+			t.Errorf("drift of the planned attachment %+v", d)
+		}
+	}
+
+	report, err = bridgeReport(node.Host(), items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bridges := report.(BridgeReport); len(bridges) != 1 || bridges[0].Attachment != "default/node1-vm-network" {
+		t.Errorf("bridges = %+v, want the planned attachment left out", bridges)
+	}
+
+	items[0].Spec.Routes = []networkv1alpha1.Route{{Destination: "10.0.0.0/8", Via: "br10"}}
+	items[1].Spec.Routes = items[0].Spec.Routes
+
+	report, err = routeReport(node.Host(), items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes := report.(RouteReport); len(routes) != 1 || routes[0].Attachment != "default/node1-vm-network" {
+		t.Errorf("routes = %+v, want the planned attachment left out", routes)
+	}
+}
+
+func TestEbtablesReport(t *testing.T) {
+	node := fake.New()
+	node.Links.Add(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}})
+	h := node.Host()
+
+	spec := networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{
+			{Name: "br10"},
+			{Name: "br20", Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 20}}},
+		},
+		IpMasq: networkv1alpha1.Masquerade{Enabled: true, Bridge: "br10", Source: "10.10.0.0/24"},
+		DHCP:   &networkv1alpha1.DHCPServer{Enabled: true, Bridge: "br20"},
+	}
+	if err := controllers.CreateNetwork(context.Background(), h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out := []string{"-p", "IPv4", "-o", "eth1.20", "--logical-out", "br20", "--ip-proto", "udp", "--ip-dport", "67:68", "-j", "DROP"}
+	if err := h.Filter.DeleteRule(ebtables.ChainOutput, out...); err != nil {
+		t.Fatal(err)
+	}
+
+	items := []networkv1alpha1.NetworkAttachment{{ObjectMeta: metav1.ObjectMeta{Name: "node1-vm-network", Namespace: "default"}, Spec: spec}}
+
+	report, err := ebtablesReport(h, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := report.(RuleReport)
+	if len(rules) != 2 || rules[0].Bridge != "br10" || rules[1].Bridge != "br20" {
+		t.Fatalf("unexpected report %+v", rules)
+	}
+	if len(rules[0].Rules) == 0 || len(rules[0].Missing) != 0 {
+		t.Errorf("br10 rules = %q, missing %q, want the gateway rule in place", rules[0].Rules, rules[0].Missing)
+	}
+	if len(rules[1].Rules) == 0 {
+		t.Errorf("br20 rules = %q, want the rest of the DHCP rules", rules[1].Rules)
+	}
+	want := []string{"rule `-A OUTPUT -p IPv4 -o eth1.20 --logical-out br20 --ip-proto udp --ip-dport 67:68 -j DROP` is missing"}
+	if !reflect.DeepEqual(rules[1].Missing, want) {
+		t.Errorf("br20 missing = %q, want %q", rules[1].Missing, want)
+	}
+}
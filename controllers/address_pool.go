@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+// Don't walk through huge IPv6 pools forever
+const maxPoolScan = 65536
+
+// Pick the lowest address of the pool which is not used yet. Network and
+// broadcast addresses of IPv4 pools are never allocated, neither is the
+// subnet-router anycast address of IPv6 pools.
+func allocateAddress(pool string, used []string) (string, error) {
+	_, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return "", fmt.Errorf("invalid address pool %q: %v", pool, err)
+	}
+
+	ones, bits := ipnet.Mask.Size()
+
+	taken := map[string]bool{}
+	for _, u := range used {
+		ip, _, err := net.ParseCIDR(u)
+		if err == nil {
+			taken[ip.String()] = true
+		}
+	}
+
+	first := big.NewInt(0).SetBytes(ipnet.IP)
+	size := big.NewInt(0).Lsh(big.NewInt(1), uint(bits-ones))
+
+	start, end := int64(0), size.Int64()
+	if !size.IsInt64() || end > maxPoolScan {
+		end = maxPoolScan
+	}
+	if bits-ones > 1 {
+		start = 1
+		if bits == 32 {
+			end--
+		}
+	}
+
+	for i := start; i < end; i++ {
+		n := big.NewInt(0).Add(first, big.NewInt(i))
+		ip := net.IP(n.FillBytes(make([]byte, len(ipnet.IP))))
+
+		if !taken[ip.String()] {
+			return fmt.Sprintf("%s/%d", ip, ones), nil
+		}
+	}
+
+	return "", fmt.Errorf("address pool %s is exhausted", pool)
+}
+
+func addressInPool(address string, pool string) bool {
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return false
+	}
+
+	_, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return false
+	}
+
+	return ipnet.Contains(ip)
+}
+
+// Update allocations of the node, so every bridge with an address pool has exactly one address
+func nodeAllocations(network *networkv1alpha1.Network, nodeName string) ([]networkv1alpha1.AddressAllocation, error) {
+	var allocations []networkv1alpha1.AddressAllocation
+
+	pools := map[string]string{}
+	for _, br := range network.Spec.Bridge {
+		if br.AddressPool != "" {
+			pools[br.Name] = br.AddressPool
+		}
+	}
+
+	// Keep allocations of other nodes and the ones still valid for this node
+	allocated := map[string]bool{}
+	for _, a := range network.Status.Allocations {
+		if a.NodeName == nodeName {
+			pool, ok := pools[a.Bridge]
+			if !ok || allocated[a.Bridge] || !addressInPool(a.Address, pool) {
+				continue
+			}
+			allocated[a.Bridge] = true
+		}
+		allocations = append(allocations, a)
+	}
+
+	for _, br := range network.Spec.Bridge {
+		if br.AddressPool == "" || allocated[br.Name] {
+			continue
+		}
+
+		var used []string
+		for _, a := range allocations {
+			if a.Bridge == br.Name {
+				used = append(used, a.Address)
+			}
+		}
+
+		address, err := allocateAddress(br.AddressPool, used)
+		if err != nil {
+			return nil, err
+		}
+
+		allocations = append(allocations, networkv1alpha1.AddressAllocation{
+			NodeName: nodeName,
+			Bridge:   br.Name,
+			Address:  address,
+		})
+	}
+
+	return allocations, nil
+}
+
+// Allocate addresses for the node and record them in the network attachment status.
+// Allocations are stored in the Network status, concurrent allocations from different
+// nodes are serialized by the API server via the resource version.
+func (r *NetworkReconciler) allocateAddresses(ctx context.Context, key types.NamespacedName, na *networkv1alpha1.NetworkAttachment, nodeName string) error {
+	var addresses []networkv1alpha1.BridgeAddress
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		network := &networkv1alpha1.Network{}
+		if err := r.Get(ctx, key, network); err != nil {
+			return err
+		}
+
+		allocations, err := nodeAllocations(network, nodeName)
+		if err != nil {
+			return err
+		}
+
+		addresses = nil
+		for _, a := range allocations {
+			if a.NodeName == nodeName {
+				addresses = append(addresses, networkv1alpha1.BridgeAddress{Bridge: a.Bridge, Address: a.Address})
+			}
+		}
+
+		if reflect.DeepEqual(allocations, network.Status.Allocations) {
+			return nil
+		}
+
+		log.FromContext(ctx).Info("Updating address allocations", "addresses", addresses)
+
+		network.Status.Allocations = allocations
+		return r.Status().Update(ctx, network)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to allocate addresses: %v", err)
+	}
+
+	if reflect.DeepEqual(addresses, na.Status.Addresses) {
+		return nil
+	}
+
+	na.Status.Addresses = addresses
+	if err := r.Status().Update(ctx, na); err != nil {
+		return fmt.Errorf("failed to update networkattachment status: %v", err)
+	}
+
+	return nil
+}
+
+// Release addresses of the node in the owner Network
+func (r *NetworkAttachmentReconciler) releaseAddresses(ctx context.Context, na *networkv1alpha1.NetworkAttachment) error {
+	owner := metav1.GetControllerOf(na)
+	if owner == nil {
+		return nil
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		network := &networkv1alpha1.Network{}
+		if err := r.Get(ctx, types.NamespacedName{Namespace: na.Namespace, Name: owner.Name}, network); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+
+		var allocations []networkv1alpha1.AddressAllocation
+		for _, a := range network.Status.Allocations {
+			if a.NodeName != na.Spec.NodeName {
+				allocations = append(allocations, a)
+			}
+		}
+
+		if len(allocations) == len(network.Status.Allocations) {
+			return nil
+		}
+
+		network.Status.Allocations = allocations
+		return r.Status().Update(ctx, network)
+	})
+}
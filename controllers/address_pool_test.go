@@ -0,0 +1,33 @@
+package controllers
+
+import "testing"
+
+func TestAllocateAddress(t *testing.T) {
+	tests := []struct {
+		pool string
+		used []string
+		want string
+	}{
+		{"10.10.0.0/24", nil, "10.10.0.1/24"},
+		{"10.10.0.0/24", []string{"10.10.0.1/24", "10.10.0.2/24"}, "10.10.0.3/24"},
+		{"10.10.0.0/30", []string{"10.10.0.1/30", "10.10.0.2/30"}, ""},
+		{"10.10.0.4/31", []string{"10.10.0.4/31"}, "10.10.0.5/31"},
+		{"fd00:10::/64", nil, "fd00:10::1/64"},
+		{"fd00:10::/64", []string{"fd00:10::1/64"}, "fd00:10::2/64"},
+		{"fd00:10::/126", []string{"fd00:10::1/126", "fd00:10::2/126"}, "fd00:10::3/126"},
+	}
+
+	for _, tt := range tests {
+		got, err := allocateAddress(tt.pool, tt.used)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("allocateAddress(%s, %q) = %s, want exhausted pool", tt.pool, tt.used, got)
+			}
+			continue
+		}
+
+		if err != nil || got != tt.want {
+			t.Errorf("allocateAddress(%s, %q) = %s, %v, want %s", tt.pool, tt.used, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/dhcp"
+	"github.com/NCCloud/tabby-cni/pkg/ebtables"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
+)
+
+type dhcpServer struct {
+	config dhcp.Config
+	server *dhcp.Server
+	// Index of the interface the server listens on, a recreated bridge needs a new socket
+	index int
+	// Gateway address which was configured on the interface for the server
+	address net.IP
+}
+
+// Resolve the DHCP server configuration, defaults come from the masquerade configuration
+func dhcpConfig(spec *networkv1alpha1.NetworkAttachmentSpec) (dhcp.Config, error) {
+	d := spec.DHCP
+
+	config := dhcp.Config{
+		Interface:    d.Bridge,
+		RangeStart:   net.ParseIP(d.RangeStart).To4(),
+		RangeEnd:     net.ParseIP(d.RangeEnd).To4(),
+		LeaseTime:    time.Duration(d.LeaseTime) * time.Second,
+		StaticLeases: map[string]net.IP{},
+	}
+
+	if config.Interface == "" {
+		config.Interface = spec.IpMasq.Bridge
+	}
+
+	if config.Interface == "" {
+		return config, fmt.Errorf("dhcp server requires a bridge")
+	}
+
+	subnet := d.Subnet
+	if subnet == "" {
+		subnet = spec.IpMasq.Source
+	}
+
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil || ipnet.IP.To4() == nil {
+		return config, fmt.Errorf("invalid dhcp subnet %q", subnet)
+	}
+	config.Netmask = ipnet.Mask
+
+	gw, err := gatewayAddress(&spec.IpMasq)
+	if err != nil {
+		return config, err
+	}
+
+	config.Gateway = gw.To4()
+	if d.Gateway != "" {
+		config.Gateway = net.ParseIP(d.Gateway).To4()
+	}
+
+	if config.Gateway == nil {
+		return config, fmt.Errorf("dhcp gateway must be an IPv4 address")
+	}
+
+	// Gateway with its own mac address receives the renewals on its macvlan interface
+	if spec.IpMasq.Enabled && config.Interface == spec.IpMasq.Bridge && config.Gateway.Equal(gw) {
+		mac, err := gatewayMAC(&spec.IpMasq, gw)
+		if err != nil {
+			return config, err
+		}
+
+		if mac != nil {
+			config.Interface = gatewayInterface(spec.IpMasq.Bridge)
+		}
+	}
+
+	for _, dns := range d.DNS {
+		ip := net.ParseIP(dns).To4()
+		if ip == nil {
+			return config, fmt.Errorf("invalid dns server %q", dns)
+		}
+		config.DNS = append(config.DNS, ip)
+	}
+
+	for _, l := range d.StaticLeases {
+		mac, err := net.ParseMAC(l.MAC)
+		if err != nil {
+			return config, fmt.Errorf("invalid mac address of static lease %q: %v", l.MAC, err)
+		}
+
+		ip := net.ParseIP(l.Address).To4()
+		if ip == nil {
+			return config, fmt.Errorf("invalid address of static lease %q", l.Address)
+		}
+
+		config.StaticLeases[mac.String()] = ip
+	}
+
+	return config, nil
+}
+
+// Clients renew their leases with unicast to the server identifier, so it has to be an
+// address of the node. The masquerade gateway is configured on the bridge, other gateways
+// are routers of the network and the server is identified by an address of the bridge.
+// Returns the gateway address which was added for the server.
+func dhcpServerAddress(h *host.Host, spec *networkv1alpha1.NetworkAttachmentSpec, config *dhcp.Config) (net.IP, error) {
+	ipmasq := &spec.IpMasq
+
+	// Gateway with its own mac address is already on the macvlan interface
+	if ipmasq.Enabled && config.Interface == gatewayInterface(ipmasq.Bridge) {
+		return nil, nil
+	}
+
+	if ipmasq.Enabled && config.Interface == ipmasq.Bridge {
+		gw, err := gatewayAddress(ipmasq)
+		if err != nil {
+			return nil, err
+		}
+
+		if gw.Equal(config.Gateway) {
+			return config.Gateway, addGatewayAddress(h, config.Gateway, config.Interface)
+		}
+	}
+
+	br, err := h.Links.LinkByName(config.Interface)
+	if err != nil {
+		return nil, nil
+	}
+
+	addrs, err := h.Links.AddrList(br, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of bridge %s: %v", config.Interface, err)
+	}
+
+	for _, addr := range addrs {
+		if addr.IP.IsGlobalUnicast() {
+			config.ServerID = addr.IP
+			break
+		}
+	}
+
+	return nil, nil
+}
+
+// Every node runs its own DHCP server for the virtual machines on the node, while the
+// bridges of the nodes share the L2 through the uplink ports. DHCP messages never cross
+// the uplink ports, so clients only ever get the offers of the local server.
+func dhcpFilterRules(spec *networkv1alpha1.NetworkAttachmentSpec) map[string][][]string {
+	if spec.DHCP == nil || !spec.DHCP.Enabled {
+		return nil
+	}
+
+	bridge := spec.DHCP.Bridge
+	if bridge == "" {
+		bridge = spec.IpMasq.Bridge
+	}
+
+	rules := map[string][][]string{}
+
+	for _, uplink := range bridgePorts(spec, bridge) {
+		// ebtables-nft -I OUTPUT -p IPv4 -o eth1.10 --logical-out br10 --ip-proto udp --ip-dport 67:68 -j DROP
+		out := []string{"-p", "IPv4", "-o", uplink, "--logical-out", bridge, "--ip-proto", "udp", "--ip-dport", "67:68", "-j", "DROP"}
+		in := []string{"-p", "IPv4", "-i", uplink, "--logical-in", bridge, "--ip-proto", "udp", "--ip-dport", "67:68", "-j", "DROP"}
+
+		rules[ebtables.ChainForward] = append(rules[ebtables.ChainForward], out, in)
+		rules[ebtables.ChainOutput] = append(rules[ebtables.ChainOutput], out)
+		rules[ebtables.ChainInput] = append(rules[ebtables.ChainInput], in)
+	}
+
+	return rules
+}
+
+func dhcpLeases(leases []networkv1alpha1.DHCPLease) []dhcp.Lease {
+	var result []dhcp.Lease
+
+	for _, l := range leases {
+		mac, err := net.ParseMAC(l.MAC)
+		if err != nil {
+			continue
+		}
+
+		ip := net.ParseIP(l.Address).To4()
+		if ip == nil {
+			continue
+		}
+
+		// The client renews the lease or it expires again after restart of the agent
+		result = append(result, dhcp.Lease{MAC: mac, IP: ip, Hostname: l.Hostname, Expires: time.Now().Add(dhcp.DefaultLeaseTime)})
+	}
+
+	return result
+}
+
+// Start, restart or stop the DHCP server of the network attachment
+func (r *NetworkAttachmentReconciler) syncDHCPServer(ctx context.Context, na *networkv1alpha1.NetworkAttachment) error {
+	key := types.NamespacedName{Namespace: na.Namespace, Name: na.Name}
+
+	if na.Spec.DHCP == nil || !na.Spec.DHCP.Enabled {
+		return r.stopDHCPServer(ctx, key)
+	}
+
+	config, err := dhcpConfig(&na.Spec)
+	if err != nil {
+		return err
+	}
+
+	address, err := dhcpServerAddress(r.Host, &na.Spec, &config)
+	if err != nil {
+		return err
+	}
+
+	r.dhcpMu.Lock()
+	defer r.dhcpMu.Unlock()
+
+	index := linkIndex(r.Host, config.Interface)
+
+	current, ok := r.dhcpServers[key]
+	if ok && reflect.DeepEqual(current.config, config) && current.index == index {
+		return nil
+	}
+
+	if ok {
+		log.FromContext(ctx).Info("Restarting dhcp server", logging.KeyInterface, current.config.Interface)
+		if err := current.server.Close(); err != nil {
+			return err
+		}
+		delete(r.dhcpServers, key)
+
+		if current.address != nil && (!current.address.Equal(address) || current.config.Interface != config.Interface) {
+			if err := deleteBridgeGateway(r.Host, current.config.Interface, current.address, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Leases changes are delivered to the controller through the channel source
+	notify := func() {
+		go func() {
+			r.leaseEvents <- event.GenericEvent{Object: na.DeepCopy()}
+		}()
+	}
+
+	server, err := dhcp.NewServer(config, dhcpLeases(na.Status.Leases), notify)
+	if err != nil {
+		return err
+	}
+
+	if err := server.Start(ctx); err != nil {
+		return err
+	}
+
+	log.FromContext(ctx).Info("Started dhcp server", logging.KeyInterface, config.Interface)
+
+	if r.dhcpServers == nil {
+		r.dhcpServers = map[types.NamespacedName]*dhcpServer{}
+	}
+	r.dhcpServers[key] = &dhcpServer{config: config, server: server, index: index, address: address}
+
+	return nil
+}
+
+// Record what syncDHCPServer would do with the dhcp server of the attachment
+func (r *NetworkAttachmentReconciler) planDHCPServer(recorder *host.Recorder, na *networkv1alpha1.NetworkAttachment) error {
+	r.dhcpMu.Lock()
+	current, ok := r.dhcpServers[types.NamespacedName{Namespace: na.Namespace, Name: na.Name}]
+	r.dhcpMu.Unlock()
+
+	if na.Spec.DHCP == nil || !na.Spec.DHCP.Enabled {
+		if ok {
+			recorder.Record("stop dhcp server on %s", current.config.Interface)
+			if current.address != nil {
+				return deleteBridgeGateway(recorder.Host(), current.config.Interface, current.address, nil)
+			}
+		}
+		return nil
+	}
+
+	config, err := dhcpConfig(&na.Spec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := dhcpServerAddress(recorder.Host(), &na.Spec, &config); err != nil {
+		return err
+	}
+
+	if !ok {
+		recorder.Record("start dhcp server on %s", config.Interface)
+	} else if !reflect.DeepEqual(current.config, config) || current.index != linkIndex(recorder.Host(), config.Interface) {
+		recorder.Record("restart dhcp server on %s", config.Interface)
+	}
+
+	return nil
+}
+
+func (r *NetworkAttachmentReconciler) stopDHCPServer(ctx context.Context, key types.NamespacedName) error {
+	r.dhcpMu.Lock()
+	defer r.dhcpMu.Unlock()
+
+	current, ok := r.dhcpServers[key]
+	if !ok {
+		return nil
+	}
+
+	log.FromContext(ctx).Info("Stopping dhcp server", logging.KeyInterface, current.config.Interface)
+
+	delete(r.dhcpServers, key)
+
+	if err := current.server.Close(); err != nil {
+		return err
+	}
+
+	if current.address == nil {
+		return nil
+	}
+
+	return deleteBridgeGateway(r.Host, current.config.Interface, current.address, nil)
+}
+
+// Expose the leases of the DHCP server in the network attachment status
+func (r *NetworkAttachmentReconciler) updateLeases(ctx context.Context, key types.NamespacedName) error {
+	var leases []networkv1alpha1.DHCPLease
+
+	r.dhcpMu.Lock()
+	current, ok := r.dhcpServers[key]
+	r.dhcpMu.Unlock()
+
+	if ok {
+		for _, l := range current.server.Leases() {
+			leases = append(leases, networkv1alpha1.DHCPLease{
+				MAC:      l.MAC.String(),
+				Address:  l.IP.String(),
+				Hostname: l.Hostname,
+			})
+		}
+	}
+
+	networkAttachment := &networkv1alpha1.NetworkAttachment{}
+	if err := r.Get(ctx, key, networkAttachment); err != nil {
+		return err
+	}
+
+	if reflect.DeepEqual(leases, networkAttachment.Status.Leases) {
+		return nil
+	}
+
+	networkAttachment.Status.Leases = leases
+	if err := r.Status().Update(ctx, networkAttachment); err != nil {
+		return fmt.Errorf("failed to update dhcp leases: %v", err)
+	}
+
+	return nil
+}
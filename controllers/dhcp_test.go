@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/ebtables"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/host/fake"
+)
+
+func TestDHCPIsolation(t *testing.T) {
+	node := fake.New()
+	node.Links.Add(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}})
+	h := node.Host()
+	ctx := context.Background()
+
+	spec := networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10", Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 10}}}},
+		IpMasq: networkv1alpha1.Masquerade{Enabled: true, Bridge: "br10", Source: "10.10.0.0/24"},
+		DHCP:   &networkv1alpha1.DHCPServer{Enabled: true},
+	}
+
+	if err := CreateNetwork(ctx, h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dhcpRules := func(chain string) int {
+		var n int
+		for _, r := range node.Filter.Rules[chain] {
+			if strings.Contains(r, "--ip-dport 67:68") && strings.Contains(r, "eth1.10") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Both directions are dropped on the uplink, forwarded and local traffic alike
+	for chain, want := range map[string]int{ebtables.ChainForward: 2, ebtables.ChainOutput: 1, ebtables.ChainInput: 1} {
+		if got := dhcpRules(chain); got != want {
+			t.Errorf("dhcp rules of %s = %d, want %d: %q", chain, got, want, node.Filter.Rules[chain])
+		}
+	}
+	requireNoDrift(t, h, &spec)
+
+	// Disabled server takes its rules away, the gateway rule stays
+	next := *spec.DeepCopy()
+	next.DHCP.Enabled = false
+	diffNetwork(t, h, spec, next)
+
+	for _, chain := range ebtables.Chains {
+		if got := dhcpRules(chain); got != 0 {
+			t.Errorf("dhcp rules of %s = %d after the server was disabled", chain, got)
+		}
+	}
+	if rules, _ := h.Filter.ListRules("br10"); len(rules) != 1 {
+		t.Errorf("ebtables rules = %q, want the gateway rule", rules)
+	}
+}
+
+func TestDHCPServerAddress(t *testing.T) {
+	node := fake.New()
+	h := node.Host()
+
+	for _, name := range []string{"br10", "br20"} {
+		if _, err := h.Links.CreateBridge(name, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spec := networkv1alpha1.NetworkAttachmentSpec{
+		IpMasq: networkv1alpha1.Masquerade{Enabled: true, Bridge: "br10", Source: "10.10.0.0/24"},
+		DHCP:   &networkv1alpha1.DHCPServer{Enabled: true},
+	}
+
+	// Proxy arp gateway is only answered for, the renewals need it on the bridge
+	config, err := dhcpConfig(&spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := dhcpServerAddress(h, &spec, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !address.Equal(config.Gateway) || config.ServerID != nil {
+		t.Errorf("server address = %s, id %s, want the gateway %s", address, config.ServerID, config.Gateway)
+	}
+	if addrs, _ := h.Links.AddrList(mustLink(t, h, "br10"), netlink.FAMILY_V4); len(addrs) != 1 || addrs[0].IPNet.String() != "169.254.1.1/32" {
+		t.Errorf("addresses of br10 = %v, want the gateway", addrs)
+	}
+
+	// Gateway with its own mac address is served from its macvlan interface
+	spec.IpMasq.GatewayMAC = "02:00:00:00:00:01"
+	if config, err = dhcpConfig(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if config.Interface != gatewayInterface("br10") {
+		t.Errorf("interface = %s, want %s", config.Interface, gatewayInterface("br10"))
+	}
+	if address, err := dhcpServerAddress(h, &spec, &config); err != nil || address != nil {
+		t.Errorf("server address = %s, %v, want none", address, err)
+	}
+
+	// Router of the network isn't on the node, the address of the bridge is
+	spec.DHCP = &networkv1alpha1.DHCPServer{Enabled: true, Bridge: "br20", Subnet: "10.20.0.0/24", Gateway: "10.20.0.1"}
+	br := mustLink(t, h, "br20")
+	if err := h.Links.AddrReplace(br, &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("10.20.0.2"), Mask: net.CIDRMask(24, 32)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if config, err = dhcpConfig(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if address, err := dhcpServerAddress(h, &spec, &config); err != nil || address != nil {
+		t.Errorf("server address = %s, %v, want none", address, err)
+	}
+	if !config.ServerID.Equal(net.ParseIP("10.20.0.2")) {
+		t.Errorf("server id = %s, want 10.20.0.2", config.ServerID)
+	}
+}
+
+func mustLink(t *testing.T, h *host.Host, name string) netlink.Link {
+	t.Helper()
+
+	link, err := h.Links.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
@@ -0,0 +1,235 @@
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/ebtables"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/iptables"
+)
+
+const (
+	DriftLink     = "link"
+	DriftRoute    = "route"
+	DriftIptables = "iptables"
+	DriftEbtables = "ebtables"
+	DriftSysctl   = "sysctl"
+)
+
+// Drift is a difference of the host network from the spec and the action which repairs it
+type Drift struct {
+	Kind    string
+	Message string
+	Action  string
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s: %s", d.Kind, d.Message)
+}
+
+// NetworkDrift compares links, routes and firewall rules of the node with the spec
+func NetworkDrift(h *host.Host, spec *networkv1alpha1.NetworkAttachmentSpec) ([]Drift, error) {
+	drift := linkDrift(h, spec)
+
+	for _, r := range spec.Routes {
+		ok, err := RouteExists(h, r)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			drift = append(drift, Drift{DriftRoute, fmt.Sprintf("route to %s via %s is missing", r.Destination, r.Via), fmt.Sprintf("add route to %s via %s", r.Destination, r.Via)})
+		}
+	}
+
+	firewall, err := firewallDrift(h, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(drift, firewall...), nil
+}
+
+func linkDrift(h *host.Host, spec *networkv1alpha1.NetworkAttachmentSpec) []Drift {
+	var drift []Drift
+
+	for _, br := range spec.Bridge {
+		// Ports of a missing bridge are checked too, they are attached once it's created
+		bridgeIndex := 0
+
+		link, err := h.Links.LinkByName(br.Name)
+		if err != nil {
+			drift = append(drift, Drift{DriftLink, fmt.Sprintf("bridge %s is missing", br.Name), fmt.Sprintf("create bridge %s", br.Name)})
+		} else {
+			bridgeIndex = link.Attrs().Index
+			drift = append(drift, linkStateDrift("bridge", link, br.Mtu)...)
+		}
+
+		for _, port := range br.Ports {
+			name := portName(port)
+
+			vlan, err := h.Links.LinkByName(name)
+			if err != nil {
+				action := fmt.Sprintf("create vlan %d on %s and attach it to bridge %s", port.Vlan, port.Name, br.Name)
+				if port.Vlan == 0 {
+					action = fmt.Sprintf("attach port %s to bridge %s", name, br.Name)
+				}
+				drift = append(drift, Drift{DriftLink, fmt.Sprintf("port %s is missing", name), action})
+				continue
+			}
+
+			// Mtu is only set on the vlan interfaces, the uplink belongs to the node
+			mtu := port.Mtu
+			if port.Vlan == 0 {
+				mtu = 0
+			}
+			drift = append(drift, linkStateDrift("port", vlan, mtu)...)
+
+			if bridgeIndex == 0 || vlan.Attrs().MasterIndex != bridgeIndex {
+				drift = append(drift, Drift{DriftLink, fmt.Sprintf("port %s is not attached to bridge %s", name, br.Name), fmt.Sprintf("attach port %s to bridge %s", name, br.Name)})
+			}
+		}
+	}
+
+	return drift
+}
+
+func linkStateDrift(kind string, link netlink.Link, mtu int) []Drift {
+	var drift []Drift
+
+	attrs := link.Attrs()
+
+	if attrs.Flags&net.FlagUp == 0 {
+		drift = append(drift, Drift{DriftLink, fmt.Sprintf("%s %s is down", kind, attrs.Name), fmt.Sprintf("set %s %s up", kind, attrs.Name)})
+	}
+
+	if mtu != 0 && attrs.MTU != mtu {
+		drift = append(drift, Drift{DriftLink, fmt.Sprintf("%s %s has mtu %d instead of %d", kind, attrs.Name, attrs.MTU, mtu), fmt.Sprintf("set mtu of %s %s to %d", kind, attrs.Name, mtu)})
+	}
+
+	return drift
+}
+
+// RouteExists finds the route of the spec by the destination and the gateway or the device
+func RouteExists(h *host.Host, r networkv1alpha1.Route) (bool, error) {
+	_, dst, err := net.ParseCIDR(r.Destination)
+	if err != nil {
+		return false, err
+	}
+
+	filter := &netlink.Route{Dst: dst}
+	mask := netlink.RT_FILTER_DST
+
+	if gw := net.ParseIP(r.Via); gw != nil {
+		filter.Gw = gw
+		mask |= netlink.RT_FILTER_GW
+	} else {
+		link, err := h.Links.LinkByName(r.Via)
+		if err != nil {
+			// The device is reported by the link drift
+			return false, nil
+		}
+		filter.LinkIndex = link.Attrs().Index
+		mask |= netlink.RT_FILTER_OIF
+	}
+
+	routes, err := h.Routes.RouteListFiltered(netlink.FAMILY_ALL, filter, mask)
+	if err != nil {
+		return false, fmt.Errorf("failed to get list of routes: %v", err)
+	}
+
+	return len(routes) > 0, nil
+}
+
+func firewallDrift(h *host.Host, spec *networkv1alpha1.NetworkAttachmentSpec) ([]Drift, error) {
+	var drift []Drift
+	var missing []string
+
+	ebRules := isolationRules(spec)
+
+	if spec.IpMasq.Enabled {
+		rules, err := h.NAT.MissingMasquerade(spec.IpMasq.Bridge, spec.IpMasq.Source, spec.IpMasq.EgressNetwork)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, rules...)
+
+		// Networks added to the set by somebody else are left alone, only the ones of the spec matter
+		networks, _, err := h.NAT.IgnoreDiff(spec.IpMasq.Bridge, spec.IpMasq.Ignore)
+		if err != nil {
+			return nil, err
+		}
+
+		set := iptables.IgnoreSetName(spec.IpMasq.Bridge)
+		for _, network := range networks {
+			drift = append(drift, Drift{DriftIptables, fmt.Sprintf("network %s is missing in ipset %s", network, set), fmt.Sprintf("add %s to ipset %s", network, set)})
+		}
+
+		gw, err := gatewayAddress(&spec.IpMasq)
+		if err != nil {
+			return nil, err
+		}
+
+		mac, err := gatewayMAC(&spec.IpMasq, gw)
+		if err != nil {
+			return nil, err
+		}
+
+		drift = append(drift, sysctlDrift(h, masqueradeSysctls(&spec.IpMasq, gw, mac))...)
+
+		ebRules[ebtables.ChainForward] = append(ebRules[ebtables.ChainForward], gatewayFilterRule(gw, spec.IpMasq.Bridge))
+		if spec.IpMasq.GatewayMode == networkv1alpha1.GatewayModeAnycast {
+			ebRules[ebtables.ChainOutput] = append(ebRules[ebtables.ChainOutput], anycastFilterRules(mac, spec.IpMasq.Bridge, bridgePorts(spec, spec.IpMasq.Bridge))...)
+		}
+	}
+
+	for _, chain := range ebtables.Chains {
+		for _, rule := range ebRules[chain] {
+			ok, err := h.Filter.RuleExists(chain, rule...)
+			if err != nil {
+				return nil, err
+			}
+
+			if !ok {
+				drift = append(drift, Drift{DriftEbtables, fmt.Sprintf("rule `-A %s %s` is missing", chain, strings.Join(rule, " ")), fmt.Sprintf("insert rule `-I %s %s`", chain, strings.Join(rule, " "))})
+			}
+		}
+	}
+
+	if name := NatBridge(spec); name != "" {
+		forwards, err := h.NAT.MissingPortForwards(name, portForwards(spec))
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, forwards...)
+	}
+
+	for _, rule := range missing {
+		drift = append(drift, Drift{DriftIptables, fmt.Sprintf("rule `%s` is missing", rule), fmt.Sprintf("insert rule `%s`", strings.Replace(rule, " -A ", " -I ", 1))})
+	}
+
+	return drift, nil
+}
+
+func sysctlDrift(h *host.Host, sysctls []sysctlValue) []Drift {
+	var drift []Drift
+
+	for _, sysctl := range sysctls {
+		value, err := h.Sysctl.Sysctl(sysctl.name)
+		if err != nil {
+			// The interface is missing, it's reported by the link drift
+			continue
+		}
+
+		if value != sysctl.value {
+			drift = append(drift, Drift{DriftSysctl, fmt.Sprintf("%s is %s instead of %s", sysctl.name, value, sysctl.value), fmt.Sprintf("set %s to %s", sysctl.name, sysctl.value)})
+		}
+	}
+
+	return drift
+}
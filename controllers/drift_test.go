@@ -0,0 +1,258 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/ebtables"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/host/fake"
+	"github.com/NCCloud/tabby-cni/pkg/iptables"
+	"github.com/NCCloud/tabby-cni/pkg/netnstest"
+)
+
+func TestLinkDrift(t *testing.T) {
+	netnstest.New(t)
+
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	if err := netlink.LinkAdd(br); err != nil {
+		t.Fatal(err)
+	}
+
+	// Veth stands for the vlan port, the kernel could lack vlan support
+	port := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth1.10", MTU: 1400}, PeerName: "peer0"}
+	if err := netlink.LinkAdd(port); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{
+			{Name: "br0", Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 10, Mtu: 1500}}},
+			{Name: "br1"},
+		},
+	}
+
+	want := []string{
+		"link: bridge br0 is down",
+		"link: port eth1.10 is down",
+		"link: port eth1.10 has mtu 1400 instead of 1500",
+		"link: port eth1.10 is not attached to bridge br0",
+		"link: bridge br1 is missing",
+	}
+	if got := driftStrings(linkDrift(host.New(), spec)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected drift %q, got %q", want, got)
+	}
+
+	for _, link := range []netlink.Link{br, port} {
+		if err := netlink.LinkSetUp(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := netlink.LinkSetMTU(port, 1500); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetMaster(port, br); err != nil {
+		t.Fatal(err)
+	}
+
+	want = []string{"link: bridge br1 is missing"}
+	if got := driftStrings(linkDrift(host.New(), spec)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected drift %q, got %q", want, got)
+	}
+}
+
+func TestUntaggedPortDrift(t *testing.T) {
+	node := fake.New()
+	node.Links.Add(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", MTU: 9000}})
+	h := node.Host()
+
+	spec := networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10", Ports: []networkv1alpha1.Port{{Name: "eth1", Mtu: 1500}}}},
+	}
+
+	// Uplink itself is the port, there is no eth1.0 to miss
+	want := []string{"link: bridge br10 is missing", "link: port eth1 is not attached to bridge br10"}
+	if got := driftStrings(linkDrift(h, &spec)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected drift %q, got %q", want, got)
+	}
+
+	if err := CreateNetwork(context.Background(), h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+	requireNoDrift(t, h, &spec)
+
+	if _, err := node.Links.LinkByName("eth1.0"); err == nil {
+		t.Error("vlan 0 interface created for the untagged port")
+	}
+}
+
+func TestRouteExists(t *testing.T) {
+	netnstest.New(t)
+
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	if err := netlink.LinkAdd(br); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		t.Fatal(err)
+	}
+
+	route := networkv1alpha1.Route{Via: "br0", Destination: "192.168.2.0/23"}
+
+	if ok, err := RouteExists(host.New(), route); err != nil || ok {
+		t.Fatalf("expected missing route, got %v, %v", ok, err)
+	}
+
+	_, dst, _ := net.ParseCIDR(route.Destination)
+	if err := netlink.RouteAdd(&netlink.Route{LinkIndex: br.Attrs().Index, Dst: dst, Scope: netlink.SCOPE_LINK}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := RouteExists(host.New(), route); err != nil || !ok {
+		t.Fatalf("expected route, got %v, %v", ok, err)
+	}
+}
+
+func driftStrings(drift []Drift) []string {
+	var result []string
+	for _, d := range drift {
+		result = append(result, d.String())
+	}
+	return result
+}
+
+func TestPlanNetwork(t *testing.T) {
+	netnstest.New(t)
+
+	port := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth1.10"}, PeerName: "peer0"}
+	if err := netlink.LinkAdd(port); err != nil {
+		t.Fatal(err)
+	}
+
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	if err := netlink.LinkAdd(br); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := netlink.ParseAddr("10.0.0.5/24")
+	if err := netlink.AddrAdd(br, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	// Links and routes of the namespace, the port forward of the previous spec is still there
+	rules := fake.New()
+	rules.NAT.PortForwards["br0"] = []iptables.PortForward{{Protocol: "tcp", Port: 2222, ToDestination: "10.1.0.2:22"}}
+	h := host.New()
+	h.NAT, h.Filter = rules.NAT, rules.Filter
+
+	prev := &networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br0", Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 10}}, AddressPool: "10.0.0.0/24"}},
+	}
+	spec := &networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br0", Mtu: 1400, Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 20}}}},
+		Routes: []networkv1alpha1.Route{{Via: "10.1.0.1", Destination: "10.2.0.0/16"}},
+		IpMasq: networkv1alpha1.Masquerade{Enabled: true, Bridge: "br0", Source: "10.1.0.0/24", Ignore: []string{"10.3.0.0/16"}},
+	}
+
+	plan, err := PlanNetwork(h, prev, spec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"delete port eth1.10",
+		"delete address 10.0.0.5/24 of pool 10.0.0.0/24 from bridge br0",
+		"set mtu of bridge br0 to 1400",
+		"set bridge br0 up",
+		"create vlan 20 on eth1",
+		"attach eth1.20 to bridge br0",
+		"add route to 10.2.0.0/16 via 10.1.0.1",
+		"set net.ipv4.conf.br0.proxy_arp to 1",
+		"set net.ipv4.neigh.br0.proxy_delay to 0",
+		"set net.ipv4.ip_forward to 1",
+		"insert rule `-I FORWARD -p ARP --logical-out br0 --arp-ip-dst 169.254.1.1 -j DROP`",
+		"insert rule `-t nat -I br0-POSTROUTING -s 10.1.0.0/24 -j MASQUERADE`",
+		"add 10.3.0.0/16 to ipset br0-IGNORE",
+		"delete rule `-t nat -D br0-PREROUTING -p tcp --dport 2222 -j DNAT --to-destination 10.1.0.2:22`",
+	}
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("expected plan %q, got %q", want, plan)
+	}
+
+	if _, err := netlink.LinkByName("eth1.10"); err != nil {
+		t.Errorf("plan must not change the host network: %v", err)
+	}
+	if len(rules.NAT.Masquerades) != 0 || len(rules.NAT.PortForwards["br0"]) != 1 {
+		t.Errorf("plan must not change the rules: %+v", rules.NAT)
+	}
+
+	// Changed ignore list of the applied masquerade is planned as the changes of its set
+	rules.NAT.Masquerades["br0"] = fake.Masquerade{Source: "10.1.0.0/24", Ignore: []string{"10.4.0.0/16"}}
+	if plan, err = PlanNetwork(h, spec, spec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var sets []string
+	for _, change := range plan {
+		if strings.Contains(change, "ipset") {
+			sets = append(sets, change)
+		}
+	}
+	want = []string{"add 10.3.0.0/16 to ipset br0-IGNORE", "delete 10.4.0.0/16 from ipset br0-IGNORE"}
+	if !reflect.DeepEqual(sets, want) {
+		t.Errorf("expected set changes %q, got %q", want, sets)
+	}
+}
+
+func TestFirewallDrift(t *testing.T) {
+	node := fake.New()
+	node.Links.Add(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}})
+	h := node.Host()
+
+	spec := networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{
+			{Name: "br10"},
+			{Name: "br20", Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 20}}},
+		},
+		IpMasq: networkv1alpha1.Masquerade{Enabled: true, Bridge: "br10", Source: "10.10.0.0/24", Ignore: []string{"10.20.0.0/16"}},
+		// Servers on the bridge which isn't masqueraded still keep their traffic on the node
+		DHCP: &networkv1alpha1.DHCPServer{Enabled: true, Bridge: "br20"},
+	}
+
+	if err := CreateNetwork(context.Background(), h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+	requireNoDrift(t, h, &spec)
+
+	masquerade := node.NAT.Masquerades["br10"]
+	masquerade.Ignore = nil
+	node.NAT.Masquerades["br10"] = masquerade
+
+	if _, err := h.Sysctl.Sysctl("net.ipv4.conf.br10.proxy_arp", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	out := []string{"-p", "IPv4", "-o", "eth1.20", "--logical-out", "br20", "--ip-proto", "udp", "--ip-dport", "67:68", "-j", "DROP"}
+	if err := h.Filter.DeleteRule(ebtables.ChainOutput, out...); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err := firewallDrift(h, &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"iptables: network 10.20.0.0/16 is missing in ipset br10-IGNORE",
+		"sysctl: net.ipv4.conf.br10.proxy_arp is 0 instead of 1",
+		"ebtables: rule `-A OUTPUT -p IPv4 -o eth1.20 --logical-out br20 --ip-proto udp --ip-dport 67:68 -j DROP` is missing",
+	}
+	if got := driftStrings(drift); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected drift %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the events about the network
+const (
+	ReasonAttachmentCreated = "AttachmentCreated"
+	ReasonAttachmentUpdated = "AttachmentUpdated"
+	ReasonBridgeCreated     = "BridgeCreated"
+	ReasonBridgeRemoved     = "BridgeRemoved"
+	ReasonPortAdded         = "PortAdded"
+	ReasonPortRemoved       = "PortRemoved"
+	ReasonRouteFailed       = "RouteFailed"
+	ReasonMasqueradeEnabled = "MasqueradeEnabled"
+	ReasonGarpSent          = "GarpSent"
+	ReasonGarpFailed        = "GarpFailed"
+)
+
+// Reasons of the events about floating ips and networkattachmentdefinitions
+const (
+	ReasonFloatingIPProgrammed = "FloatingIPProgrammed"
+	ReasonFloatingIPFailed     = "FloatingIPFailed"
+	ReasonDefinitionCreated    = "DefinitionCreated"
+	ReasonDefinitionUpdated    = "DefinitionUpdated"
+	ReasonDefinitionFailed     = "DefinitionFailed"
+)
+
+// EventFunc reports a change of the host network, e.g. as an event of the network attachment.
+// Nil EventFunc reports nothing, e.g. in the CNI plugin.
+type EventFunc func(eventtype, reason, message string)
+
+func (f EventFunc) normal(reason, message string) {
+	if f != nil {
+		f(corev1.EventTypeNormal, reason, message)
+	}
+}
+
+func (f EventFunc) warning(reason, message string) {
+	if f != nil {
+		f(corev1.EventTypeWarning, reason, message)
+	}
+}
+
+// Events of the object, nothing is reported without the recorder
+func recorderEvents(recorder record.EventRecorder, obj runtime.Object) EventFunc {
+	if recorder == nil {
+		return nil
+	}
+
+	return func(eventtype, reason, message string) {
+		recorder.Event(obj, eventtype, reason, message)
+	}
+}
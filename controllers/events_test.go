@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/tools/record"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/netnstest"
+)
+
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestNetworkEvents(t *testing.T) {
+	netnstest.New(t)
+
+	recorder := record.NewFakeRecorder(10)
+	na := &networkv1alpha1.NetworkAttachment{}
+	events := recorderEvents(recorder, na)
+
+	spec := &networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10"}},
+		Routes: []networkv1alpha1.Route{{Destination: "10.10.0.0/16", Via: "eth9"}},
+	}
+
+	if err := CreateNetwork(context.Background(), host.New(), spec, events); err == nil {
+		t.Fatal("CreateNetwork() succeeded with the missing route device")
+	}
+
+	want := []string{
+		"Normal BridgeCreated Created bridge br10",
+		"Warning RouteFailed Failed to add route to 10.10.0.0/16 via eth9: Link not found",
+	}
+	if got := recordedEvents(recorder); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+
+	// Existing bridge is not reported again
+	if err := CreateNetwork(context.Background(), host.New(), spec, events); err == nil {
+		t.Fatal("CreateNetwork() succeeded with the missing route device")
+	}
+
+	want = want[1:]
+	if got := recordedEvents(recorder); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+
+	// Nothing is reported without the recorder, e.g. by the CNI plugin
+	if err := CreateNetwork(context.Background(), host.New(), spec, nil); err == nil {
+		t.Fatal("CreateNetwork() succeeded with the missing route device")
+	}
+}
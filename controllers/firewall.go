@@ -1,69 +1,469 @@
 package controllers
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"net"
+	"strconv"
 
 	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
 	"github.com/NCCloud/tabby-cni/pkg/ebtables"
+	"github.com/NCCloud/tabby-cni/pkg/host"
 	"github.com/NCCloud/tabby-cni/pkg/iptables"
-	"github.com/containernetworking/plugins/pkg/utils/sysctl"
-	"github.com/j-keck/arping"
+	"github.com/NCCloud/tabby-cni/pkg/ndp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	IPv4InterfaceArpProxySysctlTemplate   string = "net.ipv4.conf.%s.proxy_arp"
 	IPv4InterfaceDelayProxySysctlTemplate string = "net.ipv4.neigh.%s.proxy_delay"
+	IPv4InterfaceArpIgnoreSysctlTemplate  string = "net.ipv4.conf.%s.arp_ignore"
+	IPv6InterfaceForwardingSysctlTemplate string = "net.ipv6.conf.%s.forwarding"
 	ipv4Forward                           string = "net.ipv4.ip_forward"
 	virtualIpaddress                      string = "169.254.1.1"
 )
 
-func EnableMasquerade(ipmasq *networkv1alpha1.Masquerade) error {
+// Default gateway of the virtual machines
+func gatewayAddress(ipmasq *networkv1alpha1.Masquerade) (net.IP, error) {
+	if ipmasq.Gateway == "" {
+		return net.ParseIP(virtualIpaddress), nil
+	}
+
+	gw := net.ParseIP(ipmasq.Gateway)
+	if gw == nil {
+		return nil, fmt.Errorf("invalid gateway address %q", ipmasq.Gateway)
+	}
+
+	if gw.To4() == nil && !gw.IsLinkLocalUnicast() {
+		return nil, fmt.Errorf("IPv6 gateway address must be link-local, got %q", ipmasq.Gateway)
+	}
+
+	return gw, nil
+}
+
+// Send gratuitous arp request, or unsolicited neighbor advertisement for IPv6,
+// so all virtual machines use proper mac for default gateway.
+func announceGateway(h *host.Host, gw net.IP, bridge string) error {
+	return h.ARP.Announce(gw, bridge)
+}
+
+// Make sure the neighbor discovery of the gateway won't go outside of compute node
+func gatewayFilterRule(gw net.IP, bridge string) []string {
+	if gw.To4() != nil {
+		// ebtables-nft -I FORWARD -p ARP -o br2710 --arp-ip-dst 169.254.1.1 -j DROP
+		return []string{"-p", "ARP", "--logical-out", bridge, "--arp-ip-dst", gw.String(), "-j", "DROP"}
+	}
+
+	// Neighbor solicitations are sent to the solicited-node multicast address of the gateway
+	return []string{
+		"-p", "IPv6", "--logical-out", bridge, "--ip6-dst", ndp.SolicitedNodeMulticast(gw).String(),
+		"--ip6-proto", "ipv6-icmp", "--ip6-icmp-type", "neighbour-solicitation", "-j", "DROP",
+	}
+}
+
+// Configure the gateway address on the bridge itself. Duplicate address detection
+// is disabled since every node has the same gateway address.
+func addGatewayAddress(h *host.Host, gw net.IP, bridge string) error {
+	br, err := h.Links.LinkByName(bridge)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge %s: %v", bridge, err)
+	}
+
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: gw, Mask: net.CIDRMask(32, 32)}}
+	if gw.To4() == nil {
+		addr = &netlink.Addr{
+			IPNet: &net.IPNet{IP: gw, Mask: net.CIDRMask(64, 128)},
+			Flags: unix.IFA_F_NODAD,
+		}
+	}
+
+	if err := h.Links.AddrReplace(br, addr); err != nil {
+		return fmt.Errorf("failed to add gateway %s to bridge %s: %v", gw, bridge, err)
+	}
+
+	if gw.To4() == nil {
+		ipv6SysctlValueName := fmt.Sprintf(IPv6InterfaceForwardingSysctlTemplate, bridge)
+		if _, err := h.Sysctl.Sysctl(ipv6SysctlValueName, "1"); err != nil {
+			return fmt.Errorf("failed to set forwarding on interface %s: %v", bridge, err)
+		}
+	}
+
+	return nil
+}
+
+// Virtual mac address of the anycast gateway. It's derived from the bridge name and
+// the gateway address, so every node comes up with the same one.
+func anycastGatewayMAC(bridge string, gw net.IP) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s", bridge, gw)))
+
+	mac := net.HardwareAddr(sum[:6])
+	// locally administered unicast address
+	mac[0] = (mac[0] & 0xfe) | 0x02
+
+	return mac
+}
+
+// Mac address of the gateway, nil means the bridge keeps its own mac address
+func gatewayMAC(ipmasq *networkv1alpha1.Masquerade, gw net.IP) (net.HardwareAddr, error) {
+	if ipmasq.GatewayMAC != "" {
+		mac, err := net.ParseMAC(ipmasq.GatewayMAC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway mac address %q: %v", ipmasq.GatewayMAC, err)
+		}
+		return mac, nil
+	}
+
+	if ipmasq.GatewayMode == networkv1alpha1.GatewayModeAnycast {
+		return anycastGatewayMAC(ipmasq.Bridge, gw), nil
+	}
+
+	return nil, nil
+}
+
+// Name of the macvlan interface of the bridge which owns the gateway mac address
+func gatewayInterface(bridge string) string {
+	// interface names are limited to 15 characters
+	if len(bridge) > 12 {
+		bridge = bridge[:12]
+	}
+	return bridge + "-gw"
+}
+
+// Gateway with its own mac address, e.g. the anycast one, is configured on the macvlan
+// interface of the bridge. The bridge keeps its mac address, so the gateway one isn't
+// the source of the other traffic of the node and isn't seen on the fabric from every node.
+func addGatewayInterface(h *host.Host, bridge string, gw net.IP, mac net.HardwareAddr) (string, error) {
+	name := gatewayInterface(bridge)
+
+	if _, err := h.Links.AddMacvlan(bridge, name, mac); err != nil {
+		return "", fmt.Errorf("failed to add gateway interface %s to bridge %s: %v", name, bridge, err)
+	}
+
+	// Only the macvlan answers arp requests for the gateway address
+	ipv4SysctlValueName := fmt.Sprintf(IPv4InterfaceArpIgnoreSysctlTemplate, bridge)
+	if _, err := h.Sysctl.Sysctl(ipv4SysctlValueName, "1"); err != nil {
+		return "", fmt.Errorf("failed to set arp_ignore on interface %s: %v", bridge, err)
+	}
+
+	// Earlier releases configured the gateway on the bridge itself
+	if err := deleteBridgeGateway(h, bridge, gw, mac); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// Remove the gateway address from the bridge and give the bridge its own mac address
+// back if it has the gateway one
+func deleteBridgeGateway(h *host.Host, bridge string, gw net.IP, mac net.HardwareAddr) error {
+	br, err := h.Links.LinkByName(bridge)
+	if err != nil {
+		if host.IsLinkNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to find bridge %s: %v", bridge, err)
+	}
+
+	family := netlink.FAMILY_V4
+	if gw.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+
+	addrs, err := h.Links.AddrList(br, family)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of bridge %s: %v", bridge, err)
+	}
+
+	for i := range addrs {
+		if !addrs[i].IP.Equal(gw) {
+			continue
+		}
+
+		if err := h.Links.AddrDel(br, &addrs[i]); err != nil {
+			return fmt.Errorf("failed to delete gateway %s from bridge %s: %v", gw, bridge, err)
+		}
+	}
+
+	if mac == nil || br.Attrs().HardwareAddr.String() != mac.String() {
+		return nil
+	}
+
+	// The original mac address isn't kept, so the bridge gets a random one like a new bridge does
+	random := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	random[0] = (random[0] & 0xfe) | 0x02
+
+	if err := h.Links.LinkSetHardwareAddr(br, random); err != nil {
+		return fmt.Errorf("failed to set mac address %s on bridge %s: %v", random, bridge, err)
+	}
+
+	return nil
+}
+
+// Remove the gateway of the masquerade from the node, e.g. when its mode is changed
+func deleteGateway(h *host.Host, ipmasq *networkv1alpha1.Masquerade) error {
+	gw, err := gatewayAddress(ipmasq)
+	if err != nil {
+		return err
+	}
+
+	mac, err := gatewayMAC(ipmasq, gw)
+	if err != nil {
+		return err
+	}
+
+	if err := h.Links.DeletePort(gatewayInterface(ipmasq.Bridge)); err != nil {
+		return fmt.Errorf("failed to delete gateway interface of bridge %s: %v", ipmasq.Bridge, err)
+	}
 
-	ipv4SysctlValueName := fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, ipmasq.Bridge)
-	if _, err := sysctl.Sysctl(ipv4SysctlValueName, "1"); err != nil {
-		return fmt.Errorf("failed to set proxy_arp on newly added interface %s: %v", ipmasq.Bridge, err)
+	if mac != nil {
+		if _, err := h.Links.LinkByName(ipmasq.Bridge); err == nil {
+			ipv4SysctlValueName := fmt.Sprintf(IPv4InterfaceArpIgnoreSysctlTemplate, ipmasq.Bridge)
+			if _, err := h.Sysctl.Sysctl(ipv4SysctlValueName, "0"); err != nil {
+				return fmt.Errorf("failed to reset arp_ignore on interface %s: %v", ipmasq.Bridge, err)
+			}
+		}
 	}
 
-	ipv4SysctlValueName = fmt.Sprintf(IPv4InterfaceDelayProxySysctlTemplate, ipmasq.Bridge)
-	if _, err := sysctl.Sysctl(ipv4SysctlValueName, "0"); err != nil {
-		return fmt.Errorf("failed to set proxy_delay on newly added interface %s: %v", ipmasq.Bridge, err)
+	return deleteBridgeGateway(h, ipmasq.Bridge, gw, mac)
+}
+
+// Gateway settings of the masquerade differ, so the previous gateway has to be removed
+func gatewayChanged(prev, current *networkv1alpha1.Masquerade) bool {
+	return !current.Enabled ||
+		prev.Bridge != current.Bridge ||
+		prev.Gateway != current.Gateway ||
+		prev.GatewayMode != current.GatewayMode ||
+		prev.GatewayMAC != current.GatewayMAC
+}
+
+// Every node has the same anycast gateway, make sure nothing the node sends with
+// its mac address, e.g. arp replies or router advertisements, leaves the node via
+// uplink ports of the bridge.
+func anycastFilterRules(mac net.HardwareAddr, bridge string, uplinks []string) [][]string {
+	var rules [][]string
+
+	for _, uplink := range uplinks {
+		// ebtables-nft -I OUTPUT -s 02:00:00:00:00:01 -o eth1.10 --logical-out br10 -j DROP
+		rules = append(rules, []string{"-s", mac.String(), "-o", uplink, "--logical-out", bridge, "-j", "DROP"})
 	}
 
-	if _, err := sysctl.Sysctl(ipv4Forward, "1"); err != nil {
-		return fmt.Errorf("failed to set ip_forward=1: %v", err)
+	return rules
+}
+
+type sysctlValue struct {
+	name  string
+	value string
+}
+
+// Kernel parameters which make the node the gateway of the bridge
+func forwardingSysctls(bridge string) []sysctlValue {
+	return []sysctlValue{
+		{fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, bridge), "1"},
+		{fmt.Sprintf(IPv4InterfaceDelayProxySysctlTemplate, bridge), "0"},
+		{ipv4Forward, "1"},
 	}
+}
+
+// Kernel parameters the masquerade sets on the node, including the ones of the gateway
+func masqueradeSysctls(ipmasq *networkv1alpha1.Masquerade, gw net.IP, mac net.HardwareAddr) []sysctlValue {
+	sysctls := forwardingSysctls(ipmasq.Bridge)
 
-	// Make sure arp request won't go outside of compute node
-	// ebtables-nft -I FORWARD -p ARP -o br2710 --arp-ip-dst 169.254.1.1 -j DROP
-	rule := []string{"-p", "ARP", "--logical-out", ipmasq.Bridge, "--arp-ip-dst", virtualIpaddress, "-j", "DROP"}
+	gwInterface := ipmasq.Bridge
+	if mac != nil {
+		gwInterface = gatewayInterface(ipmasq.Bridge)
+		sysctls = append(sysctls, sysctlValue{fmt.Sprintf(IPv4InterfaceArpIgnoreSysctlTemplate, ipmasq.Bridge), "1"})
+	}
+
+	if gw.To4() == nil {
+		sysctls = append(sysctls, sysctlValue{fmt.Sprintf(IPv6InterfaceForwardingSysctlTemplate, gwInterface), "1"})
+	}
 
-	if err := ebtables.AddRule(rule...); err != nil {
+	return sysctls
+}
+
+// EnableMasquerade configures the gateway of the virtual machines and snat of their traffic.
+// Uplinks are the ports of the bridge which lead outside of the node.
+func EnableMasquerade(ctx context.Context, h *host.Host, ipmasq *networkv1alpha1.Masquerade, uplinks []string) error {
+
+	gw, err := gatewayAddress(ipmasq)
+	if err != nil {
+		return err
+	}
+
+	for _, sysctl := range forwardingSysctls(ipmasq.Bridge) {
+		if _, err := h.Sysctl.Sysctl(sysctl.name, sysctl.value); err != nil {
+			return fmt.Errorf("failed to set %s=%s on interface %s: %v", sysctl.name, sysctl.value, ipmasq.Bridge, err)
+		}
+	}
+
+	// Proxy arp and neighbor advertisements use the mac address of the bridge,
+	// gateway with its own mac address gets the macvlan interface
+	mac, err := gatewayMAC(ipmasq, gw)
+	if err != nil {
+		return err
+	}
+
+	gwInterface := ipmasq.Bridge
+	if mac != nil {
+		if gwInterface, err = addGatewayInterface(h, ipmasq.Bridge, gw, mac); err != nil {
+			return err
+		}
+	}
+
+	// There is no proxy ndp for link-local addresses, so IPv6 gateway is always
+	// configured on the node. So is the gateway with its own mac address.
+	anycast := ipmasq.GatewayMode == networkv1alpha1.GatewayModeAnycast
+	if mac != nil || gw.To4() == nil {
+		if err := addGatewayAddress(h, gw, gwInterface); err != nil {
+			return err
+		}
+	}
+
+	rule := gatewayFilterRule(gw, ipmasq.Bridge)
+
+	if err := h.Filter.AddRule(ctx, ebtables.ChainForward, rule...); err != nil {
 		return fmt.Errorf("failed to add ebtables rule while enabling masquerading %v: %v", rule, err)
 	}
 
-	if err := iptables.AddRule(ipmasq.Bridge, ipmasq.Source, ipmasq.Ignore, ipmasq.EgressNetwork); err != nil {
+	if anycast {
+		for _, rule := range anycastFilterRules(mac, ipmasq.Bridge, uplinks) {
+			if err := h.Filter.AddRule(ctx, ebtables.ChainOutput, rule...); err != nil {
+				return fmt.Errorf("failed to add ebtables rule while enabling anycast gateway %v: %v", rule, err)
+			}
+		}
+	}
+
+	if err := h.NAT.AddMasquerade(ctx, ipmasq.Bridge, ipmasq.Source, ipmasq.Ignore, ipmasq.EgressNetwork); err != nil {
 		return fmt.Errorf("failed to add iptables rule while enabling masquerading: %v", err)
 	}
 
 	// After applying ebtables arp rules, it's better to send arp gratuitous request to make sure all Virtual Machines
 	// use proper mac for default gateway.
-	if err := arping.GratuitousArpOverIfaceByName(net.ParseIP(virtualIpaddress), ipmasq.Bridge); err != nil {
+	err = announceGateway(h, gw, gwInterface)
+	observeGarp(GarpSourceMasquerade, err)
+	if err != nil {
 		return fmt.Errorf("failed to send arp request after applying ebtables arp rules: %v", err)
 	}
 
 	return nil
 }
 
-func DeleteMasquerade(ipmasq *networkv1alpha1.Masquerade) error {
+func DeleteMasquerade(h *host.Host, ipmasq *networkv1alpha1.Masquerade) error {
 
-	if err := ebtables.DeleteRuleByDevice(ipmasq.Bridge); err != nil {
+	if err := deleteGateway(h, ipmasq); err != nil {
 		return err
 	}
 
-	if err := iptables.PurgeChain(ipmasq.Bridge); err != nil {
+	if err := h.Filter.DeleteRuleByDevice(ipmasq.Bridge); err != nil {
 		return err
 	}
 
+	if err := h.NAT.PurgeChain(ipmasq.Bridge); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// L2 rules which keep the services the node runs for its virtual machines off the
+// uplink ports of the bridges
+func isolationRules(spec *networkv1alpha1.NetworkAttachmentSpec) map[string][][]string {
+	rules := dhcpFilterRules(spec)
+	if rules == nil {
+		rules = map[string][][]string{}
+	}
+
+	for chain, chainRules := range raFilterRules(spec) {
+		rules[chain] = append(rules[chain], chainRules...)
+	}
+
+	return rules
+}
+
+func addFilterRules(ctx context.Context, h *host.Host, rules map[string][][]string) error {
+	for _, chain := range ebtables.Chains {
+		for _, rule := range rules[chain] {
+			if err := h.Filter.AddRule(ctx, chain, rule...); err != nil {
+				return fmt.Errorf("failed to add ebtables rule %v: %v", rule, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Remove the rules which are not wanted anymore, e.g. the previous ones of the spec
+func deleteFilterRules(h *host.Host, rules map[string][][]string, keep map[string][][]string) error {
+	for _, chain := range ebtables.Chains {
+		for _, rule := range rules[chain] {
+			if slices.ContainsFunc(keep[chain], func(k []string) bool { return slices.Equal(k, rule) }) {
+				continue
+			}
+
+			if err := h.Filter.DeleteRule(chain, rule...); err != nil {
+				return fmt.Errorf("failed to delete ebtables rule %v: %v", rule, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// NatBridge returns the bridge whose nat chains are used for the port forwards
+func NatBridge(spec *networkv1alpha1.NetworkAttachmentSpec) string {
+	if spec.IpMasq.Bridge != "" {
+		return spec.IpMasq.Bridge
+	}
+
+	if len(spec.Bridge) > 0 {
+		return spec.Bridge[0].Name
+	}
+
+	return ""
+}
+
+// Port forwards of the spec with defaults applied
+func portForwards(spec *networkv1alpha1.NetworkAttachmentSpec) []iptables.PortForward {
+	var forwards []iptables.PortForward
+
+	for _, pf := range spec.PortForwards {
+		protocol := pf.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+
+		internalPort := pf.InternalPort
+		if internalPort == 0 {
+			internalPort = pf.ExternalPort
+		}
+
+		forwards = append(forwards, iptables.PortForward{
+			Protocol:      protocol,
+			Address:       pf.ExternalAddress,
+			Port:          pf.ExternalPort,
+			ToDestination: net.JoinHostPort(pf.InternalAddress, strconv.Itoa(internalPort)),
+		})
+	}
+
+	return forwards
+}
+
+func SyncPortForwards(ctx context.Context, h *host.Host, spec *networkv1alpha1.NetworkAttachmentSpec) error {
+	name := NatBridge(spec)
+	if name == "" {
+		return nil
+	}
+
+	if err := h.NAT.SyncPortForwards(ctx, name, portForwards(spec)); err != nil {
+		return fmt.Errorf("failed to sync port forwards of bridge %s: %v", name, err)
+	}
+
 	return nil
 }
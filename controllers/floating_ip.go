@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+)
+
+func floatingIPName(fip *networkv1alpha1.FloatingIP) string {
+	return fmt.Sprintf("%s/%s", fip.Namespace, fip.Name)
+}
+
+// Find the interface the node uses to reach the address. Host routes are skipped
+// since the floating ip itself could be already routed via the bridge.
+func routeInterface(h *host.Host, ip net.IP) (string, error) {
+	var best *netlink.Route
+
+	routes, err := h.Routes.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+
+	for i, r := range routes {
+		if r.Dst != nil {
+			ones, _ := r.Dst.Mask.Size()
+			if ones == 32 || !r.Dst.Contains(ip) {
+				continue
+			}
+		}
+
+		if best == nil || prefixLen(r.Dst) > prefixLen(best.Dst) {
+			best = &routes[i]
+		}
+	}
+
+	if best == nil {
+		return "", fmt.Errorf("failed to find route to %s", ip)
+	}
+
+	link, err := h.Links.LinkByIndex(best.LinkIndex)
+	if err != nil {
+		return "", err
+	}
+
+	return link.Attrs().Name, nil
+}
+
+func prefixLen(n *net.IPNet) int {
+	if n == nil {
+		return 0
+	}
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+func floatingIPInterface(h *host.Host, spec *networkv1alpha1.FloatingIPSpec, external net.IP) (string, error) {
+	if spec.EgressNetwork != "" {
+		return h.NAT.EgressInterface(spec.EgressNetwork)
+	}
+	return routeInterface(h, external)
+}
+
+func parseFloatingIP(spec *networkv1alpha1.FloatingIPSpec) (net.IP, net.IP, error) {
+	external := net.ParseIP(spec.ExternalAddress).To4()
+	if external == nil {
+		return nil, nil, fmt.Errorf("invalid external address %q", spec.ExternalAddress)
+	}
+
+	internal := net.ParseIP(spec.InternalAddress).To4()
+	if internal == nil {
+		return nil, nil, fmt.Errorf("invalid internal address %q", spec.InternalAddress)
+	}
+
+	return external, internal, nil
+}
+
+func hostRoute(ip net.IP) *net.IPNet {
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+}
+
+// AddFloatingIP programs 1:1 nat for the virtual machine and announces the
+// external address from the node.
+func AddFloatingIP(ctx context.Context, h *host.Host, fip *networkv1alpha1.FloatingIP) error {
+	spec := &fip.Spec
+
+	external, internal, err := parseFloatingIP(spec)
+	if err != nil {
+		return err
+	}
+
+	ifaceName, err := floatingIPInterface(h, spec, external)
+	if err != nil {
+		return fmt.Errorf("failed to find egress interface for floating ip %s: %v", external, err)
+	}
+
+	iface, err := h.Links.LinkByName(ifaceName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := h.Sysctl.Sysctl(ipv4Forward, "1"); err != nil {
+		return fmt.Errorf("failed to set ip_forward=1: %v", err)
+	}
+
+	switch spec.Mode {
+	case networkv1alpha1.FloatingIPModeProxyARP:
+		ipv4SysctlValueName := fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, ifaceName)
+		if _, err := h.Sysctl.Sysctl(ipv4SysctlValueName, "1"); err != nil {
+			return fmt.Errorf("failed to set proxy_arp on interface %s: %v", ifaceName, err)
+		}
+
+		br, err := h.Links.LinkByName(spec.Bridge)
+		if err != nil {
+			return fmt.Errorf("failed to find bridge %s: %v", spec.Bridge, err)
+		}
+
+		// proxy arp answers only for addresses routed via another interface
+		route := &netlink.Route{LinkIndex: br.Attrs().Index, Scope: netlink.SCOPE_LINK, Dst: hostRoute(external)}
+		if err := h.Routes.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add route for floating ip %s: %v", external, err)
+		}
+	default:
+		if err := h.Links.AddrReplace(iface, &netlink.Addr{IPNet: hostRoute(external)}); err != nil {
+			return fmt.Errorf("failed to add floating ip %s to interface %s: %v", external, ifaceName, err)
+		}
+	}
+
+	if err := h.NAT.AddFloatingIP(ctx, floatingIPName(fip), external.String(), internal.String()); err != nil {
+		return fmt.Errorf("failed to add iptables rules for floating ip %s: %v", external, err)
+	}
+
+	// Let the upstream router know that the floating ip has moved to this node
+	if err := h.ARP.Announce(external, ifaceName); err != nil {
+		return fmt.Errorf("failed to send arp request for floating ip %s: %v", external, err)
+	}
+
+	return nil
+}
+
+// Tell whether everything AddFloatingIP adds is on the node, and whether anything of it is
+func floatingIPState(h *host.Host, fip *networkv1alpha1.FloatingIP) (bool, bool, error) {
+	spec := &fip.Spec
+
+	external, internal, err := parseFloatingIP(spec)
+	if err != nil {
+		return false, false, err
+	}
+
+	missing, err := h.NAT.MissingFloatingIP(floatingIPName(fip), external.String(), internal.String())
+	if err != nil {
+		return false, false, err
+	}
+
+	routes, err := h.Routes.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: hostRoute(external)}, netlink.RT_FILTER_DST)
+	if err != nil {
+		return false, false, err
+	}
+
+	addrs, err := h.Links.AddrList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return false, false, err
+	}
+
+	var address bool
+	for _, addr := range addrs {
+		address = address || EqualCIDR(addr.IPNet, hostRoute(external))
+	}
+
+	announced := address
+	if spec.Mode == networkv1alpha1.FloatingIPModeProxyARP {
+		announced = len(routes) > 0
+	}
+
+	// Floating ip has the DNAT and the SNAT rule
+	applied := len(missing) == 0 && announced
+	present := len(missing) < 2 || address || len(routes) > 0
+
+	return applied, present, nil
+}
+
+// DeleteFloatingIP removes everything AddFloatingIP could have added. It's safe to call
+// on nodes which never hosted the floating ip.
+func DeleteFloatingIP(h *host.Host, fip *networkv1alpha1.FloatingIP) error {
+	spec := &fip.Spec
+
+	external, internal, err := parseFloatingIP(spec)
+	if err != nil {
+		return err
+	}
+
+	if err := h.NAT.DeleteFloatingIP(floatingIPName(fip), external.String(), internal.String()); err != nil {
+		return err
+	}
+
+	addrs, err := h.Links.AddrList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if !EqualCIDR(addr.IPNet, hostRoute(external)) {
+			continue
+		}
+
+		link, err := h.Links.LinkByIndex(addr.LinkIndex)
+		if err != nil {
+			return err
+		}
+
+		if err := h.Links.AddrDel(link, &addr); err != nil {
+			return fmt.Errorf("failed to remove floating ip %s from interface %s: %v", external, link.Attrs().Name, err)
+		}
+	}
+
+	routes, err := h.Routes.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: hostRoute(external)}, netlink.RT_FILTER_DST)
+	if err != nil {
+		return err
+	}
+
+	for _, route := range routes {
+		route := route
+		if err := h.Routes.RouteDel(&route); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to remove route for floating ip %s: %v", external, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,264 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	virtv1 "kubevirt.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
+)
+
+const floatingIPFinalizer = "cloud.spaceship.com/floatingip-finalizer"
+
+// FloatingIPReconciler programs floating ips on the node which hosts the virtual machine
+type FloatingIPReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Host     *host.Host
+}
+
+//+kubebuilder:rbac:groups=cloud.spaceship.com,resources=floatingips,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=cloud.spaceship.com,resources=floatingips/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=cloud.spaceship.com,resources=floatingips/finalizers,verbs=update
+//+kubebuilder:rbac:groups=kubevirt.io,resources=virtualmachineinstances,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+
+func (r *FloatingIPReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	hostname, err := getHostname()
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to get node hostname")
+		return ctrl.Result{}, err
+	}
+
+	ctx, logger := reconcileLogger(ctx, "floatingip", "floatingip", req.NamespacedName.String(), logging.KeyNode, hostname)
+
+	logger.Info("Reconcile floatingip resource")
+
+	floatingIP := &networkv1alpha1.FloatingIP{}
+	err = r.Get(ctx, req.NamespacedName, floatingIP)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			logger.Info("FloatingIP resource not found. Ignoring since object must be deleted")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	if floatingIP.GetDeletionTimestamp() != nil {
+		if !controllerutil.ContainsFinalizer(floatingIP, floatingIPFinalizer) {
+			return ctrl.Result{}, nil
+		}
+
+		if err := DeleteFloatingIP(r.Host, floatingIP); err != nil {
+			logger.Error(err, "Failed to remove floating ip")
+			return ctrl.Result{}, err
+		}
+
+		// Only the node which has programmed the floating ip is allowed to release it,
+		// unless that node is gone
+		if floatingIP.Status.NodeName != "" && floatingIP.Status.NodeName != hostname {
+			exists, err := r.nodeExists(ctx, floatingIP.Status.NodeName)
+			if err != nil || exists {
+				return ctrl.Result{}, err
+			}
+		}
+
+		logger.Info("Removing Finalizer for floating ip after successfully perform the operations")
+		controllerutil.RemoveFinalizer(floatingIP, floatingIPFinalizer)
+		if err := r.Update(ctx, floatingIP); err != nil {
+			logger.Error(err, "Failed to remove finalizer for floating ip")
+			return ctrl.Result{}, err
+		}
+
+		return ctrl.Result{}, nil
+	}
+
+	vmiNode, err := r.virtualMachineNode(ctx, floatingIP)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	applied, present, err := floatingIPState(r.Host, floatingIP)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// The virtual machine runs somewhere else, make sure there are no leftovers
+	// on this node, e.g. after the live migration.
+	if vmiNode != hostname {
+		if !present {
+			return ctrl.Result{}, nil
+		}
+
+		logger.Info("Removing stale floating ip", "address", floatingIP.Spec.ExternalAddress)
+		if err := DeleteFloatingIP(r.Host, floatingIP); err != nil {
+			logger.Error(err, "Failed to remove stale floating ip")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(floatingIP, floatingIPFinalizer) {
+		logger.Info("Adding Finalizer for floating ip resource")
+		controllerutil.AddFinalizer(floatingIP, floatingIPFinalizer)
+
+		if err = r.Update(ctx, floatingIP); err != nil {
+			logger.Error(err, "Failed to update custom resource to add finalizer")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Announcing the address again is only needed when it moves to this node
+	if applied && floatingIP.Status.NodeName == hostname {
+		return ctrl.Result{}, nil
+	}
+
+	logger.Info("Programming floating ip", "address", floatingIP.Spec.ExternalAddress, "vmi", floatingIP.Spec.VirtualMachineInstance)
+	if err := AddFloatingIP(ctx, r.Host, floatingIP); err != nil {
+		logger.Error(err, "Failed to add floating ip")
+		recorderEvents(r.Recorder, floatingIP).warning(ReasonFloatingIPFailed,
+			fmt.Sprintf("Failed to program floating ip on node %s: %v", hostname, err))
+		return ctrl.Result{}, err
+	}
+
+	if floatingIP.Status.NodeName != hostname {
+		floatingIP.Status.NodeName = hostname
+		if err := r.Status().Update(ctx, floatingIP); err != nil {
+			logger.Error(err, "Failed to update floating ip status")
+			return ctrl.Result{}, err
+		}
+		recorderEvents(r.Recorder, floatingIP).normal(ReasonFloatingIPProgrammed,
+			fmt.Sprintf("Floating ip %s programmed on node %s", floatingIP.Spec.ExternalAddress, hostname))
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func (r *FloatingIPReconciler) nodeExists(ctx context.Context, name string) (bool, error) {
+	err := r.Get(ctx, types.NamespacedName{Name: name}, &corev1.Node{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to find node %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// Returns the node which runs the virtual machine or empty string if it is not running
+func (r *FloatingIPReconciler) virtualMachineNode(ctx context.Context, fip *networkv1alpha1.FloatingIP) (string, error) {
+	vmi := &virtv1.VirtualMachineInstance{}
+
+	err := r.Get(ctx, types.NamespacedName{Namespace: fip.Namespace, Name: fip.Spec.VirtualMachineInstance}, vmi)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to find VM %s: %v", fip.Spec.VirtualMachineInstance, err)
+	}
+
+	// The target node takes over right after the migration has completed
+	if migrationSuccessful(*vmi) && vmi.Status.MigrationState.TargetNode != "" {
+		return vmi.Status.MigrationState.TargetNode, nil
+	}
+
+	return vmi.Status.NodeName, nil
+}
+
+// Enqueue floating ips which follow the virtual machine
+func (r *FloatingIPReconciler) floatingIPsForVirtualMachine(ctx context.Context, obj client.Object) []reconcile.Request {
+	floatingIPs := &networkv1alpha1.FloatingIPList{}
+	if err := r.List(ctx, floatingIPs, client.InNamespace(obj.GetNamespace())); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to get list of floating ips")
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, fip := range floatingIPs.Items {
+		if fip.Spec.VirtualMachineInstance == obj.GetName() {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: fip.Namespace, Name: fip.Name},
+			})
+		}
+	}
+
+	return requests
+}
+
+func filterFloatingIPVirtualMachineEvents(e event.UpdateEvent) bool {
+	// Both source and target nodes have to react on the migration
+	if _, ok := migrationCompleted(e); ok {
+		return true
+	}
+
+	newVirtualMachineInstanceObj, ok := e.ObjectNew.(*virtv1.VirtualMachineInstance)
+	if !ok {
+		return false
+	}
+
+	oldVirtualMachineInstanceObj, ok := e.ObjectOld.(*virtv1.VirtualMachineInstance)
+	if !ok {
+		return false
+	}
+
+	// the VM has been scheduled or moved to another node
+	return newVirtualMachineInstanceObj.Status.NodeName != oldVirtualMachineInstanceObj.Status.NodeName
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *FloatingIPReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// Kernel of the node, unless another host is injected, e.g. in tests
+	if r.Host == nil {
+		r.Host = host.New()
+	}
+
+	p := predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return filterFloatingIPVirtualMachineEvents(e)
+		},
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		// Status updates of the controller itself don't need another reconcile
+		For(&networkv1alpha1.FloatingIP{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(
+			&virtv1.VirtualMachineInstance{},
+			handler.EnqueueRequestsFromMapFunc(r.floatingIPsForVirtualMachine),
+			builder.WithPredicates(p),
+		).
+		Complete(instrument("floatingip", r))
+}
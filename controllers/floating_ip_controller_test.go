@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	virtv1 "kubevirt.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/host/fake"
+)
+
+// Reconciler of node1 with the eth1 uplink, kubevirt is left out of the scheme unless asked for
+func newFakeFloatingIPReconciler(t *testing.T, kubevirt bool, objs ...client.Object) (*FloatingIPReconciler, *fake.Host) {
+	t.Setenv(nodeName, "node1")
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := networkv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if kubevirt {
+		if err := virtv1.AddToScheme(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	node := fake.New()
+	node.Links.Add(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}})
+	node.NAT.EgressInterfaces["192.168.0.0/24"] = "eth1"
+
+	r := &FloatingIPReconciler{
+		Client:   fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).WithStatusSubresource(&networkv1alpha1.FloatingIP{}).Build(),
+		Scheme:   scheme,
+		Recorder: record.NewFakeRecorder(20),
+		Host:     node.Host(),
+	}
+
+	return r, node
+}
+
+func newFloatingIP() *networkv1alpha1.FloatingIP {
+	return &networkv1alpha1.FloatingIP{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm1-fip", Namespace: "default"},
+		Spec: networkv1alpha1.FloatingIPSpec{
+			ExternalAddress:        "192.168.0.100",
+			InternalAddress:        "10.10.0.2",
+			Bridge:                 "br10",
+			VirtualMachineInstance: "vm1",
+			EgressNetwork:          "192.168.0.0/24",
+		},
+	}
+}
+
+func newVirtualMachineInstance(node string) *virtv1.VirtualMachineInstance {
+	return &virtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm1", Namespace: "default"},
+		Status:     virtv1.VirtualMachineInstanceStatus{NodeName: node},
+	}
+}
+
+func TestFloatingIPReconcile(t *testing.T) {
+	vmi := newVirtualMachineInstance("node1")
+	r, node := newFakeFloatingIPReconciler(t, true, newFloatingIP(), vmi)
+
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "vm1-fip"}}
+
+	// The second reconcile, e.g. of the status update, finds the floating ip in place
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if fip, ok := node.NAT.FloatingIPs["default/vm1-fip"]; !ok || fip.External != "192.168.0.100" {
+		t.Errorf("floating ips = %v", node.NAT.FloatingIPs)
+	}
+	if len(node.ARP.Announcements) != 1 {
+		t.Errorf("announcements = %v, want a single one", node.ARP.Announcements)
+	}
+
+	fip := &networkv1alpha1.FloatingIP{}
+	if err := r.Get(ctx, req.NamespacedName, fip); err != nil {
+		t.Fatal(err)
+	}
+	if fip.Status.NodeName != "node1" {
+		t.Errorf("node = %q, want node1", fip.Status.NodeName)
+	}
+
+	// Removed address is programmed again
+	eth1, _ := node.Links.LinkByName("eth1")
+	if err := node.Links.AddrDel(eth1, &netlink.Addr{IPNet: hostRoute(net.ParseIP("192.168.0.100").To4())}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.ARP.Announcements) != 2 {
+		t.Errorf("announcements = %v, want another one after the repair", node.ARP.Announcements)
+	}
+
+	// Virtual machine has moved, the node cleans up after it
+	vmi.Status.NodeName = "node2"
+	if err := r.Update(ctx, vmi); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.NAT.FloatingIPs) != 0 {
+		t.Errorf("floating ips = %v, want none", node.NAT.FloatingIPs)
+	}
+	if applied, present, err := floatingIPState(r.Host, fip); err != nil || applied || present {
+		t.Errorf("floating ip state = %v, %v, %v, want nothing left", applied, present, err)
+	}
+}
+
+func TestFloatingIPReconcileDelete(t *testing.T) {
+	deleting := func() *networkv1alpha1.FloatingIP {
+		fip := newFloatingIP()
+		fip.Finalizers = []string{floatingIPFinalizer}
+		fip.DeletionTimestamp = &metav1.Time{Time: metav1.Now().Time}
+		fip.Status.NodeName = "node2"
+		return fip
+	}
+
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "vm1-fip"}}
+
+	// Node which programmed the floating ip releases it
+	node2 := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}}
+	r, _ := newFakeFloatingIPReconciler(t, false, deleting(), node2)
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, req.NamespacedName, &networkv1alpha1.FloatingIP{}); err != nil {
+		t.Errorf("expected the floating ip to wait for node2, got %v", err)
+	}
+
+	// It's gone, so any node does. Virtual machines can't be read, which doesn't matter either.
+	r, _ = newFakeFloatingIPReconciler(t, false, deleting())
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, req.NamespacedName, &networkv1alpha1.FloatingIP{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the floating ip to be released, got %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Logger of the reconcile, named after the controller so its verbosity could be changed.
+// It's passed down in the context, so logs of the host network carry the reconcile id.
+func reconcileLogger(ctx context.Context, controller string, keysAndValues ...interface{}) (context.Context, logr.Logger) {
+	logger := log.FromContext(ctx).WithName(controller).WithValues(keysAndValues...)
+	return log.IntoContext(ctx, logger), logger
+}
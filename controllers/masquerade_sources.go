@@ -0,0 +1,352 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+// Ignore source which doesn't exist, it's resolved into no networks
+var errSourceNotFound = errors.New("ignore source not found")
+
+// UncachedObjects are read from the API server instead of the cache. Otherwise every
+// agent would cache all ConfigMaps and Services of the cluster, while only a few of
+// them are referenced by ignore sources. They are watched by metadata only.
+func UncachedObjects() []client.Object {
+	return []client.Object{&corev1.ConfigMap{}, &corev1.Service{}, &discoveryv1.EndpointSlice{}}
+}
+
+// TrimNode keeps only what the agent needs from a node in the cache, its labels and pod cidrs
+func TrimNode(obj interface{}) (interface{}, error) {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		return obj, nil
+	}
+
+	return &corev1.Node{
+		TypeMeta: node.TypeMeta,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            node.Name,
+			UID:             node.UID,
+			ResourceVersion: node.ResourceVersion,
+			Labels:          node.Labels,
+		},
+		Spec: corev1.NodeSpec{
+			PodCIDR:  node.Spec.PodCIDR,
+			PodCIDRs: node.Spec.PodCIDRs,
+		},
+	}, nil
+}
+
+// Only IPv4 networks could be ignored, since masquerading is IPv4 only
+func appendIPv4(ctx context.Context, networks []string, values ...string) []string {
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(v); ip != nil {
+			if ip.To4() != nil {
+				networks = append(networks, ip.String()+"/32")
+			}
+			continue
+		}
+
+		ip, ipnet, err := net.ParseCIDR(v)
+		if err != nil {
+			log.FromContext(ctx).Info("Skipping invalid network in masquerade ignore source", "source", v)
+			continue
+		}
+
+		if ip.To4() != nil {
+			networks = append(networks, ipnet.String())
+		}
+	}
+
+	return networks
+}
+
+// Resolve the masquerade ignore list of the network attachment, static and dynamic one.
+// Sources which don't exist, e.g. a deleted ConfigMap, are empty and returned as unresolved.
+func (r *NetworkAttachmentReconciler) masqueradeIgnore(ctx context.Context, na *networkv1alpha1.NetworkAttachment) ([]string, []string, error) {
+	var unresolved []string
+
+	ignore := append([]string{}, na.Spec.IpMasq.Ignore...)
+
+	for _, source := range na.Spec.IpMasq.IgnoreFrom {
+		var (
+			networks []string
+			err      error
+		)
+
+		switch {
+		case source.NodePodCIDRs:
+			networks, err = r.nodePodCIDRs(ctx)
+		case source.ConfigMap != nil:
+			networks, err = r.configMapNetworks(ctx, na.Namespace, source.ConfigMap)
+		case source.Services != nil:
+			networks, err = r.serviceNetworks(ctx, source.Services)
+		case source.Networks != nil:
+			networks, err = r.networkSources(ctx, na, source.Networks)
+		}
+
+		if errors.Is(err, errSourceNotFound) {
+			log.FromContext(ctx).Info("Masquerade ignore source not found", "source", err.Error())
+			unresolved = append(unresolved, err.Error())
+			continue
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ignore = append(ignore, networks...)
+	}
+
+	return ignore, unresolved, nil
+}
+
+func (r *NetworkAttachmentReconciler) nodePodCIDRs(ctx context.Context) ([]string, error) {
+	var networks []string
+
+	nodes := &corev1.NodeList{}
+	if err := r.List(ctx, nodes); err != nil {
+		return nil, fmt.Errorf("failed to get list of nodes: %v", err)
+	}
+
+	for _, node := range nodes.Items {
+		if len(node.Spec.PodCIDRs) > 0 {
+			networks = appendIPv4(ctx, networks, node.Spec.PodCIDRs...)
+		} else {
+			networks = appendIPv4(ctx, networks, node.Spec.PodCIDR)
+		}
+	}
+
+	return networks, nil
+}
+
+func (r *NetworkAttachmentReconciler) configMapNetworks(ctx context.Context, namespace string, source *networkv1alpha1.ConfigMapIgnoreSource) ([]string, error) {
+	if source.Namespace != "" {
+		namespace = source.Namespace
+	}
+
+	configMap := &corev1.ConfigMap{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: source.Name}, configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: configmap %s/%s", errSourceNotFound, namespace, source.Name)
+		}
+		return nil, fmt.Errorf("failed to get configmap %s/%s: %v", namespace, source.Name, err)
+	}
+
+	values := strings.FieldsFunc(configMap.Data[source.Key], func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\n' || c == '\t'
+	})
+
+	return appendIPv4(ctx, nil, values...), nil
+}
+
+func (r *NetworkAttachmentReconciler) serviceNetworks(ctx context.Context, source *networkv1alpha1.ServiceIgnoreSource) ([]string, error) {
+	var networks []string
+
+	selector, err := metav1.LabelSelectorAsSelector(&source.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	services := &corev1.ServiceList{}
+	if err := r.List(ctx, services, client.InNamespace(source.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, fmt.Errorf("failed to get list of services: %v", err)
+	}
+
+	for _, svc := range services.Items {
+		networks = appendIPv4(ctx, networks, svc.Spec.ClusterIPs...)
+
+		slices := &discoveryv1.EndpointSliceList{}
+		if err := r.List(ctx, slices, client.InNamespace(svc.Namespace),
+			client.MatchingLabels{discoveryv1.LabelServiceName: svc.Name}); err != nil {
+			return nil, fmt.Errorf("failed to get list of endpointslices: %v", err)
+		}
+
+		for _, slice := range slices.Items {
+			if slice.AddressType != discoveryv1.AddressTypeIPv4 {
+				continue
+			}
+
+			for _, endpoint := range slice.Endpoints {
+				networks = appendIPv4(ctx, networks, endpoint.Addresses...)
+			}
+		}
+	}
+
+	return networks, nil
+}
+
+func (r *NetworkAttachmentReconciler) networkSources(ctx context.Context, na *networkv1alpha1.NetworkAttachment, labelSelector *metav1.LabelSelector) ([]string, error) {
+	var networks []string
+
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	networkList := &networkv1alpha1.NetworkList{}
+	if err := r.List(ctx, networkList, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, fmt.Errorf("failed to get list of networks: %v", err)
+	}
+
+	for _, n := range networkList.Items {
+		if metav1.IsControlledBy(na, &n) {
+			continue
+		}
+
+		if n.Spec.IpMasq.Enabled {
+			networks = appendIPv4(ctx, networks, n.Spec.IpMasq.Source)
+		}
+	}
+
+	return networks, nil
+}
+
+// Enqueue network attachments of this node with an ignore source which refers to the object
+func (r *NetworkAttachmentReconciler) attachmentsWithIgnoreSource(match func(context.Context, *networkv1alpha1.NetworkAttachment, *networkv1alpha1.IgnoreSource, client.Object) bool) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		var requests []reconcile.Request
+
+		hostname, err := getHostname()
+		if err != nil {
+			return nil
+		}
+
+		networkAttachments := &networkv1alpha1.NetworkAttachmentList{}
+		if err := r.List(ctx, networkAttachments); err != nil {
+			log.FromContext(ctx).Error(err, "Failed to get list of networkattachments")
+			return nil
+		}
+
+		for i := range networkAttachments.Items {
+			na := &networkAttachments.Items[i]
+			if na.Spec.NodeName != hostname || !na.Spec.IpMasq.Enabled {
+				continue
+			}
+
+			for j := range na.Spec.IpMasq.IgnoreFrom {
+				if !match(ctx, na, &na.Spec.IpMasq.IgnoreFrom[j], obj) {
+					continue
+				}
+
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Namespace: na.Namespace, Name: na.Name},
+				})
+				break
+			}
+		}
+
+		return requests
+	}
+}
+
+func matchNodeSource(_ context.Context, _ *networkv1alpha1.NetworkAttachment, source *networkv1alpha1.IgnoreSource, _ client.Object) bool {
+	return source.NodePodCIDRs
+}
+
+func matchConfigMapSource(_ context.Context, na *networkv1alpha1.NetworkAttachment, source *networkv1alpha1.IgnoreSource, obj client.Object) bool {
+	if source.ConfigMap == nil {
+		return false
+	}
+
+	namespace := source.ConfigMap.Namespace
+	if namespace == "" {
+		namespace = na.Namespace
+	}
+
+	return obj.GetNamespace() == namespace && obj.GetName() == source.ConfigMap.Name
+}
+
+func matchServiceSource(_ context.Context, _ *networkv1alpha1.NetworkAttachment, source *networkv1alpha1.IgnoreSource, obj client.Object) bool {
+	if source.Services == nil {
+		return false
+	}
+
+	if source.Services.Namespace != "" && source.Services.Namespace != obj.GetNamespace() {
+		return false
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(&source.Services.Selector)
+	if err != nil {
+		return false
+	}
+
+	return selector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// Endpoint slice refers to the selected service by its label
+func (r *NetworkAttachmentReconciler) matchEndpointSliceSource(ctx context.Context, na *networkv1alpha1.NetworkAttachment, source *networkv1alpha1.IgnoreSource, obj client.Object) bool {
+	name := obj.GetLabels()[discoveryv1.LabelServiceName]
+	if source.Services == nil || name == "" {
+		return false
+	}
+
+	// Labels are enough, they come from the metadata informer of the service watch
+	svc := &metav1.PartialObjectMetadata{}
+	svc.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Service"))
+	if err := r.metadataReader().Get(ctx, types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}, svc); err != nil {
+		return false
+	}
+
+	return matchServiceSource(ctx, na, source, svc)
+}
+
+// Cache of the manager serves metadata of the uncached objects, the client would read them
+// from the API server. Tests without a manager fall back to the client.
+func (r *NetworkAttachmentReconciler) metadataReader() client.Reader {
+	if r.metadata != nil {
+		return r.metadata
+	}
+	return r.Client
+}
+
+func matchNetworkSource(_ context.Context, na *networkv1alpha1.NetworkAttachment, source *networkv1alpha1.IgnoreSource, obj client.Object) bool {
+	if source.Networks == nil || metav1.IsControlledBy(na, obj) {
+		return false
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(source.Networks)
+	if err != nil {
+		return false
+	}
+
+	return selector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// Nodes are updated all the time, react only when pod cidrs change
+func filterNodePodCIDREvent(e event.UpdateEvent) bool {
+	newNode, ok := e.ObjectNew.(*corev1.Node)
+	if !ok {
+		return false
+	}
+
+	oldNode, ok := e.ObjectOld.(*corev1.Node)
+	if !ok {
+		return false
+	}
+
+	return newNode.Spec.PodCIDR != oldNode.Spec.PodCIDR ||
+		strings.Join(newNode.Spec.PodCIDRs, ",") != strings.Join(oldNode.Spec.PodCIDRs, ",")
+}
@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+func TestIgnoreSourceMatch(t *testing.T) {
+	r, _, req := newFakeAttachmentReconciler(t, networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10"}},
+		IpMasq: networkv1alpha1.Masquerade{
+			Enabled: true,
+			Bridge:  "br10",
+			Source:  "10.10.0.0/24",
+			IgnoreFrom: []networkv1alpha1.IgnoreSource{
+				{ConfigMap: &networkv1alpha1.ConfigMapIgnoreSource{Name: "ignore", Key: "networks"}},
+				{Services: &networkv1alpha1.ServiceIgnoreSource{Selector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "dns"}}}},
+			},
+		},
+	})
+	ctx := context.Background()
+
+	// Attachment of another node is never enqueued
+	other := &networkv1alpha1.NetworkAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "node2-vm-network", Namespace: "default"},
+		Spec: networkv1alpha1.NetworkAttachmentSpec{
+			NodeName: "node2",
+			IpMasq: networkv1alpha1.Masquerade{
+				Enabled:    true,
+				IgnoreFrom: []networkv1alpha1.IgnoreSource{{ConfigMap: &networkv1alpha1.ConfigMapIgnoreSource{Name: "ignore", Key: "networks"}}},
+			},
+		},
+	}
+	if err := r.Create(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+
+	configMap := func(namespace, name string) client.Object {
+		return &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	}
+	service := func(namespace string, labels map[string]string) client.Object {
+		return &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "svc", Labels: labels}}
+	}
+
+	if err := r.Create(ctx, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "dns", Labels: map[string]string{"app": "dns"}}}); err != nil {
+		t.Fatal(err)
+	}
+	endpointSlice := func(service string) client.Object {
+		return &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: service + "-abcde",
+			Labels: map[string]string{discoveryv1.LabelServiceName: service}}}
+	}
+
+	attachment := []reconcile.Request{{NamespacedName: req.NamespacedName}}
+
+	tests := []struct {
+		name  string
+		match func(context.Context, *networkv1alpha1.NetworkAttachment, *networkv1alpha1.IgnoreSource, client.Object) bool
+		obj   client.Object
+		want  []reconcile.Request
+	}{
+		{"referenced configmap", matchConfigMapSource, configMap("default", "ignore"), attachment},
+		{"configmap of another namespace", matchConfigMapSource, configMap("kube-system", "ignore"), nil},
+		{"another configmap", matchConfigMapSource, configMap("default", "settings"), nil},
+		{"selected service", matchServiceSource, service("kube-system", map[string]string{"app": "dns"}), attachment},
+		{"another service", matchServiceSource, service("kube-system", map[string]string{"app": "web"}), nil},
+		{"endpointslice of the selected service", r.matchEndpointSliceSource, endpointSlice("dns"), attachment},
+		{"endpointslice of a missing service", r.matchEndpointSliceSource, endpointSlice("web"), nil},
+		{"node", matchNodeSource, &corev1.Node{}, nil},
+	}
+
+	for _, tt := range tests {
+		got := r.attachmentsWithIgnoreSource(tt.match)(ctx, tt.obj)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: enqueued %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMissingIgnoreSource(t *testing.T) {
+	r, _, req := newFakeAttachmentReconciler(t, networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10"}},
+		IpMasq: networkv1alpha1.Masquerade{
+			Enabled:    true,
+			Bridge:     "br10",
+			Source:     "10.10.0.0/24",
+			Ignore:     []string{"10.20.0.0/16"},
+			IgnoreFrom: []networkv1alpha1.IgnoreSource{{ConfigMap: &networkv1alpha1.ConfigMapIgnoreSource{Name: "ignore", Key: "networks"}}},
+		},
+	})
+	ctx := context.Background()
+
+	// Missing configmap doesn't take the network down
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if cond := readyCondition(t, r.Client, req); cond == nil || cond.Status != metav1.ConditionTrue {
+		t.Errorf("ready condition = %+v", cond)
+	}
+
+	cond := ignoreSourcesCondition(t, r.Client, req)
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != networkv1alpha1.NetworkAttachmentReasonSourceNotFound {
+		t.Errorf("ignore sources condition = %+v, want not found", cond)
+	}
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ignore"},
+		Data:       map[string]string{"networks": "10.30.0.0/16"},
+	}
+	if err := r.Create(ctx, configMap); err != nil {
+		t.Fatal(err)
+	}
+
+	na := &networkv1alpha1.NetworkAttachment{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: req.Name}, na); err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := r.EffectiveSpec(ctx, na)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.20.0.0/16", "10.30.0.0/16"}; !reflect.DeepEqual(spec.IpMasq.Ignore, want) {
+		t.Errorf("ignore = %q, want %q", spec.IpMasq.Ignore, want)
+	}
+}
+
+func ignoreSourcesCondition(t *testing.T, c client.Client, req reconcile.Request) *metav1.Condition {
+	na := &networkv1alpha1.NetworkAttachment{}
+	if err := c.Get(context.Background(), req.NamespacedName, na); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range na.Status.Conditions {
+		if na.Status.Conditions[i].Type == networkv1alpha1.NetworkAttachmentConditionIgnoreSourcesResolved {
+			return &na.Status.Conditions[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+)
+
+// Sources of the gratuitous arp requests
+const (
+	GarpSourceMasquerade     = "masquerade"
+	GarpSourceVirtualMachine = "virtual_machine"
+)
+
+var (
+	driftChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tabby_drift_checks_total",
+		Help: "Number of host network drift checks of the network attachment.",
+	}, []string{"namespace", "networkattachment"})
+
+	driftRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tabby_drift_repairs_total",
+		Help: "Number of repaired host network drifts of the network attachment by kind.",
+	}, []string{"namespace", "networkattachment", "kind"})
+
+	reconciles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tabby_reconcile_total",
+		Help: "Number of reconciles by controller, result and kind of the error.",
+	}, []string{"controller", "result", "error_kind"})
+
+	applyDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tabby_apply_duration_seconds",
+		Help:    "Time it takes to program the network attachment on the node.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"result"})
+
+	managedBridges = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tabby_managed_bridges",
+		Help: "Number of bridges managed on the node for the network.",
+	}, []string{"namespace", "network"})
+
+	managedPorts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tabby_managed_ports",
+		Help: "Number of vlan ports managed on the node for the network.",
+	}, []string{"namespace", "network"})
+
+	managedRoutes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tabby_managed_routes",
+		Help: "Number of static routes managed on the node for the network.",
+	}, []string{"namespace", "network"})
+
+	managedRules = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tabby_managed_rules",
+		Help: "Number of nat and ebtables rules on the node for the network.",
+	}, []string{"namespace", "network", "table"})
+
+	garps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tabby_garp_total",
+		Help: "Number of gateway announcements, gratuitous arp or unsolicited neighbor advertisement, by source and result.",
+	}, []string{"source", "result"})
+
+	attachmentReady = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tabby_network_attachment_ready",
+		Help: "Whether the network attachment is programmed on the node, 0 if the last apply failed.",
+	}, []string{"namespace", "networkattachment", "network"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		driftChecks, driftRepairs, reconciles, applyDuration,
+		managedBridges, managedPorts, managedRoutes, managedRules,
+		garps, attachmentReady,
+	)
+}
+
+func metricResult(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// Kind of the reconcile error, errors of the host network are not typed, so they are "other"
+func errorKind(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.IsConflict(err):
+		return "conflict"
+	case errors.IsNotFound(err):
+		return "not_found"
+	case errors.IsTimeout(err) || errors.IsServerTimeout(err):
+		return "timeout"
+	case errors.ReasonForError(err) != metav1.StatusReasonUnknown:
+		return "api"
+	default:
+		return "other"
+	}
+}
+
+// Reconciler which counts the reconcile outcomes of the controller
+type instrumentedReconciler struct {
+	reconcile.Reconciler
+	controller string
+}
+
+func instrument(controller string, r reconcile.Reconciler) reconcile.Reconciler {
+	return &instrumentedReconciler{Reconciler: r, controller: controller}
+}
+
+func (r *instrumentedReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	result, err := r.Reconciler.Reconcile(ctx, req)
+	reconciles.WithLabelValues(r.controller, metricResult(err), errorKind(err)).Inc()
+
+	return result, err
+}
+
+func observeApply(start time.Time, err error) {
+	applyDuration.WithLabelValues(metricResult(err)).Observe(time.Since(start).Seconds())
+}
+
+func observeGarp(source string, err error) {
+	garps.WithLabelValues(source, metricResult(err)).Inc()
+}
+
+// Name of the Network which owns the network attachment
+func attachmentNetwork(na *networkv1alpha1.NetworkAttachment) string {
+	if owner := metav1.GetControllerOf(na); owner != nil {
+		return owner.Name
+	}
+	return na.Name
+}
+
+func setAttachmentReady(na *networkv1alpha1.NetworkAttachment, ready bool) {
+	value := 0.0
+	if ready {
+		value = 1
+	}
+
+	attachmentReady.WithLabelValues(na.Namespace, na.Name, attachmentNetwork(na)).Set(value)
+}
+
+// Count the objects of the applied spec on the node. Rules are listed from the
+// kernel, since the number of them depends on the port forwards and the gateway mode.
+func setManagedObjects(ctx context.Context, h *host.Host, na *networkv1alpha1.NetworkAttachment, spec *networkv1alpha1.NetworkAttachmentSpec) {
+	network := attachmentNetwork(na)
+
+	ports := 0
+	for _, br := range spec.Bridge {
+		ports += len(br.Ports)
+	}
+
+	managedBridges.WithLabelValues(na.Namespace, network).Set(float64(len(spec.Bridge)))
+	managedPorts.WithLabelValues(na.Namespace, network).Set(float64(ports))
+	managedRoutes.WithLabelValues(na.Namespace, network).Set(float64(len(spec.Routes)))
+
+	natRules := 0
+	if name := NatBridge(spec); name != "" {
+		rules, err := h.NAT.ListRules(name)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "Failed to count nat rules")
+			return
+		}
+
+		for _, rule := range rules {
+			if strings.HasPrefix(rule, "-A ") {
+				natRules++
+			}
+		}
+	}
+
+	ebRules := 0
+	if spec.IpMasq.Enabled {
+		rules, err := h.Filter.ListRules(spec.IpMasq.Bridge)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "Failed to count ebtables rules")
+			return
+		}
+		ebRules = len(rules)
+	}
+
+	managedRules.WithLabelValues(na.Namespace, network, "nat").Set(float64(natRules))
+	managedRules.WithLabelValues(na.Namespace, network, "ebtables").Set(float64(ebRules))
+}
+
+// Forget the metrics of the deleted network attachment
+func deleteAttachmentMetrics(na *networkv1alpha1.NetworkAttachment) {
+	network := attachmentNetwork(na)
+	labels := prometheus.Labels{"namespace": na.Namespace, "network": network}
+
+	managedBridges.Delete(labels)
+	managedPorts.Delete(labels)
+	managedRoutes.Delete(labels)
+	managedRules.DeletePartialMatch(labels)
+	attachmentReady.DeleteLabelValues(na.Namespace, na.Name, network)
+	driftChecks.DeleteLabelValues(na.Namespace, na.Name)
+	driftRepairs.DeletePartialMatch(prometheus.Labels{"namespace": na.Namespace, "networkattachment": na.Name})
+}
@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestErrorKind(t *testing.T) {
+	resource := schema.GroupResource{Group: "cloud.spaceship.com", Resource: "networkattachments"}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"success", nil, ""},
+		{"conflict", errors.NewConflict(resource, "node1-vm-network", fmt.Errorf("modified")), "conflict"},
+		{"not found", errors.NewNotFound(resource, "node1-vm-network"), "not_found"},
+		{"timeout", errors.NewTimeoutError("update", 1), "timeout"},
+		{"forbidden", errors.NewForbidden(resource, "node1-vm-network", fmt.Errorf("denied")), "api"},
+		{"host", fmt.Errorf("failed to create bridge br10: file exists"), "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorKind(tt.err); got != tt.want {
+				t.Errorf("errorKind() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstrumentedReconciler(t *testing.T) {
+	var err error
+	r := instrument("test", reconcile.Func(func(context.Context, ctrl.Request) (ctrl.Result, error) {
+		return ctrl.Result{}, err
+	}))
+
+	r.Reconcile(context.Background(), ctrl.Request{})
+	err = errors.NewNotFound(schema.GroupResource{Resource: "networks"}, "vm-network")
+	r.Reconcile(context.Background(), ctrl.Request{})
+	r.Reconcile(context.Background(), ctrl.Request{})
+
+	if got := testutil.ToFloat64(reconciles.WithLabelValues("test", "success", "")); got != 1 {
+		t.Errorf("successful reconciles = %v, want 1", got)
+	}
+
+	if got := testutil.ToFloat64(reconciles.WithLabelValues("test", "failure", "not_found")); got != 2 {
+		t.Errorf("failed reconciles = %v, want 2", got)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+// Annotation of handwritten NetworkAttachmentDefinitions pointing to the network, <namespace>/<name> or <name>
+const NetworkAnnotation = "cloud.spaceship.com/network"
+
+// Bridge and plugins of the NetworkAttachmentDefinition CNI config, either a single plugin or a plugin list
+type multusCNIConfig struct {
+	Bridge  string            `json:"bridge,omitempty"`
+	Plugins []multusCNIConfig `json:"plugins,omitempty"`
+}
+
+func (c *multusCNIConfig) bridges() []string {
+	var bridges []string
+	if c.Bridge != "" {
+		bridges = append(bridges, c.Bridge)
+	}
+	for i := range c.Plugins {
+		bridges = append(bridges, c.Plugins[i].bridges()...)
+	}
+	return bridges
+}
+
+// ResolveNetwork resolves the Multus network name of a virtual machine to the Tabby network. The network is found
+// by the labels of the generated NetworkAttachmentDefinition, the annotation or the bridge of its CNI config.
+// Without a NetworkAttachmentDefinition the network is expected to have the same name.
+func ResolveNetwork(ctx context.Context, c client.Client, namespace string, networkName string) (*networkv1alpha1.Network, error) {
+	key := getNamespacedNetworkName(networkName, namespace)
+
+	nad := newNetworkAttachmentDefinition()
+	err := c.Get(ctx, key, nad)
+	if errors.IsNotFound(err) || meta.IsNoMatchError(err) {
+		return getNetwork(ctx, c, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find NetworkAttachmentDefinition %s: %v", key, err)
+	}
+
+	if labels := nad.GetLabels(); labels[NetworkLabel] != "" {
+		// Definitions labeled by hand could leave out the namespace of the network
+		namespace := labels[NetworkNamespaceLabel]
+		if namespace == "" {
+			namespace = nad.GetNamespace()
+		}
+		return getNetwork(ctx, c, types.NamespacedName{Namespace: namespace, Name: labels[NetworkLabel]})
+	}
+
+	if name := nad.GetAnnotations()[NetworkAnnotation]; name != "" {
+		return getNetwork(ctx, c, getNamespacedNetworkName(name, nad.GetNamespace()))
+	}
+
+	network, err := networkByBridge(ctx, c, nad)
+	if err != nil {
+		return nil, err
+	}
+	if network != nil {
+		return network, nil
+	}
+
+	return getNetwork(ctx, c, key)
+}
+
+func getNetwork(ctx context.Context, c client.Client, key types.NamespacedName) (*networkv1alpha1.Network, error) {
+	network := &networkv1alpha1.Network{}
+	if err := c.Get(ctx, key, network); err != nil {
+		return nil, fmt.Errorf("failed to find Network %s: %v", key, err)
+	}
+	return network, nil
+}
+
+// Find the network with the bridge of the NetworkAttachmentDefinition, networks
+// in the namespace of the definition are preferred
+func networkByBridge(ctx context.Context, c client.Client, nad *unstructured.Unstructured) (*networkv1alpha1.Network, error) {
+	bridges, err := definitionBridges(nad)
+	if err != nil || len(bridges) == 0 {
+		return nil, err
+	}
+
+	networks := &networkv1alpha1.NetworkList{}
+	if err := c.List(ctx, networks); err != nil {
+		return nil, fmt.Errorf("failed to get list of networks: %v", err)
+	}
+
+	var found *networkv1alpha1.Network
+	for i := range networks.Items {
+		network := &networks.Items[i]
+		if !hasBridge(network, bridges) {
+			continue
+		}
+
+		if network.Namespace == nad.GetNamespace() {
+			return network, nil
+		}
+
+		if found == nil {
+			found = network
+		}
+	}
+
+	return found, nil
+}
+
+// Bridges of the NetworkAttachmentDefinition CNI config
+func definitionBridges(nad *unstructured.Unstructured) ([]string, error) {
+	data, _, _ := unstructured.NestedString(nad.Object, "spec", "config")
+	if data == "" {
+		return nil, nil
+	}
+
+	config := &multusCNIConfig{}
+	if err := json.Unmarshal([]byte(data), config); err != nil {
+		return nil, fmt.Errorf("failed to parse config of NetworkAttachmentDefinition %s/%s: %v", nad.GetNamespace(), nad.GetName(), err)
+	}
+
+	return config.bridges(), nil
+}
+
+// ResolveBridge returns the bridge virtual machines of the Multus network are connected to,
+// the bridge of the NetworkAttachmentDefinition CNI config or the default bridge of the network.
+func ResolveBridge(ctx context.Context, c client.Client, namespace string, networkName string, network *networkv1alpha1.Network) (string, error) {
+	nad := newNetworkAttachmentDefinition()
+	err := c.Get(ctx, getNamespacedNetworkName(networkName, namespace), nad)
+	if err != nil && !errors.IsNotFound(err) && !meta.IsNoMatchError(err) {
+		return "", fmt.Errorf("failed to find NetworkAttachmentDefinition %s: %v", networkName, err)
+	}
+
+	if err == nil {
+		bridges, err := definitionBridges(nad)
+		if err != nil {
+			return "", err
+		}
+
+		if len(bridges) > 0 {
+			return bridges[0], nil
+		}
+	}
+
+	return defaultBridge(network), nil
+}
+
+// Bridge of the virtual machines, the masquerade bridge or the first bridge of the network
+func defaultBridge(network *networkv1alpha1.Network) string {
+	if network.Spec.IpMasq.Bridge != "" {
+		return network.Spec.IpMasq.Bridge
+	}
+
+	if len(network.Spec.Bridge) > 0 {
+		return network.Spec.Bridge[0].Name
+	}
+
+	return ""
+}
+
+func hasBridge(network *networkv1alpha1.Network, bridges []string) bool {
+	for _, br := range network.Spec.Bridge {
+		for _, name := range bridges {
+			if br.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Given a network name of the KubeVirt VM object,
+// construct a namespaced name that can be used in API requests.
+// The namespace of the VM is used if the network name has none.
+func getNamespacedNetworkName(networkName string, namespace string) types.NamespacedName {
+	namespacedNetworkName := types.NamespacedName{Namespace: namespace}
+
+	networkNameParts := strings.SplitN(networkName, "/", 2)
+	// this means the network is provided with the namespace
+	// default/network-name
+	if len(networkNameParts) == 2 {
+		namespacedNetworkName.Namespace = networkNameParts[0]
+		namespacedNetworkName.Name = networkNameParts[1]
+	} else {
+		namespacedNetworkName.Name = networkNameParts[0]
+	}
+
+	return namespacedNetworkName
+}
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+func newNetwork(namespace, name string, bridges ...string) *networkv1alpha1.Network {
+	network := &networkv1alpha1.Network{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	for _, br := range bridges {
+		network.Spec.Bridge = append(network.Spec.Bridge, networkv1alpha1.Bridge{Name: br})
+	}
+	return network
+}
+
+func newDefinition(namespace, name string, labels, annotations map[string]string, config string) *unstructured.Unstructured {
+	nad := newNetworkAttachmentDefinition()
+	nad.SetNamespace(namespace)
+	nad.SetName(name)
+	nad.SetLabels(labels)
+	nad.SetAnnotations(annotations)
+	if config != "" {
+		nad.Object["spec"] = map[string]interface{}{"config": config}
+	}
+	return nad
+}
+
+func TestResolveNetwork(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := networkv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	scheme.AddKnownTypeWithName(networkAttachmentDefinitionGVK, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(networkAttachmentDefinitionGVK.GroupVersion().WithKind("NetworkAttachmentDefinitionList"), &unstructured.UnstructuredList{})
+
+	networks := []client.Object{
+		newNetwork("default", "vm-network", "br10"),
+		newNetwork("infra", "shared", "br20"),
+		newNetwork("infra", "bridged", "br30"),
+		newNetwork("tenant", "bridged", "br30"),
+		newNetwork("tenant", "plain"),
+	}
+
+	tests := []struct {
+		name       string
+		definition *unstructured.Unstructured
+		namespace  string
+		network    string
+		want       string
+	}{
+		{
+			name:       "generated definition",
+			definition: newDefinition("tenant", "vm-net", map[string]string{NetworkLabel: "shared", NetworkNamespaceLabel: "infra"}, nil, ""),
+			namespace:  "tenant",
+			network:    "vm-net",
+			want:       "infra/shared",
+		},
+		{
+			name:       "label without the namespace",
+			definition: newDefinition("tenant", "vm-net", map[string]string{NetworkLabel: "plain"}, nil, ""),
+			namespace:  "tenant",
+			network:    "vm-net",
+			want:       "tenant/plain",
+		},
+		{
+			name:       "annotation with the namespace",
+			definition: newDefinition("tenant", "vm-net", nil, map[string]string{NetworkAnnotation: "infra/shared"}, ""),
+			namespace:  "tenant",
+			network:    "vm-net",
+			want:       "infra/shared",
+		},
+		{
+			name:       "annotation in the namespace of the definition",
+			definition: newDefinition("tenant", "vm-net", nil, map[string]string{NetworkAnnotation: "plain"}, ""),
+			namespace:  "default",
+			network:    "tenant/vm-net",
+			want:       "tenant/plain",
+		},
+		{
+			name:       "bridge of the config",
+			definition: newDefinition("default", "vm-net", nil, nil, `{"cniVersion":"0.3.1","type":"tabby","bridge":"br20"}`),
+			namespace:  "default",
+			network:    "vm-net",
+			want:       "infra/shared",
+		},
+		{
+			name:       "bridge of a plugin list prefers the namespace of the definition",
+			definition: newDefinition("tenant", "vm-net", nil, nil, `{"cniVersion":"0.3.1","plugins":[{"type":"tabby","bridge":"br30"},{"type":"tuning"}]}`),
+			namespace:  "tenant",
+			network:    "vm-net",
+			want:       "tenant/bridged",
+		},
+		{
+			name:       "unknown bridge falls back to the name",
+			definition: newDefinition("default", "vm-network", nil, nil, `{"cniVersion":"0.3.1","type":"tabby","bridge":"br99"}`),
+			namespace:  "default",
+			network:    "vm-network",
+			want:       "default/vm-network",
+		},
+		{
+			name:      "no definition in the namespace of the virtual machine",
+			namespace: "default",
+			network:   "vm-network",
+			want:      "default/vm-network",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs := append([]client.Object{}, networks...)
+			if tt.definition != nil {
+				objs = append(objs, tt.definition)
+			}
+			c := fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+
+			network, err := ResolveNetwork(context.Background(), c, tt.namespace, tt.network)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := network.Namespace + "/" + network.Name; got != tt.want {
+				t.Errorf("ResolveNetwork() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// Network of the same name is required without a definition
+	c := fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(networks...).Build()
+	if _, err := ResolveNetwork(context.Background(), c, "default", "missing"); err == nil {
+		t.Error("expected missing network to be an error")
+	}
+}
@@ -0,0 +1,265 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
+)
+
+// Netlink subscriptions are renewed after a failure
+const netlinkResubscribeDelay = 5 * time.Second
+
+// State of the link which matters for the network, changes of it are repaired
+type linkState struct {
+	up     bool
+	oper   netlink.LinkOperState
+	master int
+	mtu    int
+}
+
+func newLinkState(link netlink.Link) linkState {
+	attrs := link.Attrs()
+
+	return linkState{
+		up:     attrs.Flags&net.FlagUp != 0,
+		oper:   attrs.OperState,
+		master: attrs.MasterIndex,
+		mtu:    attrs.MTU,
+	}
+}
+
+// Report whether the link update changed the state of the link. Updates which
+// change nothing, e.g. caused by applying the network again, are ignored.
+func linkChanged(states map[int]linkState, u netlink.LinkUpdate) bool {
+	index := u.Link.Attrs().Index
+
+	if u.Header.Type == unix.RTM_DELLINK {
+		delete(states, index)
+		return true
+	}
+
+	state := newLinkState(u.Link)
+	prev, ok := states[index]
+	states[index] = state
+
+	return !ok || prev != state
+}
+
+// Interfaces of the spec, including the parents of vlan ports, e.g. bond0 of bond0.10
+func managesInterface(spec *networkv1alpha1.NetworkAttachmentSpec, name string) bool {
+	for _, br := range spec.Bridge {
+		if br.Name == name {
+			return true
+		}
+
+		for _, port := range br.Ports {
+			if port.Name == name || portName(port) == name {
+				return true
+			}
+		}
+	}
+
+	for _, r := range spec.Routes {
+		if r.Via == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func managesRoute(spec *networkv1alpha1.NetworkAttachmentSpec, route netlink.Route) bool {
+	for _, r := range spec.Routes {
+		_, dst, err := net.ParseCIDR(r.Destination)
+		if err != nil {
+			continue
+		}
+
+		if EqualCIDR(dst, route.Dst) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Enqueue network attachments of the node which match
+func (r *NetworkAttachmentReconciler) enqueueAttachments(ctx context.Context, reason string, match func(*networkv1alpha1.NetworkAttachmentSpec) bool) {
+	log := logging.FromContext(ctx, logging.Netlink)
+
+	hostname, err := getHostname()
+	if err != nil {
+		log.Error(err, "Failed to get node hostname")
+		return
+	}
+
+	attachments := &networkv1alpha1.NetworkAttachmentList{}
+	if err := r.List(ctx, attachments); err != nil {
+		log.Error(err, "Failed to get list of networkattachments")
+		return
+	}
+
+	for i := range attachments.Items {
+		na := &attachments.Items[i]
+		if na.Spec.NodeName != hostname || !match(&na.Spec) {
+			continue
+		}
+
+		log.Info("Reconcile networkattachment since the host network changed", logging.KeyAttachment, client.ObjectKeyFromObject(na).String(), "reason", reason)
+
+		// Applied again even without drift, e.g. to announce the gateway once the link is back
+		r.setAppliedFingerprint(client.ObjectKeyFromObject(na), "")
+
+		select {
+		case r.netlinkEvents <- event.GenericEvent{Object: na.DeepCopy()}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *NetworkAttachmentReconciler) linkName(index int) string {
+	link, err := r.Host.Links.LinkByIndex(index)
+	if err != nil {
+		return ""
+	}
+	return link.Attrs().Name
+}
+
+// Subscribe to netlink updates of the host until the context is done or the subscription fails
+func (r *NetworkAttachmentReconciler) subscribeNetlink(ctx context.Context) error {
+	links := make(chan netlink.LinkUpdate)
+	addrs := make(chan netlink.AddrUpdate)
+	routes := make(chan netlink.RouteUpdate)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	failed := make(chan error, 3)
+	errorCallback := func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	}
+
+	// Links known before the subscription, so only the changes of them are reported
+	states := map[int]linkState{}
+	existing, err := r.Host.Links.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to get list of links: %v", err)
+	}
+	for _, link := range existing {
+		states[link.Attrs().Index] = newLinkState(link)
+	}
+
+	if err := r.Host.Links.LinkSubscribe(links, done, errorCallback); err != nil {
+		return fmt.Errorf("failed to subscribe to link updates: %v", err)
+	}
+
+	if err := r.Host.Links.AddrSubscribe(addrs, done, errorCallback); err != nil {
+		return fmt.Errorf("failed to subscribe to address updates: %v", err)
+	}
+
+	if err := r.Host.Routes.RouteSubscribe(routes, done, errorCallback); err != nil {
+		return fmt.Errorf("failed to subscribe to route updates: %v", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err := <-failed:
+			return err
+
+		case u, ok := <-links:
+			if !ok {
+				return fmt.Errorf("link updates subscription is closed")
+			}
+
+			if !linkChanged(states, u) {
+				continue
+			}
+
+			name := u.Link.Attrs().Name
+			r.enqueueAttachments(ctx, fmt.Sprintf("link %s changed", name), func(spec *networkv1alpha1.NetworkAttachmentSpec) bool {
+				return managesInterface(spec, name)
+			})
+
+		case u, ok := <-addrs:
+			if !ok {
+				return fmt.Errorf("address updates subscription is closed")
+			}
+
+			// Addresses are configured by the agent, so only removed ones are interesting
+			if u.NewAddr {
+				continue
+			}
+
+			name := r.linkName(u.LinkIndex)
+			r.enqueueAttachments(ctx, fmt.Sprintf("address %s of %s was removed", u.LinkAddress.String(), name), func(spec *networkv1alpha1.NetworkAttachmentSpec) bool {
+				return name != "" && managesInterface(spec, name)
+			})
+
+		case u, ok := <-routes:
+			if !ok {
+				return fmt.Errorf("route updates subscription is closed")
+			}
+
+			if u.Type != unix.RTM_DELROUTE {
+				continue
+			}
+
+			r.enqueueAttachments(ctx, fmt.Sprintf("route to %s was removed", u.Route.Dst), func(spec *networkv1alpha1.NetworkAttachmentSpec) bool {
+				return managesRoute(spec, u.Route)
+			})
+		}
+	}
+}
+
+// Runnable of the agent which runs on every node. The manager starts runnables which don't
+// opt out of the leader election only on the leader, like the reconcilers do in main.go.
+type nodeRunnable func(context.Context) error
+
+func (f nodeRunnable) Start(ctx context.Context) error {
+	return f(ctx)
+}
+
+func (nodeRunnable) NeedLeaderElection() bool {
+	return false
+}
+
+func (r *NetworkAttachmentReconciler) netlinkWatcher() manager.Runnable {
+	return nodeRunnable(r.watchNetlink)
+}
+
+// Watch netlink for changes of the links, addresses and routes managed by network
+// attachments of the node, and reconcile the owning attachments right away. It repairs
+// the network faster than the resync, and announces the gateway again once a link is back.
+func (r *NetworkAttachmentReconciler) watchNetlink(ctx context.Context) error {
+	for {
+		err := r.subscribeNetlink(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		logging.FromContext(ctx, logging.Netlink).Error(err, "Netlink subscription failed, subscribing again")
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(netlinkResubscribeDelay):
+		}
+	}
+}
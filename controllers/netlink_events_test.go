@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+func linkUpdate(msgType uint16, index int, flags net.Flags, master int) netlink.LinkUpdate {
+	u := netlink.LinkUpdate{Link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: index, Flags: flags, MasterIndex: master, MTU: 1500}}}
+	u.Header.Type = msgType
+	return u
+}
+
+func TestLinkChanged(t *testing.T) {
+	states := map[int]linkState{}
+
+	tests := []struct {
+		name   string
+		update netlink.LinkUpdate
+		want   bool
+	}{
+		{"new link", linkUpdate(unix.RTM_NEWLINK, 5, net.FlagUp, 3), true},
+		{"same state", linkUpdate(unix.RTM_NEWLINK, 5, net.FlagUp, 3), false},
+		{"link down", linkUpdate(unix.RTM_NEWLINK, 5, 0, 3), true},
+		{"link up", linkUpdate(unix.RTM_NEWLINK, 5, net.FlagUp, 3), true},
+		{"removed from bridge", linkUpdate(unix.RTM_NEWLINK, 5, net.FlagUp, 0), true},
+		{"deleted", linkUpdate(unix.RTM_DELLINK, 5, net.FlagUp, 0), true},
+	}
+
+	for _, tt := range tests {
+		if got := linkChanged(states, tt.update); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestManagesInterface(t *testing.T) {
+	spec := &networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10", Ports: []networkv1alpha1.Port{{Name: "bond0", Vlan: 10}}}},
+		Routes: []networkv1alpha1.Route{{Via: "eth2", Destination: "10.0.0.0/8"}},
+	}
+
+	for name, want := range map[string]bool{"br10": true, "bond0": true, "bond0.10": true, "eth2": true, "bond0.11": false, "eth0": false} {
+		if got := managesInterface(spec, name); got != want {
+			t.Errorf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+
+	_, dst, _ := net.ParseCIDR("10.0.0.0/8")
+	if !managesRoute(spec, netlink.Route{Dst: dst}) {
+		t.Errorf("expected route to %s to be managed", dst)
+	}
+}
+
+func TestNetlinkEventReconcile(t *testing.T) {
+	r, node, req := newFakeAttachmentReconciler(t, networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10", Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 10}}}},
+		IpMasq: networkv1alpha1.Masquerade{Enabled: true, Bridge: "br10", Source: "10.10.0.0/24"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same wiring as SetupWithManager, the queue stands for the controller
+	r.netlinkEvents = make(chan event.GenericEvent)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+
+	if err := source.Channel(r.netlinkEvents, &handler.EnqueueRequestForObject{}).Start(ctx, queue); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = r.subscribeNetlink(ctx)
+	}()
+
+	port, err := node.Links.LinkByName("eth1.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Uplink flapped, the update is sent until the subscription is there
+	down := linkUpdate(unix.RTM_NEWLINK, port.Attrs().Index, 0, port.Attrs().MasterIndex)
+	down.Link.Attrs().Name = "eth1.10"
+
+	deadline := time.Now().Add(5 * time.Second)
+	for queue.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("link update was not enqueued")
+		}
+		node.Links.NotifyLink(down)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	item, _ := queue.Get()
+	if item.(reconcile.Request) != req {
+		t.Fatalf("enqueued %v, want %v", item, req)
+	}
+
+	if _, err := r.Reconcile(ctx, item.(reconcile.Request)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Applied again without drift, so the gateway is announced once the link is back
+	if len(node.ARP.Announcements) != 2 {
+		t.Errorf("announcements = %+v, want the gateway announced again", node.ARP.Announcements)
+	}
+}
+
+func TestNetlinkWatcherRunsOnEveryNode(t *testing.T) {
+	r := &NetworkAttachmentReconciler{}
+
+	runnable, ok := r.netlinkWatcher().(manager.LeaderElectionRunnable)
+	if !ok || runnable.NeedLeaderElection() {
+		t.Error("netlink watcher must not wait for the leader election")
+	}
+}
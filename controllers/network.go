@@ -8,10 +8,10 @@ import (
 	"net"
 
 	"github.com/vishvananda/netlink"
-	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
-	"github.com/NCCloud/tabby-cni/pkg/bridge"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
 )
 
 func EqualCIDR(a, b *net.IPNet) bool {
@@ -30,7 +30,7 @@ func EqualCIDR(a, b *net.IPNet) bool {
 	return true
 }
 
-func addRoute(r networkv1alpha1.Route) error {
+func addRoute(h *host.Host, r networkv1alpha1.Route) error {
 	var src_ip net.IP
 	var route netlink.Route
 
@@ -42,7 +42,7 @@ func addRoute(r networkv1alpha1.Route) error {
 	gw := net.ParseIP(r.Via)
 	// check if via ip address or device
 	if gw == nil {
-		iface, err := netlink.LinkByName(r.Via)
+		iface, err := h.Links.LinkByName(r.Via)
 		if err != nil {
 			return err
 		}
@@ -51,15 +51,13 @@ func addRoute(r networkv1alpha1.Route) error {
 		route = netlink.Route{Scope: netlink.SCOPE_UNIVERSE, Gw: gw}
 	}
 
-	fmt.Println(len(r.Source))
-
 	if r.Source != "" {
 		_, src, err := net.ParseCIDR(r.Source)
 		if err != nil {
 			return err
 		}
 
-		routeList, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+		routeList, err := h.Routes.RouteList(nil, netlink.FAMILY_V4)
 		if err != nil {
 			return err
 		}
@@ -71,7 +69,7 @@ func addRoute(r networkv1alpha1.Route) error {
 		}
 
 		if src_ip == nil {
-			return fmt.Errorf(fmt.Sprintf("Could not find src ip for network %s on host", r.Source))
+			return fmt.Errorf("could not find src ip for network %s on host", r.Source)
 		}
 
 		route.Src = src_ip
@@ -79,7 +77,7 @@ func addRoute(r networkv1alpha1.Route) error {
 
 	route.Dst = dst
 
-	err = netlink.RouteAdd(&route)
+	err = h.Routes.RouteAdd(&route)
 	if err != nil && err != syscall.EEXIST {
 		return err
 	}
@@ -87,77 +85,228 @@ func addRoute(r networkv1alpha1.Route) error {
 	return nil
 }
 
-func CreateNetwork(ctx context.Context, spec *networkv1alpha1.NetworkAttachmentSpec) error {
-	_ = log.FromContext(ctx)
+// Delete the vlan port, it's reported only if it was there
+func deletePort(ctx context.Context, h *host.Host, name string, bridgeName string, events EventFunc) error {
+	_, err := h.Links.LinkByName(name)
+	exists := err == nil
+
+	if err := h.Links.DeletePort(name); err != nil {
+		return err
+	}
+
+	if exists {
+		logging.FromContext(ctx, logging.Bridge).Info("Removed port from the bridge", logging.KeyPort, name, logging.KeyBridge, bridgeName)
+		events.normal(ReasonPortRemoved, fmt.Sprintf("Removed port %s from bridge %s", name, bridgeName))
+	}
+
+	return nil
+}
+
+// Names of the interfaces attached to the bridge by the spec
+func bridgePorts(spec *networkv1alpha1.NetworkAttachmentSpec, name string) []string {
+	var ports []string
+
+	for _, br := range spec.Bridge {
+		if br.Name != name {
+			continue
+		}
+
+		for _, port := range br.Ports {
+			ports = append(ports, portName(port))
+		}
+	}
+
+	return ports
+}
+
+// Name of the port on the bridge, the vlan interface or the uplink itself if it's untagged
+func portName(port networkv1alpha1.Port) string {
+	if port.Vlan == 0 {
+		return port.Name
+	}
+	return fmt.Sprintf("%s.%d", port.Name, port.Vlan)
+}
+
+// Configure addresses allocated from bridge address pools
+func SyncBridgeAddresses(h *host.Host, spec *networkv1alpha1.NetworkAttachmentSpec, addresses []networkv1alpha1.BridgeAddress) error {
+	for _, br := range spec.Bridge {
+		if br.AddressPool == "" {
+			continue
+		}
+
+		for _, a := range addresses {
+			if a.Bridge != br.Name {
+				continue
+			}
+
+			if err := h.Links.SyncAddress(br.Name, br.AddressPool, a.Address); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Index of the master of the link, -1 if the link is missing
+func linkMaster(h *host.Host, name string) int {
+	link, err := h.Links.LinkByName(name)
+	if err != nil {
+		return -1
+	}
+	return link.Attrs().MasterIndex
+}
+
+// Index of the interface, 0 if it doesn't exist
+func linkIndex(h *host.Host, name string) int {
+	link, err := h.Links.LinkByName(name)
+	if err != nil {
+		return 0
+	}
+	return link.Attrs().Index
+}
+
+func CreateNetwork(ctx context.Context, h *host.Host, spec *networkv1alpha1.NetworkAttachmentSpec, events EventFunc) error {
+	log := logging.FromContext(ctx, logging.Bridge)
 
 	// Create network resources
 	// Create linux bridge
 	for _, bridge_spec := range spec.Bridge {
-		br, err := (&bridge.Bridge{Name: bridge_spec.Name, Mtu: bridge_spec.Mtu}).Create()
+		_, err := h.Links.LinkByName(bridge_spec.Name)
+		created := err != nil
+
+		br, err := h.Links.CreateBridge(bridge_spec.Name, bridge_spec.Mtu)
 		if err != nil {
 			return err
 		}
+
+		if created {
+			log.Info("Created bridge", logging.KeyBridge, bridge_spec.Name)
+			events.normal(ReasonBridgeCreated, fmt.Sprintf("Created bridge %s", bridge_spec.Name))
+		}
+
 		// Add vlan to the interface
 		for _, port_spec := range bridge_spec.Ports {
-			vlan, err := bridge.AddVlan(port_spec.Name, port_spec.Vlan, port_spec.Mtu)
+			name := portName(port_spec)
+			attached := linkMaster(h, name) == br.Attrs().Index
+
+			// Untagged uplink is attached as it is
+			var vlan netlink.Link
+			if port_spec.Vlan == 0 {
+				vlan, err = h.Links.LinkByName(port_spec.Name)
+			} else {
+				vlan, err = h.Links.AddVlan(port_spec.Name, port_spec.Vlan, port_spec.Mtu)
+			}
 			if err != nil {
-				log.Log.Error(err, fmt.Sprintf("failed to add vlan %d to interface %s", port_spec.Vlan, port_spec.Name))
+				log.Error(err, "Failed to add vlan to interface", logging.KeyPort, name, logging.KeyInterface, port_spec.Name)
 				return err
 			}
 
 			// Attach vlan interface to the linux bridge
-			if err := netlink.LinkSetMaster(vlan, br); err != nil {
-				log.Log.Error(err, fmt.Sprintf("failed to add interface %s to the bridge %s", vlan.Name, br.Name))
+			if err := h.Links.LinkSetMaster(vlan, br); err != nil {
+				log.Error(err, "Failed to add port to the bridge", logging.KeyPort, name, logging.KeyBridge, bridge_spec.Name)
 				return err
 			}
+
+			if !attached {
+				log.Info("Added port to the bridge", logging.KeyPort, name, logging.KeyBridge, bridge_spec.Name)
+				events.normal(ReasonPortAdded, fmt.Sprintf("Added port %s to bridge %s", name, bridge_spec.Name))
+			}
 		}
 	}
 
 	// Add static routes
 	for _, route := range spec.Routes {
-		if err := addRoute(route); err != nil {
-			log.Log.Error(err, "Failed to add static routes")
+		if err := addRoute(h, route); err != nil {
+			log.Error(err, "Failed to add static route", "destination", route.Destination, "via", route.Via)
+			events.warning(ReasonRouteFailed, fmt.Sprintf("Failed to add route to %s via %s: %v", route.Destination, route.Via, err))
 			return err
 		}
 	}
 
 	// Add or remove snat firewall rules
 	if spec.IpMasq.Enabled {
-		if err := EnableMasquerade(&spec.IpMasq); err != nil {
-			log.Log.Error(err, fmt.Sprintf("failed to add masquerade: %v", spec.IpMasq))
+		// Masquerade is applied on every reconcile, only the first time is reported
+		enabled := false
+		if events != nil {
+			missing, err := h.NAT.MissingMasquerade(spec.IpMasq.Bridge, spec.IpMasq.Source, spec.IpMasq.EgressNetwork)
+			enabled = err == nil && len(missing) > 0
+		}
+
+		if err := EnableMasquerade(ctx, h, &spec.IpMasq, bridgePorts(spec, spec.IpMasq.Bridge)); err != nil {
+			log.Error(err, "Failed to add masquerade", logging.KeyBridge, spec.IpMasq.Bridge, "source", spec.IpMasq.Source)
 			return err
 		}
+
+		if enabled {
+			events.normal(ReasonMasqueradeEnabled, fmt.Sprintf("Enabled masquerade of %s on bridge %s", spec.IpMasq.Source, spec.IpMasq.Bridge))
+		}
+	}
+
+	if err := addFilterRules(ctx, h, isolationRules(spec)); err != nil {
+		log.Error(err, "Failed to isolate the bridge services from the uplinks")
+		return err
+	}
+
+	// Add or remove dnat firewall rules
+	if err := SyncPortForwards(ctx, h, spec); err != nil {
+		log.Error(err, "Failed to add port forwards", "portForwards", spec.PortForwards)
+		return err
 	}
 
 	return nil
 }
 
-func DeleteNetwork(ctx context.Context, spec *networkv1alpha1.NetworkAttachmentSpec) error {
+func DeleteNetwork(ctx context.Context, h *host.Host, spec *networkv1alpha1.NetworkAttachmentSpec, events EventFunc) error {
+	log := logging.FromContext(ctx, logging.Bridge)
+
 	var pName string
 	// Remove linux bridge
 	for _, br := range spec.Bridge {
-		for _, port := range br.Ports {
-			pName = port.Name
-
-			if port.Vlan != 0 {
-				pName = fmt.Sprintf("%s.%d", port.Name, port.Vlan)
+		// Bridge could stay if there are still attached interfaces
+		if br.AddressPool != "" {
+			if err := h.Links.DeleteAddresses(br.Name, br.AddressPool); err != nil {
+				log.Error(err, "Unable to delete addresses from linux bridge", logging.KeyBridge, br.Name)
+				return err
 			}
+		}
 
-			if err := bridge.DeletePort(pName); err != nil {
-				log.Log.Error(err, fmt.Sprintf("NetworkAttachment: Unable to delete port from linux bridge %s", port.Name))
+		for _, port := range br.Ports {
+			pName = portName(port)
+
+			if err := deletePort(ctx, h, pName, br.Name, events); err != nil {
+				log.Error(err, "Unable to delete port from linux bridge", logging.KeyPort, pName, logging.KeyBridge, br.Name)
 				return err
 			}
 		}
 
+		_, err := h.Links.LinkByName(br.Name)
+		exists := err == nil
+
 		// TBD check if there is no attached interfaces and only after that remove linux bridge
-		if err := (&bridge.Bridge{Name: br.Name}).Remove(); err != nil {
+		if err := h.Links.RemoveBridge(br.Name); err != nil {
 			return err
 		}
+
+		if exists {
+			log.Info("Removed bridge", logging.KeyBridge, br.Name)
+			events.normal(ReasonBridgeRemoved, fmt.Sprintf("Removed bridge %s", br.Name))
+		}
+	}
+
+	if err := deleteFilterRules(h, isolationRules(spec), nil); err != nil {
+		return err
 	}
 
 	// Remove iptables rules
 	if spec.IpMasq.Enabled {
-		if err := DeleteMasquerade(&spec.IpMasq); err != nil {
+		if err := DeleteMasquerade(h, &spec.IpMasq); err != nil {
+			return err
+		}
+	}
+
+	if len(spec.PortForwards) > 0 {
+		if err := h.NAT.PurgeChain(NatBridge(spec)); err != nil {
 			return err
 		}
 	}
@@ -21,29 +21,70 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
 
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 const networkAttachmentFinalizer = "cloud.spaceship.com/finalizer"
 const lastAppliedConfiguration = "networkattachment/last-applied-configuration"
 
+// Changing the annotation forces the node to apply the network again
+const ReapplyAnnotation = "cloud.spaceship.com/reapply"
+
 // NetworkAttachmentReconciler reconciles a Network object
 type NetworkAttachmentReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// Network of the node the attachments are programmed on
+	Host *host.Host
+
+	// Interval of the host network drift detection, zero disables it
+	ResyncInterval time.Duration
+
+	// DHCP servers running on this node
+	dhcpMu      sync.Mutex
+	dhcpServers map[types.NamespacedName]*dhcpServer
+	leaseEvents chan event.GenericEvent
+
+	// Changes of the host network seen by netlink
+	netlinkEvents chan event.GenericEvent
+
+	// Router advertisements sent on this node
+	raMu        sync.Mutex
+	advertisers map[types.NamespacedName]*routerAdvertiser
+
+	// Fingerprints of the attachments applied by this agent, resync skips them without drift
+	appliedMu sync.Mutex
+	applied   map[types.NamespacedName]string
+
+	// Metadata of the watched ignore sources
+	metadata client.Reader
 }
 
 type NetworkAttachmentChangelog struct {
@@ -54,23 +95,26 @@ type NetworkAttachmentChangelog struct {
 //+kubebuilder:rbac:groups=cloud.spaceship.com,resources=networkattachments,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=cloud.spaceship.com,resources=networkattachments/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=cloud.spaceship.com,resources=networkattachments/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=configmaps;services,verbs=get;list;watch
+//+kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 func (r *NetworkAttachmentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
-
-	log.Log.Info(fmt.Sprintf("NetworkAttachment: Reconcile networkattachment resource %+v", req))
-
 	hostname, err := getHostname()
 	if err != nil {
-		log.Log.Error(err, "NetworkAttachment: Failed to get node hostname")
+		log.FromContext(ctx).Error(err, "Failed to get node hostname")
 		return ctrl.Result{}, err
 	}
 
+	ctx, logger := reconcileLogger(ctx, "networkattachment", logging.KeyAttachment, req.NamespacedName.String(), logging.KeyNode, hostname)
+
+	logger.Info("Reconcile networkattachment resource")
+
 	networkAttachment := &networkv1alpha1.NetworkAttachment{}
 	err = r.Get(ctx, req.NamespacedName, networkAttachment)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			log.Log.Info("NetworkAttachment: NetworkAttachment resource not found. Ignoring since object must be deleted")
+			logger.Info("NetworkAttachment resource not found. Ignoring since object must be deleted")
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
@@ -80,6 +124,10 @@ func (r *NetworkAttachmentReconciler) Reconcile(ctx context.Context, req ctrl.Re
 		return ctrl.Result{}, nil
 	}
 
+	network := types.NamespacedName{Namespace: networkAttachment.Namespace, Name: attachmentNetwork(networkAttachment)}
+	logger = logger.WithValues(logging.KeyNetwork, network.String())
+	ctx = log.IntoContext(ctx, logger)
+
 	isNetworkMarkedToBeDeleted := networkAttachment.GetDeletionTimestamp() != nil
 	if isNetworkMarkedToBeDeleted {
 		if controllerutil.ContainsFinalizer(networkAttachment, networkAttachmentFinalizer) {
@@ -90,83 +138,471 @@ func (r *NetworkAttachmentReconciler) Reconcile(ctx context.Context, req ctrl.Re
 			// raise the issue "the object has been modified, please apply
 			// your changes to the latest version and try again" which would re-trigger the reconciliation
 			if err := r.Get(ctx, req.NamespacedName, networkAttachment); err != nil {
-				log.Log.Error(err, "NetworkAttachment: Failed to re-fetch network")
+				logger.Error(err, "Failed to re-fetch network")
 				return ctrl.Result{}, err
 			}
 
-			log.Log.Info("NetworkAttachment: Performing Finalizer Operations for Network resource before delete CR")
+			logger.Info("Performing Finalizer Operations for Network resource before delete CR")
 
-			if err = DeleteNetwork(ctx, &networkAttachment.Spec); err != nil {
-				log.Log.Error(err, "NetworkAttachment: Failed to remove network due to error")
-				return ctrl.Result{}, nil
-			}
+			// Network which was only planned has nothing on the node
+			_, applied := networkAttachment.GetAnnotations()[lastAppliedConfiguration]
+			if applied || !networkAttachment.Spec.DryRun {
+				if err = DeleteNetwork(ctx, r.Host, &networkAttachment.Spec, recorderEvents(r.Recorder, networkAttachment)); err != nil {
+					logger.Error(err, "Failed to remove network due to error")
+					return ctrl.Result{}, nil
+				}
 
-			if networkAttachment.Spec.IpMasq.Enabled {
-				if err = DeleteMasquerade(&networkAttachment.Spec.IpMasq); err != nil {
-					return ctrl.Result{}, err
+				if networkAttachment.Spec.IpMasq.Enabled {
+					if err = DeleteMasquerade(r.Host, &networkAttachment.Spec.IpMasq); err != nil {
+						return ctrl.Result{}, err
+					}
 				}
 			}
 
-			log.Log.Info("NetworkAttachment: Removing Finalizer for network after successfully perform the operations")
+			if err = r.stopDHCPServer(ctx, req.NamespacedName); err != nil {
+				logger.Error(err, "Failed to stop dhcp server")
+				return ctrl.Result{}, err
+			}
+
+			if err = r.stopRouterAdvertiser(ctx, req.NamespacedName); err != nil {
+				logger.Error(err, "Failed to stop router advertisements")
+				return ctrl.Result{}, err
+			}
+
+			if err = r.releaseAddresses(ctx, networkAttachment); err != nil {
+				logger.Error(err, "Failed to release bridge addresses")
+				return ctrl.Result{}, err
+			}
+
+			logger.Info("Removing Finalizer for network after successfully perform the operations")
 			if ok := controllerutil.RemoveFinalizer(networkAttachment, networkAttachmentFinalizer); !ok {
-				log.Log.Error(err, "NetworkAttachment: Failed to remove finalizer for network")
+				logger.Error(err, "Failed to remove finalizer for network")
 				return ctrl.Result{Requeue: true}, nil
 			}
 
 			if err := r.Update(ctx, networkAttachment); err != nil {
-				log.Log.Error(err, "NetworkAttachment: Failed to remove finalizer for network")
+				logger.Error(err, "Failed to remove finalizer for network")
 				return ctrl.Result{}, err
 			}
+
+			r.setAppliedFingerprint(req.NamespacedName, "")
+			deleteAttachmentMetrics(networkAttachment)
 		}
 		return ctrl.Result{}, nil
 	}
 
 	if !controllerutil.ContainsFinalizer(networkAttachment, networkAttachmentFinalizer) {
-		log.Log.Info("NetworkAttachment: Adding Finalizer for network resource")
+		logger.Info("Adding Finalizer for network resource")
 		if ok := controllerutil.AddFinalizer(networkAttachment, networkAttachmentFinalizer); !ok {
-			log.Log.Error(err, "NetworkAttachment: Failed to add finalizer into the custom resource")
+			logger.Error(err, "Failed to add finalizer into the custom resource")
 			return ctrl.Result{Requeue: true}, nil
 		}
 
 		if err = r.Update(ctx, networkAttachment); err != nil {
-			log.Log.Error(err, "NetworkAttachment: Failed to update custom resource to add finalizer")
+			logger.Error(err, "Failed to update custom resource to add finalizer")
 			return ctrl.Result{}, err
 		}
 	}
 
-	if err = r.DiffNetwork(ctx, req); err != nil {
-		return ctrl.Result{}, err
+	if networkAttachment.Spec.DryRun {
+		err = r.setPlan(ctx, req, networkAttachment)
+		return ctrl.Result{RequeueAfter: r.ResyncInterval}, err
 	}
 
-	if err = CreateNetwork(ctx, &networkAttachment.Spec); err != nil {
+	// Failure to resolve the ignore sources is reported by the apply
+	fingerprint, fingerprintErr := r.appliedFingerprintOf(ctx, networkAttachment)
+
+	// Drift is only interesting if the spec has been applied already, otherwise
+	// everything which is not there yet is simply going to be created.
+	var (
+		drift    []Drift
+		driftErr error
+	)
+	applied := isApplied(networkAttachment)
+	if applied {
+		driftChecks.WithLabelValues(req.Namespace, req.Name).Inc()
+
+		drift, driftErr = r.networkDrift(ctx, networkAttachment)
+		if driftErr != nil {
+			logger.Error(driftErr, "Failed to detect drift of the host network")
+		}
+
+		for _, d := range drift {
+			logger.Info("Host network drifted", "kind", d.Kind, "drift", d.Message)
+		}
+	}
+
+	// Applying rewrites sysctls, announces the gateway and restarts the servers,
+	// so it's skipped on resync when the node still has what this agent applied
+	if applied && driftErr == nil && len(drift) == 0 && fingerprintErr == nil && r.appliedFingerprint(req.NamespacedName) == fingerprint {
+		logger.V(1).Info("Network is up to date")
+
+		if err := r.updateLeases(ctx, req.NamespacedName); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		return ctrl.Result{RequeueAfter: r.ResyncInterval}, nil
+	}
+
+	start := time.Now()
+	err = r.applyNetwork(ctx, req, networkAttachment)
+	observeApply(start, err)
+	setAttachmentReady(networkAttachment, err == nil)
+
+	if statusErr := r.setReady(ctx, req, err); statusErr != nil {
+		logger.Error(statusErr, "Failed to update ready condition")
+	}
+
+	if err != nil || fingerprintErr != nil {
+		r.setAppliedFingerprint(req.NamespacedName, "")
+	} else {
+		r.setAppliedFingerprint(req.NamespacedName, fingerprint)
+	}
+
+	if err != nil {
 		return ctrl.Result{}, err
 	}
 
+	if len(drift) > 0 {
+		if err := r.setRepaired(ctx, req, drift); err != nil {
+			logger.Error(err, "Failed to update repaired drift")
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: r.ResyncInterval}, nil
+}
+
+// Fingerprint of everything the apply depends on besides the host, the spec with the
+// resolved ignore sources, the bridge addresses and the reapply annotation
+func (r *NetworkAttachmentReconciler) appliedFingerprintOf(ctx context.Context, networkAttachment *networkv1alpha1.NetworkAttachment) (string, error) {
+	spec, err := r.EffectiveSpec(ctx, networkAttachment)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(struct {
+		Spec      *networkv1alpha1.NetworkAttachmentSpec
+		Addresses []networkv1alpha1.BridgeAddress
+		Reapply   string
+	}{spec, networkAttachment.Status.Addresses, networkAttachment.GetAnnotations()[ReapplyAnnotation]})
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize applied configuration: %v", err)
+	}
+
+	return string(data), nil
+}
+
+func (r *NetworkAttachmentReconciler) appliedFingerprint(key types.NamespacedName) string {
+	r.appliedMu.Lock()
+	defer r.appliedMu.Unlock()
+
+	return r.applied[key]
+}
+
+// Empty fingerprint forgets the attachment, so it's applied again
+func (r *NetworkAttachmentReconciler) setAppliedFingerprint(key types.NamespacedName, fingerprint string) {
+	r.appliedMu.Lock()
+	defer r.appliedMu.Unlock()
+
+	if fingerprint == "" {
+		delete(r.applied, key)
+		return
+	}
+
+	if r.applied == nil {
+		r.applied = map[types.NamespacedName]string{}
+	}
+	r.applied[key] = fingerprint
+}
+
+// Publish the changes the node would make instead of making them
+func (r *NetworkAttachmentReconciler) setPlan(ctx context.Context, req ctrl.Request, networkAttachment *networkv1alpha1.NetworkAttachment) error {
+	prev, err := LastAppliedSpec(networkAttachment)
+	if err != nil {
+		return err
+	}
+
+	spec, err := r.EffectiveSpec(ctx, networkAttachment)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to resolve masquerade ignore sources")
+		return err
+	}
+
+	recorder := host.NewRecorder(r.Host)
+	if err := planNetwork(recorder, prev, spec, networkAttachment.Status.Addresses); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to plan network changes")
+		return err
+	}
+
+	if err := r.planDHCPServer(recorder, networkAttachment); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to plan dhcp server changes")
+		return err
+	}
+
+	if err := r.planRouterAdvertiser(recorder, networkAttachment); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to plan router advertisements changes")
+		return err
+	}
+
+	plan := recorder.Changes()
+
+	status := &networkAttachment.Status
+	if status.PlanTime != nil && (reflect.DeepEqual(plan, status.Plan) || len(plan) == 0 && len(status.Plan) == 0) {
+		return nil
+	}
+
+	log.FromContext(ctx).Info("Planned network changes", "changes", len(plan))
+
+	now := metav1.Now()
+	status.Plan = plan
+	status.PlanTime = &now
+
+	return r.Status().Update(ctx, networkAttachment)
+}
+
+// The spec was applied on the node as it is now
+func isApplied(networkAttachment *networkv1alpha1.NetworkAttachment) bool {
+	applied, ok := networkAttachment.GetAnnotations()[lastAppliedConfiguration]
+	if !ok {
+		return false
+	}
+
+	spec, err := json.Marshal(networkAttachment.Spec)
+	if err != nil {
+		return false
+	}
+
+	return applied == string(spec)
+}
+
+// Drift of the effective spec, so the ignore set is checked with the resolved sources.
+// Without them only the static part of the ignore list is checked.
+func (r *NetworkAttachmentReconciler) networkDrift(ctx context.Context, networkAttachment *networkv1alpha1.NetworkAttachment) ([]Drift, error) {
+	spec, err := r.EffectiveSpec(ctx, networkAttachment)
+	if err != nil {
+		spec = &networkAttachment.Spec
+	}
+
+	return NetworkDrift(r.Host, spec)
+}
+
+// Report the drift which is gone after the apply in the status and metrics
+func (r *NetworkAttachmentReconciler) setRepaired(ctx context.Context, req ctrl.Request, drift []Drift) error {
+	networkAttachment := &networkv1alpha1.NetworkAttachment{}
+	if err := r.Get(ctx, req.NamespacedName, networkAttachment); err != nil {
+		return err
+	}
+
+	remaining, err := r.networkDrift(ctx, networkAttachment)
+	if err != nil {
+		return fmt.Errorf("failed to detect drift of the host network: %v", err)
+	}
+
+	left := map[string]bool{}
+	for _, d := range remaining {
+		log.FromContext(ctx).Info("Host network drift was not repaired", "kind", d.Kind, "drift", d.Message)
+		left[d.String()] = true
+	}
+
+	var repaired []string
+
+	for _, d := range drift {
+		if left[d.String()] {
+			continue
+		}
+
+		driftRepairs.WithLabelValues(req.Namespace, req.Name, d.Kind).Inc()
+		repaired = append(repaired, d.String())
+	}
+
+	if len(repaired) == 0 {
+		return nil
+	}
+
+	now := metav1.Now()
+	networkAttachment.Status.Repaired = repaired
+	networkAttachment.Status.LastRepairTime = &now
+
+	return r.Status().Update(ctx, networkAttachment)
+}
+
+// Program the network on the node
+func (r *NetworkAttachmentReconciler) applyNetwork(ctx context.Context, req ctrl.Request, networkAttachment *networkv1alpha1.NetworkAttachment) error {
+	var err error
+
+	if err = r.DiffNetwork(ctx, req); err != nil {
+		return err
+	}
+
+	spec, unresolved, err := r.effectiveSpec(ctx, networkAttachment)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to resolve masquerade ignore sources")
+		return err
+	}
+
+	if err = r.setIgnoreSourcesResolved(ctx, req, unresolved); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to update ignore sources condition")
+		return err
+	}
+
+	if err = CreateNetwork(ctx, r.Host, spec, recorderEvents(r.Recorder, networkAttachment)); err != nil {
+		return err
+	}
+
+	if err = SyncBridgeAddresses(r.Host, spec, networkAttachment.Status.Addresses); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to configure bridge addresses")
+		return err
+	}
+
 	if err = r.lastAppliedConfig(ctx, req); err != nil {
-		return ctrl.Result{}, err
+		return err
+	}
+
+	if err = r.syncDHCPServer(ctx, networkAttachment); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to start dhcp server")
+		return err
+	}
+
+	if err = r.updateLeases(ctx, req.NamespacedName); err != nil {
+		return err
+	}
+
+	if err = r.syncRouterAdvertiser(ctx, networkAttachment); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to start router advertisements")
+		return err
+	}
+
+	setManagedObjects(ctx, r.Host, networkAttachment, spec)
+
+	return nil
+}
+
+// EffectiveSpec returns the spec the node applies. Masquerade ignore list could reference
+// dynamic sources, e.g. pod cidrs of the node, they are resolved into networks.
+func (r *NetworkAttachmentReconciler) EffectiveSpec(ctx context.Context, networkAttachment *networkv1alpha1.NetworkAttachment) (*networkv1alpha1.NetworkAttachmentSpec, error) {
+	spec, _, err := r.effectiveSpec(ctx, networkAttachment)
+	return spec, err
+}
+
+// Effective spec together with the ignore sources which don't exist
+func (r *NetworkAttachmentReconciler) effectiveSpec(ctx context.Context, networkAttachment *networkv1alpha1.NetworkAttachment) (*networkv1alpha1.NetworkAttachmentSpec, []string, error) {
+	var (
+		unresolved []string
+		err        error
+	)
+
+	spec := networkAttachment.Spec.DeepCopy()
+	if spec.IpMasq.Enabled {
+		spec.IpMasq.Ignore, unresolved, err = r.masqueradeIgnore(ctx, networkAttachment)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return spec, unresolved, nil
+}
+
+// Report masquerade ignore sources which don't exist, the network is applied without them
+func (r *NetworkAttachmentReconciler) setIgnoreSourcesResolved(ctx context.Context, req ctrl.Request, unresolved []string) error {
+	networkAttachment := &networkv1alpha1.NetworkAttachment{}
+	if err := r.Get(ctx, req.NamespacedName, networkAttachment); err != nil {
+		return err
 	}
 
-	return ctrl.Result{}, nil
+	var changed bool
+
+	if len(networkAttachment.Spec.IpMasq.IgnoreFrom) == 0 {
+		changed = meta.RemoveStatusCondition(&networkAttachment.Status.Conditions, networkv1alpha1.NetworkAttachmentConditionIgnoreSourcesResolved)
+	} else {
+		condition := metav1.Condition{
+			Type:               networkv1alpha1.NetworkAttachmentConditionIgnoreSourcesResolved,
+			Status:             metav1.ConditionTrue,
+			Reason:             networkv1alpha1.NetworkAttachmentReasonResolved,
+			Message:            "All masquerade ignore sources exist",
+			ObservedGeneration: networkAttachment.Generation,
+		}
+
+		if len(unresolved) > 0 {
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = networkv1alpha1.NetworkAttachmentReasonSourceNotFound
+			condition.Message = strings.Join(unresolved, ", ")
+		}
+
+		changed = meta.SetStatusCondition(&networkAttachment.Status.Conditions, condition)
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return r.Status().Update(ctx, networkAttachment)
+}
+
+// Reflect the result of the last apply in the ready condition, e.g. for the CNI plugin status
+func (r *NetworkAttachmentReconciler) setReady(ctx context.Context, req ctrl.Request, applyErr error) error {
+	networkAttachment := &networkv1alpha1.NetworkAttachment{}
+	if err := r.Get(ctx, req.NamespacedName, networkAttachment); err != nil {
+		return err
+	}
+
+	condition := metav1.Condition{
+		Type:               networkv1alpha1.NetworkAttachmentConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             networkv1alpha1.NetworkAttachmentReasonApplied,
+		Message:            "Network is programmed on the node",
+		ObservedGeneration: networkAttachment.Generation,
+	}
+
+	if applyErr != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = networkv1alpha1.NetworkAttachmentReasonFailed
+		condition.Message = applyErr.Error()
+	}
+
+	changed := meta.SetStatusCondition(&networkAttachment.Status.Conditions, condition)
+
+	// Plan of the dry run is outdated once the spec is applied
+	if networkAttachment.Status.PlanTime != nil {
+		networkAttachment.Status.Plan = nil
+		networkAttachment.Status.PlanTime = nil
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return r.Status().Update(ctx, networkAttachment)
 }
 
 func (r *NetworkAttachmentReconciler) lastAppliedConfig(ctx context.Context, req ctrl.Request) error {
 	networkAttachment := &networkv1alpha1.NetworkAttachment{}
 
 	if err := r.Get(ctx, req.NamespacedName, networkAttachment); err != nil {
-		log.Log.Error(err, "NetworkAttachment: Failed to re-fetch network")
+		log.FromContext(ctx).Error(err, "Failed to re-fetch network")
 		return err
 	}
 
 	netAttachSpec, err := json.Marshal(networkAttachment.Spec)
 	if err != nil {
-		log.Log.Error(err, "NetworkAttachment: Couldn't serialize networkAttachment.Spec into json")
+		log.FromContext(ctx).Error(err, "Couldn't serialize networkAttachment.Spec into json")
 		return err
 	}
 
-	networkAttachment.SetAnnotations(map[string]string{lastAppliedConfiguration: string(netAttachSpec)})
+	// Nothing changed since the last apply, e.g. on resync
+	if networkAttachment.GetAnnotations()[lastAppliedConfiguration] == string(netAttachSpec) {
+		return nil
+	}
+
+	annotations := networkAttachment.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[lastAppliedConfiguration] = string(netAttachSpec)
+	networkAttachment.SetAnnotations(annotations)
 
 	if err = r.Update(ctx, networkAttachment); err != nil {
-		log.Log.Error(err, "NetworkAttachment: Failed to update custom resource to add finalizer")
+		log.FromContext(ctx).Error(err, "Failed to update custom resource to add finalizer")
 		return err
 	}
 	return nil
@@ -189,11 +625,15 @@ func NewNetworkAttachment(hostname string, n *networkv1alpha1.Network, req ctrl.
 			}},
 		},
 		Spec: networkv1alpha1.NetworkAttachmentSpec{
-			Bridge:        n.Spec.Bridge,
-			Routes:        n.Spec.Routes,
-			IpMasq:        n.Spec.IpMasq,
-			NodeSelectors: n.Spec.NodeSelectors,
-			NodeName:      hostname,
+			Bridge:              n.Spec.Bridge,
+			Routes:              n.Spec.Routes,
+			IpMasq:              n.Spec.IpMasq,
+			PortForwards:        n.Spec.PortForwards,
+			DHCP:                n.Spec.DHCP,
+			RouterAdvertisement: n.Spec.RouterAdvertisement,
+			NodeSelectors:       n.Spec.NodeSelectors,
+			NodeName:            hostname,
+			DryRun:              n.Spec.DryRun,
 		},
 	}, nil
 
@@ -214,7 +654,10 @@ func filterNetworkAttachmentEvent(e event.UpdateEvent) bool {
 		return true
 	}
 
-	if reflect.DeepEqual(newNetworkAttachmentObj.Spec, oldNetworkAttachmentNodeObj.Spec) {
+	// Addresses are allocated by the network controller after the networkattachment is created
+	if reflect.DeepEqual(newNetworkAttachmentObj.Spec, oldNetworkAttachmentNodeObj.Spec) &&
+		reflect.DeepEqual(newNetworkAttachmentObj.Status.Addresses, oldNetworkAttachmentNodeObj.Status.Addresses) &&
+		newNetworkAttachmentObj.Annotations[ReapplyAnnotation] == oldNetworkAttachmentNodeObj.Annotations[ReapplyAnnotation] {
 		return false
 	}
 
@@ -223,6 +666,10 @@ func filterNetworkAttachmentEvent(e event.UpdateEvent) bool {
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *NetworkAttachmentReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// Kernel of the node, unless another host is injected, e.g. in tests
+	if r.Host == nil {
+		r.Host = host.New()
+	}
 
 	p := predicate.Funcs{
 		UpdateFunc: func(e event.UpdateEvent) bool {
@@ -230,8 +677,34 @@ func (r *NetworkAttachmentReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		},
 	}
 
+	nodePredicate := predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return filterNodePodCIDREvent(e)
+		},
+	}
+
+	r.metadata = mgr.GetCache()
+	r.leaseEvents = make(chan event.GenericEvent)
+	r.netlinkEvents = make(chan event.GenericEvent)
+
+	if err := mgr.Add(r.netlinkWatcher()); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&networkv1alpha1.NetworkAttachment{}).
+		Watches(&corev1.Node{}, handler.EnqueueRequestsFromMapFunc(r.attachmentsWithIgnoreSource(matchNodeSource)),
+			builder.WithPredicates(nodePredicate)).
+		// Sources are watched by metadata only, see UncachedObjects
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.attachmentsWithIgnoreSource(matchConfigMapSource)),
+			builder.OnlyMetadata).
+		Watches(&corev1.Service{}, handler.EnqueueRequestsFromMapFunc(r.attachmentsWithIgnoreSource(matchServiceSource)),
+			builder.OnlyMetadata).
+		Watches(&discoveryv1.EndpointSlice{}, handler.EnqueueRequestsFromMapFunc(r.attachmentsWithIgnoreSource(r.matchEndpointSliceSource)),
+			builder.OnlyMetadata).
+		Watches(&networkv1alpha1.Network{}, handler.EnqueueRequestsFromMapFunc(r.attachmentsWithIgnoreSource(matchNetworkSource))).
+		WatchesRawSource(source.Channel(r.leaseEvents, &handler.EnqueueRequestForObject{})).
+		WatchesRawSource(source.Channel(r.netlinkEvents, &handler.EnqueueRequestForObject{})).
 		WithEventFilter(p).
-		Complete(r)
+		Complete(instrument("networkattachment", r))
 }
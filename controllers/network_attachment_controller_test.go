@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/ebtables"
+	"github.com/NCCloud/tabby-cni/pkg/host/fake"
+)
+
+// Reconciler of the node1 attachment on the in-memory node with the eth1 uplink
+func newFakeAttachmentReconciler(t *testing.T, spec networkv1alpha1.NetworkAttachmentSpec) (*NetworkAttachmentReconciler, *fake.Host, ctrl.Request) {
+	t.Setenv(nodeName, "node1")
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := networkv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	spec.NodeName = "node1"
+	na := &networkv1alpha1.NetworkAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1-vm-network", Namespace: "default"},
+		Spec:       spec,
+	}
+
+	c := fakeclient.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(na).
+		WithStatusSubresource(na).
+		Build()
+
+	node := fake.New()
+	node.Links.Add(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}})
+
+	r := &NetworkAttachmentReconciler{
+		Client:   c,
+		Scheme:   scheme,
+		Recorder: record.NewFakeRecorder(20),
+		Host:     node.Host(),
+	}
+
+	return r, node, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: na.Name}}
+}
+
+func readyCondition(t *testing.T, c client.Client, req ctrl.Request) *metav1.Condition {
+	na := &networkv1alpha1.NetworkAttachment{}
+	if err := c.Get(context.Background(), req.NamespacedName, na); err != nil {
+		t.Fatal(err)
+	}
+	return meta.FindStatusCondition(na.Status.Conditions, networkv1alpha1.NetworkAttachmentConditionReady)
+}
+
+func TestNetworkAttachmentReconcile(t *testing.T) {
+	r, node, req := newFakeAttachmentReconciler(t, networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10", Mtu: 9000, Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 10}}}},
+		Routes: []networkv1alpha1.Route{{Destination: "10.20.0.0/16", Via: "br10"}},
+		IpMasq: networkv1alpha1.Masquerade{Enabled: true, Bridge: "br10", Source: "10.10.0.0/24"},
+	})
+	ctx := context.Background()
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	br, err := node.Links.LinkByName("br10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.Attrs().MTU != 9000 {
+		t.Errorf("bridge mtu = %d, want 9000", br.Attrs().MTU)
+	}
+	if ports := node.Links.Ports("br10"); len(ports) != 1 || ports[0] != "eth1.10" {
+		t.Errorf("bridge ports = %q, want eth1.10", ports)
+	}
+
+	if routes, _ := node.Routes.RouteList(br, netlink.FAMILY_V4); len(routes) != 1 {
+		t.Errorf("routes via br10 = %v, want one", routes)
+	}
+
+	if m, ok := node.NAT.Masquerades["br10"]; !ok || m.Source != "10.10.0.0/24" {
+		t.Errorf("masquerade of br10 = %+v", node.NAT.Masquerades)
+	}
+	if ok, _ := node.Filter.RuleExists(ebtables.ChainForward, "-p", "ARP", "--logical-out", "br10", "--arp-ip-dst", "169.254.1.1", "-j", "DROP"); !ok {
+		t.Errorf("gateway filter rule is missing: %v", node.Filter.Rules)
+	}
+	if v := node.Sysctl.Values["net.ipv4.conf.br10.proxy_arp"]; v != "1" {
+		t.Errorf("proxy_arp = %q, want 1", v)
+	}
+	if len(node.ARP.Announcements) != 1 || node.ARP.Announcements[0].Interface != "br10" {
+		t.Errorf("announcements = %+v, want the gateway on br10", node.ARP.Announcements)
+	}
+
+	if cond := readyCondition(t, r.Client, req); cond == nil || cond.Status != metav1.ConditionTrue {
+		t.Errorf("ready condition = %+v", cond)
+	}
+
+	// Resync without drift leaves the node alone
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.ARP.Announcements) != 1 {
+		t.Errorf("announcements = %+v, want no new one on resync", node.ARP.Announcements)
+	}
+
+	// Masquerade removed behind the back of the controller is repaired
+	if err := node.NAT.PurgeChain("br10"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := node.NAT.Masquerades["br10"]; !ok {
+		t.Error("masquerade of br10 was not repaired")
+	}
+
+	na := &networkv1alpha1.NetworkAttachment{}
+	if err := r.Get(ctx, req.NamespacedName, na); err != nil {
+		t.Fatal(err)
+	}
+	if len(na.Status.Repaired) != 1 {
+		t.Errorf("repaired drift = %q, want the masquerade rule", na.Status.Repaired)
+	}
+}
+
+func TestNetworkAttachmentReconcileAnycast(t *testing.T) {
+	r, node, req := newFakeAttachmentReconciler(t, networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10", Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 10}}}},
+		IpMasq: networkv1alpha1.Masquerade{
+			Enabled:     true,
+			Bridge:      "br10",
+			Source:      "10.10.0.0/24",
+			GatewayMode: networkv1alpha1.GatewayModeAnycast,
+		},
+	})
+
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	mac := anycastGatewayMAC("br10", net.ParseIP(virtualIpaddress))
+
+	gw, err := node.Links.LinkByName("br10-gw")
+	if err != nil || gw.Attrs().HardwareAddr.String() != mac.String() {
+		t.Fatalf("gateway interface = %v, %v, want mac %s", gw, err, mac)
+	}
+	if br, _ := node.Links.LinkByName("br10"); br.Attrs().HardwareAddr != nil {
+		t.Errorf("bridge mac = %s, want it untouched", br.Attrs().HardwareAddr)
+	}
+
+	// Frames with the anycast mac never leave the node
+	rule := []string{"-s", mac.String(), "-o", "eth1.10", "--logical-out", "br10", "-j", "DROP"}
+	if ok, _ := node.Filter.RuleExists(ebtables.ChainOutput, rule...); !ok {
+		t.Errorf("anycast filter rule is missing: %v", node.Filter.Rules)
+	}
+	if len(node.ARP.Announcements) != 1 || node.ARP.Announcements[0].Interface != "br10-gw" {
+		t.Errorf("announcements = %+v, want the gateway on br10-gw", node.ARP.Announcements)
+	}
+}
+
+func TestNetworkAttachmentReconcileDelete(t *testing.T) {
+	r, node, req := newFakeAttachmentReconciler(t, networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10", Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 10}}}},
+		IpMasq: networkv1alpha1.Masquerade{Enabled: true, Bridge: "br10", Source: "10.10.0.0/24"},
+	})
+	ctx := context.Background()
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	na := &networkv1alpha1.NetworkAttachment{}
+	if err := r.Get(ctx, req.NamespacedName, na); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete(ctx, na); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"br10", "eth1.10"} {
+		if _, err := node.Links.LinkByName(name); err == nil {
+			t.Errorf("%s is still on the node", name)
+		}
+	}
+	if _, err := node.Links.LinkByName("eth1"); err != nil {
+		t.Errorf("uplink was removed: %v", err)
+	}
+
+	if len(node.NAT.Masquerades) != 0 {
+		t.Errorf("masquerades = %+v, want none", node.NAT.Masquerades)
+	}
+	if rules, _ := node.Filter.ListRules("br10"); len(rules) != 0 {
+		t.Errorf("ebtables rules = %q, want none", rules)
+	}
+
+	if err := r.Get(ctx, req.NamespacedName, na); !errors.IsNotFound(err) {
+		t.Errorf("attachment was not released by the finalizer: %v", err)
+	}
+}
+
+func TestNetworkAttachmentReconcileFailure(t *testing.T) {
+	r, _, req := newFakeAttachmentReconciler(t, networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10", Ports: []networkv1alpha1.Port{{Name: "eth2", Vlan: 10}}}},
+	})
+
+	if _, err := r.Reconcile(context.Background(), req); err == nil {
+		t.Fatal("Reconcile() succeeded with the missing uplink")
+	}
+
+	cond := readyCondition(t, r.Client, req)
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != networkv1alpha1.NetworkAttachmentReasonFailed {
+		t.Errorf("ready condition = %+v, want failed", cond)
+	}
+}
@@ -0,0 +1,344 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
+)
+
+const (
+	networkAttachmentDefinitionFinalizer = "cloud.spaceship.com/nad-finalizer"
+	// Labels of the generated NetworkAttachmentDefinitions, they point to the network
+	NetworkLabel          = "cloud.spaceship.com/network"
+	NetworkNamespaceLabel = "cloud.spaceship.com/network-namespace"
+
+	nadCNIVersion = "0.3.1"
+)
+
+var networkAttachmentDefinitionGVK = schema.GroupVersionKind{
+	Group:   "k8s.cni.cncf.io",
+	Version: "v1",
+	Kind:    "NetworkAttachmentDefinition",
+}
+
+// NetworkAttachmentDefinitionReconciler generates Multus NetworkAttachmentDefinitions of networks
+type NetworkAttachmentDefinitionReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+// Bridge CNI plugin configuration
+// Configuration of the tabby plugin, see NetConf of cmd/tabby-cni
+type tabbyCNIConfig struct {
+	CNIVersion string                      `json:"cniVersion"`
+	Name       string                      `json:"name"`
+	Type       string                      `json:"type"`
+	Bridge     string                      `json:"bridge"`
+	Interface  string                      `json:"interface,omitempty"`
+	Vlan       int                         `json:"vlan,omitempty"`
+	MTU        int                         `json:"mtu,omitempty"`
+	IPMasq     *networkv1alpha1.Masquerade `json:"ipMasq,omitempty"`
+	IPAM       *tabbyIPAMConfig            `json:"ipam,omitempty"`
+}
+
+type tabbyIPAMConfig struct {
+	Type      string `json:"type,omitempty"`
+	Pool      string `json:"pool,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+//+kubebuilder:rbac:groups=k8s.cni.cncf.io,resources=network-attachment-definitions,verbs=get;list;watch;create;update;patch;delete
+
+func (r *NetworkAttachmentDefinitionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctx, logger := reconcileLogger(ctx, "networkattachmentdefinition", logging.KeyNetwork, req.NamespacedName.String())
+
+	logger.Info("Reconcile network")
+
+	network := &networkv1alpha1.Network{}
+	if err := r.Get(ctx, req.NamespacedName, network); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	nad := network.Spec.NetworkAttachmentDefinition
+	if network.GetDeletionTimestamp() != nil || nad == nil || !nad.Enabled {
+		finalizer := controllerutil.ContainsFinalizer(network, networkAttachmentDefinitionFinalizer)
+
+		// Definitions in the namespace of the network are garbage collected together with it
+		if network.GetDeletionTimestamp() != nil && !finalizer {
+			return ctrl.Result{}, nil
+		}
+
+		if err := r.deleteStale(ctx, network, nil); err != nil {
+			logger.Error(err, "Failed to delete networkattachmentdefinitions")
+			return ctrl.Result{}, err
+		}
+
+		if !finalizer {
+			return ctrl.Result{}, nil
+		}
+
+		logger.Info("Removing finalizer for network")
+		controllerutil.RemoveFinalizer(network, networkAttachmentDefinitionFinalizer)
+		if err := r.Update(ctx, network); err != nil {
+			logger.Error(err, "Failed to remove finalizer for network")
+			return ctrl.Result{}, err
+		}
+
+		return ctrl.Result{}, nil
+	}
+
+	config, err := networkAttachmentDefinitionConfig(network)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	namespaces := nad.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{network.Namespace}
+	}
+
+	for _, namespace := range namespaces {
+		if err := r.syncNetworkAttachmentDefinition(ctx, network, namespace, config); err != nil {
+			logger.Error(err, "Failed to sync networkattachmentdefinition", "namespace", namespace)
+			recorderEvents(r.Recorder, network).warning(ReasonDefinitionFailed,
+				fmt.Sprintf("Failed to sync networkattachmentdefinition in namespace %s: %v", namespace, err))
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := r.deleteStale(ctx, network, namespaces); err != nil {
+		logger.Error(err, "Failed to delete stale networkattachmentdefinitions")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// Render the tabby CNI configuration of the network. The plugin sets up the bridge with the
+// vlan of its uplink and the masquerade the same way the agent does, and attaches the guests.
+func networkAttachmentDefinitionConfig(network *networkv1alpha1.Network) (string, error) {
+	nad := network.Spec.NetworkAttachmentDefinition
+
+	bridge := nad.Bridge
+	if bridge == "" {
+		bridge = defaultBridge(network)
+	}
+	if bridge == "" {
+		return "", fmt.Errorf("network %s/%s has no bridge", network.Namespace, network.Name)
+	}
+
+	config := tabbyCNIConfig{
+		CNIVersion: nadCNIVersion,
+		Name:       network.Name,
+		Type:       "tabby",
+		Bridge:     bridge,
+	}
+
+	for _, br := range network.Spec.Bridge {
+		if br.Name != bridge {
+			continue
+		}
+
+		config.MTU = br.Mtu
+		// The plugin takes a single uplink
+		if len(br.Ports) > 0 && br.Ports[0].Vlan != 0 {
+			config.Interface = br.Ports[0].Name
+			config.Vlan = br.Ports[0].Vlan
+		}
+	}
+
+	if ipMasq := network.Spec.IpMasq; ipMasq.Enabled && ipMasq.Bridge == bridge {
+		// Sources are resolved by the agent, the plugin doesn't read the cluster
+		ipMasq.IgnoreFrom = nil
+		config.IPMasq = &ipMasq
+	}
+
+	if nad.IPPool != "" {
+		config.IPAM = &tabbyIPAMConfig{Type: "tabby-ipam", Pool: nad.IPPool, Namespace: network.Namespace}
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize cni config: %v", err)
+	}
+
+	return string(data), nil
+}
+
+func newNetworkAttachmentDefinition() *unstructured.Unstructured {
+	nad := &unstructured.Unstructured{}
+	nad.SetGroupVersionKind(networkAttachmentDefinitionGVK)
+	return nad
+}
+
+func managedBy(nad *unstructured.Unstructured, network *networkv1alpha1.Network) bool {
+	labels := nad.GetLabels()
+	return labels[NetworkLabel] == network.Name && labels[NetworkNamespaceLabel] == network.Namespace
+}
+
+func (r *NetworkAttachmentDefinitionReconciler) syncNetworkAttachmentDefinition(ctx context.Context, network *networkv1alpha1.Network, namespace string, config string) error {
+	nad := newNetworkAttachmentDefinition()
+
+	err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: network.Name}, nad)
+	if errors.IsNotFound(err) {
+		log.FromContext(ctx).Info("Creating networkattachmentdefinition", "namespace", namespace)
+
+		nad.SetNamespace(namespace)
+		nad.SetName(network.Name)
+		nad.SetLabels(map[string]string{NetworkLabel: network.Name, NetworkNamespaceLabel: network.Namespace})
+		if err := unstructured.SetNestedField(nad.Object, config, "spec", "config"); err != nil {
+			return err
+		}
+
+		if namespace == network.Namespace {
+			if err := controllerutil.SetControllerReference(network, nad, r.Scheme); err != nil {
+				return err
+			}
+		} else if err := r.addFinalizer(ctx, network); err != nil {
+			return err
+		}
+
+		if err := r.Create(ctx, nad); err != nil {
+			return client.IgnoreAlreadyExists(err)
+		}
+
+		recorderEvents(r.Recorder, network).normal(ReasonDefinitionCreated,
+			fmt.Sprintf("Created networkattachmentdefinition in namespace %s", namespace))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Handwritten definitions are left alone
+	if !managedBy(nad, network) {
+		return fmt.Errorf("networkattachmentdefinition %s/%s is not managed by the network", namespace, network.Name)
+	}
+
+	current, _, _ := unstructured.NestedString(nad.Object, "spec", "config")
+	if current == config {
+		return nil
+	}
+
+	log.FromContext(ctx).Info("Updating networkattachmentdefinition", "namespace", namespace)
+
+	if err := unstructured.SetNestedField(nad.Object, config, "spec", "config"); err != nil {
+		return err
+	}
+
+	if err := r.Update(ctx, nad); err != nil {
+		return err
+	}
+
+	recorderEvents(r.Recorder, network).normal(ReasonDefinitionUpdated,
+		fmt.Sprintf("Updated networkattachmentdefinition in namespace %s", namespace))
+	return nil
+}
+
+// Definitions in other namespaces can't be owned by the network, so they are deleted by
+// the finalizer. It's added only before such a definition is created, so networks without
+// one are never held back by the controller.
+func (r *NetworkAttachmentDefinitionReconciler) addFinalizer(ctx context.Context, network *networkv1alpha1.Network) error {
+	if controllerutil.ContainsFinalizer(network, networkAttachmentDefinitionFinalizer) {
+		return nil
+	}
+
+	log.FromContext(ctx).Info("Adding finalizer for network")
+	controllerutil.AddFinalizer(network, networkAttachmentDefinitionFinalizer)
+	if err := r.Update(ctx, network); err != nil {
+		return fmt.Errorf("failed to add finalizer for network: %v", err)
+	}
+
+	return nil
+}
+
+// Delete definitions of the network outside of the namespaces
+func (r *NetworkAttachmentDefinitionReconciler) deleteStale(ctx context.Context, network *networkv1alpha1.Network, namespaces []string) error {
+	nads := &unstructured.UnstructuredList{}
+	nads.SetGroupVersionKind(networkAttachmentDefinitionGVK.GroupVersion().WithKind("NetworkAttachmentDefinitionList"))
+
+	err := r.List(ctx, nads, client.MatchingLabels{NetworkLabel: network.Name, NetworkNamespaceLabel: network.Namespace})
+	if err != nil {
+		return fmt.Errorf("failed to get list of networkattachmentdefinitions: %v", err)
+	}
+
+	keep := map[string]bool{}
+	for _, namespace := range namespaces {
+		keep[namespace] = true
+	}
+
+	for i := range nads.Items {
+		nad := &nads.Items[i]
+		if keep[nad.GetNamespace()] && nad.GetName() == network.Name {
+			continue
+		}
+
+		log.FromContext(ctx).Info("Deleting networkattachmentdefinition", "namespace", nad.GetNamespace(), "name", nad.GetName())
+		if err := r.Delete(ctx, nad); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Enqueue the network of the generated definition, e.g. when it was changed or deleted by hand
+func (r *NetworkAttachmentDefinitionReconciler) networkForDefinition(ctx context.Context, obj client.Object) []reconcile.Request {
+	labels := obj.GetLabels()
+	if labels[NetworkLabel] == "" {
+		return nil
+	}
+
+	return []reconcile.Request{{
+		NamespacedName: types.NamespacedName{Namespace: labels[NetworkNamespaceLabel], Name: labels[NetworkLabel]},
+	}}
+}
+
+// SetupWithManager sets up the controller with the Manager. Definitions are cluster-wide,
+// so only the leader writes them while the agent runs on every node.
+func (r *NetworkAttachmentDefinitionReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("networkattachmentdefinition").
+		WithOptions(controller.Options{NeedLeaderElection: pointer.Bool(true)}).
+		For(&networkv1alpha1.Network{}).
+		Watches(newNetworkAttachmentDefinition(), handler.EnqueueRequestsFromMapFunc(r.networkForDefinition)).
+		Complete(instrument("networkattachmentdefinition", r))
+}
@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+func TestNetworkAttachmentDefinitionFinalizer(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := networkv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	scheme.AddKnownTypeWithName(networkAttachmentDefinitionGVK, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(networkAttachmentDefinitionGVK.GroupVersion().WithKind("NetworkAttachmentDefinitionList"), &unstructured.UnstructuredList{})
+
+	network := &networkv1alpha1.Network{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm-network", Namespace: "default"},
+		Spec: networkv1alpha1.NetworkSpec{
+			Bridge:                      []networkv1alpha1.Bridge{{Name: "br10"}},
+			NetworkAttachmentDefinition: &networkv1alpha1.NetworkAttachmentDefinition{Enabled: true},
+		},
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	r := &NetworkAttachmentDefinitionReconciler{
+		Client:   fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(network).Build(),
+		Scheme:   scheme,
+		Recorder: recorder,
+	}
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "vm-network"}}
+
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Get(ctx, req.NamespacedName, network); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	definition := func(namespace string) *unstructured.Unstructured {
+		t.Helper()
+		nad := newNetworkAttachmentDefinition()
+		err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: "vm-network"}, nad)
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nad
+	}
+
+	// Definition in the namespace of the network is owned by it
+	reconcile()
+	if controllerutil.ContainsFinalizer(network, networkAttachmentDefinitionFinalizer) {
+		t.Errorf("finalizer added without definitions in other namespaces")
+	}
+	nad := definition("default")
+	if nad == nil || len(nad.GetOwnerReferences()) != 1 || nad.GetOwnerReferences()[0].Name != "vm-network" {
+		t.Fatalf("definition = %+v, want owned by the network", nad)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ReasonDefinitionCreated) {
+		t.Errorf("event = %q, want %s", event, ReasonDefinitionCreated)
+	}
+
+	// Definition in another namespace needs the finalizer
+	network.Spec.NetworkAttachmentDefinition.Namespaces = []string{"default", "vms"}
+	if err := r.Update(ctx, network); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if !controllerutil.ContainsFinalizer(network, networkAttachmentDefinitionFinalizer) {
+		t.Errorf("finalizer not added")
+	}
+	if nad := definition("vms"); nad == nil || len(nad.GetOwnerReferences()) != 0 {
+		t.Errorf("definition = %+v, want without owner", nad)
+	}
+
+	// Disabled network cleans up and drops the finalizer
+	network.Spec.NetworkAttachmentDefinition.Enabled = false
+	if err := r.Update(ctx, network); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if controllerutil.ContainsFinalizer(network, networkAttachmentDefinitionFinalizer) {
+		t.Errorf("finalizer not removed")
+	}
+	for _, namespace := range []string{"default", "vms"} {
+		if definition(namespace) != nil {
+			t.Errorf("definition in %s not deleted", namespace)
+		}
+	}
+}
+
+func TestNetworkAttachmentDefinitionConfig(t *testing.T) {
+	network := &networkv1alpha1.Network{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm-network", Namespace: "default"},
+		Spec: networkv1alpha1.NetworkSpec{
+			Bridge: []networkv1alpha1.Bridge{
+				{Name: "br10", Mtu: 9000, Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 10, Mtu: 9000}}},
+				{Name: "br20"},
+			},
+			IpMasq: networkv1alpha1.Masquerade{
+				Enabled:    true,
+				Source:     "10.10.0.0/24",
+				Bridge:     "br10",
+				Gateway:    "10.10.0.1",
+				Ignore:     []string{"10.20.0.0/16"},
+				IgnoreFrom: []networkv1alpha1.IgnoreSource{{NodePodCIDRs: true}},
+			},
+			NetworkAttachmentDefinition: &networkv1alpha1.NetworkAttachmentDefinition{Enabled: true},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		bridge string
+		ipPool string
+		want   string
+	}{
+		{
+			name: "masquerade bridge",
+			want: `{"cniVersion":"0.3.1","name":"vm-network","type":"tabby","bridge":"br10","interface":"eth1","vlan":10,"mtu":9000,` +
+				`"ipMasq":{"enabled":true,"source":"10.10.0.0/24","ignore":["10.20.0.0/16"],"bridge":"br10","gateway":"10.10.0.1"}}`,
+		},
+		{
+			name:   "ip pool",
+			ipPool: "vm-network",
+			want: `{"cniVersion":"0.3.1","name":"vm-network","type":"tabby","bridge":"br10","interface":"eth1","vlan":10,"mtu":9000,` +
+				`"ipMasq":{"enabled":true,"source":"10.10.0.0/24","ignore":["10.20.0.0/16"],"bridge":"br10","gateway":"10.10.0.1"},` +
+				`"ipam":{"type":"tabby-ipam","pool":"vm-network","namespace":"default"}}`,
+		},
+		{
+			name:   "bridge without masquerade",
+			bridge: "br20",
+			want:   `{"cniVersion":"0.3.1","name":"vm-network","type":"tabby","bridge":"br20"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		network.Spec.NetworkAttachmentDefinition.Bridge = tt.bridge
+		network.Spec.NetworkAttachmentDefinition.IPPool = tt.ipPool
+
+		config, err := networkAttachmentDefinitionConfig(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config != tt.want {
+			t.Errorf("%s: config = %s, want %s", tt.name, config, tt.want)
+		}
+	}
+
+	// Ignore sources of the network are left alone
+	if len(network.Spec.IpMasq.IgnoreFrom) != 1 {
+		t.Errorf("ignore sources of the network changed to %+v", network.Spec.IpMasq.IgnoreFrom)
+	}
+}
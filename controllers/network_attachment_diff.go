@@ -7,7 +7,9 @@ import (
 	"strconv"
 
 	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
-	"github.com/NCCloud/tabby-cni/pkg/bridge"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
+	"github.com/go-logr/logr"
 	"github.com/r3labs/diff"
 	"golang.org/x/exp/slices"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -15,85 +17,118 @@ import (
 )
 
 func (r *NetworkAttachmentReconciler) DiffNetwork(ctx context.Context, req ctrl.Request) error {
-	_ = log.FromContext(ctx)
+	logger := log.FromContext(ctx)
 
 	networkAttachment := &networkv1alpha1.NetworkAttachment{}
-	prevNetworkAttachmentSpec := &networkv1alpha1.NetworkAttachmentSpec{}
 
 	if err := r.Get(ctx, req.NamespacedName, networkAttachment); err != nil {
-		log.Log.Error(err, "NetworkAttachment: Failed to re-fetch network")
+		logger.Error(err, "Failed to re-fetch network")
 		return err
 	}
 
-	annotations := networkAttachment.GetAnnotations()
-	if annotations == nil {
-		annotations = map[string]string{}
+	prevNetworkAttachmentSpec, err := LastAppliedSpec(networkAttachment)
+	if err != nil || prevNetworkAttachmentSpec == nil {
+		return err
 	}
 
-	originAnnotation, hasAnnotation := annotations[lastAppliedConfiguration]
+	return CleanupNetwork(ctx, r.Host, prevNetworkAttachmentSpec, &networkAttachment.Spec, recorderEvents(r.Recorder, networkAttachment))
+}
 
-	if !hasAnnotation {
-		return nil
-	}
+// CleanupNetwork removes what the previous spec configured on the node and the spec doesn't
+func CleanupNetwork(ctx context.Context, h *host.Host, prev, spec *networkv1alpha1.NetworkAttachmentSpec, events EventFunc) error {
+	logger := log.FromContext(ctx)
 
-	err := json.Unmarshal([]byte(originAnnotation), prevNetworkAttachmentSpec)
+	portsDiff, err := portDiff(prev, spec)
 	if err != nil {
-		log.Log.Error(err, "NetworkAttachment: Failed to parse json")
+		logger.Error(err, "Unable to get diff of ports for cleanup")
 		return err
 	}
 
-	portsDiff, err := portDiff(prevNetworkAttachmentSpec, &networkAttachment.Spec)
-	if err != nil {
-		log.Log.Error(err, "NetworkAttachment: Unable to get diff of ports for cleanup")
-		return err
+	if len(portsDiff) > 0 {
+		logger.V(1).Info("Ports removed from the spec", "ports", portsDiff)
 	}
 
 	for _, p := range portsDiff {
-		if err = bridge.DeletePort(p); err != nil {
-			log.Log.Error(err, fmt.Sprintf("NetworkAttachment: Unable to delete port from linux bridge %s", p))
+		if err = deletePort(ctx, h, p, portBridge(prev, p), events); err != nil {
+			logger.Error(err, "Unable to delete port from linux bridge", logging.KeyPort, p)
 			return err
 
 		}
 	}
 
+	// Address pool of the bridge was changed or removed
+	for _, br := range prev.Bridge {
+		if br.AddressPool == "" || br.AddressPool == bridgeAddressPool(spec, br.Name) {
+			continue
+		}
+
+		if err = h.Links.DeleteAddresses(br.Name, br.AddressPool); err != nil {
+			logger.Error(err, "Unable to delete addresses from linux bridge", logging.KeyBridge, br.Name)
+			return err
+		}
+	}
+
+	// Gateway of the masquerade was moved, changed its mode or the masquerade was disabled
+	if ipmasq := &prev.IpMasq; ipmasq.Enabled && gatewayChanged(ipmasq, &spec.IpMasq) {
+		if err = deleteGateway(h, ipmasq); err != nil {
+			logger.Error(err, "Unable to delete previous gateway", logging.KeyBridge, ipmasq.Bridge)
+			return err
+		}
+	}
+
+	// Ports or services of the bridge were changed
+	if err = deleteFilterRules(h, isolationRules(prev), isolationRules(spec)); err != nil {
+		logger.Error(err, "Unable to delete previous ebtables rules")
+		return err
+	}
+
 	// TBD routeDiff
 	// TBD firewallDiff
 
 	return nil
 }
 
+// LastAppliedSpec is the spec of the last apply on the node, nil if it was never applied
+func LastAppliedSpec(networkAttachment *networkv1alpha1.NetworkAttachment) (*networkv1alpha1.NetworkAttachmentSpec, error) {
+	originAnnotation, hasAnnotation := networkAttachment.GetAnnotations()[lastAppliedConfiguration]
+	if !hasAnnotation {
+		return nil, nil
+	}
+
+	spec := &networkv1alpha1.NetworkAttachmentSpec{}
+	if err := json.Unmarshal([]byte(originAnnotation), spec); err != nil {
+		return nil, fmt.Errorf("failed to parse last applied spec: %v", err)
+	}
+
+	return spec, nil
+}
+
 func portDiff(prev, current *networkv1alpha1.NetworkAttachmentSpec) ([]string, error) {
 	var ports []string
 
 	changelog, err := diff.Diff(prev, current)
 	if err != nil {
-		log.Log.Error(err, "NetworkAttachment: Failed to perform diff")
-		return nil, err
+		return nil, fmt.Errorf("failed to perform diff: %v", err)
 	}
 
 	for _, change := range changelog {
-		log.Log.Info(fmt.Sprintf("NetworkAttachment: Show networkattachment diff %+v", change))
-
 		if change.Type == "delete" || change.Type == "update" {
-			if change.Path[0] == "Bridge" {
+			// Only port changes are interesting, e.g. not mtu or address pool of the bridge
+			if change.Path[0] == "Bridge" && len(change.Path) > 3 && change.Path[2] == "Ports" {
 				// Changelog Path returns [Bridge 0 Port 0 Name]
 				_brId, _portId := change.Path[1], change.Path[3]
 				brId, err := strToInt(_brId)
 				if err != nil {
-					log.Log.Error(err, fmt.Sprintf("Failed to convert string to int %s", _brId))
 					return nil, err
 				}
 				portId, err := strToInt(_portId)
 				if err != nil {
-					log.Log.Error(err, fmt.Sprintf("Failed to convert string to int %s", _portId))
 					return nil, err
 				}
 
 				port := prev.Bridge[brId].Ports[portId]
-				portName := fmt.Sprintf("%s.%d", port.Name, port.Vlan)
-
-				if !slices.Contains(ports, portName) {
-					ports = append(ports, portName)
+				if name := portName(port); !slices.Contains(ports, name) {
+					ports = append(ports, name)
 				}
 			}
 		}
@@ -101,11 +136,61 @@ func portDiff(prev, current *networkv1alpha1.NetworkAttachmentSpec) ([]string, e
 	return ports, nil
 }
 
+func bridgeAddressPool(spec *networkv1alpha1.NetworkAttachmentSpec, name string) string {
+	for _, br := range spec.Bridge {
+		if br.Name == name {
+			return br.AddressPool
+		}
+	}
+	return ""
+}
+
+// Bridge of the vlan port
+func portBridge(spec *networkv1alpha1.NetworkAttachmentSpec, name string) string {
+	for _, br := range spec.Bridge {
+		for _, port := range br.Ports {
+			if portName(port) == name {
+				return br.Name
+			}
+		}
+	}
+	return ""
+}
+
 func strToInt(value string) (int, error) {
 	v, err := strconv.Atoi(value)
 	if err != nil {
-		log.Log.Error(err, "Error during conversion")
-		return 0, err
+		return 0, fmt.Errorf("failed to convert string to int %s: %v", value, err)
 	}
 	return v, nil
 }
+
+// PlanNetwork lists the changes applying the spec would make on the node, without
+// making them. Prev is the last applied spec, nil if the spec was never applied.
+func PlanNetwork(h *host.Host, prev, spec *networkv1alpha1.NetworkAttachmentSpec, addresses []networkv1alpha1.BridgeAddress) ([]string, error) {
+	recorder := host.NewRecorder(h)
+	if err := planNetwork(recorder, prev, spec, addresses); err != nil {
+		return nil, err
+	}
+
+	return recorder.Changes(), nil
+}
+
+// Apply the network the same way applyNetwork does, but against the host which only records the changes
+func planNetwork(recorder *host.Recorder, prev, spec *networkv1alpha1.NetworkAttachmentSpec, addresses []networkv1alpha1.BridgeAddress) error {
+	// Logs would claim the changes were made
+	ctx := log.IntoContext(context.Background(), logr.Discard())
+	h := recorder.Host()
+
+	if prev != nil {
+		if err := CleanupNetwork(ctx, h, prev, spec, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := CreateNetwork(ctx, h, spec, nil); err != nil {
+		return err
+	}
+
+	return SyncBridgeAddresses(h, spec, addresses)
+}
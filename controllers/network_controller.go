@@ -28,11 +28,13 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
 )
 
 const nodeName = "NODE_NAME"
@@ -40,7 +42,8 @@ const nodeName = "NODE_NAME"
 // NetworkReconciler reconciles a Network object
 type NetworkReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 }
 
 //+kubebuilder:rbac:groups=cloud.spaceship.com,resources=networks,verbs=get;list;watch;create;update;patch;delete
@@ -58,23 +61,24 @@ type NetworkReconciler struct {
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.13.0/pkg/reconcile
 func (r *NetworkReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
 	var shouldRun bool = false
 	var isUpdateRequired bool = false
 
-	log.Log.Info("Network: Reconcile network resource")
-
 	hostname, err := getHostname()
 	if err != nil {
-		log.Log.Error(err, "Network: Failed to get node hostname")
+		log.FromContext(ctx).Error(err, "Failed to get node hostname")
 		return ctrl.Result{}, err
 	}
 
+	ctx, logger := reconcileLogger(ctx, "network", logging.KeyNetwork, req.NamespacedName.String(), logging.KeyNode, hostname)
+
+	logger.Info("Reconcile network resource")
+
 	network := &networkv1alpha1.Network{}
 	err = r.Get(ctx, req.NamespacedName, network)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			log.Log.Info("Network: Network resource not found. Ignoring since object must be deleted")
+			logger.Info("Network resource not found. Ignoring since object must be deleted")
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
@@ -86,7 +90,7 @@ func (r *NetworkReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		// Get node hostname. Default from env variable NODE_NAME, if not defined then use hostname
 		nodelabels, err := r.nodeLabels(ctx, hostname)
 		if err != nil {
-			log.Log.Error(err, "Network: Failed to get node labels")
+			logger.Error(err, "Failed to get node labels")
 		}
 
 		var nodeSels []labels.Selector
@@ -108,21 +112,25 @@ func (r *NetworkReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 
 		err = r.Get(ctx, types.NamespacedName{Name: fmt.Sprintf("%s-%s", hostname, req.Name), Namespace: req.Namespace}, networkAttachment)
 		if err != nil && errors.IsNotFound(err) {
-			log.Log.Info("Network: Creating networkAttachment resource")
+			logger.Info("Creating networkAttachment resource")
 
 			networkAttachment, err := NewNetworkAttachment(hostname, network, req)
 			if err != nil {
-				log.Log.Error(err, "Network: Unable to allocate networkAttachment structure")
+				logger.Error(err, "Unable to allocate networkAttachment structure")
 			}
 
 			if err := r.Create(ctx, networkAttachment); err != nil {
-				log.Log.Error(err, "Network: Failed to create networkAttachment resource")
+				logger.Error(err, "Failed to create networkAttachment resource", logging.KeyAttachment, networkAttachment.Name)
 				return ctrl.Result{}, err
 			}
 
-			return ctrl.Result{}, nil
+			recorderEvents(r.Recorder, network).normal(ReasonAttachmentCreated,
+				fmt.Sprintf("Created networkattachment %s for node %s", networkAttachment.Name, hostname))
+
+			// Come back to allocate addresses once the networkattachment exists
+			return ctrl.Result{Requeue: true}, nil
 		} else if err != nil {
-			log.Log.Error(err, "Network: Failed to get networkattachment resource")
+			logger.Error(err, "Failed to get networkattachment resource")
 			return ctrl.Result{}, err
 		}
 		// TBD add proper filter and remove this w/a
@@ -141,13 +149,41 @@ func (r *NetworkReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 			isUpdateRequired = true
 		}
 
+		if !reflect.DeepEqual(network.Spec.PortForwards, networkAttachment.Spec.PortForwards) {
+			networkAttachment.Spec.PortForwards = network.Spec.PortForwards
+			isUpdateRequired = true
+		}
+
+		if !reflect.DeepEqual(network.Spec.DHCP, networkAttachment.Spec.DHCP) {
+			networkAttachment.Spec.DHCP = network.Spec.DHCP
+			isUpdateRequired = true
+		}
+
+		if !reflect.DeepEqual(network.Spec.RouterAdvertisement, networkAttachment.Spec.RouterAdvertisement) {
+			networkAttachment.Spec.RouterAdvertisement = network.Spec.RouterAdvertisement
+			isUpdateRequired = true
+		}
+
+		if network.Spec.DryRun != networkAttachment.Spec.DryRun {
+			networkAttachment.Spec.DryRun = network.Spec.DryRun
+			isUpdateRequired = true
+		}
+
 		if isUpdateRequired {
-			log.Log.Info("Network: Updating networkAttachment resource")
+			logger.Info("Updating networkAttachment resource", logging.KeyAttachment, networkAttachment.Name)
 
 			if err := r.Update(ctx, networkAttachment); err != nil {
-				log.Log.Error(err, "Network: Failed to update networkattachment resource")
+				logger.Error(err, "Failed to update networkattachment resource", logging.KeyAttachment, networkAttachment.Name)
 				return ctrl.Result{}, err
 			}
+
+			recorderEvents(r.Recorder, network).normal(ReasonAttachmentUpdated,
+				fmt.Sprintf("Updated networkattachment %s of node %s", networkAttachment.Name, hostname))
+		}
+
+		if err := r.allocateAddresses(ctx, req.NamespacedName, networkAttachment, hostname); err != nil {
+			logger.Error(err, "Failed to allocate bridge addresses")
+			return ctrl.Result{}, err
 		}
 	}
 
@@ -159,7 +195,7 @@ func (r *NetworkReconciler) nodeLabels(ctx context.Context, nodeName string) (la
 	nodes := &corev1.NodeList{}
 	err := r.List(ctx, nodes)
 	if err != nil {
-		log.Log.Error(err, "Network: Could't get list of nodes")
+		log.FromContext(ctx).Error(err, "Could't get list of nodes")
 		return nil, err
 	}
 
@@ -177,7 +213,7 @@ func (r *NetworkReconciler) nodeLabels(ctx context.Context, nodeName string) (la
 func (r *NetworkReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&networkv1alpha1.Network{}).
-		Complete(r)
+		Complete(instrument("network", r))
 }
 
 func getHostname() (string, error) {
@@ -187,8 +223,7 @@ func getHostname() (string, error) {
 	if host == "" {
 		host, err = os.Hostname()
 		if err != nil {
-			log.Log.Error(err, fmt.Sprintf("Network: Unable to get node hostname %s", host))
-			return "", err
+			return "", fmt.Errorf("unable to get node hostname: %v", err)
 		}
 	}
 	return host, nil
@@ -0,0 +1,373 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/exp/slices"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/host/fake"
+	"github.com/NCCloud/tabby-cni/pkg/netnstest"
+)
+
+// Run DiffNetwork on the node for the spec which replaces the applied one
+func diffNetwork(t *testing.T, h *host.Host, prev, spec networkv1alpha1.NetworkAttachmentSpec) {
+	t.Helper()
+
+	r, _, req := newFakeAttachmentReconciler(t, spec)
+	r.Host = h
+	ctx := context.Background()
+
+	applied, err := json.Marshal(prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	na := &networkv1alpha1.NetworkAttachment{}
+	if err := r.Get(ctx, req.NamespacedName, na); err != nil {
+		t.Fatal(err)
+	}
+	na.SetAnnotations(map[string]string{lastAppliedConfiguration: string(applied)})
+	if err := r.Update(ctx, na); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.DiffNetwork(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Links and routes of the namespace, the rules are kept in memory since
+// iptables and ebtables could be missing
+func netnsHost() *host.Host {
+	h := host.New()
+	rules := fake.New().Host()
+	h.NAT, h.Filter = rules.NAT, rules.Filter
+	return h
+}
+
+func requireNoDrift(t *testing.T, h *host.Host, spec *networkv1alpha1.NetworkAttachmentSpec) {
+	t.Helper()
+
+	drift, err := NetworkDrift(h, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) > 0 {
+		t.Errorf("drift = %v, want none", drift)
+	}
+}
+
+func TestNetworkLifecycle(t *testing.T) {
+	ns := netnstest.New(t)
+	ns.AddUplink("eth1")
+
+	ctx := context.Background()
+	h := netnsHost()
+
+	spec := networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10", Mtu: 1400, AddressPool: "10.10.0.0/24"}},
+		Routes: []networkv1alpha1.Route{{Destination: "10.20.0.0/16", Via: "br10"}},
+	}
+
+	if err := CreateNetwork(ctx, h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncBridgeAddresses(h, &spec, []networkv1alpha1.BridgeAddress{{Bridge: "br10", Address: "10.10.0.1/24"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if mtu := ns.Link("br10").Attrs().MTU; mtu != 1400 {
+		t.Errorf("bridge mtu = %d, want 1400", mtu)
+	}
+	routes := ns.Routes("br10")
+	for _, dst := range []string{"10.10.0.0/24", "10.20.0.0/16"} {
+		if !slices.Contains(routes, dst) {
+			t.Errorf("routes via br10 = %q, want %s", routes, dst)
+		}
+	}
+	requireNoDrift(t, h, &spec)
+
+	// Applying the spec again changes nothing
+	if err := CreateNetwork(ctx, h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Address pool removed from the spec takes its address away from the bridge
+	next := *spec.DeepCopy()
+	next.Bridge[0].AddressPool = ""
+	diffNetwork(t, h, spec, next)
+
+	if routes := ns.Routes("br10"); slices.Contains(routes, "10.10.0.0/24") {
+		t.Errorf("routes via br10 = %q, want the pool gone", routes)
+	}
+
+	if err := DeleteNetwork(ctx, h, &next, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if ns.LinkExists("br10") {
+		t.Error("bridge br10 was not removed")
+	}
+	if !ns.LinkExists("eth1") {
+		t.Error("uplink eth1 was removed")
+	}
+
+	// Network which is gone already is not an error
+	if err := DeleteNetwork(ctx, h, &next, nil); err != nil {
+		t.Errorf("DeleteNetwork() of the removed network: %v", err)
+	}
+}
+
+func TestNetworkVlanLifecycle(t *testing.T) {
+	ns := netnstest.New(t)
+	ns.AddUplink("eth1")
+	ns.RequireVlan("eth1")
+
+	ctx := context.Background()
+	h := netnsHost()
+
+	spec := networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{
+			Name:  "br10",
+			Mtu:   1400,
+			Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 10, Mtu: 1400}, {Name: "eth1", Vlan: 20, Mtu: 1400}},
+		}},
+	}
+
+	if err := CreateNetwork(ctx, h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if ports, want := ns.Ports("br10"), []string{"eth1.10", "eth1.20"}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("bridge ports = %q, want %q", ports, want)
+	}
+	requireNoDrift(t, h, &spec)
+
+	// Port removed from the spec is detached and deleted
+	next := *spec.DeepCopy()
+	next.Bridge[0].Ports = next.Bridge[0].Ports[:1]
+	diffNetwork(t, h, spec, next)
+
+	if ns.LinkExists("eth1.20") {
+		t.Error("vlan eth1.20 was not removed")
+	}
+	if ports, want := ns.Ports("br10"), []string{"eth1.10"}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("bridge ports = %q, want %q", ports, want)
+	}
+	requireNoDrift(t, h, &next)
+
+	if err := DeleteNetwork(ctx, h, &next, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"br10", "eth1.10"} {
+		if ns.LinkExists(name) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+	if !ns.LinkExists("eth1") {
+		t.Error("uplink eth1 was removed")
+	}
+}
+
+func TestNetworkMasqueradeLifecycle(t *testing.T) {
+	ns := netnstest.New(t)
+	netnstest.RequireCommand(t, "iptables", "ipset", "ebtables-nft")
+	ns.AddUplink("eth1")
+
+	ctx := context.Background()
+	h := host.New()
+
+	spec := networkv1alpha1.NetworkAttachmentSpec{
+		Bridge:       []networkv1alpha1.Bridge{{Name: "br10"}},
+		IpMasq:       networkv1alpha1.Masquerade{Enabled: true, Bridge: "br10", Source: "10.10.0.0/24"},
+		PortForwards: []networkv1alpha1.PortForward{{Protocol: "tcp", ExternalPort: 2222, InternalAddress: "10.10.0.2", InternalPort: 22}},
+	}
+
+	if err := CreateNetwork(ctx, h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if rules, err := h.NAT.ListRules("br10"); err != nil || len(rules) == 0 {
+		t.Errorf("nat rules = %q, %v, want masquerade and port forwards", rules, err)
+	}
+	if rules, err := h.Filter.ListRules("br10"); err != nil || len(rules) != 1 {
+		t.Errorf("ebtables rules = %q, %v, want the gateway rule", rules, err)
+	}
+	if v, err := h.Sysctl.Sysctl(fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, "br10")); err != nil || v != "1" {
+		t.Errorf("proxy_arp = %q, %v, want 1", v, err)
+	}
+	requireNoDrift(t, h, &spec)
+
+	if err := DeleteNetwork(ctx, h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if rules, err := h.NAT.ListRules("br10"); err != nil || len(rules) != 0 {
+		t.Errorf("nat rules = %q, %v, want none", rules, err)
+	}
+	if rules, err := h.Filter.ListRules("br10"); err != nil || len(rules) != 0 {
+		t.Errorf("ebtables rules = %q, %v, want none", rules, err)
+	}
+}
+
+func TestAnycastGatewayLifecycle(t *testing.T) {
+	ns := netnstest.New(t)
+
+	ctx := context.Background()
+	h := netnsHost()
+
+	spec := networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10"}},
+		IpMasq: networkv1alpha1.Masquerade{
+			Enabled:     true,
+			Bridge:      "br10",
+			Source:      "10.10.0.0/24",
+			GatewayMode: networkv1alpha1.GatewayModeAnycast,
+		},
+	}
+
+	gw := net.ParseIP(virtualIpaddress)
+	mac := anycastGatewayMAC("br10", gw)
+
+	hasGateway := func(name string) bool {
+		addrs, err := netlink.AddrList(ns.Link(name), netlink.FAMILY_V4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(gw) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if err := CreateNetwork(ctx, h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bridge keeps its own mac, the gateway one is on the macvlan
+	if got := ns.Link("br10").Attrs().HardwareAddr.String(); got == mac.String() {
+		t.Errorf("bridge mac = %s, want its own one", got)
+	}
+	link := ns.Link(gatewayInterface("br10"))
+	if link.Type() != "macvlan" || link.Attrs().HardwareAddr.String() != mac.String() {
+		t.Errorf("gateway interface type = %s, mac = %s, want macvlan with %s", link.Type(), link.Attrs().HardwareAddr, mac)
+	}
+	if !hasGateway(gatewayInterface("br10")) || hasGateway("br10") {
+		t.Error("gateway address is not on the gateway interface only")
+	}
+	if v, err := h.Sysctl.Sysctl(fmt.Sprintf(IPv4InterfaceArpIgnoreSysctlTemplate, "br10")); err != nil || v != "1" {
+		t.Errorf("arp_ignore = %q, %v, want 1", v, err)
+	}
+	requireNoDrift(t, h, &spec)
+
+	// Gateway configured on the bridge by an earlier release is moved to the macvlan
+	if err := netlink.LinkSetHardwareAddr(ns.Link("br10"), mac); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.AddrReplace(ns.Link("br10"), &netlink.Addr{IPNet: &net.IPNet{IP: gw, Mask: net.CIDRMask(32, 32)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateNetwork(ctx, h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := ns.Link("br10").Attrs().HardwareAddr.String(); got == mac.String() {
+		t.Errorf("bridge mac = %s, want it restored", got)
+	}
+	if hasGateway("br10") {
+		t.Error("gateway address was left on the bridge")
+	}
+
+	// Mode change removes the anycast gateway
+	next := *spec.DeepCopy()
+	next.IpMasq.GatewayMode = networkv1alpha1.GatewayModeProxyARP
+	diffNetwork(t, h, spec, next)
+
+	if ns.LinkExists(gatewayInterface("br10")) {
+		t.Error("gateway interface was not removed after the mode change")
+	}
+	if v, err := h.Sysctl.Sysctl(fmt.Sprintf(IPv4InterfaceArpIgnoreSysctlTemplate, "br10")); err != nil || v != "0" {
+		t.Errorf("arp_ignore = %q, %v, want 0", v, err)
+	}
+
+	if err := CreateNetwork(ctx, h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteMasquerade(h, &spec.IpMasq); err != nil {
+		t.Fatal(err)
+	}
+	if ns.LinkExists(gatewayInterface("br10")) {
+		t.Error("gateway interface was not removed with the masquerade")
+	}
+}
+
+func TestRouterAdvertiserLifecycle(t *testing.T) {
+	netnstest.New(t)
+
+	ctx := context.Background()
+	h := netnsHost()
+
+	spec := networkv1alpha1.NetworkAttachmentSpec{
+		Bridge:              []networkv1alpha1.Bridge{{Name: "br10"}},
+		RouterAdvertisement: &networkv1alpha1.RouterAdvertisement{Enabled: true, Bridge: "br10"},
+	}
+	if err := CreateNetwork(ctx, h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &NetworkAttachmentReconciler{Host: h}
+	na := &networkv1alpha1.NetworkAttachment{ObjectMeta: metav1.ObjectMeta{Name: "node1-vm-network", Namespace: "default"}, Spec: spec}
+
+	gateway := func() bool {
+		t.Helper()
+
+		addrs, err := h.Links.AddrList(mustLink(t, h, "br10"), netlink.FAMILY_V6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return slices.ContainsFunc(addrs, func(a netlink.Addr) bool { return a.IP.Equal(net.ParseIP(defaultRAGateway)) })
+	}
+
+	if err := r.syncRouterAdvertiser(ctx, na); err != nil {
+		t.Fatal(err)
+	}
+	if !gateway() {
+		t.Errorf("expected %s on br10", defaultRAGateway)
+	}
+
+	// Advertisements are turned off, the gateway goes away with them
+	na.Spec.RouterAdvertisement.Enabled = false
+	if err := r.syncRouterAdvertiser(ctx, na); err != nil {
+		t.Fatal(err)
+	}
+	if gateway() {
+		t.Errorf("expected %s to be removed from br10", defaultRAGateway)
+	}
+	if len(r.advertisers) != 0 {
+		t.Errorf("advertisers = %v, want none", r.advertisers)
+	}
+}
+
+func TestDeleteBridgeGatewayMissingLink(t *testing.T) {
+	netnstest.New(t)
+
+	gw := net.ParseIP("169.254.1.1")
+
+	// Netlink and the fake report a missing link differently, both are nothing to clean up
+	for name, h := range map[string]*host.Host{"netlink": host.New(), "fake": fake.New().Host()} {
+		if err := deleteBridgeGateway(h, "br10-gw", gw, nil); err != nil {
+			t.Errorf("%s: deleteBridgeGateway() of a missing link: %v", name, err)
+		}
+	}
+}
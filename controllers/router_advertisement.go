@@ -0,0 +1,296 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/ebtables"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
+	"github.com/NCCloud/tabby-cni/pkg/ndp"
+)
+
+const (
+	defaultRAGateway         string        = "fe80::1"
+	defaultValidLifetime     time.Duration = 86400 * time.Second
+	defaultPreferredLifetime time.Duration = 14400 * time.Second
+	// Number of router advertisements sent after migration of a virtual machine
+	raBurstCount int = 3
+)
+
+type routerAdvertiser struct {
+	config     ndp.RAConfig
+	advertiser *ndp.Advertiser
+	// Index of the interface the advertisements are sent from
+	index int
+	// Gateway address which was configured on the interface for the advertisements
+	address net.IP
+}
+
+// Link-local gateway of the advertisements is configured on the interface, unless it's the
+// gateway of the masquerade which is configured by the masquerade itself. Returns the
+// address which was added for the advertisements.
+func raGatewayAddress(h *host.Host, ipmasq *networkv1alpha1.Masquerade, config *ndp.RAConfig) (net.IP, error) {
+	if err := addGatewayAddress(h, config.Source, config.Interface); err != nil {
+		return nil, err
+	}
+
+	if ipmasq.Enabled {
+		gw, err := gatewayAddress(ipmasq)
+		if err != nil {
+			return nil, err
+		}
+
+		if gw.Equal(config.Source) {
+			return nil, nil
+		}
+	}
+
+	return config.Source, nil
+}
+
+// Every node advertises the same router to the virtual machines on the node, make sure
+// the advertisements don't leave the node via the uplink ports of the bridge
+func raFilterRules(spec *networkv1alpha1.NetworkAttachmentSpec) map[string][][]string {
+	ra := spec.RouterAdvertisement
+	if ra == nil || !ra.Enabled {
+		return nil
+	}
+
+	bridge := ra.Bridge
+	if bridge == "" {
+		bridge = spec.IpMasq.Bridge
+	}
+
+	rules := map[string][][]string{}
+
+	for _, uplink := range bridgePorts(spec, bridge) {
+		// ebtables-nft -I OUTPUT -p IPv6 -o eth1.10 --logical-out br10 --ip6-proto ipv6-icmp --ip6-icmp-type router-advertisement -j DROP
+		rule := []string{"-p", "IPv6", "-o", uplink, "--logical-out", bridge, "--ip6-proto", "ipv6-icmp", "--ip6-icmp-type", "router-advertisement", "-j", "DROP"}
+
+		rules[ebtables.ChainForward] = append(rules[ebtables.ChainForward], rule)
+		rules[ebtables.ChainOutput] = append(rules[ebtables.ChainOutput], rule)
+	}
+
+	return rules
+}
+
+// Resolve the router advertisement configuration, defaults come from the masquerade configuration
+func raConfig(ra *networkv1alpha1.RouterAdvertisement, ipmasq *networkv1alpha1.Masquerade) (ndp.RAConfig, error) {
+	config := ndp.RAConfig{
+		Interface:      ra.Bridge,
+		Managed:        ra.Managed,
+		OtherConfig:    ra.OtherConfig,
+		RouterLifetime: time.Duration(ra.RouterLifetime) * time.Second,
+		RDNSSLifetime:  time.Duration(ra.RDNSSLifetime) * time.Second,
+		MTU:            ra.MTU,
+		Interval:       time.Duration(ra.Interval) * time.Second,
+	}
+
+	if config.Interface == "" {
+		config.Interface = ipmasq.Bridge
+	}
+
+	if config.Interface == "" {
+		return config, fmt.Errorf("router advertisements require a bridge")
+	}
+
+	// Gateway with its own mac address advertises from its macvlan interface
+	if ipmasq.Enabled && config.Interface == ipmasq.Bridge {
+		gw, err := gatewayAddress(ipmasq)
+		if err != nil {
+			return config, err
+		}
+
+		mac, err := gatewayMAC(ipmasq, gw)
+		if err != nil {
+			return config, err
+		}
+
+		if mac != nil {
+			config.Interface = gatewayInterface(ipmasq.Bridge)
+		}
+	}
+
+	gateway := ra.Gateway
+	if gateway == "" {
+		gateway = defaultRAGateway
+		if gw := net.ParseIP(ipmasq.Gateway); ipmasq.Enabled && gw != nil && gw.To4() == nil {
+			gateway = ipmasq.Gateway
+		}
+	}
+
+	config.Source = net.ParseIP(gateway)
+	if config.Source == nil || config.Source.To4() != nil || !config.Source.IsLinkLocalUnicast() {
+		return config, fmt.Errorf("router advertisement gateway must be an IPv6 link-local address, got %q", gateway)
+	}
+
+	if config.RouterLifetime == 0 {
+		config.RouterLifetime = ndp.DefaultRouterLifetime
+	}
+
+	if config.RDNSSLifetime == 0 {
+		config.RDNSSLifetime = config.RouterLifetime
+	}
+
+	for _, p := range ra.Prefixes {
+		_, prefix, err := net.ParseCIDR(p.Prefix)
+		if err != nil || prefix.IP.To4() != nil {
+			return config, fmt.Errorf("invalid IPv6 prefix %q", p.Prefix)
+		}
+
+		rp := ndp.Prefix{
+			Prefix:            prefix,
+			OnLink:            p.OnLink == nil || *p.OnLink,
+			Autonomous:        p.Autonomous == nil || *p.Autonomous,
+			ValidLifetime:     time.Duration(p.ValidLifetime) * time.Second,
+			PreferredLifetime: time.Duration(p.PreferredLifetime) * time.Second,
+		}
+
+		if rp.ValidLifetime == 0 {
+			rp.ValidLifetime = defaultValidLifetime
+		}
+
+		if rp.PreferredLifetime == 0 {
+			rp.PreferredLifetime = defaultPreferredLifetime
+		}
+
+		config.Prefixes = append(config.Prefixes, rp)
+	}
+
+	for _, dns := range ra.RDNSS {
+		ip := net.ParseIP(dns)
+		if ip == nil || ip.To4() != nil {
+			return config, fmt.Errorf("invalid IPv6 dns server %q", dns)
+		}
+		config.RDNSS = append(config.RDNSS, ip)
+	}
+
+	return config, nil
+}
+
+// Start, restart or stop router advertisements of the network attachment
+func (r *NetworkAttachmentReconciler) syncRouterAdvertiser(ctx context.Context, na *networkv1alpha1.NetworkAttachment) error {
+	key := types.NamespacedName{Namespace: na.Namespace, Name: na.Name}
+
+	ra := na.Spec.RouterAdvertisement
+	if ra == nil || !ra.Enabled {
+		return r.stopRouterAdvertiser(ctx, key)
+	}
+
+	config, err := raConfig(ra, &na.Spec.IpMasq)
+	if err != nil {
+		return err
+	}
+
+	r.raMu.Lock()
+	defer r.raMu.Unlock()
+
+	index := linkIndex(r.Host, config.Interface)
+
+	current, ok := r.advertisers[key]
+	if ok && reflect.DeepEqual(current.config, config) && current.index == index {
+		return nil
+	}
+
+	if ok {
+		log.FromContext(ctx).Info("Restarting router advertisements", logging.KeyInterface, current.config.Interface)
+		if err := current.advertiser.Close(); err != nil {
+			return err
+		}
+		delete(r.advertisers, key)
+
+		if current.address != nil && (!current.address.Equal(config.Source) || current.config.Interface != config.Interface) {
+			if err := deleteBridgeGateway(r.Host, current.config.Interface, current.address, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Advertisements are sent from the gateway address, so it must be configured on the bridge
+	address, err := raGatewayAddress(r.Host, &na.Spec.IpMasq, &config)
+	if err != nil {
+		return err
+	}
+
+	advertiser := ndp.NewAdvertiser(config)
+	if err := advertiser.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start router advertisements on %s: %v", config.Interface, err)
+	}
+
+	log.FromContext(ctx).Info("Started router advertisements", logging.KeyInterface, config.Interface)
+
+	if r.advertisers == nil {
+		r.advertisers = map[types.NamespacedName]*routerAdvertiser{}
+	}
+	r.advertisers[key] = &routerAdvertiser{config: config, advertiser: advertiser, index: index, address: address}
+
+	return nil
+}
+
+// Record what syncRouterAdvertiser would do with the router advertisements of the attachment
+func (r *NetworkAttachmentReconciler) planRouterAdvertiser(recorder *host.Recorder, na *networkv1alpha1.NetworkAttachment) error {
+	r.raMu.Lock()
+	current, ok := r.advertisers[types.NamespacedName{Namespace: na.Namespace, Name: na.Name}]
+	r.raMu.Unlock()
+
+	ra := na.Spec.RouterAdvertisement
+	if ra == nil || !ra.Enabled {
+		if ok {
+			recorder.Record("stop router advertisements on %s", current.config.Interface)
+			if current.address != nil {
+				return deleteBridgeGateway(recorder.Host(), current.config.Interface, current.address, nil)
+			}
+		}
+		return nil
+	}
+
+	config, err := raConfig(ra, &na.Spec.IpMasq)
+	if err != nil {
+		return err
+	}
+
+	if ok && reflect.DeepEqual(current.config, config) && current.index == linkIndex(recorder.Host(), config.Interface) {
+		return nil
+	}
+
+	if ok {
+		recorder.Record("restart router advertisements on %s", config.Interface)
+	} else {
+		recorder.Record("start router advertisements on %s", config.Interface)
+	}
+
+	_, err = raGatewayAddress(recorder.Host(), &na.Spec.IpMasq, &config)
+	return err
+}
+
+func (r *NetworkAttachmentReconciler) stopRouterAdvertiser(ctx context.Context, key types.NamespacedName) error {
+	r.raMu.Lock()
+	defer r.raMu.Unlock()
+
+	current, ok := r.advertisers[key]
+	if !ok {
+		return nil
+	}
+
+	log.FromContext(ctx).Info("Stopping router advertisements", logging.KeyInterface, current.config.Interface)
+
+	delete(r.advertisers, key)
+
+	if err := current.advertiser.Close(); err != nil {
+		return err
+	}
+
+	if current.address == nil {
+		return nil
+	}
+
+	return deleteBridgeGateway(r.Host, current.config.Interface, current.address, nil)
+}
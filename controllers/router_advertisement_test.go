@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/ebtables"
+	"github.com/NCCloud/tabby-cni/pkg/host/fake"
+)
+
+func TestRouterAdvertisementIsolation(t *testing.T) {
+	node := fake.New()
+	node.Links.Add(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}})
+	h := node.Host()
+
+	spec := networkv1alpha1.NetworkAttachmentSpec{
+		Bridge: []networkv1alpha1.Bridge{{Name: "br10", Ports: []networkv1alpha1.Port{{Name: "eth1", Vlan: 10}, {Name: "eth1", Vlan: 20}}}},
+		RouterAdvertisement: &networkv1alpha1.RouterAdvertisement{
+			Enabled: true,
+			Bridge:  "br10",
+		},
+	}
+
+	if err := CreateNetwork(context.Background(), h, &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Advertisements of the node and forwarded ones are dropped on every uplink
+	for _, chain := range []string{ebtables.ChainForward, ebtables.ChainOutput} {
+		for _, uplink := range []string{"eth1.10", "eth1.20"} {
+			rule := "-p IPv6 -o " + uplink + " --logical-out br10 --ip6-proto ipv6-icmp --ip6-icmp-type router-advertisement -j DROP"
+			if !strings.Contains(strings.Join(node.Filter.Rules[chain], "\n"), rule) {
+				t.Errorf("%s rules = %q, want %q", chain, node.Filter.Rules[chain], rule)
+			}
+		}
+	}
+	requireNoDrift(t, h, &spec)
+
+	// Removed uplink takes its rules away
+	next := *spec.DeepCopy()
+	next.Bridge[0].Ports = next.Bridge[0].Ports[:1]
+	diffNetwork(t, h, spec, next)
+
+	if rules, _ := h.Filter.ListRules("eth1.20"); len(rules) != 0 {
+		t.Errorf("rules of the removed uplink = %q", rules)
+	}
+	if rules, _ := h.Filter.ListRules("eth1.10"); len(rules) != 2 {
+		t.Errorf("rules of eth1.10 = %q, want two", rules)
+	}
+}
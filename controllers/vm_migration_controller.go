@@ -19,13 +19,12 @@ package controllers
 import (
 	"context"
 	"fmt"
-	"net"
-	"strings"
 
 	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
-	"github.com/j-keck/arping"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	virtv1 "kubevirt.io/api/core/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -37,15 +36,18 @@ import (
 // VirtualMachineReconciler makes sure the VM has a correct mac address on the switch
 type VirtualMachineReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Host     *host.Host
 }
 
 //+kubebuilder:rbac:groups=kubevirt.io,resources=virtualmachineinstances,verbs=get;list;watch
+//+kubebuilder:rbac:groups=k8s.cni.cncf.io,resources=network-attachment-definitions,verbs=get;list;watch
 
 func (r *VirtualMachineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	ctx, logger := reconcileLogger(ctx, "virtualmachine", "vmi", req.NamespacedName.String())
 
-	log.Log.Info(fmt.Sprintf("VirtualMachine: Reconcile Virtual Machine %+v", req))
+	logger.Info("Reconcile virtual machine")
 
 	virtualMachineInstance := &virtv1.VirtualMachineInstance{}
 	err := r.Get(ctx, req.NamespacedName, virtualMachineInstance)
@@ -62,56 +64,67 @@ func (r *VirtualMachineReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 			continue
 		}
 
-		networkName := multusNetwork.NetworkName
-		namespacedNetworkName := getNamespacedNetworkName(networkName)
-
-		network := &networkv1alpha1.Network{}
-		err := r.Get(ctx, namespacedNetworkName, network)
+		network, err := ResolveNetwork(ctx, r.Client, virtualMachineInstance.Namespace, multusNetwork.NetworkName)
 		if err != nil {
-			return ctrl.Result{}, fmt.Errorf("failed to find Network %s: %v", networkName, err)
+			return ctrl.Result{}, err
 		}
 
 		networkIpMasq := network.Spec.IpMasq
+
+		// guests learn the default gateway on the new node from router advertisements
+		if ra := network.Spec.RouterAdvertisement; ra != nil && ra.Enabled {
+			config, err := raConfig(ra, &networkIpMasq)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+
+			logger.Info("Sending router advertisements", logging.KeyInterface, config.Interface)
+			if err := r.Host.NDP.SendRouterAdvertisements(&config, raBurstCount); err != nil {
+				return ctrl.Result{}, fmt.Errorf("failed to send router advertisements for VM %v: %v", req, err)
+			}
+		}
+
 		// send a garp request only if IP masquerading is enabled
 		if !networkIpMasq.Enabled {
 			continue
 		}
 
+		// anycast gateway has the same mac address on every node, nothing to re-resolve
+		if networkIpMasq.GatewayMode == networkv1alpha1.GatewayModeAnycast {
+			continue
+		}
+
+		gw, err := gatewayAddress(&networkIpMasq)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		mac, err := gatewayMAC(&networkIpMasq, gw)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
 		// arping -A -i <interface-name> -S 169.254.1.1 169.254.1.1
 		interfaceName := networkIpMasq.Bridge
-		log.Log.Info(
-			fmt.Sprintf(
-				"VirtualMachine: Sending a garp request to IP %s on interface %s for VM %s",
-				virtualIpaddress, interfaceName, req.Name),
-		)
-		err = arping.GratuitousArpOverIfaceByName(net.ParseIP(virtualIpaddress), interfaceName)
+		if mac != nil {
+			interfaceName = gatewayInterface(networkIpMasq.Bridge)
+		}
+		logger.Info("Sending a garp request", "gateway", gw, logging.KeyBridge, interfaceName)
+		err = announceGateway(r.Host, gw, interfaceName)
+		observeGarp(GarpSourceVirtualMachine, err)
 		if err != nil {
+			recorderEvents(r.Recorder, virtualMachineInstance).warning(ReasonGarpFailed,
+				fmt.Sprintf("Failed to announce gateway %s on bridge %s after migration: %v", gw, interfaceName, err))
 			return ctrl.Result{}, fmt.Errorf("failed to send an arp request for VM %v: %v", req, err)
 		}
 
+		recorderEvents(r.Recorder, virtualMachineInstance).normal(ReasonGarpSent,
+			fmt.Sprintf("Announced gateway %s on bridge %s after migration", gw, interfaceName))
 	}
 
 	return ctrl.Result{}, nil
 }
 
-// Given a network name of the KubeVirt VM object,
-// construct a namespaced name that can be used in API requests
-func getNamespacedNetworkName(networkName string) types.NamespacedName {
-	var namespacedNetworkName types.NamespacedName
-
-	networkNameParts := strings.Split(networkName, "/")
-	// this means the network is provided with the namespace
-	// default/network-name
-	if len(networkNameParts) == 2 {
-		namespacedNetworkName.Namespace = networkNameParts[0]
-		namespacedNetworkName.Name = networkNameParts[1]
-	} else {
-		namespacedNetworkName.Name = networkNameParts[0]
-	}
-
-	return namespacedNetworkName
-}
-
 // check if the migration status of the VMI object indicates that the migration was successful
 func migrationSuccessful(vmi virtv1.VirtualMachineInstance) bool {
 	// the migration has not yet been performed on this VM
@@ -125,16 +138,17 @@ func migrationSuccessful(vmi virtv1.VirtualMachineInstance) bool {
 	return vmi.Status.MigrationState.Completed && !vmi.Status.MigrationState.Failed
 }
 
-func filterVirtualMachineMigrationEvents(e event.UpdateEvent) bool {
+// check if the update event is the one in which the migration of the VMI has just succeeded
+func migrationCompleted(e event.UpdateEvent) (*virtv1.VirtualMachineInstance, bool) {
 
 	newVirtualMachineInstanceObj, ok := e.ObjectNew.(*virtv1.VirtualMachineInstance)
 	if !ok {
-		return false
+		return nil, false
 	}
 
 	oldVirtualMachineInstanceObj, ok := e.ObjectOld.(*virtv1.VirtualMachineInstance)
 	if !ok {
-		return false
+		return nil, false
 	}
 
 	newMigrationSuccessful := migrationSuccessful(*newVirtualMachineInstanceObj)
@@ -142,17 +156,30 @@ func filterVirtualMachineMigrationEvents(e event.UpdateEvent) bool {
 
 	// the migration has not succeeded yet
 	if !newMigrationSuccessful {
-		return false
+		return nil, false
 	}
 
 	// the migration state is the same, e.g. true and true; don't send a duplicate arp request
 	if newMigrationSuccessful == oldMigrationSuccessful {
+		return nil, false
+	}
+
+	return newVirtualMachineInstanceObj, true
+}
+
+// Predicates have no context, events are logged by the logger of the controller
+var filterLog = log.Log.WithName("virtualmachine")
+
+func filterVirtualMachineMigrationEvents(e event.UpdateEvent) bool {
+
+	newVirtualMachineInstanceObj, ok := migrationCompleted(e)
+	if !ok {
 		return false
 	}
 
 	hostname, err := getHostname()
 	if err != nil {
-		log.Log.Error(err, "VirtualMachine Filter: Failed to get node hostname, skipping the event")
+		filterLog.Error(err, "Failed to get node hostname, skipping the event")
 		return false
 	}
 
@@ -163,12 +190,16 @@ func filterVirtualMachineMigrationEvents(e event.UpdateEvent) bool {
 	}
 
 	vmiName := newVirtualMachineInstanceObj.Name
-	log.Log.Info(fmt.Sprintf("VirtualMachine Filter: VM %s has completed the migration", vmiName))
+	filterLog.Info("VM has completed the migration", "vmi", vmiName, logging.KeyNode, hostname)
 	return true
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *VirtualMachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// Kernel of the node, unless another host is injected, e.g. in tests
+	if r.Host == nil {
+		r.Host = host.New()
+	}
 
 	p := predicate.Funcs{
 		CreateFunc: func(e event.CreateEvent) bool {
@@ -188,5 +219,5 @@ func (r *VirtualMachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&virtv1.VirtualMachineInstance{}).
 		WithEventFilter(p).
-		Complete(r)
+		Complete(instrument("virtualmachine", r))
 }
@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	virtv1 "kubevirt.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+	"github.com/NCCloud/tabby-cni/pkg/host/fake"
+)
+
+func TestVirtualMachineMigration(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := virtv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := networkv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	network := &networkv1alpha1.Network{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm-network", Namespace: "default"},
+		Spec: networkv1alpha1.NetworkSpec{
+			Bridge:              []networkv1alpha1.Bridge{{Name: "br10"}},
+			IpMasq:              networkv1alpha1.Masquerade{Enabled: true, Bridge: "br10", Source: "10.10.0.0/24"},
+			RouterAdvertisement: &networkv1alpha1.RouterAdvertisement{Enabled: true},
+		},
+	}
+	vmi := &virtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm1", Namespace: "default"},
+		Spec: virtv1.VirtualMachineInstanceSpec{
+			Networks: []virtv1.Network{{
+				Name:          "vm-network",
+				NetworkSource: virtv1.NetworkSource{Multus: &virtv1.MultusNetwork{NetworkName: "vm-network"}},
+			}},
+		},
+	}
+
+	node := fake.New()
+	r := &VirtualMachineReconciler{
+		Client:   fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(network, vmi).Build(),
+		Scheme:   scheme,
+		Recorder: record.NewFakeRecorder(20),
+		Host:     node.Host(),
+	}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "vm1"}}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// Guests learn the gateway of the new node from the burst and the gratuitous arp
+	if len(node.NDP.Advertisements) != 1 || node.NDP.Advertisements[0].Interface != "br10" || node.NDP.Advertisements[0].Count != raBurstCount {
+		t.Errorf("router advertisements = %+v, want a burst on br10", node.NDP.Advertisements)
+	}
+	if len(node.ARP.Announcements) != 1 || node.ARP.Announcements[0].Interface != "br10" {
+		t.Errorf("announcements = %+v, want the gateway on br10", node.ARP.Announcements)
+	}
+}
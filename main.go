@@ -18,16 +18,22 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/config"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/server"
@@ -35,6 +41,7 @@ import (
 	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
 	"github.com/NCCloud/tabby-cni/controllers"
 	commmon "github.com/NCCloud/tabby-cni/pkg/common"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
 	virtv1 "kubevirt.io/api/core/v1"
 	//+kubebuilder:scaffold:imports
 )
@@ -64,17 +71,41 @@ func main() {
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
-
 	operatorConfig := commmon.NewConfig()
 
+	levels, err := logging.ParseLevels(operatorConfig.LogLevels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to parse log levels: %v\n", err)
+		os.Exit(1)
+	}
+
+	logger, err := logging.New(operatorConfig.LogFormat, levels, zap.UseFlagOptions(&opts))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create logger: %v\n", err)
+		os.Exit(1)
+	}
+	ctrl.SetLogger(logger)
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme: scheme,
 		Metrics: server.Options{
 			BindAddress: metricsAddr,
 		},
 		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         false,
+		// Only the generation of NetworkAttachmentDefinitions is cluster-wide, the other
+		// controllers manage the node the agent runs on and don't wait for the leader
+		LeaderElection:   operatorConfig.EnableNetworkAttachmentDefinition,
+		LeaderElectionID: "tabby-cni.cloud.spaceship.com",
+		Controller:       config.Controller{NeedLeaderElection: pointer.Bool(false)},
+		// Every node runs the agent, keep its cache small
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.Node{}: {Transform: controllers.TrimNode},
+			},
+		},
+		Client: client.Options{
+			Cache: &client.CacheOptions{DisableFor: controllers.UncachedObjects()},
+		},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -82,28 +113,52 @@ func main() {
 	}
 
 	if err = (&controllers.NetworkReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("tabby-cni"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Network")
 		os.Exit(1)
 	}
 	if err = (&controllers.NetworkAttachmentReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:         mgr.GetClient(),
+		Scheme:         mgr.GetScheme(),
+		Recorder:       mgr.GetEventRecorderFor("tabby-cni"),
+		ResyncInterval: operatorConfig.ResyncInterval,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "NetworkAttachment")
 		os.Exit(1)
 	}
 	if operatorConfig.WatchKubevirtMigration {
 		if err = (&controllers.VirtualMachineReconciler{
-			Client: mgr.GetClient(),
-			Scheme: mgr.GetScheme(),
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor("tabby-cni"),
 		}).SetupWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create controller", "controller", "VirtualMachine")
 			os.Exit(1)
 		}
 	}
+	if operatorConfig.EnableFloatingIP {
+		if err = (&controllers.FloatingIPReconciler{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor("tabby-cni"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "FloatingIP")
+			os.Exit(1)
+		}
+	}
+	if operatorConfig.EnableNetworkAttachmentDefinition {
+		if err = (&controllers.NetworkAttachmentDefinitionReconciler{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor("tabby-cni"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "NetworkAttachmentDefinition")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
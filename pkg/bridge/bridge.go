@@ -2,14 +2,12 @@ package bridge
 
 import (
 	"fmt"
-	"os"
+	"net"
 	"syscall"
 
 	"github.com/vishvananda/netlink"
 )
 
-const SYSFS_PATH = "/sys/class/net/%s/brif/"
-
 type Bridge struct {
 	Name  string
 	Mtu   int
@@ -41,6 +39,13 @@ func (bridge *Bridge) Create() (*netlink.Bridge, error) {
 		return nil, err
 	}
 
+	// Existing bridge could have another mtu
+	if bridge.Mtu != 0 {
+		if err = netlink.LinkSetMTU(br, bridge.Mtu); err != nil {
+			return nil, fmt.Errorf("failed to set mtu %d of bridge %s: %v", bridge.Mtu, bridge.Name, err)
+		}
+	}
+
 	if err = netlink.LinkSetUp(br); err != nil {
 		return nil, err
 	}
@@ -87,16 +92,26 @@ func (bridge *Bridge) Remove() error {
 	return nil
 }
 
+// BridgeListPorts returns the names of the interfaces attached to the bridge.
+// Links are listed over netlink rather than sysfs, which shows the interfaces
+// of the namespace it was mounted in.
 func BridgeListPorts(name string) ([]string, error) {
 	var ports []string
 
-	files, err := os.ReadDir(fmt.Sprintf(SYSFS_PATH, name))
+	br, err := netlink.LinkByName(name)
 	if err != nil {
-		return nil, fmt.Errorf("unable to find bridge path %w", err)
+		return nil, fmt.Errorf("unable to find bridge %s: %w", name, err)
 	}
 
-	for _, file := range files {
-		ports = append(ports, file.Name())
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+
+	for _, link := range links {
+		if link.Attrs().MasterIndex == br.Attrs().Index {
+			ports = append(ports, link.Attrs().Name)
+		}
 	}
 
 	return ports, nil
@@ -107,13 +122,12 @@ func (bridge *Bridge) AddPort(port *Port) error {
 		port.Mtu = bridge.Mtu
 	}
 
-	if port.Vlan == 0 {
-
-	} else {
-		AddVlan(port.Name, port.Vlan, port.Mtu)
+	if port.Vlan != 0 {
+		if _, err := AddVlan(port.Name, port.Vlan, port.Mtu); err != nil {
+			return err
+		}
 	}
 
-	fmt.Println(port.Mtu)
 	return nil
 }
 
@@ -126,9 +140,9 @@ func DeletePort(name string) error {
 		return err
 	}
 
-	// Allow to remove vlan interface for now
-	if port.Type() != "vlan" {
-		return fmt.Errorf("only vlan interface could be removed: name: %s, type: %s", name, port.Type())
+	// Allow to remove vlan and macvlan interfaces for now
+	if port.Type() != "vlan" && port.Type() != "macvlan" {
+		return fmt.Errorf("only vlan or macvlan interface could be removed: name: %s, type: %s", name, port.Type())
 	}
 
 	if err = netlink.LinkSetNoMaster(port); err != nil {
@@ -164,6 +178,12 @@ func AddVlan(iface string, vlanId int, mtu int) (*netlink.Vlan, error) {
 		return nil, fmt.Errorf("failed to add a new link device vlan=%+v, error=%v", vlan, err)
 	}
 
+	if mtu != 0 {
+		if err = netlink.LinkSetMTU(vlan, mtu); err != nil {
+			return nil, fmt.Errorf("failed to set mtu %d of vlan %s: %v", mtu, vlan.Name, err)
+		}
+	}
+
 	if err = netlink.LinkSetUp(vlan); err != nil {
 		return nil, fmt.Errorf("failed to enable the link vlan=%+v, error=%v", vlan, err)
 	}
@@ -171,6 +191,43 @@ func AddVlan(iface string, vlanId int, mtu int) (*netlink.Vlan, error) {
 	return vlan, nil
 }
 
+// AddMacvlan creates the macvlan interface on top of the parent, e.g. the bridge,
+// with the given mac address and sets it up. Private mode keeps it apart from
+// other macvlan interfaces of the parent.
+func AddMacvlan(parent string, name string, mac net.HardwareAddr) (*netlink.Macvlan, error) {
+
+	parentLink, err := netlink.LinkByName(parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find a link by name %s: %v", parent, err)
+	}
+
+	macvlan := &netlink.Macvlan{
+		Mode: netlink.MACVLAN_MODE_PRIVATE,
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         name,
+			HardwareAddr: mac,
+			TxQLen:       -1,
+			ParentIndex:  parentLink.Attrs().Index,
+		},
+	}
+
+	err = netlink.LinkAdd(macvlan)
+	if err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("failed to add a new link device macvlan=%+v, error=%v", macvlan, err)
+	}
+
+	// Existing interface could have another mac address
+	if err = netlink.LinkSetHardwareAddr(macvlan, mac); err != nil {
+		return nil, fmt.Errorf("failed to set mac address %s of macvlan %s: %v", mac, name, err)
+	}
+
+	if err = netlink.LinkSetUp(macvlan); err != nil {
+		return nil, fmt.Errorf("failed to enable the link macvlan=%+v, error=%v", macvlan, err)
+	}
+
+	return macvlan, nil
+}
+
 func removeElement(s []string, value string) []string {
 	var idx = -1
 
@@ -189,3 +246,65 @@ func removeElement(s []string, value string) []string {
 	s[idx] = s[len(s)-1]
 	return s[:len(s)-1]
 }
+
+// SyncAddress configures the address on the bridge and removes other addresses
+// of the same pool, e.g. the ones left after reallocation.
+func SyncAddress(name string, pool string, address string) error {
+	br, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge %s: %v", name, err)
+	}
+
+	addr, err := netlink.ParseAddr(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %s: %v", address, err)
+	}
+
+	if err := deleteAddresses(br, pool, addr.IP); err != nil {
+		return err
+	}
+
+	if err := netlink.AddrReplace(br, addr); err != nil {
+		return fmt.Errorf("failed to add address %s to bridge %s: %v", address, name, err)
+	}
+
+	return nil
+}
+
+// DeleteAddresses removes all addresses of the pool from the bridge
+func DeleteAddresses(name string, pool string) error {
+	br, err := netlink.LinkByName(name)
+	if err != nil {
+		if err.Error() == "Link not found" {
+			return nil
+		}
+		return err
+	}
+
+	return deleteAddresses(br, pool, nil)
+}
+
+func deleteAddresses(br netlink.Link, pool string, keep net.IP) error {
+	_, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return fmt.Errorf("invalid address pool %s: %v", pool, err)
+	}
+
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of bridge %s: %v", br.Attrs().Name, err)
+	}
+
+	for _, addr := range addrs {
+		if !ipnet.Contains(addr.IP) || addr.IP.Equal(keep) {
+			continue
+		}
+
+		addr := addr
+		if err := netlink.AddrDel(br, &addr); err != nil {
+			return fmt.Errorf("failed to delete address %s from bridge %s: %v", addr.IPNet, br.Attrs().Name, err)
+		}
+	}
+
+	return nil
+}
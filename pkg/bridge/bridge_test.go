@@ -0,0 +1,190 @@
+package bridge
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/NCCloud/tabby-cni/pkg/netnstest"
+)
+
+func TestBridge(t *testing.T) {
+	ns := netnstest.New(t)
+	uplink := ns.AddUplink("eth1")
+
+	bridge := &Bridge{Name: "br10", Mtu: 1400}
+	br, err := bridge.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing bridge takes the new mtu
+	bridge.Mtu = 1300
+	if _, err := bridge.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if link := ns.Link("br10"); link.Attrs().MTU != 1300 || link.Attrs().Flags&net.FlagUp == 0 {
+		t.Errorf("bridge mtu = %d, flags = %v, want 1300 and up", link.Attrs().MTU, link.Attrs().Flags)
+	}
+
+	if err := netlink.LinkSetMaster(uplink, br); err != nil {
+		t.Fatal(err)
+	}
+
+	ports, err := BridgeListPorts("br10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ports, []string{"eth1"}) {
+		t.Errorf("BridgeListPorts() = %q, want eth1", ports)
+	}
+
+	// Bridge with the foreign port is kept
+	if err := bridge.Remove(); err == nil {
+		t.Fatal("Remove() succeeded with the attached eth1")
+	}
+
+	// Port of the spec goes away with the bridge
+	bridge.Ports = []Port{{Name: "eth1"}}
+	if err := bridge.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if ns.LinkExists("br10") {
+		t.Error("bridge br10 was not removed")
+	}
+
+	// Missing bridge is not an error
+	if err := bridge.Remove(); err != nil {
+		t.Errorf("Remove() of the missing bridge: %v", err)
+	}
+}
+
+func TestVlan(t *testing.T) {
+	ns := netnstest.New(t)
+	ns.AddUplink("eth1")
+	ns.RequireVlan("eth1")
+
+	vlan, err := AddVlan("eth1", 10, 1400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vlan.Name != "eth1.10" {
+		t.Errorf("vlan name = %s, want eth1.10", vlan.Name)
+	}
+
+	// Existing vlan is not an error
+	if _, err := AddVlan("eth1", 10, 1400); err != nil {
+		t.Fatal(err)
+	}
+
+	link := ns.Link("eth1.10")
+	if link.Type() != "vlan" || link.Attrs().MTU != 1400 {
+		t.Errorf("link %s type = %s, mtu = %d", link.Attrs().Name, link.Type(), link.Attrs().MTU)
+	}
+
+	if _, err := AddVlan("eth2", 10, 0); err == nil {
+		t.Error("AddVlan() succeeded with the missing parent")
+	}
+
+	if err := DeletePort("eth1.10"); err != nil {
+		t.Fatal(err)
+	}
+	if ns.LinkExists("eth1.10") {
+		t.Error("vlan eth1.10 was not removed")
+	}
+
+	// Only vlan and macvlan interfaces are removed
+	if err := DeletePort("eth1"); err == nil {
+		t.Error("DeletePort() removed the uplink")
+	}
+	if err := DeletePort("eth1.20"); err != nil {
+		t.Errorf("DeletePort() of the missing vlan: %v", err)
+	}
+}
+
+func TestSyncAddress(t *testing.T) {
+	ns := netnstest.New(t)
+
+	if _, err := (&Bridge{Name: "br10"}).Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	addresses := func() []string {
+		addrs, err := netlink.AddrList(ns.Link("br10"), netlink.FAMILY_V4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, addr := range addrs {
+			got = append(got, addr.IPNet.String())
+		}
+		return got
+	}
+
+	if err := netlink.AddrAdd(ns.Link("br10"), &netlink.Addr{IPNet: netlink.NewIPNet([]byte{192, 168, 0, 1})}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SyncAddress("br10", "10.10.0.0/24", "10.10.0.2/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reallocated address replaces the previous one of the pool
+	if err := SyncAddress("br10", "10.10.0.0/24", "10.10.0.3/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := addresses(), []string{"192.168.0.1/32", "10.10.0.3/24"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("addresses = %q, want %q", got, want)
+	}
+
+	if err := DeleteAddresses("br10", "10.10.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := addresses(), []string{"192.168.0.1/32"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("addresses = %q, want %q", got, want)
+	}
+
+	if err := DeleteAddresses("br20", "10.10.0.0/24"); err != nil {
+		t.Errorf("DeleteAddresses() of the missing bridge: %v", err)
+	}
+}
+
+func TestMacvlan(t *testing.T) {
+	ns := netnstest.New(t)
+
+	if _, err := (&Bridge{Name: "br10"}).Create(); err != nil {
+		t.Fatal(err)
+	}
+	brMAC := ns.Link("br10").Attrs().HardwareAddr.String()
+
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	if _, err := AddMacvlan("br10", "br10-gw", mac); err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing macvlan gets the new mac address
+	mac, _ = net.ParseMAC("02:00:00:00:00:02")
+	if _, err := AddMacvlan("br10", "br10-gw", mac); err != nil {
+		t.Fatal(err)
+	}
+
+	link := ns.Link("br10-gw")
+	if link.Type() != "macvlan" || link.Attrs().HardwareAddr.String() != mac.String() || link.Attrs().Flags&net.FlagUp == 0 {
+		t.Errorf("link %s type = %s, mac = %s, flags = %s", link.Attrs().Name, link.Type(), link.Attrs().HardwareAddr, link.Attrs().Flags)
+	}
+	if got := ns.Link("br10").Attrs().HardwareAddr.String(); got != brMAC {
+		t.Errorf("bridge mac = %s, want %s", got, brMAC)
+	}
+
+	if err := DeletePort("br10-gw"); err != nil {
+		t.Fatal(err)
+	}
+	if ns.LinkExists("br10-gw") {
+		t.Error("macvlan br10-gw was not removed")
+	}
+}
@@ -1,9 +1,22 @@
 package commmon
 
-import "github.com/caarlos0/env/v11"
+import (
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
 
 type Config struct {
 	WatchKubevirtMigration bool `env:"WATCH_KUBEVIRT_MIGRATION" envDefault:"false"`
+	EnableFloatingIP       bool `env:"ENABLE_FLOATING_IP" envDefault:"false"`
+	// Generate Multus NetworkAttachmentDefinitions of networks
+	EnableNetworkAttachmentDefinition bool `env:"ENABLE_NETWORK_ATTACHMENT_DEFINITION" envDefault:"false"`
+	// Interval of the host network drift detection, zero disables it
+	ResyncInterval time.Duration `env:"RESYNC_INTERVAL" envDefault:"5m"`
+	// Log output, console or json
+	LogFormat string `env:"LOG_FORMAT" envDefault:"console"`
+	// Verbosity in general and per subsystem, e.g. "0,iptables=2,dhcp=1"
+	LogLevels string `env:"LOG_LEVELS" envDefault:"0"`
 }
 
 func NewConfig() *Config {
@@ -0,0 +1,413 @@
+package dhcp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+
+	"github.com/NCCloud/tabby-cni/pkg/logging"
+)
+
+const (
+	DefaultLeaseTime time.Duration = time.Hour
+	// Offered address is reserved for the client until it requests it
+	offerTimeout time.Duration = 30 * time.Second
+)
+
+type Config struct {
+	// Interface the server is bound to, e.g. the bridge of the virtual machines
+	Interface  string
+	RangeStart net.IP
+	RangeEnd   net.IP
+	Netmask    net.IPMask
+	// Gateway is announced as router and used as server identifier
+	Gateway net.IP
+	// ServerID replaces the gateway as server identifier, clients send their renewals
+	// to it, so it has to be an address of the node
+	ServerID     net.IP
+	DNS          []net.IP
+	LeaseTime    time.Duration
+	StaticLeases map[string]net.IP
+}
+
+type Lease struct {
+	MAC      net.HardwareAddr
+	IP       net.IP
+	Hostname string
+	Expires  time.Time
+	// Lease is only offered to the client but not requested yet
+	offered bool
+}
+
+type Server struct {
+	config Config
+	server *server4.Server
+	notify func()
+	done   chan struct{}
+	log    logr.Logger
+
+	mu     sync.Mutex
+	leases map[string]*Lease
+}
+
+// NewServer creates a server with leases known from previous runs. The notify
+// function is called every time the set of bound leases changes.
+func NewServer(config Config, leases []Lease, notify func()) (*Server, error) {
+	if config.RangeStart.To4() == nil || config.RangeEnd.To4() == nil {
+		return nil, fmt.Errorf("invalid dhcp range %s-%s", config.RangeStart, config.RangeEnd)
+	}
+
+	if ipToInt(config.RangeStart) > ipToInt(config.RangeEnd) {
+		return nil, fmt.Errorf("invalid dhcp range %s-%s", config.RangeStart, config.RangeEnd)
+	}
+
+	if config.LeaseTime == 0 {
+		config.LeaseTime = DefaultLeaseTime
+	}
+
+	s := &Server{
+		config: config,
+		notify: notify,
+		leases: map[string]*Lease{},
+	}
+
+	for _, l := range leases {
+		l := l
+		s.leases[l.MAC.String()] = &l
+	}
+
+	return s, nil
+}
+
+// Start listens on the interface and serves requests in the background. The server
+// logs with the logger of the context, e.g. of the reconcile which started it.
+func (s *Server) Start(ctx context.Context) error {
+	s.log = logging.FromContext(ctx, logging.DHCP).WithValues(logging.KeyInterface, s.config.Interface)
+
+	server, err := server4.NewServer(s.config.Interface, nil, s.handle)
+	if err != nil {
+		return fmt.Errorf("failed to start dhcp server on %s: %v", s.config.Interface, err)
+	}
+
+	s.server = server
+	s.done = make(chan struct{})
+
+	go func() {
+		if err := server.Serve(); err != nil {
+			s.log.V(1).Info("DHCP server stopped", "reason", err.Error())
+		}
+	}()
+
+	go s.expireLoop(s.done)
+
+	return nil
+}
+
+func (s *Server) Close() error {
+	if s.server == nil {
+		return nil
+	}
+
+	close(s.done)
+	err := s.server.Close()
+	s.server = nil
+
+	return err
+}
+
+func (s *Server) serverID() net.IP {
+	if s.config.ServerID != nil {
+		return s.config.ServerID
+	}
+	return s.config.Gateway
+}
+
+func (s *Server) expireLoop(done chan struct{}) {
+	ticker := time.NewTicker(offerTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if s.expire(now) && s.notify != nil {
+				s.notify()
+			}
+		}
+	}
+}
+
+// Leases returns bound leases ordered by address
+func (s *Server) Leases() []Lease {
+	var leases []Lease
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range s.leases {
+		if !l.offered {
+			leases = append(leases, *l)
+		}
+	}
+
+	sort.Slice(leases, func(i, j int) bool {
+		return ipToInt(leases[i].IP) < ipToInt(leases[j].IP)
+	})
+
+	return leases
+}
+
+func ipToInt(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func intToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+func (s *Server) inRange(ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
+	}
+	n := ipToInt(ip)
+	return n >= ipToInt(s.config.RangeStart) && n <= ipToInt(s.config.RangeEnd)
+}
+
+// Address is in use by another client, either leased or reserved statically
+func (s *Server) inUse(ip net.IP, mac string, now time.Time) bool {
+	for m, static := range s.config.StaticLeases {
+		if m != mac && static.Equal(ip) {
+			return true
+		}
+	}
+
+	for m, l := range s.leases {
+		if m != mac && l.IP.Equal(ip) && l.Expires.After(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Pick the address for the client: static lease, current lease, requested
+// address and the lowest free address of the range, in that order.
+func (s *Server) allocate(mac string, requested net.IP, now time.Time) (net.IP, error) {
+	if ip, ok := s.config.StaticLeases[mac]; ok {
+		return ip, nil
+	}
+
+	if l, ok := s.leases[mac]; ok && s.inRange(l.IP) && !s.inUse(l.IP, mac, now) {
+		return l.IP, nil
+	}
+
+	if requested != nil && s.inRange(requested) && !s.inUse(requested, mac, now) {
+		return requested, nil
+	}
+
+	for n := ipToInt(s.config.RangeStart); n <= ipToInt(s.config.RangeEnd); n++ {
+		ip := intToIP(n)
+		if !s.inUse(ip, mac, now) {
+			return ip, nil
+		}
+		if n == ^uint32(0) {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("no free address in range %s-%s", s.config.RangeStart, s.config.RangeEnd)
+}
+
+// Discover reserves an address for the client
+func (s *Server) discover(mac net.HardwareAddr, requested net.IP, now time.Time) (net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ip, err := s.allocate(mac.String(), requested, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if l, ok := s.leases[mac.String()]; ok && !l.offered && l.IP.Equal(ip) {
+		return ip, nil
+	}
+
+	s.leases[mac.String()] = &Lease{MAC: mac, IP: ip, Expires: now.Add(offerTimeout), offered: true}
+
+	return ip, nil
+}
+
+// Request binds the address to the client, returns false if the address can't be leased
+func (s *Server) request(mac net.HardwareAddr, requested net.IP, hostname string, now time.Time) (bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ip, err := s.allocate(mac.String(), requested, now)
+	if err != nil || !ip.Equal(requested) {
+		return false, false
+	}
+
+	prev, ok := s.leases[mac.String()]
+	changed := !ok || prev.offered || !prev.IP.Equal(ip) || prev.Hostname != hostname
+
+	s.leases[mac.String()] = &Lease{MAC: mac, IP: ip, Hostname: hostname, Expires: now.Add(s.config.LeaseTime)}
+
+	return true, changed
+}
+
+func (s *Server) release(mac net.HardwareAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.leases[mac.String()]
+	if !ok {
+		return false
+	}
+
+	delete(s.leases, mac.String())
+
+	return !l.offered
+}
+
+// Remove leases which were not renewed in time, returns true if any bound lease expired
+func (s *Server) expire(now time.Time) bool {
+	var expired bool
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for mac, l := range s.leases {
+		if l.Expires.After(now) {
+			continue
+		}
+
+		delete(s.leases, mac)
+		expired = expired || !l.offered
+	}
+
+	return expired
+}
+
+func (s *Server) reply(req *dhcpv4.DHCPv4, msgType dhcpv4.MessageType, ip net.IP) (*dhcpv4.DHCPv4, error) {
+	if msgType == dhcpv4.MessageTypeNak {
+		return dhcpv4.NewReplyFromRequest(req,
+			dhcpv4.WithMessageType(msgType),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.serverID())),
+		)
+	}
+
+	modifiers := []dhcpv4.Modifier{
+		dhcpv4.WithMessageType(msgType),
+		dhcpv4.WithYourIP(ip),
+		dhcpv4.WithNetmask(s.config.Netmask),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.serverID())),
+		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(s.config.LeaseTime)),
+		dhcpv4.WithOption(dhcpv4.OptRouter(s.config.Gateway)),
+	}
+
+	// Gateway could be outside of the subnet of the client, e.g. 169.254.1.1,
+	// so it's announced as reachable on the link via classless static routes.
+	subnet := &net.IPNet{IP: ip.Mask(s.config.Netmask), Mask: s.config.Netmask}
+	if !subnet.Contains(s.config.Gateway) {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptClasslessStaticRoute(
+			&dhcpv4.Route{Dest: &net.IPNet{IP: s.config.Gateway, Mask: net.CIDRMask(32, 32)}, Router: net.IPv4zero},
+			&dhcpv4.Route{Dest: &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, Router: s.config.Gateway},
+		)))
+	}
+
+	if len(s.config.DNS) > 0 {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptDNS(s.config.DNS...)))
+	}
+
+	return dhcpv4.NewReplyFromRequest(req, modifiers...)
+}
+
+func (s *Server) handle(conn net.PacketConn, _ net.Addr, req *dhcpv4.DHCPv4) {
+	var (
+		resp    *dhcpv4.DHCPv4
+		ip      net.IP
+		changed bool
+		err     error
+	)
+
+	if req.OpCode != dhcpv4.OpcodeBootRequest {
+		return
+	}
+
+	now := time.Now()
+	log := s.log.WithValues("mac", req.ClientHWAddr.String())
+
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		if ip, err = s.discover(req.ClientHWAddr, req.RequestedIPAddress(), now); err != nil {
+			log.Error(err, "Failed to offer dhcp address")
+			return
+		}
+		resp, err = s.reply(req, dhcpv4.MessageTypeOffer, ip)
+	case dhcpv4.MessageTypeRequest:
+		// Requested address is in the option during selecting, in ciaddr during renewing
+		requested := req.RequestedIPAddress()
+		if requested == nil || requested.IsUnspecified() {
+			requested = req.ClientIPAddr
+		}
+
+		// Request is addressed to another server
+		if sid := req.ServerIdentifier(); sid != nil && !sid.Equal(s.serverID()) {
+			return
+		}
+
+		var ok bool
+		if ok, changed = s.request(req.ClientHWAddr, requested, req.HostName(), now); ok {
+			resp, err = s.reply(req, dhcpv4.MessageTypeAck, requested)
+		} else {
+			log.Info("Declined dhcp request", "address", requested.String())
+			resp, err = s.reply(req, dhcpv4.MessageTypeNak, nil)
+		}
+	case dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		changed = s.release(req.ClientHWAddr)
+	default:
+		return
+	}
+
+	if err != nil {
+		log.Error(err, "Failed to build dhcp reply")
+		return
+	}
+
+	if resp != nil {
+		if _, err := conn.WriteTo(resp.ToBytes(), replyAddr(req, resp)); err != nil {
+			log.Error(err, "Failed to send dhcp reply")
+		}
+	}
+
+	if changed {
+		log.Info("DHCP leases changed", "message", req.MessageType().String())
+		if s.notify != nil {
+			s.notify()
+		}
+	}
+}
+
+// Clients without configured address only receive broadcasts, RFC 2131 4.1
+func replyAddr(req *dhcpv4.DHCPv4, resp *dhcpv4.DHCPv4) net.Addr {
+	if req.GatewayIPAddr != nil && !req.GatewayIPAddr.IsUnspecified() {
+		return &net.UDPAddr{IP: req.GatewayIPAddr, Port: dhcpv4.ServerPort}
+	}
+
+	if resp.MessageType() != dhcpv4.MessageTypeNak && req.ClientIPAddr != nil && !req.ClientIPAddr.IsUnspecified() {
+		return &net.UDPAddr{IP: req.ClientIPAddr, Port: dhcpv4.ClientPort}
+	}
+
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+}
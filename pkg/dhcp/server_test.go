@@ -0,0 +1,294 @@
+package dhcp
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+func testConfig() Config {
+	return Config{
+		RangeStart: net.ParseIP("192.168.1.10").To4(),
+		RangeEnd:   net.ParseIP("192.168.1.12").To4(),
+		Netmask:    net.CIDRMask(24, 32),
+		Gateway:    net.ParseIP("169.254.1.1").To4(),
+		StaticLeases: map[string]net.IP{
+			"02:00:00:00:00:10": net.ParseIP("192.168.1.100").To4(),
+		},
+	}
+}
+
+func mac(s string) net.HardwareAddr {
+	m, _ := net.ParseMAC(s)
+	return m
+}
+
+func TestAllocate(t *testing.T) {
+	now := time.Now()
+
+	s, err := NewServer(testConfig(), []Lease{
+		{MAC: mac("02:00:00:00:00:01"), IP: net.ParseIP("192.168.1.11").To4(), Expires: now.Add(time.Hour)},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		mac       string
+		requested net.IP
+		want      string
+	}{
+		{"static lease", "02:00:00:00:00:10", nil, "192.168.1.100"},
+		{"existing lease", "02:00:00:00:00:01", nil, "192.168.1.11"},
+		{"lowest free address", "02:00:00:00:00:02", nil, "192.168.1.10"},
+		{"requested address", "02:00:00:00:00:02", net.ParseIP("192.168.1.12"), "192.168.1.12"},
+		{"requested address is leased", "02:00:00:00:00:02", net.ParseIP("192.168.1.11"), "192.168.1.10"},
+		{"requested address out of range", "02:00:00:00:00:02", net.ParseIP("10.0.0.1"), "192.168.1.10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, err := s.allocate(tt.mac, tt.requested, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip.String() != tt.want {
+				t.Errorf("allocate() = %s, want %s", ip, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeaseLifecycle(t *testing.T) {
+	now := time.Now()
+
+	s, err := NewServer(testConfig(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := []net.HardwareAddr{mac("02:00:00:00:00:01"), mac("02:00:00:00:00:02"), mac("02:00:00:00:00:03")}
+	for _, c := range clients {
+		ip, err := s.discover(c, nil, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, changed := s.request(c, ip, "", now); !ok || !changed {
+			t.Fatalf("request(%s, %s) = %v, %v", c, ip, ok, changed)
+		}
+	}
+
+	if len(s.Leases()) != 3 {
+		t.Fatalf("expected 3 leases, got %+v", s.Leases())
+	}
+
+	if _, err := s.discover(mac("02:00:00:00:00:04"), nil, now); err == nil {
+		t.Error("expected exhausted range")
+	}
+
+	// Address of another client can't be requested
+	if ok, _ := s.request(mac("02:00:00:00:00:04"), net.ParseIP("192.168.1.10").To4(), "", now); ok {
+		t.Error("expected request of leased address to be declined")
+	}
+
+	if !s.release(clients[0]) {
+		t.Error("expected release to change leases")
+	}
+
+	if ip, err := s.discover(mac("02:00:00:00:00:04"), nil, now); err != nil || ip.String() != "192.168.1.10" {
+		t.Errorf("discover() = %s, %v, want released address", ip, err)
+	}
+
+	// Offered addresses expire fast, bound leases only after the lease time
+	if s.expire(now.Add(time.Minute)) {
+		t.Error("expected only offers to expire")
+	}
+
+	if !s.expire(now.Add(2 * DefaultLeaseTime)) {
+		t.Error("expected leases to expire")
+	}
+
+	if len(s.Leases()) != 0 {
+		t.Errorf("expected no leases, got %+v", s.Leases())
+	}
+}
+
+// Run the server on one end of a veth pair in a network namespace and a client on the other end
+func TestServerOnVeth(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("test requires root to create a network namespace")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("unable to create network namespace: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(origin)
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "dhcp0"}, PeerName: "dhcp1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatal(err)
+	}
+
+	// Client is in its own namespace, so the renewals are sent through the veth
+	clientNs, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientNs.Close()
+
+	if err := netns.Set(ns); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := netlink.LinkByName("dhcp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(clientNs)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Server side has the gateway, which is the server identifier, and the route to the clients
+	server := netnsLink(t, "dhcp0")
+	if err := netlink.AddrAdd(server, &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("169.254.1.1"), Mask: net.CIDRMask(32, 32)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.RouteAdd(&netlink.Route{LinkIndex: server.Attrs().Index, Dst: &net.IPNet{IP: net.ParseIP("192.168.1.0").To4(), Mask: net.CIDRMask(24, 32)}, Scope: netlink.SCOPE_LINK}); err != nil {
+		t.Fatal(err)
+	}
+
+	notified := make(chan struct{}, 10)
+
+	config := testConfig()
+	config.Interface = "dhcp0"
+	config.DNS = []net.IP{net.ParseIP("1.1.1.1").To4()}
+
+	s, err := NewServer(config, nil, func() { notified <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Sockets of the client stay in its namespace
+	if err := netns.Set(clientNs); err != nil {
+		t.Fatal(err)
+	}
+	defer netns.Set(ns)
+
+	peer = netnsLink(t, "dhcp1")
+
+	client, err := nclient4.New("dhcp1", nclient4.WithTimeout(2*time.Second), nclient4.WithRetry(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lease, err := client.Request(ctx, dhcpv4.WithOption(dhcpv4.OptHostName("vm1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ack := lease.ACK
+	if ack.YourIPAddr.String() != "192.168.1.10" {
+		t.Errorf("leased address = %s, want 192.168.1.10", ack.YourIPAddr)
+	}
+
+	if routers := ack.Router(); len(routers) != 1 || !routers[0].Equal(config.Gateway) {
+		t.Errorf("router = %v, want %s", routers, config.Gateway)
+	}
+
+	if len(ack.ClasslessStaticRoute()) != 2 {
+		t.Errorf("expected on-link route to the gateway, got %v", ack.ClasslessStaticRoute())
+	}
+
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Error("expected lease notification")
+	}
+
+	leases := s.Leases()
+	if len(leases) != 1 || leases[0].Hostname != "vm1" {
+		t.Errorf("unexpected leases %+v", leases)
+	}
+
+	// Renewal is unicast from the leased address to the server identifier
+	if err := netlink.AddrAdd(peer, &netlink.Addr{IPNet: &net.IPNet{IP: ack.YourIPAddr, Mask: config.Netmask}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.RouteAdd(&netlink.Route{LinkIndex: peer.Attrs().Index, Dst: &net.IPNet{IP: config.Gateway, Mask: net.CIDRMask(32, 32)}, Scope: netlink.SCOPE_LINK}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ack.YourIPAddr, Port: dhcpv4.ClientPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	renew, err := dhcpv4.NewRenewFromAck(ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(renew.ToBytes(), &net.UDPAddr{IP: ack.ServerIdentifier(), Port: dhcpv4.ServerPort}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no reply to the renewal: %v", err)
+	}
+
+	reply, err := dhcpv4.FromBytes(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.MessageType() != dhcpv4.MessageTypeAck || !reply.YourIPAddr.Equal(ack.YourIPAddr) {
+		t.Errorf("renewal reply = %s %s, want ack of %s", reply.MessageType(), reply.YourIPAddr, ack.YourIPAddr)
+	}
+}
+
+func netnsLink(t *testing.T, name string) netlink.Link {
+	t.Helper()
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
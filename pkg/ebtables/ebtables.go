@@ -1,18 +1,24 @@
 package ebtables
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
 	"strings"
 
-	"github.com/sirupsen/logrus"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
 )
 
 const (
 	ChainForward string = "FORWARD"
+	ChainOutput  string = "OUTPUT"
+	ChainInput   string = "INPUT"
 	cmdebtables  string = "ebtables-nft"
 )
 
+// Chains of the filter table which have the rules of the bridges
+var Chains = []string{ChainForward, ChainOutput, ChainInput}
+
 func checkIfRuleExists(listChainOutput string, args ...string) bool {
 	rule := strings.Join(args, " ")
 	for _, line := range strings.Split(listChainOutput, "\n") {
@@ -27,31 +33,66 @@ func makeFullArgs(table string, op string, chain string, args ...string) []strin
 	return append([]string{"-t", table, op, chain}, args...)
 }
 
-func AddRule(rule ...string) error {
+func AddRule(ctx context.Context, rule ...string) error {
+	return AddChainRule(ctx, ChainForward, rule...)
+}
 
-	cmd := exec.Command(cmdebtables, "--list", ChainForward)
+func listChain(chain string) (string, error) {
+	cmd := exec.Command(cmdebtables, "--list", chain)
 	stdout, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to get list of ebtables rules: %v", err)
+		return "", fmt.Errorf("failed to get list of ebtables rules: %v", err)
+	}
+
+	return string(stdout), nil
+}
+
+// RuleExists checks whether the rule is in the chain of the filter table
+func RuleExists(chain string, rule ...string) (bool, error) {
+	stdout, err := listChain(chain)
+	if err != nil {
+		return false, err
 	}
 
-	exist := checkIfRuleExists(string(stdout), rule...)
+	return checkIfRuleExists(stdout, rule...), nil
+}
+
+// ListRules returns the rules of the filter table which refer to the bridge
+func ListRules(bridge string) ([]string, error) {
+	var rules []string
+
+	for _, chain := range Chains {
+		stdout, err := listChain(chain)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(stdout, "\n") {
+			if strings.Contains(line, bridge) {
+				rules = append(rules, fmt.Sprintf("-A %s %s", chain, strings.TrimSpace(line)))
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+func AddChainRule(ctx context.Context, chain string, rule ...string) error {
+	log := logging.FromContext(ctx, logging.Ebtables).WithValues(
+		logging.KeyTable, "filter", logging.KeyChain, chain, logging.KeyRule, strings.Join(rule, " "))
+
+	exist, err := RuleExists(chain, rule...)
+	if err != nil {
+		return err
+	}
 
 	if exist {
-		logrus.WithFields(logrus.Fields{
-			"chain": ChainForward,
-			"table": "filter",
-			"rule":  strings.Join(rule, " "),
-		}).Info("Nothing to do, ebtables rule already exists:")
+		log.V(1).Info("Nothing to do, ebtables rule already exists")
 	} else {
-		logrus.WithFields(logrus.Fields{
-			"chain": ChainForward,
-			"table": "filter",
-			"rule":  strings.Join(rule, " "),
-		}).Info("ebtables rule should be added:")
-
-		fullargs := makeFullArgs("filter", "-I", ChainForward, rule...)
-		cmd = exec.Command(cmdebtables, fullargs...)
+		log.Info("Adding ebtables rule")
+
+		fullargs := makeFullArgs("filter", "-I", chain, rule...)
+		cmd := exec.Command(cmdebtables, fullargs...)
 		_, err = cmd.CombinedOutput()
 		if err != nil {
 			return fmt.Errorf("failed to add ebtables rule %v, %v", rule, err)
@@ -62,17 +103,19 @@ func AddRule(rule ...string) error {
 }
 
 func DeleteRuleByDevice(bridge string) error {
-	cmd := exec.Command(cmdebtables, "--list", ChainForward)
-	stdout, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to get list of ebtables rules: %v", err)
-	}
+	for _, chain := range Chains {
+		cmd := exec.Command(cmdebtables, "--list", chain)
+		stdout, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to get list of ebtables rules: %v", err)
+		}
 
-	for _, line := range strings.Split(string(stdout), "\n") {
-		if strings.Contains(line, bridge) {
-			if err = DeleteRule(strings.TrimSpace(line)); err != nil {
-				return fmt.Errorf(
-					"failed to delete ebtables rule %q for bridge %q: %v", line, bridge, err)
+		for _, line := range strings.Split(string(stdout), "\n") {
+			if strings.Contains(line, bridge) {
+				if err = DeleteChainRule(chain, strings.TrimSpace(line)); err != nil {
+					return fmt.Errorf(
+						"failed to delete ebtables rule %q for bridge %q: %v", line, bridge, err)
+				}
 			}
 		}
 	}
@@ -81,8 +124,12 @@ func DeleteRuleByDevice(bridge string) error {
 }
 
 func DeleteRule(rule string) error {
+	return DeleteChainRule(ChainForward, rule)
+}
+
+func DeleteChainRule(chain string, rule string) error {
 	r := strings.Split(rule, " ")
-	fullargs := makeFullArgs("filter", "-D", ChainForward, r...)
+	fullargs := makeFullArgs("filter", "-D", chain, r...)
 	cmd := exec.Command(cmdebtables, fullargs...)
 	_, err := cmd.CombinedOutput()
 	if err != nil {
@@ -0,0 +1,81 @@
+package ebtables
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/NCCloud/tabby-cni/pkg/netnstest"
+)
+
+func TestCheckIfRuleExists(t *testing.T) {
+	output := `Bridge table: filter
+
+Bridge chain: FORWARD, entries: 1, policy: ACCEPT
+-p ARP --logical-out br10 --arp-ip-dst 169.254.1.1 -j DROP
+`
+
+	if !checkIfRuleExists(output, "-p", "ARP", "--logical-out", "br10", "--arp-ip-dst", "169.254.1.1", "-j", "DROP") {
+		t.Error("rule of br10 was not found")
+	}
+	if checkIfRuleExists(output, "-p", "ARP", "--logical-out", "br20", "--arp-ip-dst", "169.254.1.1", "-j", "DROP") {
+		t.Error("rule of br20 was found")
+	}
+}
+
+func TestRules(t *testing.T) {
+	netnstest.New(t)
+	netnstest.RequireCommand(t, cmdebtables)
+
+	ctx := context.Background()
+	forward := []string{"-p", "ARP", "--logical-out", "br10", "--arp-ip-dst", "169.254.1.1", "-j", "DROP"}
+	output := []string{"-p", "ARP", "-o", "eth1.10", "--arp-ip-src", "169.254.1.1", "-j", "DROP"}
+
+	if exist, err := RuleExists(ChainForward, forward...); err != nil || exist {
+		t.Fatalf("RuleExists() = %v, %v before the rule was added", exist, err)
+	}
+
+	// Existing rule is not added twice
+	for i := 0; i < 2; i++ {
+		if err := AddRule(ctx, forward...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := AddChainRule(ctx, ChainOutput, output...); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRule(ctx, "-p", "ARP", "--logical-out", "br20", "-j", "DROP"); err != nil {
+		t.Fatal(err)
+	}
+
+	if exist, err := RuleExists(ChainForward, forward...); err != nil || !exist {
+		t.Errorf("RuleExists() = %v, %v after the rule was added", exist, err)
+	}
+
+	rules, err := ListRules("br10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-A FORWARD -p ARP --logical-out br10 --arp-ip-dst 169.254.1.1 -j DROP"}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("ListRules() = %q, want %q", rules, want)
+	}
+
+	if err := DeleteRuleByDevice("br10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteRuleByDevice("eth1.10"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bridge := range []string{"br10", "eth1.10"} {
+		if rules, err := ListRules(bridge); err != nil || len(rules) != 0 {
+			t.Errorf("ListRules(%s) = %q, %v, want none", bridge, rules, err)
+		}
+	}
+
+	// Rules of other bridges are kept
+	if rules, err := ListRules("br20"); err != nil || len(rules) != 1 {
+		t.Errorf("ListRules(br20) = %q, %v, want one", rules, err)
+	}
+}
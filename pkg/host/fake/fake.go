@@ -0,0 +1,936 @@
+// Package fake is an in-memory network of a node, so the controllers could be
+// tested without root and without touching the network of the machine.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/exp/slices"
+
+	"github.com/NCCloud/tabby-cni/pkg/ebtables"
+	"github.com/NCCloud/tabby-cni/pkg/host"
+	"github.com/NCCloud/tabby-cni/pkg/iptables"
+	"github.com/NCCloud/tabby-cni/pkg/ndp"
+)
+
+// Host keeps the state of every part of the node network
+type Host struct {
+	Links  *Links
+	Routes *Routes
+	Sysctl *Sysctl
+	NAT    *NAT
+	Filter *Filter
+	ARP    *ARP
+	NDP    *NDP
+}
+
+// New returns an empty node, interfaces of the node are added with Links.Add
+func New() *Host {
+	return &Host{
+		Links:  &Links{links: map[string]netlink.Link{}},
+		Routes: &Routes{},
+		Sysctl: &Sysctl{Values: map[string]string{}},
+		NAT: &NAT{
+			Masquerades:      map[string]Masquerade{},
+			PortForwards:     map[string][]iptables.PortForward{},
+			FloatingIPs:      map[string]FloatingIP{},
+			EgressInterfaces: map[string]string{},
+		},
+		Filter: &Filter{Rules: map[string][]string{}},
+		ARP:    &ARP{},
+		NDP:    &NDP{},
+	}
+}
+
+// Host returns the node for the controllers
+func (h *Host) Host() *host.Host {
+	return &host.Host{
+		Links:  h.Links,
+		Routes: h.Routes,
+		Sysctl: h.Sysctl,
+		NAT:    h.NAT,
+		Filter: h.Filter,
+		ARP:    h.ARP,
+		NDP:    h.NDP,
+	}
+}
+
+// Callers check it with host.IsLinkNotFound
+func linkNotFound() error {
+	return host.ErrLinkNotFound
+}
+
+// Subscriber of netlink updates, the updates are sent by the tests
+type subscription[T any] struct {
+	ch   chan<- T
+	done <-chan struct{}
+}
+
+type subscriptions[T any] struct {
+	mu   sync.Mutex
+	subs []subscription[T]
+}
+
+func (s *subscriptions[T]) add(ch chan<- T, done <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subs = append(s.subs, subscription[T]{ch: ch, done: done})
+}
+
+// Send the update to every subscriber, it blocks until the subscriber takes it or is done
+func (s *subscriptions[T]) notify(u T) {
+	s.mu.Lock()
+	subs := append([]subscription[T]{}, s.subs...)
+	s.mu.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.ch <- u:
+		case <-sub.done:
+		}
+	}
+}
+
+// Links are the interfaces of the node with their addresses
+type Links struct {
+	mu    sync.Mutex
+	links map[string]netlink.Link
+	addrs []netlink.Addr
+	index int
+
+	linkSubs subscriptions[netlink.LinkUpdate]
+	addrSubs subscriptions[netlink.AddrUpdate]
+}
+
+// NotifyLink sends the link update to the subscribers, the links are not changed
+func (l *Links) NotifyLink(u netlink.LinkUpdate) {
+	l.linkSubs.notify(u)
+}
+
+// NotifyAddr sends the address update to the subscribers, the addresses are not changed
+func (l *Links) NotifyAddr(u netlink.AddrUpdate) {
+	l.addrSubs.notify(u)
+}
+
+func (l *Links) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}, onError func(error)) error {
+	l.linkSubs.add(ch, done)
+	return nil
+}
+
+func (l *Links) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}, onError func(error)) error {
+	l.addrSubs.add(ch, done)
+	return nil
+}
+
+// Add adds the interface, e.g. the uplink of the node, and returns it with the index set
+func (l *Links) Add(link netlink.Link) netlink.Link {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.add(link)
+}
+
+func (l *Links) add(link netlink.Link) netlink.Link {
+	l.index++
+
+	attrs := link.Attrs()
+	attrs.Index = l.index
+	attrs.Flags |= net.FlagUp
+	if attrs.MTU == 0 {
+		attrs.MTU = 1500
+	}
+
+	l.links[attrs.Name] = link
+	return link
+}
+
+// Names of the interfaces attached to the master
+func (l *Links) Ports(master string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.ports(master)
+}
+
+func (l *Links) ports(master string) []string {
+	var ports []string
+
+	br, ok := l.links[master]
+	if !ok {
+		return nil
+	}
+
+	for name, link := range l.links {
+		if link.Attrs().MasterIndex == br.Attrs().Index {
+			ports = append(ports, name)
+		}
+	}
+
+	return ports
+}
+
+func (l *Links) LinkByName(name string) (netlink.Link, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	link, ok := l.links[name]
+	if !ok {
+		return nil, linkNotFound()
+	}
+	return link, nil
+}
+
+func (l *Links) LinkByIndex(index int) (netlink.Link, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, link := range l.links {
+		if link.Attrs().Index == index {
+			return link, nil
+		}
+	}
+	return nil, linkNotFound()
+}
+
+func (l *Links) LinkList() ([]netlink.Link, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var links []netlink.Link
+	for _, link := range l.links {
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func (l *Links) CreateBridge(name string, mtu int) (netlink.Link, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	br, ok := l.links[name]
+	if !ok {
+		br = l.add(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}})
+	}
+
+	if mtu != 0 {
+		br.Attrs().MTU = mtu
+	}
+	br.Attrs().Flags |= net.FlagUp
+
+	return br, nil
+}
+
+func (l *Links) RemoveBridge(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	br, ok := l.links[name]
+	if !ok {
+		return nil
+	}
+
+	if ports := l.ports(name); len(ports) > 0 {
+		return fmt.Errorf("unable to delete bridge, there is still attached interface %s", ports)
+	}
+
+	l.delete(br)
+	return nil
+}
+
+func (l *Links) delete(link netlink.Link) {
+	delete(l.links, link.Attrs().Name)
+
+	var addrs []netlink.Addr
+	for _, a := range l.addrs {
+		if a.LinkIndex != link.Attrs().Index {
+			addrs = append(addrs, a)
+		}
+	}
+	l.addrs = addrs
+}
+
+func (l *Links) AddVlan(parent string, vlan int, mtu int) (netlink.Link, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.links[parent]
+	if !ok {
+		return nil, fmt.Errorf("failed to find a link by name %s: %v", parent, linkNotFound())
+	}
+
+	name := fmt.Sprintf("%s.%d", parent, vlan)
+	link, ok := l.links[name]
+	if !ok {
+		link = l.add(&netlink.Vlan{VlanId: vlan, LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: p.Attrs().Index}})
+	}
+
+	if mtu != 0 {
+		link.Attrs().MTU = mtu
+	}
+	link.Attrs().Flags |= net.FlagUp
+
+	return link, nil
+}
+
+func (l *Links) AddMacvlan(parent string, name string, mac net.HardwareAddr) (netlink.Link, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.links[parent]
+	if !ok {
+		return nil, fmt.Errorf("failed to find a link by name %s: %v", parent, linkNotFound())
+	}
+
+	link, ok := l.links[name]
+	if !ok {
+		link = l.add(&netlink.Macvlan{Mode: netlink.MACVLAN_MODE_PRIVATE, LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: p.Attrs().Index}})
+	}
+
+	link.Attrs().HardwareAddr = mac
+	link.Attrs().Flags |= net.FlagUp
+
+	return link, nil
+}
+
+func (l *Links) DeletePort(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	port, ok := l.links[name]
+	if !ok {
+		return nil
+	}
+
+	if port.Type() != "vlan" && port.Type() != "macvlan" {
+		return fmt.Errorf("only vlan or macvlan interface could be removed: name: %s, type: %s", name, port.Type())
+	}
+
+	l.delete(port)
+	return nil
+}
+
+func (l *Links) LinkSetMaster(link netlink.Link, master netlink.Link) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	port, ok := l.links[link.Attrs().Name]
+	if !ok {
+		return linkNotFound()
+	}
+
+	br, ok := l.links[master.Attrs().Name]
+	if !ok {
+		return linkNotFound()
+	}
+
+	port.Attrs().MasterIndex = br.Attrs().Index
+	return nil
+}
+
+func (l *Links) LinkSetHardwareAddr(link netlink.Link, mac net.HardwareAddr) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stored, ok := l.links[link.Attrs().Name]
+	if !ok {
+		return linkNotFound()
+	}
+
+	stored.Attrs().HardwareAddr = mac
+	return nil
+}
+
+func addrFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+func (l *Links) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var addrs []netlink.Addr
+	for _, a := range l.addrs {
+		if link != nil && a.LinkIndex != link.Attrs().Index {
+			continue
+		}
+		if family != netlink.FAMILY_ALL && addrFamily(a.IP) != family {
+			continue
+		}
+		addrs = append(addrs, a)
+	}
+
+	return addrs, nil
+}
+
+func (l *Links) AddrReplace(link netlink.Link, addr *netlink.Addr) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stored, ok := l.links[link.Attrs().Name]
+	if !ok {
+		return linkNotFound()
+	}
+
+	a := *addr
+	a.LinkIndex = stored.Attrs().Index
+
+	for i := range l.addrs {
+		if l.addrs[i].LinkIndex == a.LinkIndex && l.addrs[i].IP.Equal(a.IP) {
+			l.addrs[i] = a
+			return nil
+		}
+	}
+
+	l.addrs = append(l.addrs, a)
+	return nil
+}
+
+func (l *Links) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, a := range l.addrs {
+		if a.LinkIndex == link.Attrs().Index && a.IP.Equal(addr.IP) {
+			l.addrs = append(l.addrs[:i], l.addrs[i+1:]...)
+			return nil
+		}
+	}
+
+	return syscall.EADDRNOTAVAIL
+}
+
+func (l *Links) SyncAddress(name string, pool string, address string) error {
+	br, err := l.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge %s: %v", name, err)
+	}
+
+	addr, err := netlink.ParseAddr(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %s: %v", address, err)
+	}
+
+	if err := l.deleteAddresses(br, pool, addr.IP); err != nil {
+		return err
+	}
+
+	return l.AddrReplace(br, addr)
+}
+
+func (l *Links) DeleteAddresses(name string, pool string) error {
+	br, err := l.LinkByName(name)
+	if err != nil {
+		return nil
+	}
+
+	return l.deleteAddresses(br, pool, nil)
+}
+
+func (l *Links) deleteAddresses(br netlink.Link, pool string, keep net.IP) error {
+	_, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return fmt.Errorf("invalid address pool %s: %v", pool, err)
+	}
+
+	addrs, _ := l.AddrList(br, netlink.FAMILY_ALL)
+	for _, a := range addrs {
+		if !ipnet.Contains(a.IP) || a.IP.Equal(keep) {
+			continue
+		}
+
+		a := a
+		if err := l.AddrDel(br, &a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Routes is the routing table of the node
+type Routes struct {
+	mu     sync.Mutex
+	routes []netlink.Route
+
+	subs subscriptions[netlink.RouteUpdate]
+}
+
+// Notify sends the route update to the subscribers, the routing table is not changed
+func (r *Routes) Notify(u netlink.RouteUpdate) {
+	r.subs.notify(u)
+}
+
+func (r *Routes) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}, onError func(error)) error {
+	r.subs.add(ch, done)
+	return nil
+}
+
+func sameRoute(a, b *netlink.Route) bool {
+	return a.Dst.String() == b.Dst.String() && a.Gw.Equal(b.Gw) && a.LinkIndex == b.LinkIndex
+}
+
+func routeFamily(r *netlink.Route) int {
+	if r.Dst != nil {
+		return addrFamily(r.Dst.IP)
+	}
+	if r.Gw != nil {
+		return addrFamily(r.Gw)
+	}
+	return netlink.FAMILY_V4
+}
+
+func (r *Routes) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	filter := &netlink.Route{}
+	var mask uint64
+
+	if link != nil {
+		filter.LinkIndex = link.Attrs().Index
+		mask |= netlink.RT_FILTER_OIF
+	}
+
+	return r.RouteListFiltered(family, filter, mask)
+}
+
+func (r *Routes) RouteListFiltered(family int, filter *netlink.Route, mask uint64) ([]netlink.Route, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var routes []netlink.Route
+	for _, route := range r.routes {
+		if family != netlink.FAMILY_ALL && routeFamily(&route) != family {
+			continue
+		}
+		if mask&netlink.RT_FILTER_DST != 0 && route.Dst.String() != filter.Dst.String() {
+			continue
+		}
+		if mask&netlink.RT_FILTER_GW != 0 && !route.Gw.Equal(filter.Gw) {
+			continue
+		}
+		if mask&netlink.RT_FILTER_OIF != 0 && route.LinkIndex != filter.LinkIndex {
+			continue
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+func (r *Routes) RouteAdd(route *netlink.Route) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.routes {
+		if sameRoute(&r.routes[i], route) {
+			return syscall.EEXIST
+		}
+	}
+
+	r.routes = append(r.routes, *route)
+	return nil
+}
+
+func (r *Routes) RouteReplace(route *netlink.Route) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.routes {
+		if r.routes[i].Dst.String() == route.Dst.String() {
+			r.routes[i] = *route
+			return nil
+		}
+	}
+
+	r.routes = append(r.routes, *route)
+	return nil
+}
+
+func (r *Routes) RouteDel(route *netlink.Route) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.routes {
+		if sameRoute(&r.routes[i], route) {
+			r.routes = append(r.routes[:i], r.routes[i+1:]...)
+			return nil
+		}
+	}
+
+	return syscall.ESRCH
+}
+
+// Sysctl keeps the kernel parameters written by the controllers
+type Sysctl struct {
+	mu     sync.Mutex
+	Values map[string]string
+}
+
+func (s *Sysctl) Sysctl(name string, value ...string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(value) > 0 {
+		s.Values[name] = value[0]
+		return value[0], nil
+	}
+
+	v, ok := s.Values[name]
+	if !ok {
+		return "", fmt.Errorf("unknown sysctl %s", name)
+	}
+	return v, nil
+}
+
+type Masquerade struct {
+	Source        string
+	Ignore        []string
+	EgressNetwork string
+}
+
+type FloatingIP struct {
+	External string
+	Internal string
+}
+
+// NAT keeps the L3 rules by the name of the bridge
+type NAT struct {
+	mu           sync.Mutex
+	Masquerades  map[string]Masquerade
+	PortForwards map[string][]iptables.PortForward
+	FloatingIPs  map[string]FloatingIP
+	// Interfaces the node uses to reach the networks
+	EgressInterfaces map[string]string
+}
+
+func masqueradeRule(name string, source string, egressnetwork string) string {
+	rule := fmt.Sprintf("-t nat -A %s-POSTROUTING -s %s", name, source)
+	if egressnetwork != "" {
+		rule += " -d " + egressnetwork
+	}
+	return rule + " -j MASQUERADE"
+}
+
+func portForwardRule(name string, f iptables.PortForward) string {
+	rule := fmt.Sprintf("-t nat -A %s-PREROUTING -p %s", name, f.Protocol)
+	if f.Address != "" {
+		rule += " -d " + f.Address
+	}
+	return fmt.Sprintf("%s --dport %d -j DNAT --to-destination %s", rule, f.Port, f.ToDestination)
+}
+
+func (n *NAT) AddMasquerade(ctx context.Context, name string, source string, ignore []string, egressnetwork string) error {
+	if egressnetwork != "" {
+		if _, err := n.EgressInterface(egressnetwork); err != nil {
+			return err
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Masquerades[name] = Masquerade{Source: source, Ignore: ignore, EgressNetwork: egressnetwork}
+	return nil
+}
+
+func (n *NAT) MissingMasquerade(name string, source string, egressnetwork string) ([]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	m, ok := n.Masquerades[name]
+	if ok && m.Source == source && m.EgressNetwork == egressnetwork {
+		return nil, nil
+	}
+
+	return []string{masqueradeRule(name, source, egressnetwork)}, nil
+}
+
+func (n *NAT) IgnoreDiff(name string, ignore []string) ([]string, []string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	current := n.Masquerades[name].Ignore
+
+	var missing, stale []string
+	for _, network := range ignore {
+		if !slices.Contains(current, network) {
+			missing = append(missing, network)
+		}
+	}
+	for _, network := range current {
+		if !slices.Contains(ignore, network) {
+			stale = append(stale, network)
+		}
+	}
+
+	return missing, stale, nil
+}
+
+func (n *NAT) SyncPortForwards(ctx context.Context, name string, forwards []iptables.PortForward) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(forwards) == 0 {
+		delete(n.PortForwards, name)
+		return nil
+	}
+
+	n.PortForwards[name] = append([]iptables.PortForward(nil), forwards...)
+	return nil
+}
+
+func (n *NAT) MissingPortForwards(name string, forwards []iptables.PortForward) ([]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var missing []string
+
+	for _, f := range forwards {
+		found := false
+		for _, existing := range n.PortForwards[name] {
+			if existing == f {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			missing = append(missing, portForwardRule(name, f))
+		}
+	}
+
+	return missing, nil
+}
+
+func (n *NAT) StalePortForwards(name string, forwards []iptables.PortForward) ([]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var stale []string
+
+	for _, existing := range n.PortForwards[name] {
+		found := false
+		for _, f := range forwards {
+			if existing == f {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			stale = append(stale, portForwardRule(name, existing))
+		}
+	}
+
+	return stale, nil
+}
+
+func (n *NAT) AddFloatingIP(ctx context.Context, name string, external string, internal string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.FloatingIPs[name] = FloatingIP{External: external, Internal: internal}
+	return nil
+}
+
+func (n *NAT) MissingFloatingIP(name string, external string, internal string) ([]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if fip, ok := n.FloatingIPs[name]; ok && fip.External == external && fip.Internal == internal {
+		return nil, nil
+	}
+
+	return []string{
+		fmt.Sprintf("-t nat -A %s -d %s -j DNAT --to-destination %s", iptables.FloatingIPPreroutingChain, external, internal),
+		fmt.Sprintf("-t nat -A %s -s %s -j SNAT --to-source %s", iptables.FloatingIPPostroutingChain, internal, external),
+	}, nil
+}
+
+func (n *NAT) DeleteFloatingIP(name string, external string, internal string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.FloatingIPs, name)
+	return nil
+}
+
+func (n *NAT) EgressInterface(network string) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	iface, ok := n.EgressInterfaces[network]
+	if !ok {
+		return "", fmt.Errorf("failed to find network for snat: %s", network)
+	}
+	return iface, nil
+}
+
+func (n *NAT) ListRules(name string) ([]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var rules []string
+
+	if m, ok := n.Masquerades[name]; ok {
+		rules = append(rules, strings.TrimPrefix(masqueradeRule(name, m.Source, m.EgressNetwork), "-t nat "))
+	}
+
+	for _, f := range n.PortForwards[name] {
+		rules = append(rules, strings.TrimPrefix(portForwardRule(name, f), "-t nat "))
+	}
+
+	return rules, nil
+}
+
+func (n *NAT) PurgeChain(name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.Masquerades, name)
+	delete(n.PortForwards, name)
+	return nil
+}
+
+// Filter keeps the L2 rules by the chain
+type Filter struct {
+	mu    sync.Mutex
+	Rules map[string][]string
+}
+
+func (f *Filter) AddRule(ctx context.Context, chain string, rule ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r := strings.Join(rule, " ")
+	for _, existing := range f.Rules[chain] {
+		if existing == r {
+			return nil
+		}
+	}
+
+	f.Rules[chain] = append([]string{r}, f.Rules[chain]...)
+	return nil
+}
+
+func (f *Filter) RuleExists(chain string, rule ...string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r := strings.Join(rule, " ")
+	for _, existing := range f.Rules[chain] {
+		if existing == r {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (f *Filter) ListRules(bridge string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var rules []string
+
+	for _, chain := range ebtables.Chains {
+		for _, r := range f.Rules[chain] {
+			if strings.Contains(r, bridge) {
+				rules = append(rules, fmt.Sprintf("-A %s %s", chain, r))
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+func (f *Filter) DeleteRule(chain string, rule ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r := strings.Join(rule, " ")
+
+	var keep []string
+	for _, existing := range f.Rules[chain] {
+		if existing != r {
+			keep = append(keep, existing)
+		}
+	}
+	f.Rules[chain] = keep
+
+	return nil
+}
+
+func (f *Filter) DeleteRuleByDevice(bridge string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for chain, rules := range f.Rules {
+		var keep []string
+		for _, r := range rules {
+			if !strings.Contains(r, bridge) {
+				keep = append(keep, r)
+			}
+		}
+		f.Rules[chain] = keep
+	}
+
+	return nil
+}
+
+type Announcement struct {
+	IP        net.IP
+	Interface string
+}
+
+// ARP records the announcements, Err fails them
+type ARP struct {
+	mu            sync.Mutex
+	Announcements []Announcement
+	Err           error
+}
+
+func (a *ARP) Announce(ip net.IP, iface string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.Err != nil {
+		return a.Err
+	}
+
+	a.Announcements = append(a.Announcements, Announcement{IP: ip, Interface: iface})
+	return nil
+}
+
+type Advertisement struct {
+	Interface string
+	Source    net.IP
+	Count     int
+}
+
+// NDP records the router advertisement bursts, Err fails them
+type NDP struct {
+	mu             sync.Mutex
+	Advertisements []Advertisement
+	Err            error
+}
+
+func (n *NDP) SendRouterAdvertisements(config *ndp.RAConfig, count int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.Err != nil {
+		return n.Err
+	}
+
+	n.Advertisements = append(n.Advertisements, Advertisement{Interface: config.Interface, Source: config.Source, Count: count})
+	return nil
+}
@@ -0,0 +1,349 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/j-keck/arping"
+	"github.com/vishvananda/netlink"
+
+	"github.com/NCCloud/tabby-cni/pkg/bridge"
+	"github.com/NCCloud/tabby-cni/pkg/ebtables"
+	"github.com/NCCloud/tabby-cni/pkg/iptables"
+	"github.com/NCCloud/tabby-cni/pkg/ndp"
+)
+
+// ErrLinkNotFound is returned for a missing link by the links which aren't backed by netlink, e.g. the fake ones
+var ErrLinkNotFound = errors.New("Link not found")
+
+// IsLinkNotFound reports whether the link lookup failed because the link doesn't exist
+func IsLinkNotFound(err error) bool {
+	var notFound netlink.LinkNotFoundError
+	return errors.As(err, &notFound) || errors.Is(err, ErrLinkNotFound)
+}
+
+// Links manages the interfaces of the node and their addresses
+type Links interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+	// LinkSubscribe sends link updates until done is closed, a broken subscription is reported to onError
+	LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}, onError func(error)) error
+	// AddrSubscribe sends address updates until done is closed, a broken subscription is reported to onError
+	AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}, onError func(error)) error
+	// CreateBridge creates the bridge, or updates the mtu of the existing one, and sets it up
+	CreateBridge(name string, mtu int) (netlink.Link, error)
+	// RemoveBridge removes the bridge unless other interfaces are still attached to it
+	RemoveBridge(name string) error
+	// AddVlan creates the <parent>.<vlan> interface and sets it up
+	AddVlan(parent string, vlan int, mtu int) (netlink.Link, error)
+	// AddMacvlan creates the macvlan interface of the parent with the mac address and sets it up
+	AddMacvlan(parent string, name string, mac net.HardwareAddr) (netlink.Link, error)
+	// DeletePort removes the vlan or macvlan interface, a missing one is not an error
+	DeletePort(name string) error
+	LinkSetMaster(link netlink.Link, master netlink.Link) error
+	LinkSetHardwareAddr(link netlink.Link, mac net.HardwareAddr) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrReplace(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+	// SyncAddress configures the address on the bridge and removes other addresses of the pool
+	SyncAddress(bridge string, pool string, address string) error
+	// DeleteAddresses removes the addresses of the pool from the bridge
+	DeleteAddresses(bridge string, pool string) error
+}
+
+// Routes manages the routing table of the node
+type Routes interface {
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	RouteListFiltered(family int, filter *netlink.Route, mask uint64) ([]netlink.Route, error)
+	RouteAdd(route *netlink.Route) error
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	// RouteSubscribe sends route updates until done is closed, a broken subscription is reported to onError
+	RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}, onError func(error)) error
+}
+
+// Sysctl reads the kernel parameter, or writes it if the value is given
+type Sysctl interface {
+	Sysctl(name string, value ...string) (string, error)
+}
+
+// NAT manages the L3 rules of the node, chains are named after the bridge
+type NAT interface {
+	AddMasquerade(ctx context.Context, name string, source string, ignore []string, egressnetwork string) error
+	// MissingMasquerade returns the masquerade rules which are not on the node
+	MissingMasquerade(name string, source string, egressnetwork string) ([]string, error)
+	// IgnoreDiff returns the networks which are missing in the ignore set of the masquerade
+	// and the ones in the set which are not in ignore
+	IgnoreDiff(name string, ignore []string) ([]string, []string, error)
+	SyncPortForwards(ctx context.Context, name string, forwards []iptables.PortForward) error
+	// MissingPortForwards returns the port forward rules which are not on the node
+	MissingPortForwards(name string, forwards []iptables.PortForward) ([]string, error)
+	// StalePortForwards returns the port forward rules on the node which are not in forwards
+	StalePortForwards(name string, forwards []iptables.PortForward) ([]string, error)
+	AddFloatingIP(ctx context.Context, name string, external string, internal string) error
+	// MissingFloatingIP returns the nat rules of the floating ip which are not on the node
+	MissingFloatingIP(name string, external string, internal string) ([]string, error)
+	DeleteFloatingIP(name string, external string, internal string) error
+	// EgressInterface returns the interface the node uses to reach the network
+	EgressInterface(network string) (string, error)
+	ListRules(name string) ([]string, error)
+	// PurgeChain removes the chains of the bridge
+	PurgeChain(name string) error
+}
+
+// Filter manages the L2 rules of the node
+type Filter interface {
+	// AddRule inserts the rule into the chain unless it's there already
+	AddRule(ctx context.Context, chain string, rule ...string) error
+	RuleExists(chain string, rule ...string) (bool, error)
+	// ListRules returns the rules which refer to the bridge
+	ListRules(bridge string) ([]string, error)
+	// DeleteRule removes the rule from the chain, a missing one is not an error
+	DeleteRule(chain string, rule ...string) error
+	DeleteRuleByDevice(bridge string) error
+}
+
+// ARP announces addresses of the node to its neighbors
+type ARP interface {
+	// Announce sends a gratuitous arp, or an unsolicited neighbor advertisement for IPv6
+	Announce(ip net.IP, iface string) error
+}
+
+// NDP sends router advertisements of the node
+type NDP interface {
+	// SendRouterAdvertisements sends the burst of unsolicited router advertisements
+	SendRouterAdvertisements(config *ndp.RAConfig, count int) error
+}
+
+// Host is the network of the node programmed by the agent
+type Host struct {
+	Links  Links
+	Routes Routes
+	Sysctl Sysctl
+	NAT    NAT
+	Filter Filter
+	ARP    ARP
+	NDP    NDP
+}
+
+// New returns the host which programs the kernel of the node
+func New() *Host {
+	return &Host{
+		Links:  links{},
+		Routes: routes{},
+		Sysctl: sysctls{},
+		NAT:    nat{},
+		Filter: filter{},
+		ARP:    arp{},
+		NDP:    ndpSender{},
+	}
+}
+
+type links struct{}
+
+func (links) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+
+func (links) LinkByIndex(index int) (netlink.Link, error) {
+	return netlink.LinkByIndex(index)
+}
+
+func (links) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+func (links) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}, onError func(error)) error {
+	return netlink.LinkSubscribeWithOptions(ch, done, netlink.LinkSubscribeOptions{ErrorCallback: onError})
+}
+
+func (links) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}, onError func(error)) error {
+	return netlink.AddrSubscribeWithOptions(ch, done, netlink.AddrSubscribeOptions{ErrorCallback: onError})
+}
+
+func (links) CreateBridge(name string, mtu int) (netlink.Link, error) {
+	br, err := (&bridge.Bridge{Name: name, Mtu: mtu}).Create()
+	if err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+func (links) RemoveBridge(name string) error {
+	return (&bridge.Bridge{Name: name}).Remove()
+}
+
+func (links) AddVlan(parent string, vlan int, mtu int) (netlink.Link, error) {
+	link, err := bridge.AddVlan(parent, vlan, mtu)
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func (links) AddMacvlan(parent string, name string, mac net.HardwareAddr) (netlink.Link, error) {
+	link, err := bridge.AddMacvlan(parent, name, mac)
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func (links) DeletePort(name string) error {
+	return bridge.DeletePort(name)
+}
+
+func (links) LinkSetMaster(link netlink.Link, master netlink.Link) error {
+	return netlink.LinkSetMaster(link, master)
+}
+
+func (links) LinkSetHardwareAddr(link netlink.Link, mac net.HardwareAddr) error {
+	return netlink.LinkSetHardwareAddr(link, mac)
+}
+
+func (links) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, family)
+}
+
+func (links) AddrReplace(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrReplace(link, addr)
+}
+
+func (links) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrDel(link, addr)
+}
+
+func (links) SyncAddress(name string, pool string, address string) error {
+	return bridge.SyncAddress(name, pool, address)
+}
+
+func (links) DeleteAddresses(name string, pool string) error {
+	return bridge.DeleteAddresses(name, pool)
+}
+
+type routes struct{}
+
+func (routes) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	return netlink.RouteList(link, family)
+}
+
+func (routes) RouteListFiltered(family int, filter *netlink.Route, mask uint64) ([]netlink.Route, error) {
+	return netlink.RouteListFiltered(family, filter, mask)
+}
+
+func (routes) RouteAdd(route *netlink.Route) error {
+	return netlink.RouteAdd(route)
+}
+
+func (routes) RouteReplace(route *netlink.Route) error {
+	return netlink.RouteReplace(route)
+}
+
+func (routes) RouteDel(route *netlink.Route) error {
+	return netlink.RouteDel(route)
+}
+
+func (routes) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}, onError func(error)) error {
+	return netlink.RouteSubscribeWithOptions(ch, done, netlink.RouteSubscribeOptions{ErrorCallback: onError})
+}
+
+type sysctls struct{}
+
+func (sysctls) Sysctl(name string, value ...string) (string, error) {
+	return sysctl.Sysctl(name, value...)
+}
+
+type nat struct{}
+
+func (nat) AddMasquerade(ctx context.Context, name string, source string, ignore []string, egressnetwork string) error {
+	return iptables.AddRule(ctx, name, source, ignore, egressnetwork)
+}
+
+func (nat) MissingMasquerade(name string, source string, egressnetwork string) ([]string, error) {
+	return iptables.MissingRules(name, source, egressnetwork)
+}
+
+func (nat) IgnoreDiff(name string, ignore []string) ([]string, []string, error) {
+	return iptables.IgnoreDiff(name, ignore)
+}
+
+func (nat) SyncPortForwards(ctx context.Context, name string, forwards []iptables.PortForward) error {
+	return iptables.SyncPortForwards(ctx, name, forwards)
+}
+
+func (nat) MissingPortForwards(name string, forwards []iptables.PortForward) ([]string, error) {
+	return iptables.MissingPortForwards(name, forwards)
+}
+
+func (nat) StalePortForwards(name string, forwards []iptables.PortForward) ([]string, error) {
+	return iptables.StalePortForwards(name, forwards)
+}
+
+func (nat) AddFloatingIP(ctx context.Context, name string, external string, internal string) error {
+	return iptables.AddFloatingIP(ctx, name, external, internal)
+}
+
+func (nat) MissingFloatingIP(name string, external string, internal string) ([]string, error) {
+	return iptables.MissingFloatingIP(name, external, internal)
+}
+
+func (nat) DeleteFloatingIP(name string, external string, internal string) error {
+	return iptables.DeleteFloatingIP(name, external, internal)
+}
+
+func (nat) EgressInterface(network string) (string, error) {
+	return iptables.EgressInterface(network)
+}
+
+func (nat) ListRules(name string) ([]string, error) {
+	return iptables.ListRules(name)
+}
+
+func (nat) PurgeChain(name string) error {
+	return iptables.PurgeChain(name)
+}
+
+type filter struct{}
+
+func (filter) AddRule(ctx context.Context, chain string, rule ...string) error {
+	return ebtables.AddChainRule(ctx, chain, rule...)
+}
+
+func (filter) RuleExists(chain string, rule ...string) (bool, error) {
+	return ebtables.RuleExists(chain, rule...)
+}
+
+func (filter) ListRules(bridge string) ([]string, error) {
+	return ebtables.ListRules(bridge)
+}
+
+func (filter) DeleteRule(chain string, rule ...string) error {
+	exist, err := ebtables.RuleExists(chain, rule...)
+	if err != nil || !exist {
+		return err
+	}
+	return ebtables.DeleteChainRule(chain, strings.Join(rule, " "))
+}
+
+func (filter) DeleteRuleByDevice(bridge string) error {
+	return ebtables.DeleteRuleByDevice(bridge)
+}
+
+type arp struct{}
+
+func (arp) Announce(ip net.IP, iface string) error {
+	if ip.To4() != nil {
+		return arping.GratuitousArpOverIfaceByName(ip, iface)
+	}
+	return ndp.SendUnsolicitedNA(ip, iface)
+}
+
+type ndpSender struct{}
+
+func (ndpSender) SendRouterAdvertisements(config *ndp.RAConfig, count int) error {
+	return ndp.SendRouterAdvertisements(config, count)
+}
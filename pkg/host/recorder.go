@@ -0,0 +1,558 @@
+package host
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/NCCloud/tabby-cni/pkg/iptables"
+	"github.com/NCCloud/tabby-cni/pkg/ndp"
+)
+
+// Recorder is the host which only records the changes. Reads are served by the
+// underlying host and writes which would change nothing are not recorded, so the
+// changes are the ones the same code would make on the node.
+type Recorder struct {
+	host *Host
+
+	mu      sync.Mutex
+	changes []string
+	// Links which would be created, they are not on the node yet
+	created map[string]netlink.Link
+}
+
+// NewRecorder returns the recorder of the changes to the host
+func NewRecorder(h *Host) *Recorder {
+	return &Recorder{host: h, created: map[string]netlink.Link{}}
+}
+
+// Host returns the host which records the changes instead of making them
+func (r *Recorder) Host() *Host {
+	return &Host{
+		Links:  recordedLinks{r},
+		Routes: recordedRoutes{r},
+		Sysctl: recordedSysctl{r},
+		NAT:    recordedNAT{r},
+		Filter: recordedFilter{r},
+		ARP:    recordedARP{r},
+		NDP:    recordedNDP{r},
+	}
+}
+
+// Changes returns the recorded changes in the order they would be made
+func (r *Recorder) Changes() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.changes...)
+}
+
+// Record adds the change, the same change is recorded once
+func (r *Recorder) Record(format string, args ...interface{}) {
+	change := fmt.Sprintf(format, args...)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.changes {
+		if c == change {
+			return
+		}
+	}
+	r.changes = append(r.changes, change)
+}
+
+func (r *Recorder) createdLink(name string) (netlink.Link, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	link, ok := r.created[name]
+	return link, ok
+}
+
+func (r *Recorder) createdLinkByIndex(index int) (netlink.Link, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, link := range r.created {
+		if link.Attrs().Index == index {
+			return link, true
+		}
+	}
+	return nil, false
+}
+
+// Create the link which stands for the new one, it gets a negative index
+// which is never on the node
+func (r *Recorder) create(link netlink.Link) netlink.Link {
+	attrs := link.Attrs()
+	attrs.Flags |= net.FlagUp
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attrs.Index = -len(r.created) - 1
+	r.created[attrs.Name] = link
+	return link
+}
+
+func isCreated(link netlink.Link) bool {
+	return link != nil && link.Attrs().Index < 0
+}
+
+// Listed rule, e.g. `-t nat -A br10-POSTROUTING ...`, the way it's inserted or deleted
+func insertRule(rule string) string {
+	return fmt.Sprintf("insert rule `%s`", strings.Replace(rule, "-A ", "-I ", 1))
+}
+
+func deleteRule(rule string) string {
+	return fmt.Sprintf("delete rule `%s`", strings.Replace(rule, "-A ", "-D ", 1))
+}
+
+type recordedLinks struct{ r *Recorder }
+
+func (l recordedLinks) LinkByName(name string) (netlink.Link, error) {
+	if link, ok := l.r.createdLink(name); ok {
+		return link, nil
+	}
+	return l.r.host.Links.LinkByName(name)
+}
+
+func (l recordedLinks) LinkByIndex(index int) (netlink.Link, error) {
+	if link, ok := l.r.createdLinkByIndex(index); ok {
+		return link, nil
+	}
+	return l.r.host.Links.LinkByIndex(index)
+}
+
+func (l recordedLinks) LinkList() ([]netlink.Link, error) {
+	return l.r.host.Links.LinkList()
+}
+
+func (l recordedLinks) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}, onError func(error)) error {
+	return l.r.host.Links.LinkSubscribe(ch, done, onError)
+}
+
+func (l recordedLinks) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}, onError func(error)) error {
+	return l.r.host.Links.AddrSubscribe(ch, done, onError)
+}
+
+// Record the changes of the state of the existing link
+func (l recordedLinks) recordState(kind string, link netlink.Link, mtu int) {
+	attrs := link.Attrs()
+
+	if mtu != 0 && attrs.MTU != mtu {
+		l.r.Record("set mtu of %s %s to %d", kind, attrs.Name, mtu)
+	}
+
+	if attrs.Flags&net.FlagUp == 0 {
+		l.r.Record("set %s %s up", kind, attrs.Name)
+	}
+}
+
+func (l recordedLinks) CreateBridge(name string, mtu int) (netlink.Link, error) {
+	br, err := l.LinkByName(name)
+	if err != nil {
+		l.r.Record("create bridge %s", name)
+		return l.r.create(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu}}), nil
+	}
+
+	if !isCreated(br) {
+		l.recordState("bridge", br, mtu)
+	}
+	return br, nil
+}
+
+func (l recordedLinks) RemoveBridge(name string) error {
+	if _, err := l.LinkByName(name); err == nil {
+		l.r.Record("delete bridge %s", name)
+	}
+	return nil
+}
+
+func (l recordedLinks) AddVlan(parent string, vlan int, mtu int) (netlink.Link, error) {
+	name := fmt.Sprintf("%s.%d", parent, vlan)
+
+	port, err := l.LinkByName(name)
+	if err != nil {
+		l.r.Record("create vlan %d on %s", vlan, parent)
+		return l.r.create(&netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu}, VlanId: vlan}), nil
+	}
+
+	if !isCreated(port) {
+		l.recordState("port", port, mtu)
+	}
+	return port, nil
+}
+
+func (l recordedLinks) AddMacvlan(parent string, name string, mac net.HardwareAddr) (netlink.Link, error) {
+	link, err := l.LinkByName(name)
+	if err != nil {
+		l.r.Record("create macvlan %s on %s with mac %s", name, parent, mac)
+		return l.r.create(&netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: name, HardwareAddr: mac}, Mode: netlink.MACVLAN_MODE_PRIVATE}), nil
+	}
+
+	if !isCreated(link) {
+		if link.Attrs().HardwareAddr.String() != mac.String() {
+			l.r.Record("set mac of %s to %s", name, mac)
+		}
+		l.recordState("interface", link, 0)
+	}
+	return link, nil
+}
+
+func (l recordedLinks) DeletePort(name string) error {
+	if _, err := l.LinkByName(name); err == nil {
+		l.r.Record("delete port %s", name)
+	}
+	return nil
+}
+
+func (l recordedLinks) LinkSetMaster(link netlink.Link, master netlink.Link) error {
+	if isCreated(link) || isCreated(master) || link.Attrs().MasterIndex != master.Attrs().Index {
+		l.r.Record("attach %s to bridge %s", link.Attrs().Name, master.Attrs().Name)
+	}
+	return nil
+}
+
+func (l recordedLinks) LinkSetHardwareAddr(link netlink.Link, mac net.HardwareAddr) error {
+	// The only new mac address of the existing link is the random one of the bridge
+	l.r.Record("replace mac %s of %s", link.Attrs().HardwareAddr, link.Attrs().Name)
+	return nil
+}
+
+func (l recordedLinks) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	if isCreated(link) {
+		return nil, nil
+	}
+	return l.r.host.Links.AddrList(link, family)
+}
+
+func (l recordedLinks) hasAddr(link netlink.Link, ip net.IP) bool {
+	addrs, err := l.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false
+	}
+
+	for _, a := range addrs {
+		if a.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l recordedLinks) AddrReplace(link netlink.Link, addr *netlink.Addr) error {
+	if !l.hasAddr(link, addr.IP) {
+		l.r.Record("add address %s to %s", addr.IPNet, link.Attrs().Name)
+	}
+	return nil
+}
+
+func (l recordedLinks) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	l.r.Record("delete address %s from %s", addr.IPNet, link.Attrs().Name)
+	return nil
+}
+
+// Record removal of the addresses of the pool from the bridge, but the kept one
+func (l recordedLinks) deleteAddresses(br netlink.Link, pool string, keep net.IP) error {
+	_, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return fmt.Errorf("invalid address pool %s: %v", pool, err)
+	}
+
+	addrs, err := l.AddrList(br, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of bridge %s: %v", br.Attrs().Name, err)
+	}
+
+	for i := range addrs {
+		if ipnet.Contains(addrs[i].IP) && !addrs[i].IP.Equal(keep) {
+			l.r.Record("delete address %s of pool %s from bridge %s", addrs[i].IPNet, pool, br.Attrs().Name)
+		}
+	}
+
+	return nil
+}
+
+func (l recordedLinks) SyncAddress(bridge string, pool string, address string) error {
+	br, err := l.LinkByName(bridge)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge %s: %v", bridge, err)
+	}
+
+	addr, err := netlink.ParseAddr(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %s: %v", address, err)
+	}
+
+	if err := l.deleteAddresses(br, pool, addr.IP); err != nil {
+		return err
+	}
+
+	if !l.hasAddr(br, addr.IP) {
+		l.r.Record("add address %s of pool %s to bridge %s", address, pool, bridge)
+	}
+	return nil
+}
+
+func (l recordedLinks) DeleteAddresses(bridge string, pool string) error {
+	br, err := l.LinkByName(bridge)
+	if err != nil {
+		return nil
+	}
+	return l.deleteAddresses(br, pool, nil)
+}
+
+type recordedRoutes struct{ r *Recorder }
+
+func (rt recordedRoutes) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	if isCreated(link) {
+		return nil, nil
+	}
+	return rt.r.host.Routes.RouteList(link, family)
+}
+
+func (rt recordedRoutes) RouteListFiltered(family int, filter *netlink.Route, mask uint64) ([]netlink.Route, error) {
+	// Routes of the links which would be created
+	if mask&netlink.RT_FILTER_OIF != 0 && filter.LinkIndex < 0 {
+		return nil, nil
+	}
+	return rt.r.host.Routes.RouteListFiltered(family, filter, mask)
+}
+
+// Route by its destination and the gateway or the device
+func (rt recordedRoutes) describe(route *netlink.Route) string {
+	via := route.Gw.String()
+	if route.Gw == nil {
+		if link, err := (recordedLinks{rt.r}).LinkByIndex(route.LinkIndex); err == nil {
+			via = link.Attrs().Name
+		}
+	}
+	return fmt.Sprintf("route to %s via %s", route.Dst, via)
+}
+
+func (rt recordedRoutes) exists(route *netlink.Route) bool {
+	if route.LinkIndex < 0 {
+		return false
+	}
+
+	filter := &netlink.Route{Dst: route.Dst, Gw: route.Gw, LinkIndex: route.LinkIndex}
+	mask := netlink.RT_FILTER_DST
+	if route.Gw != nil {
+		mask |= netlink.RT_FILTER_GW
+	}
+	if route.LinkIndex != 0 {
+		mask |= netlink.RT_FILTER_OIF
+	}
+
+	routes, err := rt.r.host.Routes.RouteListFiltered(netlink.FAMILY_ALL, filter, mask)
+	return err == nil && len(routes) > 0
+}
+
+func (rt recordedRoutes) RouteAdd(route *netlink.Route) error {
+	if !rt.exists(route) {
+		rt.r.Record("add %s", rt.describe(route))
+	}
+	return nil
+}
+
+func (rt recordedRoutes) RouteReplace(route *netlink.Route) error {
+	if !rt.exists(route) {
+		rt.r.Record("replace %s", rt.describe(route))
+	}
+	return nil
+}
+
+func (rt recordedRoutes) RouteDel(route *netlink.Route) error {
+	if rt.exists(route) {
+		rt.r.Record("delete %s", rt.describe(route))
+	}
+	return nil
+}
+
+func (rt recordedRoutes) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}, onError func(error)) error {
+	return rt.r.host.Routes.RouteSubscribe(ch, done, onError)
+}
+
+type recordedSysctl struct{ r *Recorder }
+
+func (s recordedSysctl) Sysctl(name string, value ...string) (string, error) {
+	current, err := s.r.host.Sysctl.Sysctl(name)
+	if len(value) == 0 {
+		return current, err
+	}
+
+	// Parameters of the links which would be created are missing too
+	if err != nil || strings.TrimSpace(current) != value[0] {
+		s.r.Record("set %s to %s", name, value[0])
+	}
+	return value[0], nil
+}
+
+type recordedNAT struct{ r *Recorder }
+
+func (n recordedNAT) AddMasquerade(ctx context.Context, name string, source string, ignore []string, egressnetwork string) error {
+	if egressnetwork != "" {
+		if _, err := n.EgressInterface(egressnetwork); err != nil {
+			return err
+		}
+	}
+
+	missing, err := n.MissingMasquerade(name, source, egressnetwork)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range missing {
+		n.r.Record("%s", insertRule(rule))
+	}
+
+	networks, stale, err := n.IgnoreDiff(name, ignore)
+	if err != nil {
+		return err
+	}
+
+	set := iptables.IgnoreSetName(name)
+	for _, network := range networks {
+		n.r.Record("add %s to ipset %s", network, set)
+	}
+	for _, network := range stale {
+		n.r.Record("delete %s from ipset %s", network, set)
+	}
+	return nil
+}
+
+func (n recordedNAT) MissingMasquerade(name string, source string, egressnetwork string) ([]string, error) {
+	return n.r.host.NAT.MissingMasquerade(name, source, egressnetwork)
+}
+
+func (n recordedNAT) IgnoreDiff(name string, ignore []string) ([]string, []string, error) {
+	return n.r.host.NAT.IgnoreDiff(name, ignore)
+}
+
+func (n recordedNAT) SyncPortForwards(ctx context.Context, name string, forwards []iptables.PortForward) error {
+	missing, err := n.MissingPortForwards(name, forwards)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range missing {
+		n.r.Record("%s", insertRule(rule))
+	}
+
+	stale, err := n.StalePortForwards(name, forwards)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range stale {
+		n.r.Record("%s", deleteRule(rule))
+	}
+	return nil
+}
+
+func (n recordedNAT) MissingPortForwards(name string, forwards []iptables.PortForward) ([]string, error) {
+	return n.r.host.NAT.MissingPortForwards(name, forwards)
+}
+
+func (n recordedNAT) StalePortForwards(name string, forwards []iptables.PortForward) ([]string, error) {
+	return n.r.host.NAT.StalePortForwards(name, forwards)
+}
+
+func (n recordedNAT) AddFloatingIP(ctx context.Context, name string, external string, internal string) error {
+	n.r.Record("add floating ip %s of %s", external, internal)
+	return nil
+}
+
+func (n recordedNAT) MissingFloatingIP(name string, external string, internal string) ([]string, error) {
+	return n.r.host.NAT.MissingFloatingIP(name, external, internal)
+}
+
+func (n recordedNAT) DeleteFloatingIP(name string, external string, internal string) error {
+	n.r.Record("delete floating ip %s of %s", external, internal)
+	return nil
+}
+
+func (n recordedNAT) EgressInterface(network string) (string, error) {
+	return n.r.host.NAT.EgressInterface(network)
+}
+
+func (n recordedNAT) ListRules(name string) ([]string, error) {
+	return n.r.host.NAT.ListRules(name)
+}
+
+func (n recordedNAT) PurgeChain(name string) error {
+	rules, err := n.ListRules(name)
+	if err != nil {
+		return err
+	}
+
+	if len(rules) > 0 {
+		n.r.Record("delete iptables chains of %s", name)
+	}
+	return nil
+}
+
+type recordedFilter struct{ r *Recorder }
+
+func (f recordedFilter) AddRule(ctx context.Context, chain string, rule ...string) error {
+	ok, err := f.RuleExists(chain, rule...)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		f.r.Record("insert rule `-I %s %s`", chain, strings.Join(rule, " "))
+	}
+	return nil
+}
+
+func (f recordedFilter) RuleExists(chain string, rule ...string) (bool, error) {
+	return f.r.host.Filter.RuleExists(chain, rule...)
+}
+
+func (f recordedFilter) ListRules(bridge string) ([]string, error) {
+	return f.r.host.Filter.ListRules(bridge)
+}
+
+func (f recordedFilter) DeleteRule(chain string, rule ...string) error {
+	ok, err := f.RuleExists(chain, rule...)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		f.r.Record("delete rule `-D %s %s`", chain, strings.Join(rule, " "))
+	}
+	return nil
+}
+
+func (f recordedFilter) DeleteRuleByDevice(bridge string) error {
+	rules, err := f.ListRules(bridge)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		f.r.Record("%s", deleteRule(rule))
+	}
+	return nil
+}
+
+// Announcements change nothing on the node, so they are not part of the changes
+type recordedARP struct{ r *Recorder }
+
+func (recordedARP) Announce(ip net.IP, iface string) error {
+	return nil
+}
+
+type recordedNDP struct{ r *Recorder }
+
+func (recordedNDP) SendRouterAdvertisements(config *ndp.RAConfig, count int) error {
+	return nil
+}
@@ -0,0 +1,408 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+// Owner of the allocated address, the VirtualMachineInstance of KubeVirt
+// virtual machines or the pod itself
+type Owner struct {
+	APIVersion string
+	Kind       string
+	Name       string
+	UID        types.UID
+}
+
+// OwnerOf returns the owner of the pod addresses. Addresses of virt-launcher pods
+// belong to the VirtualMachineInstance, so they survive live migration.
+func OwnerOf(pod *corev1.Pod) Owner {
+	if ref := metav1.GetControllerOf(pod); ref != nil && ref.Kind == networkv1alpha1.IPAllocationOwnerVirtualMachineInstance {
+		return Owner{APIVersion: ref.APIVersion, Kind: ref.Kind, Name: ref.Name, UID: ref.UID}
+	}
+
+	return Owner{APIVersion: "v1", Kind: networkv1alpha1.IPAllocationOwnerPod, Name: pod.Name, UID: pod.UID}
+}
+
+// Attachment is the container interface the address is configured on
+type Attachment struct {
+	ContainerID string
+	Interface   string
+	NodeName    string
+}
+
+// AllocationName is unique for the address in the pool
+func AllocationName(pool string, ip net.IP) string {
+	if ip.To4() != nil {
+		return fmt.Sprintf("%s-%s", pool, ip)
+	}
+
+	name := strings.ReplaceAll(ip.String(), ":", "-")
+	if strings.HasSuffix(name, "-") {
+		name += "0"
+	}
+
+	return fmt.Sprintf("%s-%s", pool, name)
+}
+
+//+kubebuilder:rbac:groups=cloud.spaceship.com,resources=ippools,verbs=get;list;watch
+//+kubebuilder:rbac:groups=cloud.spaceship.com,resources=ipallocations,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get
+
+// Allocator hands out addresses of IPPool objects
+type Allocator struct {
+	client.Client
+}
+
+func NewAllocator(c client.Client) *Allocator {
+	return &Allocator{Client: c}
+}
+
+// Pool returns the pool by name, or the first pool bound to the network if the name is empty
+func (a *Allocator) Pool(ctx context.Context, namespace string, name string, network string) (*networkv1alpha1.IPPool, error) {
+	if name != "" {
+		pool := &networkv1alpha1.IPPool{}
+		if err := a.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, pool); err != nil {
+			return nil, fmt.Errorf("failed to get ippool %s/%s: %v", namespace, name, err)
+		}
+		return pool, nil
+	}
+
+	pools := &networkv1alpha1.IPPoolList{}
+	if err := a.List(ctx, pools, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("failed to get list of ippools: %v", err)
+	}
+
+	for i := range pools.Items {
+		if pools.Items[i].Spec.Network == network {
+			return &pools.Items[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("there is no ippool for network %s/%s", namespace, network)
+}
+
+// Pools returns pools bound to the network, or the pool with the name if it's not empty.
+// Pools of all namespaces are returned if the namespace is empty.
+func (a *Allocator) Pools(ctx context.Context, namespace string, name string, network string) ([]networkv1alpha1.IPPool, error) {
+	pools := &networkv1alpha1.IPPoolList{}
+	if err := a.List(ctx, pools, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("failed to get list of ippools: %v", err)
+	}
+
+	var result []networkv1alpha1.IPPool
+	for _, pool := range pools.Items {
+		if (name != "" && pool.Name == name) || (name == "" && pool.Spec.Network == network) {
+			result = append(result, pool)
+		}
+	}
+
+	return result, nil
+}
+
+func (a *Allocator) ownerAllocations(ctx context.Context, namespace string, owner types.UID, labels client.MatchingLabels) ([]networkv1alpha1.IPAllocation, error) {
+	allocations := &networkv1alpha1.IPAllocationList{}
+
+	labels[networkv1alpha1.IPAllocationOwnerLabel] = string(owner)
+	if err := a.List(ctx, allocations, client.InNamespace(namespace), labels); err != nil {
+		return nil, fmt.Errorf("failed to get list of ipallocations: %v", err)
+	}
+
+	return allocations.Items, nil
+}
+
+// Allocations returns addresses of the owner in the pool
+func (a *Allocator) Allocations(ctx context.Context, pool *networkv1alpha1.IPPool, owner Owner) ([]networkv1alpha1.IPAllocation, error) {
+	return a.ownerAllocations(ctx, pool.Namespace, owner.UID, client.MatchingLabels{networkv1alpha1.IPAllocationPoolLabel: pool.Name})
+}
+
+// Allocate returns the address of the owner interface in the pool, a new one is
+// allocated if there is none yet. The name of the allocation is unique for the address,
+// so concurrent allocations of the same address are rejected by the API server.
+func (a *Allocator) Allocate(ctx context.Context, pool *networkv1alpha1.IPPool, owner Owner, attachment Attachment) (*networkv1alpha1.IPAllocation, error) {
+	existing, err := a.Allocations(ctx, pool, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range existing {
+		if existing[i].Spec.Interface == attachment.Interface {
+			return a.reattach(ctx, &existing[i], attachment)
+		}
+	}
+
+	r, err := NewRange(&pool.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	allocations := &networkv1alpha1.IPAllocationList{}
+	if err := a.List(ctx, allocations, client.InNamespace(pool.Namespace), client.MatchingLabels{networkv1alpha1.IPAllocationPoolLabel: pool.Name}); err != nil {
+		return nil, fmt.Errorf("failed to get list of ipallocations: %v", err)
+	}
+
+	used := map[string]bool{}
+	for _, alloc := range allocations.Items {
+		used[alloc.Name] = true
+	}
+
+	for ip := r.First(); ip != nil; ip = r.Next(ip) {
+		name := AllocationName(pool.Name, ip)
+		if used[name] {
+			continue
+		}
+
+		alloc := newAllocation(pool, owner, attachment, name, &net.IPNet{IP: ip, Mask: r.Mask})
+
+		err := a.Create(ctx, alloc)
+		if errors.IsAlreadyExists(err) {
+			// Somebody else was faster
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ipallocation %s: %v", name, err)
+		}
+
+		return alloc, nil
+	}
+
+	return nil, fmt.Errorf("ippool %s/%s is exhausted", pool.Namespace, pool.Name)
+}
+
+// The address is kept by the owner, e.g. the virtual machine moved to another node
+// or the sandbox of the pod was recreated, so GC has to know the new container
+func (a *Allocator) reattach(ctx context.Context, alloc *networkv1alpha1.IPAllocation, attachment Attachment) (*networkv1alpha1.IPAllocation, error) {
+	if alloc.Spec.ContainerID == attachment.ContainerID && alloc.Spec.NodeName == attachment.NodeName {
+		return alloc, nil
+	}
+
+	alloc.Spec.ContainerID = attachment.ContainerID
+	alloc.Spec.NodeName = attachment.NodeName
+
+	if err := a.Update(ctx, alloc); err != nil {
+		return nil, fmt.Errorf("failed to update ipallocation %s: %v", alloc.Name, err)
+	}
+
+	return alloc, nil
+}
+
+// Release deletes addresses of the owner interface in all pools
+func (a *Allocator) Release(ctx context.Context, namespace string, owner Owner, iface string) error {
+	allocations, err := a.ownerAllocations(ctx, namespace, owner.UID, client.MatchingLabels{})
+	if err != nil {
+		return err
+	}
+
+	for i := range allocations {
+		if allocations[i].Spec.Interface != iface {
+			continue
+		}
+
+		if err := a.Delete(ctx, &allocations[i]); client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("failed to delete ipallocation %s: %v", allocations[i].Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Collect deletes addresses of pod interfaces attached on the node which are not valid anymore,
+// e.g. the container runtime has lost the DEL. Addresses of virtual machines are kept,
+// they follow the VirtualMachineInstance across nodes and go away together with it.
+func (a *Allocator) Collect(ctx context.Context, pool *networkv1alpha1.IPPool, node string, valid []Attachment) error {
+	allocations := &networkv1alpha1.IPAllocationList{}
+	if err := a.List(ctx, allocations, client.InNamespace(pool.Namespace), client.MatchingLabels{networkv1alpha1.IPAllocationPoolLabel: pool.Name}); err != nil {
+		return fmt.Errorf("failed to get list of ipallocations: %v", err)
+	}
+
+	attached := map[Attachment]bool{}
+	for _, v := range valid {
+		attached[Attachment{ContainerID: v.ContainerID, Interface: v.Interface}] = true
+	}
+
+	for i := range allocations.Items {
+		spec := &allocations.Items[i].Spec
+		if spec.OwnerKind == networkv1alpha1.IPAllocationOwnerVirtualMachineInstance || spec.NodeName != node || spec.ContainerID == "" {
+			continue
+		}
+
+		if attached[Attachment{ContainerID: spec.ContainerID, Interface: spec.Interface}] {
+			continue
+		}
+
+		if err := a.Delete(ctx, &allocations.Items[i]); client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("failed to delete ipallocation %s: %v", allocations.Items[i].Name, err)
+		}
+	}
+
+	return nil
+}
+
+// The allocation is garbage collected together with the owner
+func newAllocation(pool *networkv1alpha1.IPPool, owner Owner, attachment Attachment, name string, address *net.IPNet) *networkv1alpha1.IPAllocation {
+	return &networkv1alpha1.IPAllocation{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: pool.Namespace,
+			Labels: map[string]string{
+				networkv1alpha1.IPAllocationPoolLabel:  pool.Name,
+				networkv1alpha1.IPAllocationOwnerLabel: string(owner.UID),
+			},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: owner.APIVersion,
+				Kind:       owner.Kind,
+				Name:       owner.Name,
+				UID:        owner.UID,
+			}},
+		},
+		Spec: networkv1alpha1.IPAllocationSpec{
+			Pool:        pool.Name,
+			Address:     address.String(),
+			OwnerKind:   owner.Kind,
+			OwnerName:   owner.Name,
+			Interface:   attachment.Interface,
+			ContainerID: attachment.ContainerID,
+			NodeName:    attachment.NodeName,
+		},
+	}
+}
+
+// Range of addresses handed out by the pool
+type Range struct {
+	Start   net.IP
+	End     net.IP
+	Mask    net.IPMask
+	Gateway net.IP
+	Exclude []*net.IPNet
+}
+
+func NewRange(spec *networkv1alpha1.IPPoolSpec) (*Range, error) {
+	_, subnet, err := net.ParseCIDR(spec.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ippool cidr %q: %v", spec.CIDR, err)
+	}
+
+	r := &Range{Mask: subnet.Mask}
+
+	first, last := toInt(subnet.IP), lastAddress(subnet)
+
+	// Network and broadcast addresses
+	ones, bits := subnet.Mask.Size()
+	if bits == 32 && bits-ones > 1 {
+		first.Add(first, big.NewInt(1))
+		last.Sub(last, big.NewInt(1))
+	}
+
+	r.Start, r.End = fromInt(first, len(subnet.IP)), fromInt(last, len(subnet.IP))
+
+	if spec.RangeStart != "" {
+		if r.Start = net.ParseIP(spec.RangeStart); r.Start == nil || !subnet.Contains(r.Start) {
+			return nil, fmt.Errorf("ippool range start %q is outside of %s", spec.RangeStart, spec.CIDR)
+		}
+	}
+
+	if spec.RangeEnd != "" {
+		if r.End = net.ParseIP(spec.RangeEnd); r.End == nil || !subnet.Contains(r.End) {
+			return nil, fmt.Errorf("ippool range end %q is outside of %s", spec.RangeEnd, spec.CIDR)
+		}
+	}
+
+	if spec.Gateway != "" {
+		if r.Gateway = net.ParseIP(spec.Gateway); r.Gateway == nil {
+			return nil, fmt.Errorf("invalid ippool gateway %q", spec.Gateway)
+		}
+	}
+
+	for _, e := range spec.Exclude {
+		if !strings.Contains(e, "/") {
+			if ip := net.ParseIP(e); ip != nil && ip.To4() != nil {
+				e += "/32"
+			} else {
+				e += "/128"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ippool exclude %q: %v", e, err)
+		}
+		r.Exclude = append(r.Exclude, ipnet)
+	}
+
+	return r, nil
+}
+
+func (r *Range) excluded(ip net.IP) bool {
+	if r.Gateway != nil && r.Gateway.Equal(ip) {
+		return true
+	}
+
+	for _, e := range r.Exclude {
+		if e.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// First returns the first address which could be handed out, nil if there is none
+func (r *Range) First() net.IP {
+	ip := r.Start
+	if r.excluded(ip) {
+		return r.Next(ip)
+	}
+	return normalize(ip)
+}
+
+// Next returns the next address which could be handed out, nil at the end of the range
+func (r *Range) Next(ip net.IP) net.IP {
+	n, end := toInt(ip), toInt(r.End)
+
+	for {
+		n.Add(n, big.NewInt(1))
+		if n.Cmp(end) > 0 {
+			return nil
+		}
+
+		next := fromInt(n, len(normalize(r.Start)))
+		if !r.excluded(next) {
+			return next
+		}
+	}
+}
+
+func normalize(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+func toInt(ip net.IP) *big.Int {
+	return big.NewInt(0).SetBytes(normalize(ip))
+}
+
+func fromInt(n *big.Int, size int) net.IP {
+	return net.IP(n.FillBytes(make([]byte, size)))
+}
+
+func lastAddress(subnet *net.IPNet) *big.Int {
+	ip := normalize(subnet.IP)
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^subnet.Mask[i]
+	}
+	return toInt(last)
+}
@@ -0,0 +1,233 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	networkv1alpha1 "github.com/NCCloud/tabby-cni/api/v1alpha1"
+)
+
+func addresses(t *testing.T, spec networkv1alpha1.IPPoolSpec) []string {
+	r, err := NewRange(&spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result []string
+	for ip := r.First(); ip != nil; ip = r.Next(ip) {
+		result = append(result, ip.String())
+	}
+	return result
+}
+
+func TestRange(t *testing.T) {
+	got := addresses(t, networkv1alpha1.IPPoolSpec{
+		CIDR:    "192.168.1.0/29",
+		Gateway: "192.168.1.1",
+		Exclude: []string{"192.168.1.4/31"},
+	})
+	want := []string{"192.168.1.2", "192.168.1.3", "192.168.1.6"}
+	if len(got) != len(want) {
+		t.Fatalf("addresses = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("addresses = %v, want %v", got, want)
+		}
+	}
+
+	got = addresses(t, networkv1alpha1.IPPoolSpec{
+		CIDR:       "fd00::/64",
+		RangeStart: "fd00::ffff",
+		RangeEnd:   "fd00::1:1",
+		Exclude:    []string{"fd00::1:0"},
+	})
+	if len(got) != 2 || got[0] != "fd00::ffff" || got[1] != "fd00::1:1" {
+		t.Fatalf("addresses = %v", got)
+	}
+
+	if _, err := NewRange(&networkv1alpha1.IPPoolSpec{CIDR: "10.0.0.0/24", RangeStart: "10.0.1.1"}); err == nil {
+		t.Error("expected range start outside of the subnet to be rejected")
+	}
+}
+
+func TestAllocationName(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1":  "pool-10.0.0.1",
+		"fd00::1":   "pool-fd00--1",
+		"fd00::":    "pool-fd00--0",
+		"fd00:1::2": "pool-fd00-1--2",
+	}
+
+	for ip, want := range tests {
+		if got := AllocationName("pool", net.ParseIP(ip)); got != want {
+			t.Errorf("AllocationName(%s) = %s, want %s", ip, got, want)
+		}
+	}
+}
+
+func newFakeAllocator(t *testing.T, funcs interceptor.Funcs) (*Allocator, *networkv1alpha1.IPPool) {
+	scheme := runtime.NewScheme()
+	if err := networkv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := &networkv1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool", Namespace: "default"},
+		Spec:       networkv1alpha1.IPPoolSpec{Network: "vm-network", CIDR: "10.10.0.0/24", Gateway: "10.10.0.1"},
+	}
+
+	c := fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(pool).WithInterceptorFuncs(funcs).Build()
+	return NewAllocator(c), pool
+}
+
+func vmOwner(name string) Owner {
+	return Owner{APIVersion: "kubevirt.io/v1", Kind: networkv1alpha1.IPAllocationOwnerVirtualMachineInstance, Name: name, UID: types.UID(name)}
+}
+
+func TestAllocate(t *testing.T) {
+	a, pool := newFakeAllocator(t, interceptor.Funcs{})
+	ctx := context.Background()
+
+	first, err := a.Allocate(ctx, pool, vmOwner("vm1"), Attachment{Interface: "eth0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Spec.Address != "10.10.0.2/24" {
+		t.Errorf("address = %s, want 10.10.0.2/24", first.Spec.Address)
+	}
+
+	// Owner interface keeps its address, the allocation follows the new container
+	again, err := a.Allocate(ctx, pool, vmOwner("vm1"), Attachment{ContainerID: "target", Interface: "eth0", NodeName: "node2"})
+	if err != nil || again.Name != first.Name {
+		t.Errorf("Allocate() again = %v, %v, want %s", again, err, first.Name)
+	}
+	if again != nil && (again.Spec.ContainerID != "target" || again.Spec.NodeName != "node2") {
+		t.Errorf("allocation is attached to %s on %s, want target on node2", again.Spec.ContainerID, again.Spec.NodeName)
+	}
+
+	second, err := a.Allocate(ctx, pool, vmOwner("vm2"), Attachment{Interface: "eth0"})
+	if err != nil || second.Spec.Address != "10.10.0.3/24" {
+		t.Errorf("Allocate() of vm2 = %v, %v, want 10.10.0.3/24", second, err)
+	}
+
+	// Released address is handed out again
+	if err := a.Release(ctx, "default", vmOwner("vm1"), "eth0"); err != nil {
+		t.Fatal(err)
+	}
+	if allocations, err := a.Allocations(ctx, pool, vmOwner("vm1")); err != nil || len(allocations) != 0 {
+		t.Errorf("allocations of vm1 = %v, %v, want none", allocations, err)
+	}
+
+	third, err := a.Allocate(ctx, pool, vmOwner("vm3"), Attachment{Interface: "eth0"})
+	if err != nil || third.Spec.Address != first.Spec.Address {
+		t.Errorf("Allocate() of vm3 = %v, %v, want %s", third, err, first.Spec.Address)
+	}
+}
+
+func TestAllocateConflict(t *testing.T) {
+	taken := AllocationName("pool", net.ParseIP("10.10.0.2"))
+
+	// Another agent creates the allocation after the list, before the create
+	a, pool := newFakeAllocator(t, interceptor.Funcs{
+		Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			if obj.GetName() == taken {
+				return apierrors.NewAlreadyExists(schema.GroupResource{Group: networkv1alpha1.GroupVersion.Group, Resource: "ipallocations"}, taken)
+			}
+			return c.Create(ctx, obj, opts...)
+		},
+	})
+
+	alloc, err := a.Allocate(context.Background(), pool, vmOwner("vm1"), Attachment{Interface: "eth0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alloc.Spec.Address != "10.10.0.3/24" {
+		t.Errorf("address = %s, want the next one 10.10.0.3/24", alloc.Spec.Address)
+	}
+}
+
+func TestAllocateConcurrent(t *testing.T) {
+	a, pool := newFakeAllocator(t, interceptor.Funcs{})
+	ctx := context.Background()
+
+	const owners = 20
+
+	var wg sync.WaitGroup
+	addrs := make([]string, owners)
+	errs := make([]error, owners)
+
+	for i := 0; i < owners; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			alloc, err := a.Allocate(ctx, pool, vmOwner(fmt.Sprintf("vm%d", i)), Attachment{Interface: "eth0"})
+			if err == nil {
+				addrs[i] = alloc.Spec.Address
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for i := range addrs {
+		if errs[i] != nil {
+			t.Fatalf("Allocate() of vm%d: %v", i, errs[i])
+		}
+		if seen[addrs[i]] {
+			t.Errorf("address %s was allocated twice", addrs[i])
+		}
+		seen[addrs[i]] = true
+	}
+}
+
+func podOwner(name string) Owner {
+	return Owner{APIVersion: "v1", Kind: networkv1alpha1.IPAllocationOwnerPod, Name: name, UID: types.UID(name)}
+}
+
+func TestCollect(t *testing.T) {
+	a, pool := newFakeAllocator(t, interceptor.Funcs{})
+	ctx := context.Background()
+
+	allocate := func(owner Owner, attachment Attachment) *networkv1alpha1.IPAllocation {
+		alloc, err := a.Allocate(ctx, pool, owner, attachment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return alloc
+	}
+
+	live := allocate(podOwner("live"), Attachment{ContainerID: "live", Interface: "eth0", NodeName: "node1"})
+	stale := allocate(podOwner("stale"), Attachment{ContainerID: "stale", Interface: "eth0", NodeName: "node1"})
+	// Containers of other nodes are not in the list of the node
+	remote := allocate(podOwner("remote"), Attachment{ContainerID: "remote", Interface: "eth0", NodeName: "node2"})
+	vm := allocate(vmOwner("vm"), Attachment{ContainerID: "launcher", Interface: "eth0", NodeName: "node1"})
+
+	if err := a.Collect(ctx, pool, "node1", []Attachment{{ContainerID: "live", Interface: "eth0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alloc := range []*networkv1alpha1.IPAllocation{live, remote, vm} {
+		if err := a.Get(ctx, client.ObjectKeyFromObject(alloc), &networkv1alpha1.IPAllocation{}); err != nil {
+			t.Errorf("expected ipallocation %s of %s to stay: %v", alloc.Name, alloc.Spec.OwnerName, err)
+		}
+	}
+
+	if err := a.Get(ctx, client.ObjectKeyFromObject(stale), &networkv1alpha1.IPAllocation{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected ipallocation %s of the stale container to be deleted, got %v", stale.Name, err)
+	}
+}
@@ -0,0 +1,154 @@
+package ipset
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/NCCloud/tabby-cni/pkg/logging"
+)
+
+const (
+	cmdipset    string = "ipset"
+	TypeHashNet string = "hash:net"
+)
+
+func run(args ...string) (string, error) {
+	cmd := exec.Command(cmdipset, args...)
+	stdout, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ipset %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(stdout)))
+	}
+	return string(stdout), nil
+}
+
+// ipset shows host networks without the prefix length, e.g. 10.0.0.1/32 is shown as 10.0.0.1
+func normalize(entry string) string {
+	ip, ipnet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return entry
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if ones == bits {
+		return ip.String()
+	}
+
+	return ipnet.String()
+}
+
+// Create makes a new set if it doesn't exist yet
+func Create(name string, setType string) error {
+	_, err := run("create", name, setType, "family", "inet", "-exist")
+	return err
+}
+
+// List returns entries of the set
+func List(name string) ([]string, error) {
+	var entries []string
+
+	stdout, err := run("save", name)
+	if err != nil {
+		return nil, err
+	}
+
+	// add br10-IGNORE 10.10.10.0/24
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "add" && fields[1] == name {
+			entries = append(entries, normalize(fields[2]))
+		}
+	}
+
+	return entries, nil
+}
+
+// Diff returns the entries which are not in the set yet and the entries of the set
+// which are not in the given ones. All entries are missing if there is no set.
+func Diff(name string, entries []string) ([]string, []string, error) {
+	var current []string
+
+	if exists(name) {
+		var err error
+		if current, err = List(name); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	desired := map[string]bool{}
+	for _, e := range entries {
+		desired[normalize(e)] = true
+	}
+
+	existing := map[string]bool{}
+	var stale []string
+	for _, e := range current {
+		existing[e] = true
+		if !desired[e] {
+			stale = append(stale, e)
+		}
+	}
+
+	var missing []string
+	for _, e := range entries {
+		e = normalize(e)
+		if !existing[e] {
+			missing = append(missing, e)
+			// Duplicates of the entries are added once
+			existing[e] = true
+		}
+	}
+
+	return missing, stale, nil
+}
+
+// Sync updates the set incrementally, so it contains only the given entries.
+// Entries which are already in the set are left untouched.
+func Sync(ctx context.Context, name string, setType string, entries []string) error {
+	log := logging.FromContext(ctx, logging.Ipset).WithValues("set", name)
+
+	if err := Create(name, setType); err != nil {
+		return err
+	}
+
+	missing, stale, err := Diff(name, entries)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range stale {
+		log.Info("Removing ipset entry", "entry", e)
+
+		if _, err := run("del", name, e, "-exist"); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range missing {
+		log.Info("Adding ipset entry", "entry", e)
+
+		if _, err := run("add", name, e, "-exist"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func exists(name string) bool {
+	_, err := run("list", "-name", name)
+	return err == nil
+}
+
+// Destroy removes the set. The set must not be referenced by iptables rules.
+func Destroy(name string) error {
+	if !exists(name) {
+		// Nothing to do, the set doesn't exist
+		return nil
+	}
+
+	_, err := run("destroy", name)
+	return err
+}
@@ -0,0 +1,77 @@
+package ipset
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/NCCloud/tabby-cni/pkg/netnstest"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"10.10.0.0/24": "10.10.0.0/24",
+		"10.10.0.1/24": "10.10.0.0/24",
+		"10.10.0.1/32": "10.10.0.1",
+		"10.10.0.1":    "10.10.0.1",
+	}
+
+	for entry, want := range tests {
+		if got := normalize(entry); got != want {
+			t.Errorf("normalize(%s) = %s, want %s", entry, got, want)
+		}
+	}
+}
+
+func list(t *testing.T, name string) []string {
+	t.Helper()
+
+	entries, err := List(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func TestSync(t *testing.T) {
+	netnstest.New(t)
+	netnstest.RequireCommand(t, "ipset")
+
+	ctx := context.Background()
+
+	if err := Sync(ctx, "br10-IGNORE", TypeHashNet, []string{"10.20.0.0/16", "10.30.0.1/32"}); err != nil {
+		t.Fatal(err)
+	}
+	if entries := list(t, "br10-IGNORE"); !reflect.DeepEqual(entries, []string{"10.20.0.0/16", "10.30.0.1"}) {
+		t.Errorf("List() = %q", entries)
+	}
+
+	// Entries are replaced, host networks are the same with or without the prefix length
+	if err := Sync(ctx, "br10-IGNORE", TypeHashNet, []string{"10.30.0.1", "10.40.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if entries := list(t, "br10-IGNORE"); !reflect.DeepEqual(entries, []string{"10.30.0.1", "10.40.0.0/24"}) {
+		t.Errorf("List() = %q", entries)
+	}
+
+	if err := Sync(ctx, "br10-IGNORE", TypeHashNet, nil); err != nil {
+		t.Fatal(err)
+	}
+	if entries := list(t, "br10-IGNORE"); len(entries) != 0 {
+		t.Errorf("List() = %q, want none", entries)
+	}
+
+	if err := Destroy("br10-IGNORE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := List("br10-IGNORE"); err == nil {
+		t.Error("expected the set to be destroyed")
+	}
+
+	// Destroyed set is not an error
+	if err := Destroy("br10-IGNORE"); err != nil {
+		t.Errorf("Destroy() of the missing set: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/NCCloud/tabby-cni/pkg/logging"
+)
+
+const (
+	FloatingIPPreroutingChain  string = "FLOATINGIP-PREROUTING"
+	FloatingIPPostroutingChain string = "FLOATINGIP-POSTROUTING"
+)
+
+func floatingIPRules(name string, external string, internal string) []Rules {
+	return []Rules{
+		{
+			table:         "nat",
+			chain:         FloatingIPPreroutingChain,
+			destination:   external,
+			action:        "DNAT",
+			toDestination: internal,
+			comment:       name,
+		},
+		{
+			table:    "nat",
+			chain:    FloatingIPPostroutingChain,
+			source:   internal,
+			action:   "SNAT",
+			toSource: external,
+			comment:  name,
+		},
+	}
+}
+
+// AddFloatingIP makes 1:1 nat between external and internal address.
+// Floating ip chains are jumped to before any other nat rule, so the
+// floating ip takes precedence over masquerading of the bridge.
+func AddFloatingIP(ctx context.Context, name string, external string, internal string) error {
+	log := logging.FromContext(ctx, logging.Iptables)
+
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+
+	for _, chain := range []string{FloatingIPPreroutingChain, FloatingIPPostroutingChain} {
+		exist, err := ipt.ChainExists("nat", chain)
+		if err != nil {
+			return fmt.Errorf("failed to check iptables chain %s: %v", chain, err)
+		}
+
+		if !exist {
+			if err = ipt.NewChain("nat", chain); err != nil {
+				return fmt.Errorf("failed to create iptables chain %s: %v", chain, err)
+			}
+		}
+	}
+
+	if err = pinFloatingIPJumps(ipt); err != nil {
+		return err
+	}
+
+	for _, rls := range floatingIPRules(name, external, internal) {
+		r := renderRule(&rls)
+
+		exist, _ := ipt.Exists(rls.table, rls.chain, r...)
+		if exist {
+			continue
+		}
+
+		log.Info("Adding iptables rule", logging.KeyTable, rls.table, logging.KeyChain, rls.chain, logging.KeyRule, strings.Join(r, " "))
+
+		if err = ipt.Insert(rls.table, rls.chain, 1, r...); err != nil {
+			return fmt.Errorf("failed to add iptables rule %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Jumps from the builtin chains to the floating ip chains
+func floatingIPJumps() []Rules {
+	return []Rules{
+		{
+			table:  "nat",
+			chain:  "PREROUTING",
+			action: FloatingIPPreroutingChain,
+		},
+		{
+			table:  "nat",
+			chain:  "OUTPUT",
+			action: FloatingIPPreroutingChain,
+		},
+		{
+			table:  "nat",
+			chain:  "POSTROUTING",
+			action: FloatingIPPostroutingChain,
+		},
+	}
+}
+
+// pinFloatingIPJumps moves the floating ip jumps to the top of the builtin chains.
+// Jumps of the bridge chains are inserted at the top as well, so the order is
+// fixed every time either of them is applied.
+func pinFloatingIPJumps(ipt *iptables.IPTables) error {
+	for _, rls := range floatingIPJumps() {
+		exist, err := ipt.ChainExists(rls.table, rls.action)
+		if err != nil {
+			return fmt.Errorf("failed to check iptables chain %s: %v", rls.action, err)
+		}
+
+		// Nothing to pin, there was never a floating ip on the node
+		if !exist {
+			continue
+		}
+
+		r := renderRule(&rls)
+
+		rules, err := ipt.List(rls.table, rls.chain)
+		if err != nil {
+			return fmt.Errorf("failed to get list of iptables rules %v", err)
+		}
+
+		if firstRule(rules) == fmt.Sprintf("-A %s %s", rls.chain, strings.Join(r, " ")) {
+			continue
+		}
+
+		if err = ipt.DeleteIfExists(rls.table, rls.chain, r...); err != nil {
+			return fmt.Errorf("failed to delete iptables rule `%s`, %v", strings.Join(r, " "), err)
+		}
+
+		if err = ipt.Insert(rls.table, rls.chain, 1, r...); err != nil {
+			return fmt.Errorf("failed to add iptables rule %v", err)
+		}
+	}
+
+	return nil
+}
+
+// First rule of the chain listing, the policy goes before it, e.g. -P POSTROUTING ACCEPT
+func firstRule(rules []string) string {
+	for _, rule := range rules {
+		if strings.HasPrefix(rule, "-A ") {
+			return rule
+		}
+	}
+	return ""
+}
+
+// MissingFloatingIP returns the nat rules of the floating ip which are not on the node.
+// The jumps to the floating ip chains are pinned by AddRule and AddFloatingIP.
+func MissingFloatingIP(name string, external string, internal string) ([]string, error) {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, err
+	}
+
+	return missingRules(ipt, floatingIPRules(name, external, internal))
+}
+
+// DeleteFloatingIP removes nat rules of the floating ip. Chains are kept
+// since they are shared between all floating ips on the node.
+func DeleteFloatingIP(name string, external string, internal string) error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+
+	for _, rls := range floatingIPRules(name, external, internal) {
+		exist, err := ipt.ChainExists(rls.table, rls.chain)
+		if err != nil {
+			return fmt.Errorf("failed to check iptables chain %s: %v", rls.chain, err)
+		}
+
+		if !exist {
+			continue
+		}
+
+		r := renderRule(&rls)
+		if err = ipt.DeleteIfExists(rls.table, rls.chain, r...); err != nil {
+			return fmt.Errorf("failed to delete iptables rule `%s`, %v", strings.Join(r, " "), err)
+		}
+	}
+
+	return nil
+}
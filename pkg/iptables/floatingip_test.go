@@ -0,0 +1,60 @@
+package iptables
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/NCCloud/tabby-cni/pkg/netnstest"
+)
+
+func TestFloatingIPOrder(t *testing.T) {
+	netnstest.New(t)
+	netnstest.RequireCommand(t, "iptables", "ipset")
+
+	ctx := context.Background()
+
+	if err := AddFloatingIP(ctx, "default/vm1", "192.168.0.10", "10.10.0.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Masquerade and port forwards are applied after the floating ip, e.g. on resync
+	if err := AddRule(ctx, "br10", "10.10.0.0/24", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncPortForwards(ctx, "br10", []PortForward{{Protocol: "tcp", Port: 2222, ToDestination: "10.10.0.2:22"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"POSTROUTING": {"-A POSTROUTING -j FLOATINGIP-POSTROUTING", "-A POSTROUTING -s 10.10.0.0/24 -j br10-POSTROUTING"},
+		"PREROUTING":  {"-A PREROUTING -j FLOATINGIP-PREROUTING", "-A PREROUTING -j br10-PREROUTING"},
+		"OUTPUT":      {"-A OUTPUT -j FLOATINGIP-PREROUTING", "-A OUTPUT -j br10-PREROUTING"},
+	}
+
+	for chain, jumps := range want {
+		rules, err := ipt.List("nat", chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Policy of the builtin chain goes first
+		if len(rules) != len(jumps)+1 || rules[1] != jumps[0] || rules[2] != jumps[1] {
+			t.Errorf("%s rules = %q, want %q", chain, rules[1:], jumps)
+		}
+	}
+
+	// Jumps are not duplicated when the order is already right
+	if err := AddFloatingIP(ctx, "default/vm1", "192.168.0.10", "10.10.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if rules, err := ipt.List("nat", "POSTROUTING"); err != nil || len(rules) != 3 {
+		t.Errorf("POSTROUTING rules = %q, %v, want two jumps", rules, err)
+	}
+}
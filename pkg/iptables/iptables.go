@@ -1,24 +1,35 @@
 package iptables
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
-	"github.com/sirupsen/logrus"
+	"github.com/go-logr/logr"
 	"github.com/vishvananda/netlink"
+
+	"github.com/NCCloud/tabby-cni/pkg/ipset"
+	"github.com/NCCloud/tabby-cni/pkg/logging"
 )
 
 type Rules struct {
-	table       string
-	source      string
-	destination string
-	inface      string
-	outface     string
-	action      string
-	chain       string
-	comment     string
+	table         string
+	source        string
+	destination   string
+	protocol      string
+	dport         int
+	dstType       string
+	matchSet      string
+	inface        string
+	outface       string
+	action        string
+	chain         string
+	comment       string
+	toDestination string
+	toSource      string
 }
 
 func renderRule(rule *Rules) []string {
@@ -32,8 +43,24 @@ func renderRule(rule *Rules) []string {
 		prepareRule = append(prepareRule, "-d", rule.destination)
 	}
 
-	if rule.action != "" {
-		prepareRule = append(prepareRule, "-j", rule.action)
+	if rule.protocol != "" {
+		prepareRule = append(prepareRule, "-p", rule.protocol)
+	}
+
+	if rule.dport != 0 {
+		prepareRule = append(prepareRule, "-m", rule.protocol, "--dport", strconv.Itoa(rule.dport))
+	}
+
+	if rule.dstType != "" {
+		prepareRule = append(prepareRule, "-m", "addrtype", "--dst-type", rule.dstType)
+	}
+
+	if rule.matchSet != "" {
+		prepareRule = append(prepareRule, "-m", "set", "--match-set", rule.matchSet, "dst")
+	}
+
+	if rule.inface != "" {
+		prepareRule = append(prepareRule, "-i", rule.inface)
 	}
 
 	if rule.outface != "" {
@@ -41,47 +68,93 @@ func renderRule(rule *Rules) []string {
 	}
 
 	if rule.comment != "" {
-		prepareRule = append(prepareRule, "-m comment --comment", rule.comment)
+		prepareRule = append(prepareRule, "-m", "comment", "--comment", rule.comment)
+	}
+
+	if rule.action != "" {
+		prepareRule = append(prepareRule, "-j", rule.action)
+	}
+
+	if rule.toDestination != "" {
+		prepareRule = append(prepareRule, "--to-destination", rule.toDestination)
+	}
+
+	if rule.toSource != "" {
+		prepareRule = append(prepareRule, "--to-source", rule.toSource)
 	}
 
 	return prepareRule
 }
 
-func AddRule(name string, source string, ignore []string, egressnetwork string) error {
+// EgressInterface returns the name of the interface the node uses to reach the network.
+// The network could be defined as a cidr or a single ip address.
+func EgressInterface(network string) (string, error) {
+	egressNetIp := net.ParseIP(network)
+	if egressNetIp == nil {
+		ip, _, err := net.ParseCIDR(network)
+		if err != nil {
+			return "", err
+		}
+		egressNetIp = ip
+	}
+
+	egressRoute, _ := netlink.RouteGet(egressNetIp)
+	if len(egressRoute) != 1 {
+		return "", fmt.Errorf("failed to find network for snat: %v", egressRoute)
+	}
+
+	i, err := net.InterfaceByIndex(egressRoute[0].LinkIndex)
+	if err != nil {
+		return "", err
+	}
+
+	return i.Name, nil
+}
 
-	var (
-		egressInterface string
-	)
+// Jump to the <name>-POSTROUTING chain which masquerades the source network,
+// followed by the rules of the chain in their order
+func masqueradeRules(name string, source string, egressnetwork string) ([]Rules, error) {
+	var egressInterface string
+	var err error
 
 	if egressnetwork != "" {
-		egressNetIp, _, err := net.ParseCIDR(egressnetwork)
+		egressInterface, err = EgressInterface(egressnetwork)
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		egressRoute, _ := netlink.RouteGet(egressNetIp)
-		if len(egressRoute) != 1 {
-			return fmt.Errorf("failed to find network for snat: %v", egressRoute)
-		}
-
-		i, _ := net.InterfaceByIndex(egressRoute[0].LinkIndex)
-		egressInterface = i.Name
 	}
 
-	// Default iptables rules
-	rules := []Rules{
+	return []Rules{
 		{
 			table:  "nat",
 			chain:  "POSTROUTING",
 			source: source,
 			action: fmt.Sprintf("%s-POSTROUTING", name),
 		},
+		// Ignore list is kept in the ipset, so the chain needs a single rule
+		// regardless of the number of ignored networks. It has to stay above
+		// the masquerade, otherwise ignored networks are masqueraded as well.
+		{
+			table:    "nat",
+			chain:    fmt.Sprintf("%s-POSTROUTING", name),
+			matchSet: IgnoreSetName(name),
+			action:   "ACCEPT",
+		},
 		{
 			table:   "nat",
 			chain:   fmt.Sprintf("%s-POSTROUTING", name),
 			outface: egressInterface,
 			action:  "MASQUERADE",
 		},
+	}, nil
+}
+
+func AddRule(ctx context.Context, name string, source string, ignore []string, egressnetwork string) error {
+	log := logging.FromContext(ctx, logging.Iptables).WithValues(logging.KeyBridge, name)
+
+	rules, err := masqueradeRules(name, source, egressnetwork)
+	if err != nil {
+		return err
 	}
 
 	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
@@ -89,72 +162,315 @@ func AddRule(name string, source string, ignore []string, egressnetwork string)
 		return err
 	}
 
-	ipt.NewChain("nat", fmt.Sprintf("%s-POSTROUTING", name))
+	chain := fmt.Sprintf("%s-POSTROUTING", name)
+	ipt.NewChain("nat", chain)
+
+	entries, err := IgnoreEntries(ignore)
+	if err != nil {
+		return err
+	}
+
+	if err = ipset.Sync(ctx, IgnoreSetName(name), ipset.TypeHashNet, entries); err != nil {
+		return fmt.Errorf("failed to sync ipset %s: %v", IgnoreSetName(name), err)
+	}
+
+	jump, accept, masquerade := rules[0], rules[1], rules[2]
+
+	r := renderRule(&jump)
+	exist, _ := ipt.Exists(jump.table, jump.chain, r...)
+	if exist {
+		log.V(1).Info("Nothing to do, iptables rule already exists", logging.KeyTable, jump.table, logging.KeyChain, jump.chain, logging.KeyRule, strings.Join(r, " "))
+	} else {
+		log.Info("Adding iptables rule", logging.KeyTable, jump.table, logging.KeyChain, jump.chain, logging.KeyRule, strings.Join(r, " "))
+
+		if err = ipt.Insert(jump.table, jump.chain, 1, r...); err != nil {
+			return fmt.Errorf("failed to add iptables rule %v", err)
+		}
+	}
+
+	// Masquerade jump was inserted at the top, floating ips go before it
+	if err = pinFloatingIPJumps(ipt); err != nil {
+		return err
+	}
+
+	listed, err := ipt.List("nat", chain)
+	if err != nil {
+		return fmt.Errorf("failed to get list of iptables rules %v", err)
+	}
+
+	// The ignore list is the first rule of the chain, wherever it was before
+	r = renderRule(&accept)
+	if len(listed) < 2 || listed[1] != listedRule(&accept) {
+		log.Info("Adding iptables rule", logging.KeyTable, accept.table, logging.KeyChain, chain, logging.KeyRule, strings.Join(r, " "))
+
+		if err = ipt.DeleteIfExists(accept.table, chain, r...); err != nil {
+			return fmt.Errorf("failed to delete iptables rule %v", err)
+		}
+
+		if err = ipt.Insert(accept.table, chain, 1, r...); err != nil {
+			return fmt.Errorf("failed to add iptables rule %v", err)
+		}
+	}
+
+	r = renderRule(&masquerade)
+	exist, err = ipt.Exists(masquerade.table, chain, r...)
+	if err != nil {
+		return fmt.Errorf("failed to check iptables rule %v", err)
+	}
+
+	if !exist {
+		log.Info("Adding iptables rule", logging.KeyTable, masquerade.table, logging.KeyChain, chain, logging.KeyRule, strings.Join(r, " "))
+
+		if err = ipt.Append(masquerade.table, chain, r...); err != nil {
+			return fmt.Errorf("failed to add iptables rule %v", err)
+		}
+	}
+
+	return deleteStaleRules(log, ipt, chain, []Rules{accept, masquerade})
+}
+
+// Remove rules of the chain other than the wanted ones, e.g. the masquerade of the
+// previous egress interface, or ACCEPT rules of ignored networks which are kept in
+// the ipset now
+func deleteStaleRules(log logr.Logger, ipt *iptables.IPTables, chain string, rules []Rules) error {
+	wanted := map[string]bool{}
+	for i := range rules {
+		wanted[listedRule(&rules[i])] = true
+	}
 
-	for _, r := range ignore {
-		rules = append(
-			rules, Rules{
-				table:       "nat",
-				chain:       fmt.Sprintf("%s-POSTROUTING", name),
-				destination: r,
-				action:      "ACCEPT",
-			})
+	listed, err := ipt.List("nat", chain)
+	if err != nil {
+		return fmt.Errorf("failed to get list of iptables rules %v", err)
 	}
 
+	for _, rule := range listed {
+		// -A br10-POSTROUTING -o eth1 -j MASQUERADE
+		if !strings.HasPrefix(rule, "-A ") || wanted[rule] {
+			continue
+		}
+
+		log.Info("Removing iptables rule", logging.KeyTable, "nat", logging.KeyChain, chain, logging.KeyRule, rule)
+
+		if err = ipt.DeleteIfExists("nat", chain, strings.Split(rule, " ")[2:]...); err != nil {
+			return fmt.Errorf("failed to delete iptables rule `%s`, %v", rule, err)
+		}
+	}
+
+	return nil
+}
+
+// Rules which are not in their chains, rendered the way iptables-save shows them
+func missingRules(ipt *iptables.IPTables, rules []Rules) ([]string, error) {
+	var missing []string
+
 	for _, rls := range rules {
 		r := renderRule(&rls)
 
-		exist, _ := ipt.Exists(rls.table, rls.chain, r...)
+		exist, err := ipt.ChainExists(rls.table, rls.chain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check iptables chain %s: %v", rls.chain, err)
+		}
+
 		if exist {
-			logrus.WithFields(logrus.Fields{
-				"chain": rls.chain,
-				"table": rls.table,
-				"rule":  strings.Join(r, " "),
-			}).Info("Nothing to do, iptables rule already exists:")
-		} else {
-			logrus.WithFields(logrus.Fields{
-				"chain": rls.chain,
-				"table": rls.table,
-				"rule":  strings.Join(r, " "),
-			}).Info("iptables rule should be added:")
-
-			err = ipt.Insert(rls.table, rls.chain, 1, r...)
+			exist, err = ipt.Exists(rls.table, rls.chain, r...)
 			if err != nil {
-				return fmt.Errorf("failed to add iptables rule %v", err)
+				return nil, fmt.Errorf("failed to check iptables rule %v", err)
 			}
 		}
+
+		if !exist {
+			missing = append(missing, fmt.Sprintf("-t %s -A %s %s", rls.table, rls.chain, strings.Join(r, " ")))
+		}
 	}
 
-	return nil
+	return missing, nil
 }
 
-func PurgeChain(name string) error {
+// MissingRules returns the masquerade rules of the bridge which are not in the nat table
+func MissingRules(name string, source string, egressnetwork string) ([]string, error) {
+	rules, err := masqueradeRules(name, source, egressnetwork)
+	if err != nil {
+		return nil, err
+	}
+
 	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
+	}
+
+	missing, err := missingRules(ipt, rules)
+	if err != nil || len(missing) > 0 {
+		return missing, err
 	}
 
-	rules, err := ipt.List("nat", "POSTROUTING")
+	// Ignore list below the masquerade is as good as missing, it's inserted at the top again
+	accept := rules[1]
+	listed, err := ipt.List(accept.table, accept.chain)
 	if err != nil {
-		return fmt.Errorf("failed to get list of iptables rules %v", err)
+		return nil, fmt.Errorf("failed to get list of iptables rules %v", err)
 	}
 
-	for _, rule := range rules {
-		res := strings.Contains(rule, fmt.Sprintf("%s-POSTROUTING", name))
-		if res {
-			r := strings.Split(rule, " ")[2:]
-			err = ipt.DeleteIfExists("nat", "POSTROUTING", r...)
-			if err != nil {
-				return fmt.Errorf("failed to delete iptables rule `%s`, %v", rule, err)
+	if len(listed) < 2 || listed[1] != listedRule(&accept) {
+		missing = append(missing, fmt.Sprintf("-t %s -A %s %s", accept.table, accept.chain, strings.Join(renderRule(&accept), " ")))
+	}
+
+	return missing, nil
+}
+
+// IgnoreDiff returns entries of the ignore set of the bridge which are missing on the node,
+// and the ones on the node which are not in the ignore list
+func IgnoreDiff(name string, ignore []string) ([]string, []string, error) {
+	entries, err := IgnoreEntries(ignore)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ipset.Diff(IgnoreSetName(name), entries)
+}
+
+// ListRules returns the rules of the nat chains of the bridge together with the jumps to them
+func ListRules(name string) ([]string, error) {
+	var result []string
+
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, err
+	}
+
+	chains := []string{fmt.Sprintf("%s-POSTROUTING", name), fmt.Sprintf("%s-PREROUTING", name)}
+
+	for _, parent := range []string{"POSTROUTING", "PREROUTING", "OUTPUT"} {
+		rules, err := ipt.List("nat", parent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get list of iptables rules %v", err)
+		}
+
+		for _, rule := range rules {
+			r := strings.Split(rule, " ")
+			if len(r) >= 4 && r[len(r)-2] == "-j" && (r[len(r)-1] == chains[0] || r[len(r)-1] == chains[1]) {
+				result = append(result, rule)
 			}
+		}
+	}
 
-			// Delete rules from postrouting
-			err = ipt.ClearAndDeleteChain("nat", fmt.Sprintf("%s-POSTROUTING", name))
-			if err != nil {
-				return fmt.Errorf("failed to delete iptables chain %v", err)
+	for _, chain := range chains {
+		exist, err := ipt.ChainExists("nat", chain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check iptables chain %s: %v", chain, err)
+		}
+
+		if !exist {
+			continue
+		}
+
+		rules, err := ipt.List("nat", chain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get list of iptables rules %v", err)
+		}
+		result = append(result, rules...)
+	}
+
+	return result, nil
+}
+
+// IgnoreEntries returns entries of the ignore set for the networks which are not masqueraded.
+// The masquerade is IPv4 only, so IPv6 networks are left out, and the default route is
+// split in halves, as the hash:net set doesn't take networks with the zero prefix length.
+func IgnoreEntries(ignore []string) ([]string, error) {
+	var entries []string
+
+	for _, network := range ignore {
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() == nil {
+				continue
 			}
+			network += "/32"
+		}
+
+		ip, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid masquerade ignore network %q: %v", network, err)
+		}
+
+		if ip.To4() == nil {
+			continue
+		}
+
+		if ones, _ := ipnet.Mask.Size(); ones == 0 {
+			entries = append(entries, "0.0.0.0/1", "128.0.0.0/1")
+			continue
+		}
+
+		entries = append(entries, ipnet.String())
+	}
+
+	return entries, nil
+}
+
+// IgnoreSetName returns name of the ipset with networks which are not masqueraded
+func IgnoreSetName(name string) string {
+	return fmt.Sprintf("%s-IGNORE", name)
+}
+
+// Remove jumps from the builtin chain to the tabby chain
+func deleteJumps(ipt *iptables.IPTables, table string, parent string, chain string) error {
+	rules, err := ipt.List(table, parent)
+	if err != nil {
+		return fmt.Errorf("failed to get list of iptables rules %v", err)
+	}
+
+	for _, rule := range rules {
+		// -A POSTROUTING -s 192.168.1.0/23 -j br10-POSTROUTING
+		r := strings.Split(rule, " ")
+		if len(r) < 4 || r[len(r)-2] != "-j" || r[len(r)-1] != chain {
+			continue
+		}
+
+		if err = ipt.DeleteIfExists(table, parent, r[2:]...); err != nil {
+			return fmt.Errorf("failed to delete iptables rule `%s`, %v", rule, err)
 		}
 	}
 
 	return nil
 }
+
+func deleteChain(ipt *iptables.IPTables, table string, chain string) error {
+	exist, err := ipt.ChainExists(table, chain)
+	if err != nil {
+		return fmt.Errorf("failed to check iptables chain %s: %v", chain, err)
+	}
+
+	if !exist {
+		return nil
+	}
+
+	if err = ipt.ClearAndDeleteChain(table, chain); err != nil {
+		return fmt.Errorf("failed to delete iptables chain %v", err)
+	}
+
+	return nil
+}
+
+// PurgeChain removes all nat chains of the bridge together with the jumps to them
+func PurgeChain(name string) error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+
+	postrouting := fmt.Sprintf("%s-POSTROUTING", name)
+
+	if err = deleteJumps(ipt, "nat", "POSTROUTING", postrouting); err != nil {
+		return err
+	}
+
+	if err = deleteChain(ipt, "nat", postrouting); err != nil {
+		return err
+	}
+
+	if err = ipset.Destroy(IgnoreSetName(name)); err != nil {
+		return fmt.Errorf("failed to delete ipset %s: %v", IgnoreSetName(name), err)
+	}
+
+	return DeletePortForwards(name)
+}
@@ -0,0 +1,223 @@
+package iptables
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+
+	"github.com/NCCloud/tabby-cni/pkg/netnstest"
+)
+
+func TestRenderRules(t *testing.T) {
+	rules, err := masqueradeRules("br10", "10.10.0.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwards := portForwardRules("br10", []PortForward{
+		{Protocol: "tcp", Port: 2222, ToDestination: "10.10.0.2:22"},
+		{Protocol: "udp", Address: "192.168.0.1", Port: 53, ToDestination: "10.10.0.3"},
+	})
+
+	var got []string
+	for _, rls := range append(rules, forwards...) {
+		got = append(got, strings.Join(renderRule(&rls), " "))
+	}
+
+	if rule := listedRule(&forwards[1]); rule != "-A br10-PREROUTING -d 192.168.0.1/32 -p udp -m udp --dport 53 -j DNAT --to-destination 10.10.0.3" {
+		t.Errorf("listed rule = %q", rule)
+	}
+
+	want := []string{
+		"-s 10.10.0.0/24 -j br10-POSTROUTING",
+		"-m set --match-set br10-IGNORE dst -j ACCEPT",
+		"-j MASQUERADE",
+		"-p tcp -m tcp --dport 2222 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.10.0.2:22",
+		"-d 192.168.0.1 -p udp -m udp --dport 53 -j DNAT --to-destination 10.10.0.3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rules = %q, want %q", got, want)
+	}
+}
+
+func TestIgnoreEntries(t *testing.T) {
+	entries, err := IgnoreEntries([]string{"10.20.0.0/16", "10.30.0.1", "fd00::/64", "fd00::1", "0.0.0.0/0", "10.40.0.1/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"10.20.0.0/16", "10.30.0.1/32", "0.0.0.0/1", "128.0.0.0/1", "10.40.0.0/24"}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("IgnoreEntries() = %q, want %q", entries, want)
+	}
+
+	if _, err := IgnoreEntries([]string{"10.20.0.0/33"}); err == nil {
+		t.Error("expected invalid network to be rejected")
+	}
+}
+
+func TestMasquerade(t *testing.T) {
+	ns := netnstest.New(t)
+	netnstest.RequireCommand(t, "iptables", "ipset")
+
+	uplink := ns.AddUplink("eth0")
+	addr, err := netlink.ParseAddr("192.168.0.2/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.AddrAdd(uplink, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	missing, err := MissingRules("br10", "10.10.0.0/24", "192.168.0.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 3 {
+		t.Errorf("missing rules = %q, want all three", missing)
+	}
+
+	// Networks which the IPv4 set doesn't take are not an error
+	if err := AddRule(ctx, "br10", "10.10.0.0/24", []string{"10.20.0.0/16", "fd00::/64", "0.0.0.0/0"}, "192.168.0.10"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddRule(ctx, "br10", "10.10.0.0/24", []string{"10.20.0.0/16"}, "192.168.0.10"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Applying the same rules twice keeps a single copy of them
+	if err := AddRule(ctx, "br10", "10.10.0.0/24", []string{"10.20.0.0/16"}, "192.168.0.10"); err != nil {
+		t.Fatal(err)
+	}
+
+	if missing, err := MissingRules("br10", "10.10.0.0/24", "192.168.0.10"); err != nil || len(missing) != 0 {
+		t.Errorf("missing rules = %q, %v, want none", missing, err)
+	}
+
+	rules, err := ListRules("br10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"-A POSTROUTING -s 10.10.0.0/24 -j br10-POSTROUTING",
+		"-N br10-POSTROUTING",
+		"-A br10-POSTROUTING -m set --match-set br10-IGNORE dst -j ACCEPT",
+		"-A br10-POSTROUTING -o eth0 -j MASQUERADE",
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("ListRules() = %q, want %q", rules, want)
+	}
+
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Repaired masquerade goes below the ignore list
+	if err := ipt.Delete("nat", "br10-POSTROUTING", "-o", "eth0", "-j", "MASQUERADE"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRule(ctx, "br10", "10.10.0.0/24", []string{"10.20.0.0/16"}, "192.168.0.10"); err != nil {
+		t.Fatal(err)
+	}
+	if rules, err := ListRules("br10"); err != nil || !reflect.DeepEqual(rules, want) {
+		t.Errorf("ListRules() after the repair = %q, %v, want %q", rules, err, want)
+	}
+
+	// Masquerade of the previous egress interface is replaced
+	second := ns.AddUplink("eth1")
+	addr, err = netlink.ParseAddr("192.168.1.2/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.AddrAdd(second, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddRule(ctx, "br10", "10.10.0.0/24", []string{"10.20.0.0/16"}, "192.168.1.10"); err != nil {
+		t.Fatal(err)
+	}
+	want[3] = "-A br10-POSTROUTING -o eth1 -j MASQUERADE"
+	if rules, err := ListRules("br10"); err != nil || !reflect.DeepEqual(rules, want) {
+		t.Errorf("ListRules() after the egress change = %q, %v, want %q", rules, err, want)
+	}
+
+	if err := PurgeChain("br10"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rules, err := ListRules("br10"); err != nil || len(rules) != 0 {
+		t.Errorf("ListRules() = %q, %v, want none", rules, err)
+	}
+
+	// Purged chain is not an error
+	if err := PurgeChain("br10"); err != nil {
+		t.Errorf("PurgeChain() of the missing chain: %v", err)
+	}
+}
+
+func TestPortForwards(t *testing.T) {
+	netnstest.New(t)
+	netnstest.RequireCommand(t, "iptables")
+
+	ctx := context.Background()
+	forwards := []PortForward{
+		{Protocol: "tcp", Port: 2222, ToDestination: "10.10.0.2:22"},
+		{Protocol: "tcp", Address: "192.168.0.1", Port: 8080, ToDestination: "10.10.0.3:80"},
+	}
+
+	if err := SyncPortForwards(ctx, "br10", forwards); err != nil {
+		t.Fatal(err)
+	}
+	if missing, err := MissingPortForwards("br10", forwards); err != nil || len(missing) != 0 {
+		t.Errorf("missing port forwards = %q, %v, want none", missing, err)
+	}
+
+	// Unchanged forwards are kept in place
+	applied, err := ListRules("br10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncPortForwards(ctx, "br10", forwards); err != nil {
+		t.Fatal(err)
+	}
+	if rules, err := ListRules("br10"); err != nil || !reflect.DeepEqual(rules, applied) {
+		t.Errorf("ListRules() = %q, %v, want %q", rules, err, applied)
+	}
+
+	// Removed forward is cleaned up from the chain
+	if err := SyncPortForwards(ctx, "br10", forwards[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if missing, err := MissingPortForwards("br10", forwards); err != nil || len(missing) != 1 {
+		t.Errorf("missing port forwards = %q, %v, want the second one", missing, err)
+	}
+
+	rules, err := ListRules("br10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"-A PREROUTING -j br10-PREROUTING",
+		"-A OUTPUT -j br10-PREROUTING",
+		"-N br10-PREROUTING",
+		"-A br10-PREROUTING -p tcp -m tcp --dport 2222 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.10.0.2:22",
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("ListRules() = %q, want %q", rules, want)
+	}
+
+	if err := SyncPortForwards(ctx, "br10", nil); err != nil {
+		t.Fatal(err)
+	}
+	if rules, err := ListRules("br10"); err != nil || len(rules) != 0 {
+		t.Errorf("ListRules() = %q, %v, want none", rules, err)
+	}
+}
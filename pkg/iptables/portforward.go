@@ -0,0 +1,235 @@
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/NCCloud/tabby-cni/pkg/logging"
+)
+
+type PortForward struct {
+	Protocol string
+	// Node address, any local address is used if empty
+	Address string
+	Port    int
+	// Virtual machine ip:port
+	ToDestination string
+}
+
+func portForwardRules(name string, forwards []PortForward) []Rules {
+	var rules []Rules
+
+	for _, f := range forwards {
+		rule := Rules{
+			table:         "nat",
+			chain:         fmt.Sprintf("%s-PREROUTING", name),
+			destination:   f.Address,
+			protocol:      f.Protocol,
+			dport:         f.Port,
+			action:        "DNAT",
+			toDestination: f.ToDestination,
+		}
+
+		if f.Address == "" {
+			rule.dstType = "LOCAL"
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// Traffic from outside and from the node itself, like hostPort does
+func portForwardJumps(name string) []Rules {
+	chain := fmt.Sprintf("%s-PREROUTING", name)
+
+	return []Rules{
+		{
+			table:  "nat",
+			chain:  "PREROUTING",
+			action: chain,
+		},
+		{
+			table:  "nat",
+			chain:  "OUTPUT",
+			action: chain,
+		},
+	}
+}
+
+// MissingPortForwards returns the port forward rules of the bridge which are not in the nat table
+func MissingPortForwards(name string, forwards []PortForward) ([]string, error) {
+	if len(forwards) == 0 {
+		return nil, nil
+	}
+
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, err
+	}
+
+	return missingRules(ipt, append(portForwardJumps(name), portForwardRules(name, forwards)...))
+}
+
+// StalePortForwards returns the rules of the <name>-PREROUTING chain which are not port
+// forwards of the spec, they are removed by SyncPortForwards
+func StalePortForwards(name string, forwards []PortForward) ([]string, error) {
+	chain := fmt.Sprintf("%s-PREROUTING", name)
+
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, err
+	}
+
+	exist, err := ipt.ChainExists("nat", chain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check iptables chain %s: %v", chain, err)
+	}
+
+	if !exist {
+		return nil, nil
+	}
+
+	wanted := map[string]bool{}
+	for _, rls := range portForwardRules(name, forwards) {
+		wanted[listedRule(&rls)] = true
+	}
+
+	listed, err := ipt.List("nat", chain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get list of iptables rules %v", err)
+	}
+
+	var stale []string
+	for _, rule := range listed {
+		if strings.HasPrefix(rule, "-A ") && !wanted[rule] {
+			stale = append(stale, "-t nat "+rule)
+		}
+	}
+
+	return stale, nil
+}
+
+// Rule the way iptables -S shows it, single addresses get the prefix length
+func listedRule(rls *Rules) string {
+	r := renderRule(rls)
+
+	for i := 0; i < len(r)-1; i++ {
+		if (r[i] == "-s" || r[i] == "-d") && !strings.Contains(r[i+1], "/") {
+			r[i+1] += "/32"
+		}
+	}
+
+	return fmt.Sprintf("-A %s %s", rls.chain, strings.Join(r, " "))
+}
+
+// SyncPortForwards renders port forwards into the <name>-PREROUTING chain.
+// Missing rules are appended before stale ones are deleted, so forwards which
+// stay in the spec keep working while the chain is updated.
+func SyncPortForwards(ctx context.Context, name string, forwards []PortForward) error {
+	log := logging.FromContext(ctx, logging.Iptables).WithValues(logging.KeyBridge, name)
+
+	if len(forwards) == 0 {
+		return DeletePortForwards(name)
+	}
+
+	chain := fmt.Sprintf("%s-PREROUTING", name)
+
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+
+	exist, err := ipt.ChainExists("nat", chain)
+	if err != nil {
+		return fmt.Errorf("failed to check iptables chain %s: %v", chain, err)
+	}
+
+	if !exist {
+		if err = ipt.NewChain("nat", chain); err != nil {
+			return fmt.Errorf("failed to create iptables chain %s: %v", chain, err)
+		}
+	}
+
+	for _, rls := range portForwardJumps(name) {
+		r := renderRule(&rls)
+
+		exist, _ := ipt.Exists(rls.table, rls.chain, r...)
+		if exist {
+			continue
+		}
+
+		if err = ipt.Insert(rls.table, rls.chain, 1, r...); err != nil {
+			return fmt.Errorf("failed to add iptables rule %v", err)
+		}
+	}
+
+	if err = pinFloatingIPJumps(ipt); err != nil {
+		return err
+	}
+
+	rules := portForwardRules(name, forwards)
+	wanted := map[string]bool{}
+
+	for _, rls := range rules {
+		r := renderRule(&rls)
+		wanted[listedRule(&rls)] = true
+
+		exist, err := ipt.Exists(rls.table, rls.chain, r...)
+		if err != nil {
+			return fmt.Errorf("failed to check iptables rule %v", err)
+		}
+
+		if exist {
+			continue
+		}
+
+		log.Info("Adding iptables rule", logging.KeyTable, rls.table, logging.KeyChain, rls.chain, logging.KeyRule, strings.Join(r, " "))
+
+		if err = ipt.Append(rls.table, rls.chain, r...); err != nil {
+			return fmt.Errorf("failed to add iptables rule %v", err)
+		}
+	}
+
+	listed, err := ipt.List("nat", chain)
+	if err != nil {
+		return fmt.Errorf("failed to get list of iptables rules %v", err)
+	}
+
+	for _, rule := range listed {
+		// -A br10-PREROUTING -p tcp -m tcp --dport 2222 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.10.0.2:22
+		if !strings.HasPrefix(rule, "-A ") || wanted[rule] {
+			continue
+		}
+
+		log.Info("Removing iptables rule", logging.KeyTable, "nat", logging.KeyChain, chain, logging.KeyRule, rule)
+
+		if err = ipt.DeleteIfExists("nat", chain, strings.Split(rule, " ")[2:]...); err != nil {
+			return fmt.Errorf("failed to delete iptables rule `%s`, %v", rule, err)
+		}
+	}
+
+	return nil
+}
+
+// DeletePortForwards removes the <name>-PREROUTING chain together with the jumps to it
+func DeletePortForwards(name string) error {
+	chain := fmt.Sprintf("%s-PREROUTING", name)
+
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+
+	for _, parent := range []string{"PREROUTING", "OUTPUT"} {
+		if err = deleteJumps(ipt, "nat", parent, chain); err != nil {
+			return err
+		}
+	}
+
+	return deleteChain(ipt, "nat", chain)
+}
@@ -0,0 +1,175 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"go.uber.org/zap/zapcore"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// Subsystems which log with their own name, so their verbosity could be changed separately
+const (
+	Bridge   = "bridge"
+	DHCP     = "dhcp"
+	Ebtables = "ebtables"
+	Ipset    = "ipset"
+	Iptables = "iptables"
+	NDP      = "ndp"
+	Netlink  = "netlink"
+)
+
+// Keys of the log values, the same object is logged with the same key everywhere
+const (
+	KeyNetwork    = "network"
+	KeyAttachment = "attachment"
+	KeyNode       = "node"
+	KeyBridge     = "bridge"
+	KeyPort       = "port"
+	KeyRule       = "rule"
+	KeyChain      = "chain"
+	KeyTable      = "table"
+	KeyInterface  = "interface"
+)
+
+// Output formats
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
+)
+
+// FromContext returns the logger of the subsystem. It carries the values of the
+// reconcile, e.g. the reconcile id, when the context comes from the controller.
+func FromContext(ctx context.Context, subsystem string) logr.Logger {
+	return log.FromContext(ctx).WithName(subsystem)
+}
+
+// Levels is the verbosity, in general and per subsystem
+type Levels struct {
+	Default    int
+	Subsystems map[string]int
+}
+
+// ParseLevels parses the verbosity, e.g. "1,iptables=2,dhcp=0"
+func ParseLevels(value string) (Levels, error) {
+	levels := Levels{Subsystems: map[string]int{}}
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, level, ok := strings.Cut(item, "=")
+		if !ok {
+			level, name = name, ""
+		}
+
+		v, err := strconv.Atoi(level)
+		if err != nil || v < 0 {
+			return levels, fmt.Errorf("invalid log level %q", item)
+		}
+
+		if name == "" {
+			levels.Default = v
+		} else {
+			levels.Subsystems[name] = v
+		}
+	}
+
+	return levels, nil
+}
+
+// Verbosity of the logger name, e.g. "networkattachment.iptables". The most specific
+// configured part of the name wins.
+func (l Levels) level(name string) int {
+	parts := strings.Split(name, ".")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if v, ok := l.Subsystems[parts[i]]; ok {
+			return v
+		}
+	}
+
+	return l.Default
+}
+
+func (l Levels) max() int {
+	max := l.Default
+	for _, v := range l.Subsystems {
+		if v > max {
+			max = v
+		}
+	}
+
+	return max
+}
+
+// Sink which drops messages above the verbosity of the subsystem
+type levelSink struct {
+	logr.LogSink
+	levels Levels
+	name   string
+}
+
+// The sink of zap is initialized already, only the frame of this sink is added
+func (s *levelSink) Init(info logr.RuntimeInfo) {
+	s.LogSink.Init(logr.RuntimeInfo{CallDepth: 1})
+}
+
+func (s *levelSink) Enabled(level int) bool {
+	return level <= s.levels.level(s.name) && s.LogSink.Enabled(level)
+}
+
+func (s *levelSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	s.LogSink.Info(level, msg, keysAndValues...)
+}
+
+func (s *levelSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	s.LogSink.Error(err, msg, keysAndValues...)
+}
+
+func (s *levelSink) WithName(name string) logr.LogSink {
+	full := name
+	if s.name != "" {
+		full = s.name + "." + name
+	}
+
+	return &levelSink{LogSink: s.LogSink.WithName(name), levels: s.levels, name: full}
+}
+
+func (s *levelSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return &levelSink{LogSink: s.LogSink.WithValues(keysAndValues...), levels: s.levels, name: s.name}
+}
+
+func (s *levelSink) WithCallDepth(depth int) logr.LogSink {
+	sink, ok := s.LogSink.(logr.CallDepthLogSink)
+	if !ok {
+		return s
+	}
+
+	return &levelSink{LogSink: sink.WithCallDepth(depth), levels: s.levels, name: s.name}
+}
+
+// New returns the zap logger in the format, with the verbosity per subsystem. Options,
+// e.g. from the command line flags, are applied first.
+func New(format string, levels Levels, opts ...zap.Opts) (logr.Logger, error) {
+	switch format {
+	case FormatJSON:
+		opts = append(opts, zap.JSONEncoder())
+	case FormatConsole, "":
+		opts = append(opts, zap.ConsoleEncoder())
+	default:
+		return logr.Logger{}, fmt.Errorf("unknown log format %q", format)
+	}
+
+	// zap filters by the highest verbosity, the sink by the verbosity of the subsystem
+	opts = append(opts, zap.Level(zapcore.Level(-levels.max())))
+
+	logger := zap.New(opts...)
+
+	return logr.New(&levelSink{LogSink: logger.GetSink(), levels: levels}), nil
+}
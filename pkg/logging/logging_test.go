@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func TestParseLevels(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Levels
+	}{
+		{"", Levels{Subsystems: map[string]int{}}},
+		{"2", Levels{Default: 2, Subsystems: map[string]int{}}},
+		{"1, iptables=2,dhcp=0", Levels{Default: 1, Subsystems: map[string]int{"iptables": 2, "dhcp": 0}}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseLevels(tt.value)
+		if err != nil {
+			t.Fatalf("ParseLevels(%q) error: %v", tt.value, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseLevels(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"x", "iptables=x", "-1", "dhcp=-2"} {
+		if _, err := ParseLevels(value); err == nil {
+			t.Errorf("ParseLevels(%q) succeeded", value)
+		}
+	}
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	levels, err := ParseLevels("0,iptables=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	logger, err := New(FormatJSON, levels, zap.WriteTo(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attachment := logger.WithName("networkattachment").WithValues(KeyAttachment, "default/vlan10")
+	attachment.Info("reconcile")
+	attachment.V(1).Info("dropped")
+	attachment.WithName(Iptables).V(2).Info("rule", KeyRule, "-j MASQUERADE")
+	attachment.WithName(DHCP).V(1).Info("dropped")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2: %s", len(lines), out)
+	}
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("invalid json %q: %v", lines[1], err)
+	}
+
+	if entry["logger"] != "networkattachment.iptables" || entry[KeyAttachment] != "default/vlan10" || entry[KeyRule] != "-j MASQUERADE" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := New("xml", Levels{}); err == nil {
+		t.Error("New() succeeded with an unknown format")
+	}
+}
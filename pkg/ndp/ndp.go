@@ -0,0 +1,111 @@
+package ndp
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// Neighbor Discovery messages must be sent with hop limit 255, RFC 4861
+	hopLimit int = 255
+
+	optionSourceLinkLayerAddress int = 1
+	optionTargetLinkLayerAddress int = 2
+
+	flagRouter   byte = 0x80
+	flagOverride byte = 0x20
+)
+
+var allNodes = net.ParseIP("ff02::1")
+
+// SolicitedNodeMulticast returns the multicast address neighbor solicitations for the ip are sent to
+func SolicitedNodeMulticast(ip net.IP) net.IP {
+	ip = ip.To16()
+	return net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, ip[13], ip[14], ip[15]}
+}
+
+// Link-layer address option, the option length is in units of 8 octets
+func linkLayerAddressOption(optionType int, mac net.HardwareAddr) []byte {
+	option := make([]byte, 8)
+	option[0] = byte(optionType)
+	option[1] = 1
+	copy(option[2:], mac)
+	return option
+}
+
+// Open an icmpv6 socket bound to the link-local address of the interface,
+// ready to send Neighbor Discovery messages to the link.
+func listen(source net.IP, iface *net.Interface) (*icmp.PacketConn, error) {
+	conn, err := icmp.ListenPacket("ip6:ipv6-icmp", fmt.Sprintf("%s%%%s", source, iface.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open icmpv6 socket on %s: %v", iface.Name, err)
+	}
+
+	pc := conn.IPv6PacketConn()
+	if err := pc.SetMulticastHopLimit(hopLimit); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := pc.SetHopLimit(hopLimit); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := pc.SetMulticastInterface(iface); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func send(conn *icmp.PacketConn, msgType ipv6.ICMPType, body []byte, dst net.IP, iface *net.Interface) error {
+	msg := icmp.Message{
+		Type: msgType,
+		Code: 0,
+		Body: &icmp.RawBody{Data: body},
+	}
+
+	// Checksum is calculated by the kernel for icmpv6 sockets
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.WriteTo(b, &net.IPAddr{IP: dst, Zone: iface.Name}); err != nil {
+		return fmt.Errorf("failed to send %v on %s: %v", msgType, iface.Name, err)
+	}
+
+	return nil
+}
+
+// SendUnsolicitedNA announces the link-local address of the router to all nodes on
+// the link, so they update the mac address in their neighbor cache. It's the IPv6
+// counterpart of the gratuitous arp request. The address must be configured on the interface.
+func SendUnsolicitedNA(ip net.IP, ifaceName string) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+
+	conn, err := listen(ip, iface)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return send(conn, ipv6.ICMPTypeNeighborAdvertisement, neighborAdvertisement(ip, iface.HardwareAddr), allNodes, iface)
+}
+
+// Neighbor advertisement message body of the router, RFC 4861 4.4
+func neighborAdvertisement(ip net.IP, mac net.HardwareAddr) []byte {
+	// Flags, reserved, target address and target link-layer address option
+	body := make([]byte, 20)
+	body[0] = flagRouter | flagOverride
+	copy(body[4:], ip.To16())
+	return append(body, linkLayerAddressOption(optionTargetLinkLayerAddress, mac)...)
+}
@@ -0,0 +1,288 @@
+package ndp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+
+	"github.com/NCCloud/tabby-cni/pkg/logging"
+)
+
+const (
+	optionPrefixInformation int = 3
+	optionMTU               int = 5
+	optionRDNSS             int = 25
+
+	flagManaged     byte = 0x80
+	flagOtherConfig byte = 0x40
+
+	flagOnLink     byte = 0x80
+	flagAutonomous byte = 0x40
+
+	DefaultInterval       time.Duration = 600 * time.Second
+	DefaultRouterLifetime time.Duration = 1800 * time.Second
+	// Interval between advertisements of a burst, e.g. after migration of a virtual machine
+	burstInterval time.Duration = time.Second
+)
+
+var allRouters = net.ParseIP("ff02::2")
+
+type Prefix struct {
+	Prefix            *net.IPNet
+	OnLink            bool
+	Autonomous        bool
+	ValidLifetime     time.Duration
+	PreferredLifetime time.Duration
+}
+
+type RAConfig struct {
+	Interface string
+	// Link-local address the advertisements are sent from, it becomes the default gateway
+	Source         net.IP
+	Managed        bool
+	OtherConfig    bool
+	RouterLifetime time.Duration
+	Prefixes       []Prefix
+	RDNSS          []net.IP
+	RDNSSLifetime  time.Duration
+	MTU            int
+	// Maximum interval between unsolicited advertisements
+	Interval time.Duration
+}
+
+func seconds(d time.Duration) uint32 {
+	return uint32(d / time.Second)
+}
+
+// Router advertisement message body, RFC 4861 4.2
+func routerAdvertisement(config *RAConfig, mac net.HardwareAddr) []byte {
+	body := make([]byte, 12)
+
+	// Current hop limit is unspecified
+	body[0] = 0
+	if config.Managed {
+		body[1] |= flagManaged
+	}
+	if config.OtherConfig {
+		body[1] |= flagOtherConfig
+	}
+	binary.BigEndian.PutUint16(body[2:4], uint16(seconds(config.RouterLifetime)))
+	// Reachable time and retrans timer are unspecified
+
+	body = append(body, linkLayerAddressOption(optionSourceLinkLayerAddress, mac)...)
+
+	if config.MTU > 0 {
+		option := make([]byte, 8)
+		option[0] = byte(optionMTU)
+		option[1] = 1
+		binary.BigEndian.PutUint32(option[4:], uint32(config.MTU))
+		body = append(body, option...)
+	}
+
+	for _, p := range config.Prefixes {
+		ones, _ := p.Prefix.Mask.Size()
+
+		option := make([]byte, 32)
+		option[0] = byte(optionPrefixInformation)
+		option[1] = 4
+		option[2] = byte(ones)
+		if p.OnLink {
+			option[3] |= flagOnLink
+		}
+		if p.Autonomous {
+			option[3] |= flagAutonomous
+		}
+		binary.BigEndian.PutUint32(option[4:8], seconds(p.ValidLifetime))
+		binary.BigEndian.PutUint32(option[8:12], seconds(p.PreferredLifetime))
+		copy(option[16:], p.Prefix.IP.To16())
+		body = append(body, option...)
+	}
+
+	// Recursive DNS server option, RFC 8106
+	if len(config.RDNSS) > 0 {
+		option := make([]byte, 8, 8+16*len(config.RDNSS))
+		option[0] = byte(optionRDNSS)
+		option[1] = byte(1 + 2*len(config.RDNSS))
+		binary.BigEndian.PutUint32(option[4:8], seconds(config.RDNSSLifetime))
+		for _, ip := range config.RDNSS {
+			option = append(option, ip.To16()...)
+		}
+		body = append(body, option...)
+	}
+
+	return body
+}
+
+// SendRouterAdvertisements sends a burst of unsolicited router advertisements to all nodes
+func SendRouterAdvertisements(config *RAConfig, count int) error {
+	iface, err := net.InterfaceByName(config.Interface)
+	if err != nil {
+		return err
+	}
+
+	conn, err := listen(config.Source, iface)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(burstInterval)
+		}
+
+		if err := send(conn, ipv6.ICMPTypeRouterAdvertisement, routerAdvertisement(config, iface.HardwareAddr), allNodes, iface); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Advertiser sends periodic router advertisements on the interface and answers router solicitations
+type Advertiser struct {
+	config RAConfig
+	iface  *net.Interface
+	conn   *icmp.PacketConn
+	log    logr.Logger
+
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+func NewAdvertiser(config RAConfig) *Advertiser {
+	if config.Interval == 0 {
+		config.Interval = DefaultInterval
+	}
+
+	return &Advertiser{config: config}
+}
+
+// Start advertises in the background, it logs with the logger of the context
+func (a *Advertiser) Start(ctx context.Context) error {
+	a.log = logging.FromContext(ctx, logging.NDP).WithValues(logging.KeyInterface, a.config.Interface)
+
+	iface, err := net.InterfaceByName(a.config.Interface)
+	if err != nil {
+		return err
+	}
+
+	conn, err := listen(a.config.Source, iface)
+	if err != nil {
+		return err
+	}
+
+	pc := conn.IPv6PacketConn()
+
+	// Router solicitations are sent to the all-routers address
+	if err := pc.JoinGroup(iface, &net.IPAddr{IP: allRouters}); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to join all-routers group on %s: %v", iface.Name, err)
+	}
+
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeRouterSolicitation)
+	if err := pc.SetICMPFilter(&filter); err != nil {
+		conn.Close()
+		return err
+	}
+
+	a.iface = iface
+	a.conn = conn
+	a.done = make(chan struct{})
+
+	go a.solicitations(conn)
+	go a.periodic(a.done)
+
+	return nil
+}
+
+// Close stops the advertisements. The last one has zero router lifetime, so the hosts
+// stop using the router right away instead of waiting for the lifetime to expire, RFC 4861 6.2.5.
+func (a *Advertiser) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conn == nil {
+		return nil
+	}
+
+	close(a.done)
+
+	// The interface could be gone already, e.g. when the network is deleted
+	if err := send(a.conn, ipv6.ICMPTypeRouterAdvertisement, finalAdvertisement(&a.config, a.iface.HardwareAddr), allNodes, a.iface); err != nil {
+		a.log.V(1).Info("Final router advertisement not sent", "reason", err.Error())
+	}
+
+	err := a.conn.Close()
+	a.conn = nil
+
+	return err
+}
+
+// Router advertisement which withdraws the router, the prefixes stay as they are
+func finalAdvertisement(config *RAConfig, mac net.HardwareAddr) []byte {
+	final := *config
+	final.RouterLifetime = 0
+	return routerAdvertisement(&final, mac)
+}
+
+func (a *Advertiser) advertise() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conn == nil {
+		return nil
+	}
+
+	return send(a.conn, ipv6.ICMPTypeRouterAdvertisement, routerAdvertisement(&a.config, a.iface.HardwareAddr), allNodes, a.iface)
+}
+
+// Unsolicited advertisements are sent at random intervals between 1/3 and the maximum interval, RFC 4861 6.2.4
+func (a *Advertiser) periodic(done chan struct{}) {
+	for {
+		if err := a.advertise(); err != nil {
+			a.log.Error(err, "Failed to send router advertisement")
+		}
+
+		min := a.config.Interval / 3
+		interval := min + time.Duration(rand.Int63n(int64(a.config.Interval-min)+1))
+
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (a *Advertiser) solicitations(conn *icmp.PacketConn) {
+	buf := make([]byte, 1500)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			// Connection is closed
+			return
+		}
+
+		msg, err := icmp.ParseMessage(ipv6.ICMPTypeRouterSolicitation.Protocol(), buf[:n])
+		if err != nil || msg.Type != ipv6.ICMPTypeRouterSolicitation {
+			continue
+		}
+
+		// Solicited advertisements could be sent to all nodes as well
+		if err := a.advertise(); err != nil {
+			a.log.Error(err, "Failed to answer router solicitation")
+		}
+	}
+}
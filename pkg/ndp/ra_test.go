@@ -0,0 +1,134 @@
+package ndp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func testRAConfig() RAConfig {
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/64")
+
+	return RAConfig{
+		Interface:      "br10",
+		Source:         net.ParseIP("fe80::1"),
+		Managed:        true,
+		RouterLifetime: 1800 * time.Second,
+		Prefixes: []Prefix{{
+			Prefix:            prefix,
+			OnLink:            true,
+			Autonomous:        true,
+			ValidLifetime:     86400 * time.Second,
+			PreferredLifetime: 14400 * time.Second,
+		}},
+		RDNSS:         []net.IP{net.ParseIP("2001:db8::53"), net.ParseIP("2001:db8::54")},
+		RDNSSLifetime: 600 * time.Second,
+		MTU:           1400,
+	}
+}
+
+var testMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+// Options of the message body which follow the header of the given length
+func options(t *testing.T, body []byte, header int) map[int][]byte {
+	t.Helper()
+
+	result := map[int][]byte{}
+	for b := body[header:]; len(b) > 0; {
+		if len(b) < 2 || b[1] == 0 || len(b) < int(b[1])*8 {
+			t.Fatalf("malformed option %x", b)
+		}
+		size := int(b[1]) * 8
+		result[int(b[0])] = b[:size]
+		b = b[size:]
+	}
+	return result
+}
+
+func TestRouterAdvertisement(t *testing.T) {
+	config := testRAConfig()
+	body := routerAdvertisement(&config, testMAC)
+
+	if body[1] != flagManaged {
+		t.Errorf("flags = %#x, want managed", body[1])
+	}
+	if lifetime := binary.BigEndian.Uint16(body[2:4]); lifetime != 1800 {
+		t.Errorf("router lifetime = %d, want 1800", lifetime)
+	}
+
+	opts := options(t, body, 12)
+
+	if lla := opts[optionSourceLinkLayerAddress]; !bytes.Equal(lla[2:8], testMAC) {
+		t.Errorf("source link-layer address option = %x", lla)
+	}
+
+	if mtu := opts[optionMTU]; len(mtu) != 8 || binary.BigEndian.Uint32(mtu[4:]) != 1400 {
+		t.Errorf("mtu option = %x", mtu)
+	}
+
+	prefix := opts[optionPrefixInformation]
+	if len(prefix) != 32 || prefix[2] != 64 || prefix[3] != flagOnLink|flagAutonomous {
+		t.Fatalf("prefix option = %x", prefix)
+	}
+	if valid, preferred := binary.BigEndian.Uint32(prefix[4:8]), binary.BigEndian.Uint32(prefix[8:12]); valid != 86400 || preferred != 14400 {
+		t.Errorf("prefix lifetimes = %d/%d, want 86400/14400", valid, preferred)
+	}
+	if ip := net.IP(prefix[16:32]); !ip.Equal(net.ParseIP("2001:db8:1::")) {
+		t.Errorf("prefix = %s, want 2001:db8:1::", ip)
+	}
+
+	rdnss := opts[optionRDNSS]
+	if len(rdnss) != 40 || binary.BigEndian.Uint32(rdnss[4:8]) != 600 {
+		t.Fatalf("rdnss option = %x", rdnss)
+	}
+	if first, second := net.IP(rdnss[8:24]), net.IP(rdnss[24:40]); !first.Equal(config.RDNSS[0]) || !second.Equal(config.RDNSS[1]) {
+		t.Errorf("rdnss servers = %s, %s", first, second)
+	}
+}
+
+func TestFinalAdvertisement(t *testing.T) {
+	config := testRAConfig()
+
+	body := finalAdvertisement(&config, testMAC)
+	if lifetime := binary.BigEndian.Uint16(body[2:4]); lifetime != 0 {
+		t.Errorf("router lifetime = %d, want 0", lifetime)
+	}
+
+	// Only the router is withdrawn, the rest of the advertisement is the same
+	regular := routerAdvertisement(&config, testMAC)
+	if !bytes.Equal(body[4:], regular[4:]) || body[1] != regular[1] {
+		t.Errorf("final advertisement %x differs from %x", body, regular)
+	}
+	if config.RouterLifetime != 1800*time.Second {
+		t.Errorf("router lifetime of the config changed to %s", config.RouterLifetime)
+	}
+}
+
+func TestNeighborAdvertisement(t *testing.T) {
+	ip := net.ParseIP("fe80::1")
+	body := neighborAdvertisement(ip, testMAC)
+
+	if body[0] != flagRouter|flagOverride {
+		t.Errorf("flags = %#x, want router and override", body[0])
+	}
+	if target := net.IP(body[4:20]); !target.Equal(ip) {
+		t.Errorf("target = %s, want %s", target, ip)
+	}
+	if lla := options(t, body, 20)[optionTargetLinkLayerAddress]; !bytes.Equal(lla[2:8], testMAC) {
+		t.Errorf("target link-layer address option = %x", lla)
+	}
+}
+
+func TestSolicitedNodeMulticast(t *testing.T) {
+	for ip, want := range map[string]string{
+		"fe80::1":              "ff02::1:ff00:1",
+		"2001:db8::1234:5678":  "ff02::1:ff34:5678",
+		"fe80::aabb:ccff:fedd": "ff02::1:ffff:fedd",
+	} {
+		if got := SolicitedNodeMulticast(net.ParseIP(ip)); got.String() != want {
+			t.Errorf("SolicitedNodeMulticast(%s) = %s, want %s", ip, got, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Package netnstest runs integration tests of the host network in a throwaway
+// network namespace. Tests are skipped unless they run as root, e.g. with
+// sudo -E go test ./...
+package netnstest
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Namespace is the network namespace of the test
+type Namespace struct {
+	t testing.TB
+}
+
+// New moves the test into a fresh network namespace, the origin one is
+// restored when the test is done. The test is pinned to its OS thread, so it
+// must not run in parallel or spawn goroutines which touch the network.
+func New(t testing.TB) *Namespace {
+	t.Helper()
+
+	if os.Getuid() != 0 {
+		t.Skip("test requires root to create a network namespace")
+	}
+
+	runtime.LockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatal(err)
+	}
+
+	ns, err := netns.New()
+	if err != nil {
+		origin.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("unable to create network namespace: %v", err)
+	}
+
+	t.Cleanup(func() {
+		netns.Set(origin)
+		origin.Close()
+		ns.Close()
+		runtime.UnlockOSThread()
+	})
+
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Namespace{t: t}
+}
+
+// AddUplink adds the link standing for a physical interface of the node. It's
+// a dummy link, or a veth pair if the kernel lacks the dummy driver.
+func (n *Namespace) AddUplink(name string) netlink.Link {
+	n.t.Helper()
+
+	attrs := netlink.LinkAttrs{Name: name, TxQLen: -1}
+
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: attrs}); err != nil {
+		veth := &netlink.Veth{LinkAttrs: attrs, PeerName: name + "-peer"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			n.t.Fatalf("failed to add uplink %s: %v", name, err)
+		}
+
+		// Peer is the switch port, the uplink has no carrier without it
+		if err := netlink.LinkSetUp(n.Link(veth.PeerName)); err != nil {
+			n.t.Fatalf("failed to enable uplink peer %s: %v", veth.PeerName, err)
+		}
+	}
+
+	link := n.Link(name)
+	if err := netlink.LinkSetUp(link); err != nil {
+		n.t.Fatalf("failed to enable uplink %s: %v", name, err)
+	}
+
+	return link
+}
+
+// Link returns the link or fails the test if it's missing
+func (n *Namespace) Link(name string) netlink.Link {
+	n.t.Helper()
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		n.t.Fatalf("failed to find link %s: %v", name, err)
+	}
+	return link
+}
+
+// LinkExists reports whether the link is in the namespace
+func (n *Namespace) LinkExists(name string) bool {
+	_, err := netlink.LinkByName(name)
+	return err == nil
+}
+
+// Ports returns the names of the links attached to the bridge
+func (n *Namespace) Ports(bridge string) []string {
+	n.t.Helper()
+
+	br := n.Link(bridge)
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		n.t.Fatal(err)
+	}
+
+	var ports []string
+	for _, link := range links {
+		if link.Attrs().MasterIndex == br.Attrs().Index {
+			ports = append(ports, link.Attrs().Name)
+		}
+	}
+	return ports
+}
+
+// Routes returns the destinations of the IPv4 routes via the link
+func (n *Namespace) Routes(name string) []string {
+	n.t.Helper()
+
+	routes, err := netlink.RouteList(n.Link(name), netlink.FAMILY_V4)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+
+	var destinations []string
+	for _, route := range routes {
+		if route.Dst != nil {
+			destinations = append(destinations, route.Dst.String())
+		}
+	}
+	return destinations
+}
+
+// RequireVlan skips the test if the kernel lacks the 8021q driver
+func (n *Namespace) RequireVlan(parent string) {
+	n.t.Helper()
+
+	vlan := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{Name: "vlanprobe", ParentIndex: n.Link(parent).Attrs().Index},
+		VlanId:    4094,
+	}
+	if err := netlink.LinkAdd(vlan); err != nil {
+		n.t.Skipf("kernel lacks vlan support: %v", err)
+	}
+	if err := netlink.LinkDel(vlan); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+// RequireCommand skips the test if the command is not installed
+func RequireCommand(t testing.TB, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("test requires %s: %v", name, err)
+		}
+	}
+}